@@ -0,0 +1,87 @@
+package attachment
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/opencord/api/internal/media"
+	"github.com/opencord/api/internal/storage"
+)
+
+// MaxPerMessage caps how many attachments one message may reference.
+const MaxPerMessage = 10
+
+// Attachment statuses. Only ready attachments can be sent in a message,
+// and the others have no URL.
+const (
+	StatusProcessing  = "processing"  // waiting for the malware scan
+	StatusReady       = "ready"       // usable
+	StatusQuarantined = "quarantined" // flagged by the scan, held for admin review
+	StatusFailed      = "failed"      // couldn't be scanned
+)
+
+// Attachment is an uploaded file. It is pending (MessageID nil) from upload
+// until a message created by the uploader claims it.
+type Attachment struct {
+	ID          uuid.UUID  `json:"id"`
+	UploaderID  uuid.UUID  `json:"uploaderId"`
+	MessageID   *uuid.UUID `json:"messageId"`
+	Filename    string     `json:"filename"`
+	ContentType string     `json:"contentType"`
+	Size        int64      `json:"size"`
+	Width       *int       `json:"width"`
+	Height      *int       `json:"height"`
+	SHA256      string     `json:"sha256"`
+	Blurhash    *string    `json:"blurhash"`
+	Variants    []string   `json:"variants"`   // sizes servable with ?size=
+	DurationMS  *int64     `json:"durationMs"` // audio and video only
+	Status      string     `json:"status"`
+	// Public attachments (avatars, the instance icon) have a plain URL;
+	// the rest get signed, expiring ones.
+	Public bool `json:"public"`
+	// Category and Inline are derived from ContentType: inline attachments
+	// can be shown or played in place, the rest are offered as downloads.
+	Category   media.Category `json:"category"`
+	Inline     bool           `json:"inline"`
+	StorageKey string         `json:"-"`
+	URL        string         `json:"url"`
+	CreatedAt  time.Time      `json:"createdAt"`
+}
+
+// Blob is a stored file. Attachments with identical content share one blob,
+// which is deleted when the last of them is.
+type Blob struct {
+	StorageKey string
+	SHA256     string
+	Size       int64
+	Variants   []string
+	RefCount   int
+}
+
+// Quarantined is a flagged attachment awaiting admin review.
+type Quarantined struct {
+	Attachment
+	Username  string    `json:"username"`
+	Signature string    `json:"signature"`
+	ScannedAt time.Time `json:"scannedAt"`
+}
+
+// Usage is the storage taken by one uploader's attachments.
+type Usage struct {
+	UserID   uuid.UUID `json:"userId"`
+	Username string    `json:"username"`
+	Files    int64     `json:"files"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// SetURL fills in where a ready attachment is served from.
+func (a *Attachment) SetURL(signer *storage.Signer) {
+	switch {
+	case a.Status != StatusReady:
+		a.URL = ""
+	case a.Public:
+		a.URL = signer.PublicURL(a.StorageKey)
+	default:
+		a.URL = signer.URL(a.StorageKey, a.ID.String())
+	}
+}
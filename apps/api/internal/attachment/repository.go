@@ -0,0 +1,521 @@
+package attachment
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/opencord/api/internal/media"
+)
+
+// ErrNotClaimable means an attachment doesn't exist, belongs to someone
+// else, is already part of a message or isn't ready.
+var ErrNotClaimable = errors.New("attachment not found")
+
+// ErrBlobGone means a blob found for reuse was deleted before it could be
+// referenced; store the file afresh instead.
+var ErrBlobGone = errors.New("blob no longer exists")
+
+type Repository interface {
+	Create(a *Attachment) error
+	GetByID(id uuid.UUID) (*Attachment, error)
+	ListByMessages(messageIDs []uuid.UUID) (map[uuid.UUID][]Attachment, error)
+	ListByUploader(uploaderID uuid.UUID) ([]Attachment, error)
+	UsageByUser(userID uuid.UUID) (int64, error)
+	TotalUsage() (int64, error)
+	ListUsage() ([]Usage, error)
+	DeleteUnreferenced(before time.Time, limit int) (int, []Blob, error)
+	FindBySHA256(sha256, contentType string, public bool) (*Attachment, error)
+	CreateShared(a *Attachment) error
+	ListByStatus(status string) ([]Attachment, error)
+	SetScanResult(id uuid.UUID, status string, signature *string) (*Attachment, error)
+	ListQuarantined() ([]Quarantined, error)
+	Release(id uuid.UUID) (*Attachment, error)
+	DeleteQuarantined(id uuid.UUID) (*Blob, error)
+}
+
+// columns is the select list matching scanAttachment.
+const columns = `id, uploader_id, message_id, filename, content_type, size, width, height, sha256, blurhash, variants, duration_ms, status, public, storage_key, created_at`
+
+// prefixed qualifies columns with a table alias.
+func prefixed(alias string) string {
+	return alias + strings.ReplaceAll(columns, ", ", ", "+alias)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAttachment(row scanner, a *Attachment, extra ...interface{}) error {
+	dest := []interface{}{&a.ID, &a.UploaderID, &a.MessageID, &a.Filename, &a.ContentType, &a.Size,
+		&a.Width, &a.Height, &a.SHA256, &a.Blurhash, (*pq.StringArray)(&a.Variants), &a.DurationMS, &a.Status, &a.Public, &a.StorageKey, &a.CreatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	if a.Variants == nil {
+		a.Variants = []string{}
+	}
+	a.Category, a.Inline = media.Classify(a.ContentType)
+	return nil
+}
+
+type PostgresRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresRepository(db *sql.DB) *PostgresRepository {
+	return &PostgresRepository{db: db}
+}
+
+// Create records an attachment whose file was just stored under
+// a.StorageKey, along with a new blob for that file.
+func (r *PostgresRepository) Create(a *Attachment) error {
+	if a.Variants == nil {
+		a.Variants = []string{}
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`INSERT INTO blobs (storage_key, sha256, content_type, size, variants, refcount)
+		 VALUES ($1, $2, $3, $4, $5, 1)`,
+		a.StorageKey, a.SHA256, a.ContentType, a.Size, pq.Array(a.Variants),
+	); err != nil {
+		return err
+	}
+	if err := insert(tx, a); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateShared records an attachment that reuses the blob under
+// a.StorageKey, found with FindBySHA256. It returns ErrBlobGone if the
+// blob lost its last reference in the meantime.
+func (r *PostgresRepository) CreateShared(a *Attachment) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE blobs SET refcount = refcount + 1 WHERE storage_key = $1 AND refcount > 0`, a.StorageKey)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrBlobGone
+	}
+	if err := insert(tx, a); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insert(tx *sql.Tx, a *Attachment) error {
+	if a.Status == "" {
+		a.Status = StatusReady
+	}
+	return tx.QueryRow(
+		`INSERT INTO attachments (id, uploader_id, filename, content_type, size, width, height, sha256, blurhash, variants, duration_ms, status, public, storage_key)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		 RETURNING created_at`,
+		a.ID, a.UploaderID, a.Filename, a.ContentType, a.Size, a.Width, a.Height, a.SHA256, a.Blurhash,
+		pq.Array(a.Variants), a.DurationMS, a.Status, a.Public, a.StorageKey,
+	).Scan(&a.CreatedAt)
+}
+
+// FindBySHA256 returns a ready attachment of a live blob with this content,
+// to copy the storage key and metadata from. Blobs still being scanned or
+// quarantined are never shared, and public and private uploads never share
+// a blob.
+func (r *PostgresRepository) FindBySHA256(sha256, contentType string, public bool) (*Attachment, error) {
+	a := &Attachment{}
+	err := scanAttachment(r.db.QueryRow(
+		`SELECT `+prefixed("a.")+` FROM blobs b
+		 JOIN attachments a ON a.storage_key = b.storage_key
+		 WHERE b.sha256 = $1 AND b.content_type = $2 AND b.refcount > 0
+		   AND a.status = 'ready' AND a.public = $3
+		 LIMIT 1`,
+		sha256, contentType, public,
+	), a)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// IsPublic reports whether a stored object belongs to a public attachment,
+// or is a file uploaded before attachments were tracked, and may be served
+// without a signature.
+func (r *PostgresRepository) IsPublic(key string) (bool, error) {
+	var public bool
+	err := r.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM attachments WHERE storage_key = $1 AND public AND status = 'ready')
+		     OR EXISTS (SELECT 1 FROM legacy_uploads WHERE storage_key = $1)`, key,
+	).Scan(&public)
+	return public, err
+}
+
+// Filename returns the name the attachment id was uploaded under, if it's
+// stored at key. Without an id it uses the oldest public attachment at key,
+// since anyone can fetch those. It returns "" if there's no such attachment.
+func (r *PostgresRepository) Filename(key, id string) (string, error) {
+	var name string
+	var err error
+	if id != "" {
+		err = r.db.QueryRow(
+			`SELECT filename FROM attachments WHERE id = $1 AND storage_key = $2`, id, key,
+		).Scan(&name)
+	} else {
+		err = r.db.QueryRow(
+			`SELECT filename FROM attachments WHERE storage_key = $1 AND public AND status = 'ready'
+			 ORDER BY created_at LIMIT 1`, key,
+		).Scan(&name)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return name, err
+}
+
+func (r *PostgresRepository) GetByID(id uuid.UUID) (*Attachment, error) {
+	a := &Attachment{}
+	if err := scanAttachment(r.db.QueryRow(`SELECT `+columns+` FROM attachments WHERE id = $1`, id), a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ListByMessages returns the attachments of each message in upload order.
+func (r *PostgresRepository) ListByMessages(messageIDs []uuid.UUID) (map[uuid.UUID][]Attachment, error) {
+	out := make(map[uuid.UUID][]Attachment)
+	if len(messageIDs) == 0 {
+		return out, nil
+	}
+	rows, err := r.db.Query(
+		`SELECT `+columns+` FROM attachments
+		 WHERE message_id = ANY($1::uuid[])
+		 ORDER BY message_id, position`,
+		pq.Array(uuidStrings(messageIDs)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Attachment
+		if err := scanAttachment(rows, &a); err != nil {
+			return nil, err
+		}
+		out[*a.MessageID] = append(out[*a.MessageID], a)
+	}
+	return out, rows.Err()
+}
+
+// ListByUploader returns everything a user has uploaded, oldest first.
+func (r *PostgresRepository) ListByUploader(uploaderID uuid.UUID) ([]Attachment, error) {
+	rows, err := r.db.Query(`SELECT `+columns+` FROM attachments WHERE uploader_id = $1 ORDER BY created_at`, uploaderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := scanAttachment(rows, &a); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// UsageByUser returns the bytes stored for a user's attachments.
+func (r *PostgresRepository) UsageByUser(userID uuid.UUID) (int64, error) {
+	var n int64
+	err := r.db.QueryRow(`SELECT COALESCE(SUM(size), 0) FROM attachments WHERE uploader_id = $1`, userID).Scan(&n)
+	return n, err
+}
+
+// TotalUsage returns the bytes stored, counting shared blobs once.
+func (r *PostgresRepository) TotalUsage() (int64, error) {
+	var n int64
+	err := r.db.QueryRow(`SELECT COALESCE(SUM(size), 0) FROM blobs WHERE refcount > 0`).Scan(&n)
+	return n, err
+}
+
+// ListUsage returns each uploader's usage, largest first.
+func (r *PostgresRepository) ListUsage() ([]Usage, error) {
+	rows, err := r.db.Query(
+		`SELECT a.uploader_id, u.username, COUNT(*), SUM(a.size)
+		 FROM attachments a
+		 JOIN users u ON u.id = a.uploader_id
+		 GROUP BY a.uploader_id, u.username
+		 ORDER BY SUM(a.size) DESC`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Usage{}
+	for rows.Next() {
+		var u Usage
+		if err := rows.Scan(&u.UserID, &u.Username, &u.Files, &u.Bytes); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// DeleteUnreferenced removes up to limit attachments uploaded before the
+// given time that no message claims and that aren't in use as an avatar or
+// the instance icon, which reference uploads by URL. Quarantined
+// attachments are left for an admin to review. Rows being claimed
+// concurrently are skipped. It returns how many attachments were removed
+// and the blobs that lost their last reference; the caller deletes their
+// files.
+func (r *PostgresRepository) DeleteUnreferenced(before time.Time, limit int) (int, []Blob, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`DELETE FROM attachments WHERE id IN (
+			SELECT a.id FROM attachments a
+			WHERE a.message_id IS NULL AND a.created_at < $1 AND a.status <> 'quarantined'
+			  AND NOT EXISTS (SELECT 1 FROM users u WHERE u.avatar_url LIKE '%/uploads/' || a.storage_key)
+			  AND NOT EXISTS (SELECT 1 FROM instance_settings s WHERE s.icon_url LIKE '%/uploads/' || a.storage_key)
+			ORDER BY a.created_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING storage_key`,
+		before, limit,
+	)
+	if err != nil {
+		return 0, nil, err
+	}
+	released := make(map[string]int)
+	deleted := 0
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		released[key]++
+		deleted++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	orphaned, err := releaseBlobs(tx, released)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return deleted, orphaned, nil
+}
+
+// releaseBlobs drops n references to each blob in released, deletes the
+// blobs left unreferenced and returns them.
+func releaseBlobs(tx *sql.Tx, released map[string]int) ([]Blob, error) {
+	var orphaned []Blob
+	for key, n := range released {
+		var b Blob
+		err := tx.QueryRow(
+			`UPDATE blobs SET refcount = refcount - $2 WHERE storage_key = $1
+			 RETURNING storage_key, sha256, size, variants, refcount`,
+			key, n,
+		).Scan(&b.StorageKey, &b.SHA256, &b.Size, (*pq.StringArray)(&b.Variants), &b.RefCount)
+		if err != nil {
+			return nil, err
+		}
+		if b.RefCount <= 0 {
+			orphaned = append(orphaned, b)
+		}
+	}
+	if len(orphaned) > 0 {
+		keys := make([]string, len(orphaned))
+		for i, b := range orphaned {
+			keys[i] = b.StorageKey
+		}
+		if _, err := tx.Exec(`DELETE FROM blobs WHERE storage_key = ANY($1)`, pq.Array(keys)); err != nil {
+			return nil, err
+		}
+	}
+	return orphaned, nil
+}
+
+// ListByStatus returns every attachment in a status, oldest first.
+func (r *PostgresRepository) ListByStatus(status string) ([]Attachment, error) {
+	rows, err := r.db.Query(`SELECT `+columns+` FROM attachments WHERE status = $1 ORDER BY created_at`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := scanAttachment(rows, &a); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// SetScanResult moves a processing attachment to the status its scan
+// decided, recording what was found. It returns sql.ErrNoRows if the
+// attachment is gone or was already scanned.
+func (r *PostgresRepository) SetScanResult(id uuid.UUID, status string, signature *string) (*Attachment, error) {
+	a := &Attachment{}
+	err := scanAttachment(r.db.QueryRow(
+		`UPDATE attachments SET status = $2, scan_signature = $3, scanned_at = NOW()
+		 WHERE id = $1 AND status = 'processing'
+		 RETURNING `+columns,
+		id, status, signature,
+	), a)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ListQuarantined returns the attachments awaiting review, newest first.
+func (r *PostgresRepository) ListQuarantined() ([]Quarantined, error) {
+	rows, err := r.db.Query(
+		`SELECT ` + prefixed("a.") + `, u.username, COALESCE(a.scan_signature, ''), a.scanned_at
+		 FROM attachments a
+		 JOIN users u ON u.id = a.uploader_id
+		 WHERE a.status = 'quarantined'
+		 ORDER BY a.scanned_at DESC`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Quarantined{}
+	for rows.Next() {
+		var q Quarantined
+		if err := scanAttachment(rows, &q.Attachment, &q.Username, &q.Signature, &q.ScannedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, q)
+	}
+	return out, rows.Err()
+}
+
+// Release marks a quarantined attachment ready after an admin judged the
+// scan wrong. It returns sql.ErrNoRows if it isn't quarantined.
+func (r *PostgresRepository) Release(id uuid.UUID) (*Attachment, error) {
+	a := &Attachment{}
+	err := scanAttachment(r.db.QueryRow(
+		`UPDATE attachments SET status = 'ready'
+		 WHERE id = $1 AND status = 'quarantined'
+		 RETURNING `+columns,
+		id,
+	), a)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// DeleteQuarantined removes a quarantined attachment and returns its blob
+// if that lost its last reference, or nil. It returns sql.ErrNoRows if the
+// attachment isn't quarantined.
+func (r *PostgresRepository) DeleteQuarantined(id uuid.UUID) (*Blob, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var key string
+	err = tx.QueryRow(
+		`DELETE FROM attachments WHERE id = $1 AND status = 'quarantined' RETURNING storage_key`, id,
+	).Scan(&key)
+	if err != nil {
+		return nil, err
+	}
+	orphaned, err := releaseBlobs(tx, map[string]int{key: 1})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if len(orphaned) == 0 {
+		return nil, nil
+	}
+	return &orphaned[0], nil
+}
+
+// Claim attaches pending attachments owned by uploaderID to a message, in
+// the given order. It runs in the caller's transaction so the message is
+// only created if every attachment could be claimed.
+func Claim(tx *sql.Tx, messageID, uploaderID uuid.UUID, ids []uuid.UUID) ([]Attachment, error) {
+	if len(ids) == 0 {
+		return []Attachment{}, nil
+	}
+	rows, err := tx.Query(
+		`UPDATE attachments
+		 SET message_id = $1, position = array_position($3::uuid[], id)
+		 WHERE id = ANY($3::uuid[]) AND uploader_id = $2 AND message_id IS NULL AND status = 'ready'
+		 RETURNING `+columns+`, position`,
+		messageID, uploaderID, pq.Array(uuidStrings(ids)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	claimed := make([]Attachment, len(ids))
+	n := 0
+	for rows.Next() {
+		var a Attachment
+		var position int
+		if err := scanAttachment(rows, &a, &position); err != nil {
+			return nil, err
+		}
+		claimed[position-1] = a
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if n != len(ids) {
+		return nil, ErrNotClaimable
+	}
+	return claimed, nil
+}
+
+func uuidStrings(ids []uuid.UUID) []string {
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		out[i] = id.String()
+	}
+	return out
+}
@@ -3,36 +3,47 @@ package auth
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
-var ErrInvalidToken = errors.New("invalid token")
+var (
+	ErrInvalidToken     = errors.New("invalid token")
+	ErrEmailNotVerified = errors.New("email not verified")
+	// ErrUserDeleted is returned for a user the auth server deleted, whose
+	// access tokens may not have expired yet
+	ErrUserDeleted = errors.New("user deleted")
+)
 
 // CentralAuthService validates JWTs issued by the central auth server using JWKS.
+// Only tokens the server issued for this instance are accepted, so a token
+// handed to one instance can't be replayed against another.
 type CentralAuthService struct {
-	jwks *JWKSClient
+	jwks     *JWKSClient
+	issuer   string
+	audience string
+
+	// RequireVerifiedEmail rejects users who haven't verified their email
+	// with the auth server.
+	RequireVerifiedEmail bool
 }
 
-func NewCentralAuthService(jwks *JWKSClient) *CentralAuthService {
-	return &CentralAuthService{jwks: jwks}
+// NewCentralAuthService expects tokens issued by issuer (the auth server's
+// ISSUER) for instanceURL, this instance's public URL.
+func NewCentralAuthService(jwks *JWKSClient, issuer, instanceURL string) *CentralAuthService {
+	return &CentralAuthService{
+		jwks:     jwks,
+		issuer:   strings.TrimRight(issuer, "/"),
+		audience: normalizeInstanceURL(instanceURL),
+	}
 }
 
 func (s *CentralAuthService) ValidateAccessToken(tokenString string) (*TokenClaims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-
-		kid, ok := token.Header["kid"].(string)
-		if !ok {
-			return nil, fmt.Errorf("missing kid in token header")
-		}
-
-		return s.jwks.GetKey(kid)
-	})
-	if err != nil || !token.Valid {
+	token, err := jwt.Parse(tokenString, s.key, jwt.WithIssuer(s.issuer), jwt.WithAudience(s.audience))
+	if err != nil || !token.Valid || !hasType(token, "JWT") {
 		return nil, ErrInvalidToken
 	}
 
@@ -61,6 +72,72 @@ func (s *CentralAuthService) ValidateAccessToken(tokenString string) (*TokenClai
 	if avatarURL, ok := claims["avatar_url"].(string); ok {
 		tc.AvatarURL = &avatarURL
 	}
+	tc.EmailVerified, _ = claims["email_verified"].(bool)
 
+	if s.RequireVerifiedEmail && !tc.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
 	return tc, nil
 }
+
+// EventAccountDeleted is the security event the auth server sends when it
+// deletes an account that was used on this instance.
+const EventAccountDeleted = "account_deleted"
+
+// ValidateAccountDeleted checks a security event token (RFC 8417) the auth
+// server pushed to this instance and returns the deleted user's ID.
+func (s *CentralAuthService) ValidateAccountDeleted(tokenString string) (uuid.UUID, error) {
+	// Security events are signed with the same keys for the same audience
+	// as access tokens; only the typ header tells the two apart
+	token, err := jwt.Parse(tokenString, s.key, jwt.WithIssuer(s.issuer), jwt.WithAudience(s.audience))
+	if err != nil || !token.Valid || !hasType(token, "secevent+jwt") {
+		return uuid.Nil, ErrInvalidToken
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return uuid.Nil, ErrInvalidToken
+	}
+	events, _ := claims["events"].(map[string]interface{})
+	if _, ok := events[EventAccountDeleted]; !ok {
+		return uuid.Nil, ErrInvalidToken
+	}
+	sub, _ := claims["sub"].(string)
+	userID, err := uuid.Parse(sub)
+	if err != nil {
+		return uuid.Nil, ErrInvalidToken
+	}
+	return userID, nil
+}
+
+// key finds the auth server's public key for a token by kid.
+func (s *CentralAuthService) key(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing kid in token header")
+	}
+
+	return s.jwks.GetKey(kid)
+}
+
+// hasType checks a token's typ header, which is optional for "JWT".
+func hasType(token *jwt.Token, typ string) bool {
+	got, ok := token.Header["typ"].(string)
+	if !ok {
+		return typ == "JWT"
+	}
+	return strings.EqualFold(got, typ)
+}
+
+// normalizeInstanceURL matches how the auth server writes instance URLs
+// into the aud claim: lowercase scheme and host, no trailing slash.
+func normalizeInstanceURL(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return strings.TrimRight(raw, "/")
+	}
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + strings.TrimRight(u.EscapedPath(), "/")
+}
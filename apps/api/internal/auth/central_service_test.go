@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// newTestCentralAuth serves a JWKS with one key, "k1", and returns a
+// service for the instance https://chat.example.com that trusts it.
+func newTestCentralAuth(t *testing.T) (*CentralAuthService, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwksResponse{Keys: []JWK{{
+			KTY: "EC", CRV: "P-256", KID: "k1", Use: "sig", Alg: "ES256",
+			X: base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+			Y: base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+		}}})
+	}))
+	t.Cleanup(srv.Close)
+
+	jwks, err := NewJWKSClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCentralAuthService(jwks, "https://auth.example.com/", "https://Chat.Example.com/"), key
+}
+
+func TestCentralAuthAudience(t *testing.T) {
+	svc, key := newTestCentralAuth(t)
+
+	userID := uuid.New()
+	verified := false
+	sign := func(iss, aud string) string {
+		claims := jwt.MapClaims{"sub": userID.String(), "iss": iss, "exp": time.Now().Add(time.Minute).Unix(), "email_verified": verified}
+		if aud != "" {
+			claims["aud"] = aud
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = "k1"
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name, iss, aud string
+		ok             bool
+	}{
+		{"issued for this instance", "https://auth.example.com", "https://chat.example.com", true},
+		{"issued for another instance", "https://auth.example.com", "https://evil.example.com", false},
+		{"central token", "https://auth.example.com", "https://auth.example.com", false},
+		{"no audience", "https://auth.example.com", "", false},
+		{"other issuer", "https://other.example.com", "https://chat.example.com", false},
+	}
+	for _, tt := range tests {
+		claims, err := svc.ValidateAccessToken(sign(tt.iss, tt.aud))
+		if tt.ok && (err != nil || claims.UserID != userID) {
+			t.Errorf("%s: rejected: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+
+	// Instances can insist on a verified email
+	svc.RequireVerifiedEmail = true
+	if _, err := svc.ValidateAccessToken(sign("https://auth.example.com", "https://chat.example.com")); err != ErrEmailNotVerified {
+		t.Errorf("unverified email = %v", err)
+	}
+	verified = true
+	if claims, err := svc.ValidateAccessToken(sign("https://auth.example.com", "https://chat.example.com")); err != nil || !claims.EmailVerified {
+		t.Errorf("verified email = %+v, %v", claims, err)
+	}
+}
+
+func TestAccountDeletedEvent(t *testing.T) {
+	svc, key := newTestCentralAuth(t)
+	userID := uuid.New()
+	sign := func(typ, aud string, events map[string]interface{}) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"iss": "https://auth.example.com", "aud": aud, "sub": userID.String(),
+			"exp": time.Now().Add(time.Minute).Unix(), "events": events,
+		})
+		token.Header["kid"] = "k1"
+		token.Header["typ"] = typ
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	deleted := map[string]interface{}{EventAccountDeleted: map[string]interface{}{}}
+
+	event := sign("secevent+jwt", "https://chat.example.com", deleted)
+	if got, err := svc.ValidateAccountDeleted(event); err != nil || got != userID {
+		t.Fatalf("ValidateAccountDeleted = %v, %v", got, err)
+	}
+	// Neither kind of token passes for the other
+	if _, err := svc.ValidateAccessToken(event); err != ErrInvalidToken {
+		t.Errorf("event accepted as access token: %v", err)
+	}
+	if _, err := svc.ValidateAccountDeleted(sign("JWT", "https://chat.example.com", deleted)); err != ErrInvalidToken {
+		t.Errorf("access token accepted as event: %v", err)
+	}
+	if _, err := svc.ValidateAccountDeleted(sign("secevent+jwt", "https://evil.example.com", deleted)); err != ErrInvalidToken {
+		t.Errorf("event for another instance accepted: %v", err)
+	}
+	if _, err := svc.ValidateAccountDeleted(sign("secevent+jwt", "https://chat.example.com", map[string]interface{}{"other": map[string]interface{}{}})); err != ErrInvalidToken {
+		t.Errorf("other event accepted: %v", err)
+	}
+}
+
+// memoryUserCache is a UserCacheRepository that remembers usernames.
+type memoryUserCache struct {
+	usernames map[uuid.UUID]string
+	deleted   map[uuid.UUID]bool
+}
+
+func (m *memoryUserCache) UpsertFromClaims(claims *TokenClaims) error {
+	if m.deleted[claims.UserID] {
+		return ErrUserDeleted
+	}
+	m.usernames[claims.UserID] = claims.Username
+	return nil
+}
+
+func (m *memoryUserCache) Anonymize(id uuid.UUID) error {
+	m.usernames[id] = "deleted-" + strings.ReplaceAll(id.String(), "-", "")[:12]
+	m.deleted[id] = true
+	return nil
+}
+
+func TestDeletedUserTokensRejected(t *testing.T) {
+	svc, key := newTestCentralAuth(t)
+	userID := uuid.New()
+	sign := func(typ string, claims jwt.MapClaims) string {
+		claims["iss"], claims["aud"], claims["sub"] = "https://auth.example.com", "https://chat.example.com", userID.String()
+		claims["exp"] = time.Now().Add(time.Minute).Unix()
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = "k1"
+		token.Header["typ"] = typ
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	access := sign("JWT", jwt.MapClaims{"username": "alice", "display_name": "Alice"})
+
+	cache := &memoryUserCache{usernames: make(map[uuid.UUID]string), deleted: make(map[uuid.UUID]bool)}
+	h := NewCentralHandler(svc, cache)
+	protected := h.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	get := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/api/users/me", nil)
+		req.Header.Set("Authorization", "Bearer "+access)
+		rec := httptest.NewRecorder()
+		protected.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := get(); code != http.StatusNoContent || cache.usernames[userID] != "alice" {
+		t.Fatalf("request before deletion = %d, cached %q", code, cache.usernames[userID])
+	}
+
+	event := sign("secevent+jwt", jwt.MapClaims{"events": map[string]interface{}{EventAccountDeleted: map[string]interface{}{}}})
+	rec := httptest.NewRecorder()
+	h.Events(rec, httptest.NewRequest(http.MethodPost, "/api/auth/events", strings.NewReader(event)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("event = %d: %s", rec.Code, rec.Body)
+	}
+
+	// The token still verifies, but must not bring the profile back
+	if code := get(); code != http.StatusUnauthorized {
+		t.Errorf("request after deletion = %d, want 401", code)
+	}
+	if cache.usernames[userID] == "alice" {
+		t.Error("deleted user's profile was restored from the token")
+	}
+}
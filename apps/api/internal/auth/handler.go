@@ -1,24 +1,41 @@
 package auth
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"github.com/opencord/shared/loginthrottle"
+	"github.com/opencord/shared/validation"
 )
 
 type Handler struct {
 	validator TokenValidator
 	localAuth *LocalAuthService   // nil in central mode
+	central   *CentralAuthService // nil in local mode
 	userRepo  UserCacheRepository // nil in local mode
 }
 
-// UserCacheRepository is implemented by user.PostgresRepository to upsert from JWT claims.
+// UserCacheRepository is implemented by user.PostgresRepository to upsert from JWT claims
+// and forget users deleted on the auth server. UpsertFromClaims returns
+// ErrUserDeleted for those, leaving the anonymized row alone.
 type UserCacheRepository interface {
 	UpsertFromClaims(claims *TokenClaims) error
+	Anonymize(id uuid.UUID) error
 }
 
 func NewCentralHandler(svc *CentralAuthService, userRepo UserCacheRepository) *Handler {
-	return &Handler{validator: svc, userRepo: userRepo}
+	return &Handler{validator: svc, central: svc, userRepo: userRepo}
 }
 
 func NewLocalHandler(svc *LocalAuthService) *Handler {
@@ -52,6 +69,10 @@ func (h *Handler) Middleware(next http.Handler) http.Handler {
 		}
 
 		claims, err := h.validator.ValidateAccessToken(parts[1])
+		if errors.Is(err, ErrEmailNotVerified) {
+			writeError(w, "verify your email address to use this instance", http.StatusForbidden)
+			return
+		}
 		if err != nil {
 			writeError(w, "invalid token", http.StatusUnauthorized)
 			return
@@ -59,7 +80,12 @@ func (h *Handler) Middleware(next http.Handler) http.Handler {
 
 		// Upsert user cache only in central mode (local mode users are already in the DB)
 		if h.userRepo != nil {
-			if err := h.userRepo.UpsertFromClaims(claims); err != nil {
+			err := h.userRepo.UpsertFromClaims(claims)
+			if errors.Is(err, ErrUserDeleted) {
+				writeError(w, "account deleted", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
 				writeError(w, "failed to sync user", http.StatusInternalServerError)
 				return
 			}
@@ -72,6 +98,34 @@ func (h *Handler) Middleware(next http.Handler) http.Handler {
 	})
 }
 
+// maxEventSize bounds the body of a pushed security event.
+const maxEventSize = 16 << 10
+
+// Events handles POST /api/auth/events (central auth only): security events
+// the auth server pushes to instances (RFC 8935). When an account is
+// deleted its cached profile is anonymized; its messages stay, shown as
+// from a deleted user.
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEventSize))
+	if err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.central.ValidateAccountDeleted(strings.TrimSpace(string(body)))
+	if err != nil {
+		writeError(w, "invalid security event", http.StatusBadRequest)
+		return
+	}
+	if err := h.userRepo.Anonymize(userID); err != nil {
+		log.Printf("failed to anonymize deleted user %s: %v", userID, err)
+		writeError(w, "failed to process event", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("anonymized user %s, deleted on the auth server", userID)
+	w.WriteHeader(http.StatusAccepted)
+}
+
 // Register handles POST /api/auth/register (local auth only).
 func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 	var req RegisterRequest
@@ -89,9 +143,15 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 		req.DisplayName = req.Username
 	}
 
-	resp, err := h.localAuth.Register(req)
+	resp, err := h.localAuth.Register(req, clientInfo(r, req.DeviceName))
 	if err != nil {
-		writeError(w, err.Error(), http.StatusBadRequest)
+		var fieldErr *validation.FieldError
+		if errors.As(err, &fieldErr) {
+			writeFieldError(w, fieldErr)
+			return
+		}
+		log.Printf("registration failed: %v", err)
+		writeError(w, "registration failed", http.StatusInternalServerError)
 		return
 	}
 
@@ -111,9 +171,20 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := h.localAuth.Login(req)
+	resp, err := h.localAuth.Login(req, clientInfo(r, req.DeviceName))
 	if err != nil {
-		writeError(w, err.Error(), http.StatusUnauthorized)
+		if err == ErrInvalidCredentials {
+			writeError(w, "invalid email or password", http.StatusUnauthorized)
+			return
+		}
+		var throttled *loginthrottle.ThrottledError
+		if errors.As(err, &throttled) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			writeError(w, "too many failed login attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+		log.Printf("login failed: %v", err)
+		writeError(w, "login failed", http.StatusInternalServerError)
 		return
 	}
 
@@ -133,7 +204,7 @@ func (h *Handler) Refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := h.localAuth.RefreshTokens(req.RefreshToken)
+	resp, err := h.localAuth.RefreshTokens(req.RefreshToken, clientInfo(r, ""))
 	if err != nil {
 		writeError(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -154,6 +225,69 @@ func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// ListSessions handles GET /api/sessions (local auth only).
+func (h *Handler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := h.localAuth.ListSessions(claims.UserID, claims.SessionID)
+	if err != nil {
+		writeError(w, "failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, sessions, http.StatusOK)
+}
+
+// RevokeSession handles DELETE /api/sessions/{id} (local auth only).
+func (h *Handler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessionID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.localAuth.RevokeSession(userID, sessionID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, "session not found", http.StatusNotFound)
+			return
+		}
+		writeError(w, "failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clientInfo describes the device making a login or refresh request.
+func clientInfo(r *http.Request, deviceName string) ClientInfo {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ClientInfo{
+		DeviceName: truncate(deviceName, 64),
+		IP:         ip,
+		UserAgent:  truncate(r.UserAgent(), 512),
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return strings.ToValidUTF8(s[:n], "")
+	}
+	return s
+}
+
 func writeJSON(w http.ResponseWriter, data interface{}, status int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -165,3 +299,15 @@ func writeError(w http.ResponseWriter, message string, status int) {
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(map[string]string{"error": message})
 }
+
+// writeFieldError adds the field and code to the error envelope so clients
+// can point at the offending input. Values already in use are conflicts.
+func writeFieldError(w http.ResponseWriter, err *validation.FieldError) {
+	status := http.StatusBadRequest
+	if err == validation.ErrEmailTaken || err == validation.ErrUsernameTaken {
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Message, "field": err.Field, "code": err.Code})
+}
@@ -5,17 +5,29 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
+
+	"github.com/opencord/shared/breach"
+	"github.com/opencord/shared/loginthrottle"
+	"github.com/opencord/shared/validation"
 )
 
+// ErrInvalidCredentials is returned for a wrong email or password.
+var ErrInvalidCredentials = errors.New("invalid email or password")
+
 // LocalAuthService handles registration, login, and HS256 JWT validation for standalone instances.
 type LocalAuthService struct {
 	repo      Repository
 	jwtSecret []byte
+
+	// BreachedPasswords, when set, is checked for every new password.
+	BreachedPasswords *breach.List
 }
 
 func NewLocalAuthService(repo Repository, jwtSecret string) *LocalAuthService {
@@ -25,7 +37,25 @@ func NewLocalAuthService(repo Repository, jwtSecret string) *LocalAuthService {
 	}
 }
 
-func (s *LocalAuthService) Register(req RegisterRequest) (*AuthResponse, error) {
+// Register creates an account. Every field is validated, and the errors
+// for bad or taken values are *FieldErrors.
+func (s *LocalAuthService) Register(req RegisterRequest, client ClientInfo) (*AuthResponse, error) {
+	req.Email = strings.TrimSpace(req.Email)
+	req.Username = strings.TrimSpace(req.Username)
+	req.DisplayName = strings.TrimSpace(req.DisplayName)
+	if err := validation.Email(req.Email); err != nil {
+		return nil, err
+	}
+	if err := validation.Username(req.Username); err != nil {
+		return nil, err
+	}
+	if err := validation.DisplayName(req.DisplayName); err != nil {
+		return nil, err
+	}
+	if err := validation.Password(req.Password, s.BreachedPasswords, req.Username, req.Email); err != nil {
+		return nil, err
+	}
+
 	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash password: %w", err)
@@ -36,27 +66,39 @@ func (s *LocalAuthService) Register(req RegisterRequest) (*AuthResponse, error)
 		return nil, err
 	}
 
-	return s.generateTokens(user)
+	return s.startSession(user, client)
 }
 
-func (s *LocalAuthService) Login(req LoginRequest) (*AuthResponse, error) {
-	user, err := s.repo.GetUserByEmail(req.Email)
+// Login checks the user's password. Repeated failures lock the account
+// and IP address out for a while (see loginthrottle); the response never
+// says whether the email has an account.
+func (s *LocalAuthService) Login(req LoginRequest, client ClientInfo) (*AuthResponse, error) {
+	attempt, err := s.beginLogin(req.Email, client)
 	if err != nil {
-		return nil, errors.New("invalid email or password")
+		return nil, err
 	}
 
-	if user.PasswordHash == nil {
-		return nil, errors.New("invalid email or password")
+	user, err := s.repo.GetUserByEmail(req.Email)
+	if err != nil || user.PasswordHash == nil {
+		_ = bcrypt.CompareHashAndPassword(loginthrottle.DummyPasswordHash, []byte(req.Password))
+		s.loginFailed(attempt, nil, client)
+		return nil, ErrInvalidCredentials
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(*user.PasswordHash), []byte(req.Password)); err != nil {
-		return nil, errors.New("invalid email or password")
+		s.loginFailed(attempt, user, client)
+		return nil, ErrInvalidCredentials
 	}
+	s.loginSucceeded(attempt, user, client)
 
-	return s.generateTokens(user)
+	return s.startSession(user, client)
 }
 
-func (s *LocalAuthService) RefreshTokens(refreshToken string) (*AuthResponse, error) {
+// RefreshTokens rotates a refresh token within its session. Presenting a
+// token that was already rotated means it was copied, so the whole session
+// is revoked: whichever of the thief and the user refreshes next is logged
+// out.
+func (s *LocalAuthService) RefreshTokens(refreshToken string, client ClientInfo) (*AuthResponse, error) {
 	tokenHash := hashToken(refreshToken)
 
 	stored, err := s.repo.GetRefreshToken(tokenHash)
@@ -64,29 +106,59 @@ func (s *LocalAuthService) RefreshTokens(refreshToken string) (*AuthResponse, er
 		return nil, errors.New("invalid refresh token")
 	}
 
-	if stored.ExpiresAt.Before(time.Now()) {
-		_ = s.repo.DeleteRefreshToken(stored.ID)
+	if stored.UsedAt == nil && stored.ExpiresAt.Before(time.Now()) {
+		_ = s.repo.DeleteSession(stored.UserID, stored.SessionID)
 		return nil, errors.New("refresh token expired")
 	}
 
-	// Rotate: delete old token
-	_ = s.repo.DeleteRefreshToken(stored.ID)
+	fresh := stored.UsedAt == nil
+	if fresh {
+		if fresh, err = s.repo.MarkRefreshTokenUsed(stored.ID); err != nil {
+			return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+		}
+	}
+	if !fresh {
+		log.Printf("refresh token reused for user %s; revoking session %s", stored.UserID, stored.SessionID)
+		_ = s.repo.DeleteSession(stored.UserID, stored.SessionID)
+		return nil, errors.New("invalid refresh token")
+	}
 
 	user, err := s.repo.GetUserByID(stored.UserID)
 	if err != nil {
 		return nil, errors.New("user not found")
 	}
 
-	return s.generateTokens(user)
+	_ = s.repo.TouchSession(stored.SessionID, client)
+	return s.generateTokens(user, stored.SessionID)
 }
 
+// Logout ends the session the refresh token belongs to.
 func (s *LocalAuthService) Logout(refreshToken string) error {
 	tokenHash := hashToken(refreshToken)
 	stored, err := s.repo.GetRefreshToken(tokenHash)
 	if err != nil {
 		return nil // Already invalid, treat as success
 	}
-	return s.repo.DeleteRefreshToken(stored.ID)
+	return s.repo.DeleteSession(stored.UserID, stored.SessionID)
+}
+
+// ListSessions lists the user's active sessions, marking the one current
+// belongs to.
+func (s *LocalAuthService) ListSessions(userID, current uuid.UUID) ([]Session, error) {
+	sessions, err := s.repo.ListSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	return sessions, nil
+}
+
+// RevokeSession ends one of the user's sessions. Access tokens already
+// issued to it stay valid until they expire.
+func (s *LocalAuthService) RevokeSession(userID, sessionID uuid.UUID) error {
+	return s.repo.DeleteSession(userID, sessionID)
 }
 
 func (s *LocalAuthService) ValidateAccessToken(tokenString string) (*TokenClaims, error) {
@@ -116,6 +188,9 @@ func (s *LocalAuthService) ValidateAccessToken(tokenString string) (*TokenClaims
 	}
 
 	tc := &TokenClaims{UserID: userID}
+	if sid, ok := claims["sid"].(string); ok {
+		tc.SessionID, _ = uuid.Parse(sid)
+	}
 	if username, ok := claims["username"].(string); ok {
 		tc.Username = username
 	}
@@ -129,10 +204,19 @@ func (s *LocalAuthService) ValidateAccessToken(tokenString string) (*TokenClaims
 	return tc, nil
 }
 
-func (s *LocalAuthService) generateTokens(user *LocalUser) (*AuthResponse, error) {
+func (s *LocalAuthService) startSession(user *LocalUser, client ClientInfo) (*AuthResponse, error) {
+	session, err := s.repo.CreateSession(user.ID, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+	return s.generateTokens(user, session.ID)
+}
+
+func (s *LocalAuthService) generateTokens(user *LocalUser, sessionID uuid.UUID) (*AuthResponse, error) {
 	now := time.Now()
 	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"sub":          user.ID.String(),
+		"sid":          sessionID.String(),
 		"username":     user.Username,
 		"display_name": user.DisplayName,
 		"avatar_url":   user.AvatarURL,
@@ -149,7 +233,7 @@ func (s *LocalAuthService) generateTokens(user *LocalUser) (*AuthResponse, error
 	refreshTokenHash := hashToken(refreshTokenID)
 	expiresAt := now.Add(7 * 24 * time.Hour)
 
-	if err := s.repo.CreateRefreshToken(user.ID, refreshTokenHash, expiresAt); err != nil {
+	if err := s.repo.CreateRefreshToken(user.ID, sessionID, refreshTokenHash, expiresAt); err != nil {
 		return nil, fmt.Errorf("failed to store refresh token: %w", err)
 	}
 
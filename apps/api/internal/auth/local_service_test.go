@@ -0,0 +1,345 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"github.com/opencord/shared/clientip"
+	"github.com/opencord/shared/loginthrottle"
+	"github.com/opencord/shared/validation"
+)
+
+// memoryRepo is an in-memory Repository.
+type memoryRepo struct {
+	mu       sync.Mutex
+	users    map[uuid.UUID]*LocalUser
+	sessions map[uuid.UUID]*Session
+	tokens   map[string]*StoredRefreshToken
+	*loginthrottle.MemoryStore
+}
+
+func newMemoryRepo() *memoryRepo {
+	return &memoryRepo{
+		users:    map[uuid.UUID]*LocalUser{},
+		sessions: map[uuid.UUID]*Session{},
+		tokens:   map[string]*StoredRefreshToken{},
+
+		MemoryStore: loginthrottle.NewMemoryStore(),
+	}
+}
+
+func (m *memoryRepo) CreateUser(email, username, displayName, passwordHash string) (*LocalUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, email) {
+			return nil, validation.ErrEmailTaken
+		}
+		if strings.EqualFold(u.Username, username) {
+			return nil, validation.ErrUsernameTaken
+		}
+	}
+	u := &LocalUser{ID: uuid.New(), Email: email, Username: username, DisplayName: displayName, PasswordHash: &passwordHash, CreatedAt: time.Now()}
+	m.users[u.ID] = u
+	return u, nil
+}
+
+func (m *memoryRepo) GetUserByEmail(email string) (*LocalUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRepo) GetUserByID(id uuid.UUID) (*LocalUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.users[id]; ok {
+		return u, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRepo) CreateSession(userID uuid.UUID, client ClientInfo) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &Session{ID: uuid.New(), UserID: userID, DeviceName: client.DeviceName, IPAddress: client.IP,
+		UserAgent: client.UserAgent, CreatedAt: time.Now(), LastUsedAt: time.Now()}
+	m.sessions[s.ID] = s
+	return s, nil
+}
+
+func (m *memoryRepo) TouchSession(id uuid.UUID, client ClientInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; ok {
+		s.IPAddress, s.UserAgent, s.LastUsedAt = client.IP, client.UserAgent, time.Now()
+	}
+	return nil
+}
+
+func (m *memoryRepo) ListSessions(userID uuid.UUID) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []Session{}
+	for _, s := range m.sessions {
+		if s.UserID == userID {
+			out = append(out, *s)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryRepo) DeleteSession(userID, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; !ok || s.UserID != userID {
+		return sql.ErrNoRows
+	}
+	delete(m.sessions, id)
+	for hash, t := range m.tokens {
+		if t.SessionID == id {
+			delete(m.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (m *memoryRepo) CreateRefreshToken(userID, sessionID uuid.UUID, tokenHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[tokenHash] = &StoredRefreshToken{ID: uuid.New(), UserID: userID, SessionID: sessionID,
+		TokenHash: tokenHash, ExpiresAt: expiresAt, CreatedAt: time.Now()}
+	return nil
+}
+
+func (m *memoryRepo) GetRefreshToken(tokenHash string) (*StoredRefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tokens[tokenHash]; ok {
+		stored := *t
+		return &stored, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRepo) MarkRefreshTokenUsed(id uuid.UUID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tokens {
+		if t.ID == id {
+			if t.UsedAt != nil {
+				return false, nil
+			}
+			now := time.Now()
+			t.UsedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	repo := newMemoryRepo()
+	svc := NewLocalAuthService(repo, "secret")
+	laptop := ClientInfo{DeviceName: "Laptop", IP: "203.0.113.1", UserAgent: "Firefox"}
+
+	if _, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, laptop); err != nil {
+		t.Fatal(err)
+	}
+	phone, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{DeviceName: "Phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := svc.ValidateAccessToken(login.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := svc.ListSessions(claims.UserID, claims.SessionID)
+	if err != nil || len(sessions) != 3 {
+		t.Fatalf("sessions = %+v, %v", sessions, err)
+	}
+	current := 0
+	for _, s := range sessions {
+		if s.Current {
+			current++
+			if s.ID != claims.SessionID || s.DeviceName != "Laptop" || s.IPAddress != "203.0.113.1" {
+				t.Errorf("current session = %+v", s)
+			}
+		}
+	}
+	if current != 1 {
+		t.Errorf("%d sessions marked current", current)
+	}
+
+	// Normal rotation stays in the session
+	rotated, err := svc.RefreshTokens(login.RefreshToken, laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := svc.ValidateAccessToken(rotated.AccessToken); c.SessionID != claims.SessionID {
+		t.Errorf("rotated token in session %s, want %s", c.SessionID, claims.SessionID)
+	}
+
+	// Replaying the old token kills the session, including the token the
+	// legitimate client now holds
+	if _, err := svc.RefreshTokens(login.RefreshToken, ClientInfo{IP: "198.51.100.7"}); err == nil {
+		t.Fatal("replayed refresh token accepted")
+	}
+	if _, err := svc.RefreshTokens(rotated.RefreshToken, laptop); err == nil {
+		t.Error("session survived refresh token reuse")
+	}
+
+	// Other sessions are unaffected
+	if _, err := svc.RefreshTokens(phone.RefreshToken, ClientInfo{}); err != nil {
+		t.Errorf("other session revoked: %v", err)
+	}
+	if sessions, _ := svc.ListSessions(claims.UserID, uuid.Nil); len(sessions) != 2 {
+		t.Errorf("sessions after revocation = %d, want 2", len(sessions))
+	}
+}
+
+func TestLoginThrottling(t *testing.T) {
+	repo := newMemoryRepo()
+	svc := NewLocalAuthService(repo, "secret")
+	if _, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, ClientInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	attacker := ClientInfo{IP: "198.51.100.7"}
+
+	// Unknown accounts fail the same way as real ones
+	for _, email := range []string{"a@example.com", "nobody@example.com"} {
+		for i := 0; i < loginthrottle.AccountFreeAttempts; i++ {
+			_, err := svc.Login(LoginRequest{Email: email, Password: "wrong"}, attacker)
+			if err == nil || err.Error() != "invalid email or password" {
+				t.Fatalf("failure %d for %s = %v", i+1, email, err)
+			}
+		}
+		var throttled *loginthrottle.ThrottledError
+		if _, err := svc.Login(LoginRequest{Email: email, Password: "hunter22"}, ClientInfo{}); !errors.As(err, &throttled) {
+			t.Errorf("login to locked out %s = %v", email, err)
+		}
+	}
+
+	// Guessing across accounts locks out the IP address
+	for i := 0; i < loginthrottle.IPFreeAttempts; i++ {
+		_, _ = svc.Login(LoginRequest{Email: fmt.Sprintf("user%d@example.com", i), Password: "wrong"}, attacker)
+	}
+	_ = repo.ClearLoginAttempts("account:a@example.com")
+	var throttled *loginthrottle.ThrottledError
+	if _, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, attacker); !errors.As(err, &throttled) {
+		t.Errorf("login from locked out IP = %v", err)
+	}
+	if _, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{IP: "203.0.113.1"}); err != nil {
+		t.Errorf("login from another IP = %v", err)
+	}
+}
+
+func TestLoginThrottlingIgnoresSpoofedIP(t *testing.T) {
+	svc := NewLocalAuthService(newMemoryRepo(), "secret")
+	proxies, err := clientip.ParseProxies("private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := chi.NewRouter()
+	router.Use(proxies.Middleware)
+	router.Post("/api/auth/login", NewLocalHandler(svc).Login)
+
+	// A client that isn't a proxy can't pick its address with the headers
+	login := func(i int) int {
+		body := fmt.Sprintf(`{"email":"user%d@example.com","password":"wrong"}`, i)
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(body))
+		req.RemoteAddr = "198.51.100.7:40000"
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("192.0.2.%d", i))
+		req.Header.Set("X-Real-IP", fmt.Sprintf("192.0.2.%d", i))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for i := 0; i < loginthrottle.IPFreeAttempts; i++ {
+		if code := login(i); code != http.StatusUnauthorized {
+			t.Fatalf("failure %d = %d", i+1, code)
+		}
+	}
+	if code := login(loginthrottle.IPFreeAttempts); code != http.StatusTooManyRequests {
+		t.Errorf("login after %d failures with changing headers = %d, want 429", loginthrottle.IPFreeAttempts, code)
+	}
+}
+
+// brokenThrottleRepo fails to count login attempts, like a database that's
+// down.
+type brokenThrottleRepo struct {
+	*memoryRepo
+}
+
+func (brokenThrottleRepo) RecordLoginAttempt(key string, free int) (int, time.Time, error) {
+	return 0, time.Time{}, errors.New("dial tcp 10.0.0.5:5432: connect: connection refused")
+}
+
+func TestLoginHidesInternalErrors(t *testing.T) {
+	h := NewLocalHandler(NewLocalAuthService(brokenThrottleRepo{newMemoryRepo()}, "secret"))
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(`{"email":"a@example.com","password":"hunter22"}`))
+	rec := httptest.NewRecorder()
+	h.Login(rec, req)
+	if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "10.0.0.5") {
+		t.Errorf("login with the database down = %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	svc := NewLocalAuthService(newMemoryRepo(), "secret")
+	register := func(email, username, password string) error {
+		_, err := svc.Register(RegisterRequest{Email: email, Username: username, DisplayName: "Alice", Password: password}, ClientInfo{})
+		return err
+	}
+	for _, tc := range []struct {
+		email, username, password string
+		want                      *validation.FieldError
+	}{
+		// The rules are tested in the validation package
+		{"not an email", "alice", "hunter22", validation.ErrInvalidEmail},
+		{"a@example.com", "root", "hunter22", validation.ErrReservedUsername},
+		{"a@example.com", "alice12345", "alice12345", validation.ErrGuessablePassword},
+	} {
+		if err := register(tc.email, tc.username, tc.password); err != tc.want {
+			t.Errorf("Register(%q, %q, %q) = %v, want %v", tc.email, tc.username, tc.password, err, tc.want)
+		}
+	}
+
+	if err := register("a@example.com", "alice", "hunter22"); err != nil {
+		t.Fatal(err)
+	}
+	if err := register("A@EXAMPLE.COM", "bob", "hunter22"); err != validation.ErrEmailTaken {
+		t.Errorf("duplicate email = %v", err)
+	}
+	err := register("b@example.com", "Alice", "hunter22")
+	if err != validation.ErrUsernameTaken {
+		t.Fatalf("duplicate username = %v", err)
+	}
+
+	// Clients get a 409 naming the field, not the database's error
+	rec := httptest.NewRecorder()
+	writeFieldError(rec, err.(*validation.FieldError))
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), `"field":"username"`) || !strings.Contains(rec.Body.String(), `"code":"username_taken"`) {
+		t.Errorf("username taken response = %d %s", rec.Code, rec.Body)
+	}
+}
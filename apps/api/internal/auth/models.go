@@ -9,9 +9,21 @@ import (
 // TokenClaims holds the claims extracted from a JWT (both central and local auth).
 type TokenClaims struct {
 	UserID      uuid.UUID
+	SessionID   uuid.UUID // zero if the token isn't tied to a session
 	Username    string
 	DisplayName string
 	AvatarURL   *string
+
+	// EmailVerified is set by the central auth server once the user has
+	// confirmed their email; always false with local auth.
+	EmailVerified bool
+}
+
+// ClientInfo describes the device a session belongs to.
+type ClientInfo struct {
+	DeviceName string
+	IP         string
+	UserAgent  string
 }
 
 type contextKey string
@@ -26,11 +38,13 @@ type RegisterRequest struct {
 	Username    string `json:"username"`
 	DisplayName string `json:"displayName"`
 	Password    string `json:"password"`
+	DeviceName  string `json:"deviceName,omitempty"`
 }
 
 type LoginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	DeviceName string `json:"deviceName,omitempty"`
 }
 
 type RefreshRequest struct {
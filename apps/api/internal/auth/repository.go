@@ -5,6 +5,9 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/opencord/shared/loginthrottle"
+	"github.com/opencord/shared/validation"
 )
 
 // LocalUser is the full user row used by local auth (includes password_hash).
@@ -18,31 +21,53 @@ type LocalUser struct {
 	CreatedAt    time.Time
 }
 
-// StoredRefreshToken is a refresh token row.
+// StoredRefreshToken is a refresh token row. Tokens are kept after
+// rotation with UsedAt set.
 type StoredRefreshToken struct {
 	ID        uuid.UUID
 	UserID    uuid.UUID
+	SessionID uuid.UUID
 	TokenHash string
 	ExpiresAt time.Time
+	UsedAt    *time.Time
 	CreatedAt time.Time
 }
 
+// Session is a login on one device: the family of refresh tokens rotated
+// from the one issued at login.
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	UserID     uuid.UUID `json:"-"`
+	DeviceName string    `json:"deviceName"`
+	IPAddress  string    `json:"ipAddress"`
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	Current    bool      `json:"current"`
+}
+
 // Repository defines data access for local auth (users + refresh tokens).
 type Repository interface {
 	CreateUser(email, username, displayName, passwordHash string) (*LocalUser, error)
 	GetUserByEmail(email string) (*LocalUser, error)
 	GetUserByID(id uuid.UUID) (*LocalUser, error)
-	CreateRefreshToken(userID uuid.UUID, tokenHash string, expiresAt time.Time) error
+	CreateSession(userID uuid.UUID, client ClientInfo) (*Session, error)
+	TouchSession(id uuid.UUID, client ClientInfo) error
+	ListSessions(userID uuid.UUID) ([]Session, error)
+	DeleteSession(userID, id uuid.UUID) error
+	CreateRefreshToken(userID, sessionID uuid.UUID, tokenHash string, expiresAt time.Time) error
 	GetRefreshToken(tokenHash string) (*StoredRefreshToken, error)
-	DeleteRefreshToken(id uuid.UUID) error
+	MarkRefreshTokenUsed(id uuid.UUID) (bool, error)
+	loginthrottle.Store
 }
 
 type PostgresRepository struct {
 	db *sql.DB
+	*loginthrottle.PostgresStore
 }
 
 func NewPostgresRepository(db *sql.DB) *PostgresRepository {
-	return &PostgresRepository{db: db}
+	return &PostgresRepository{db: db, PostgresStore: loginthrottle.NewPostgresStore(db)}
 }
 
 func (r *PostgresRepository) CreateUser(email, username, displayName, passwordHash string) (*LocalUser, error) {
@@ -54,7 +79,7 @@ func (r *PostgresRepository) CreateUser(email, username, displayName, passwordHa
 		email, username, displayName, passwordHash,
 	).Scan(&u.ID, &u.Email, &u.Username, &u.DisplayName, &u.AvatarURL, &u.PasswordHash, &u.CreatedAt)
 	if err != nil {
-		return nil, err
+		return nil, validation.UserConflict(err)
 	}
 	return u, nil
 }
@@ -63,7 +88,7 @@ func (r *PostgresRepository) GetUserByEmail(email string) (*LocalUser, error) {
 	u := &LocalUser{}
 	err := r.db.QueryRow(
 		`SELECT id, email, username, display_name, avatar_url, password_hash, created_at
-		 FROM users WHERE email = $1`, email,
+		 FROM users WHERE LOWER(email) = LOWER($1)`, email,
 	).Scan(&u.ID, &u.Email, &u.Username, &u.DisplayName, &u.AvatarURL, &u.PasswordHash, &u.CreatedAt)
 	if err != nil {
 		return nil, err
@@ -83,10 +108,84 @@ func (r *PostgresRepository) GetUserByID(id uuid.UUID) (*LocalUser, error) {
 	return u, nil
 }
 
-func (r *PostgresRepository) CreateRefreshToken(userID uuid.UUID, tokenHash string, expiresAt time.Time) error {
+// CreateSession starts a session, first clearing out the user's sessions
+// whose tokens have all expired.
+func (r *PostgresRepository) CreateSession(userID uuid.UUID, client ClientInfo) (*Session, error) {
+	if _, err := r.db.Exec(
+		`DELETE FROM sessions s WHERE s.user_id = $1 AND NOT EXISTS (
+			SELECT 1 FROM refresh_tokens t WHERE t.session_id = s.id AND t.expires_at > NOW())`,
+		userID,
+	); err != nil {
+		return nil, err
+	}
+
+	s := &Session{}
+	err := r.db.QueryRow(
+		`INSERT INTO sessions (user_id, device_name, ip_address, user_agent)
+		 VALUES ($1, $2, $3, $4)
+		 RETURNING id, user_id, device_name, ip_address, user_agent, created_at, last_used_at`,
+		userID, client.DeviceName, client.IP, client.UserAgent,
+	).Scan(&s.ID, &s.UserID, &s.DeviceName, &s.IPAddress, &s.UserAgent, &s.CreatedAt, &s.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// TouchSession records where a session was last used from.
+func (r *PostgresRepository) TouchSession(id uuid.UUID, client ClientInfo) error {
 	_, err := r.db.Exec(
-		`INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
-		userID, tokenHash, expiresAt,
+		`UPDATE sessions SET ip_address = $2, user_agent = $3, last_used_at = NOW() WHERE id = $1`,
+		id, client.IP, client.UserAgent,
+	)
+	return err
+}
+
+// ListSessions returns the user's sessions that can still be refreshed,
+// most recently used first.
+func (r *PostgresRepository) ListSessions(userID uuid.UUID) ([]Session, error) {
+	rows, err := r.db.Query(
+		`SELECT s.id, s.user_id, s.device_name, s.ip_address, s.user_agent, s.created_at, s.last_used_at
+		 FROM sessions s
+		 WHERE s.user_id = $1 AND EXISTS (
+			SELECT 1 FROM refresh_tokens t
+			WHERE t.session_id = s.id AND t.used_at IS NULL AND t.expires_at > NOW())
+		 ORDER BY s.last_used_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.DeviceName, &s.IPAddress, &s.UserAgent, &s.CreatedAt, &s.LastUsedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSession ends a session, deleting its refresh tokens. It returns
+// sql.ErrNoRows if the user has no such session.
+func (r *PostgresRepository) DeleteSession(userID, id uuid.UUID) error {
+	res, err := r.db.Exec(`DELETE FROM sessions WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *PostgresRepository) CreateRefreshToken(userID, sessionID uuid.UUID, tokenHash string, expiresAt time.Time) error {
+	_, err := r.db.Exec(
+		`INSERT INTO refresh_tokens (user_id, session_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)`,
+		userID, sessionID, tokenHash, expiresAt,
 	)
 	return err
 }
@@ -94,16 +193,22 @@ func (r *PostgresRepository) CreateRefreshToken(userID uuid.UUID, tokenHash stri
 func (r *PostgresRepository) GetRefreshToken(tokenHash string) (*StoredRefreshToken, error) {
 	t := &StoredRefreshToken{}
 	err := r.db.QueryRow(
-		`SELECT id, user_id, token_hash, expires_at, created_at
+		`SELECT id, user_id, session_id, token_hash, expires_at, used_at, created_at
 		 FROM refresh_tokens WHERE token_hash = $1`, tokenHash,
-	).Scan(&t.ID, &t.UserID, &t.TokenHash, &t.ExpiresAt, &t.CreatedAt)
+	).Scan(&t.ID, &t.UserID, &t.SessionID, &t.TokenHash, &t.ExpiresAt, &t.UsedAt, &t.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return t, nil
 }
 
-func (r *PostgresRepository) DeleteRefreshToken(id uuid.UUID) error {
-	_, err := r.db.Exec(`DELETE FROM refresh_tokens WHERE id = $1`, id)
-	return err
+// MarkRefreshTokenUsed marks a token as rotated. It reports false if the
+// token had already been used, which means it was replayed.
+func (r *PostgresRepository) MarkRefreshTokenUsed(id uuid.UUID) (bool, error) {
+	res, err := r.db.Exec(`UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1 AND used_at IS NULL`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
 }
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"log"
+
+	"github.com/opencord/shared/loginthrottle"
+)
+
+// Logins are throttled per account and IP address by loginthrottle.
+// Instances don't send email, so these hooks log lockouts of real accounts
+// for the operator.
+
+// beginLogin counts a login attempt before the password is checked. It
+// fails with a *loginthrottle.ThrottledError while the account or IP
+// address is locked out.
+func (s *LocalAuthService) beginLogin(email string, client ClientInfo) (*loginthrottle.Attempt, error) {
+	return loginthrottle.Begin(s.repo, loginthrottle.NewKeys(email, client.IP))
+}
+
+func (s *LocalAuthService) loginFailed(attempt *loginthrottle.Attempt, user *LocalUser, client ClientInfo) {
+	if user != nil && attempt.LockedOut() {
+		log.Printf("locked out logins to user %s after %d failures (last from %s)", user.ID, attempt.Failures, client.IP)
+	}
+}
+
+func (s *LocalAuthService) loginSucceeded(attempt *loginthrottle.Attempt, user *LocalUser, client ClientInfo) {
+	if err := attempt.Succeeded(); err != nil {
+		log.Printf("failed to clear login failures for user %s: %v", user.ID, err)
+	}
+	if failures := attempt.EarlierFailures(); failures >= loginthrottle.AccountFreeAttempts {
+		log.Printf("suspicious login: user %s signed in from %s after %d failed attempts", user.ID, client.IP, failures)
+	}
+}
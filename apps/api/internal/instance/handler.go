@@ -3,14 +3,21 @@ package instance
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
+
+	"github.com/opencord/api/internal/attachment"
+	"github.com/opencord/api/internal/auth"
+	"github.com/opencord/api/internal/member"
 )
 
 type Handler struct {
-	repo Repository
+	repo        Repository
+	memberRepo  member.Repository
+	attachments attachment.Repository
 }
 
-func NewHandler(repo Repository) *Handler {
-	return &Handler{repo: repo}
+func NewHandler(repo Repository, memberRepo member.Repository, attachments attachment.Repository) *Handler {
+	return &Handler{repo: repo, memberRepo: memberRepo, attachments: attachments}
 }
 
 func (h *Handler) GetInfo(w http.ResponseWriter, r *http.Request) {
@@ -22,6 +29,77 @@ func (h *Handler) GetInfo(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, info, http.StatusOK)
 }
 
+// Update changes instance settings. Admins and the owner only.
+func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		writeError(w, "insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	var req UpdateInstanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		writeError(w, "name cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if req.MaxUploadSize != nil && *req.MaxUploadSize <= 0 {
+		writeError(w, "maxUploadSize must be positive", http.StatusBadRequest)
+		return
+	}
+	if (req.StorageQuota != nil && *req.StorageQuota < 0) || (req.UserStorageQuota != nil && *req.UserStorageQuota < 0) {
+		writeError(w, "quotas cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	info, err := h.repo.Update(req)
+	if err != nil {
+		writeError(w, "failed to update instance", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, info, http.StatusOK)
+}
+
+// Storage reports upload storage use per user against the quotas. Admins
+// and the owner only.
+func (h *Handler) Storage(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		writeError(w, "insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	info, err := h.repo.Get()
+	if err != nil {
+		writeError(w, "failed to get instance info", http.StatusInternalServerError)
+		return
+	}
+	users, err := h.attachments.ListUsage()
+	if err != nil {
+		writeError(w, "failed to get storage usage", http.StatusInternalServerError)
+		return
+	}
+	usage := StorageUsage{
+		StorageQuota:     info.StorageQuota,
+		UserStorageQuota: info.UserStorageQuota,
+		Users:            users,
+	}
+	for _, u := range users {
+		usage.UsedBytes += u.Bytes
+	}
+	writeJSON(w, usage, http.StatusOK)
+}
+
+func (h *Handler) isAdmin(r *http.Request) bool {
+	userID, ok := auth.UserFromContext(r.Context())
+	if !ok {
+		return false
+	}
+	caller, err := h.memberRepo.GetByUserID(userID)
+	return err == nil && (caller.Role == "admin" || caller.Role == "owner")
+}
+
 func writeJSON(w http.ResponseWriter, data interface{}, status int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
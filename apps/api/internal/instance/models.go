@@ -1,5 +1,7 @@
 package instance
 
+import "github.com/opencord/api/internal/attachment"
+
 type InstanceInfo struct {
 	Name             string  `json:"name"`
 	IconURL          *string `json:"iconUrl"`
@@ -7,6 +9,13 @@ type InstanceInfo struct {
 	Version          string  `json:"version"`
 	RegistrationOpen bool    `json:"registrationOpen"`
 	AuthServerURL    *string `json:"authServerUrl"`
+	// MaxUploadSize caps every upload in bytes, on top of the per-category
+	// limits the server is configured with.
+	MaxUploadSize int64 `json:"maxUploadSize"`
+	// Storage quotas in bytes for all uploads and for each user's; nil
+	// means unlimited.
+	StorageQuota     *int64 `json:"storageQuota"`
+	UserStorageQuota *int64 `json:"userStorageQuota"`
 }
 
 type UpdateInstanceRequest struct {
@@ -14,4 +23,16 @@ type UpdateInstanceRequest struct {
 	IconURL          *string `json:"iconUrl"`
 	Description      *string `json:"description"`
 	RegistrationOpen *bool   `json:"registrationOpen"`
+	MaxUploadSize    *int64  `json:"maxUploadSize"`
+	// 0 removes a quota
+	StorageQuota     *int64 `json:"storageQuota"`
+	UserStorageQuota *int64 `json:"userStorageQuota"`
+}
+
+// StorageUsage is the admin view of upload storage.
+type StorageUsage struct {
+	UsedBytes        int64              `json:"usedBytes"`
+	StorageQuota     *int64             `json:"storageQuota"`
+	UserStorageQuota *int64             `json:"userStorageQuota"`
+	Users            []attachment.Usage `json:"users"`
 }
@@ -7,6 +7,13 @@ type Repository interface {
 	Update(req UpdateInstanceRequest) (*InstanceInfo, error)
 }
 
+const columns = `name, icon_url, description, registration_open, auth_server_url, max_upload_size, storage_quota, user_storage_quota`
+
+func (info *InstanceInfo) fields() []interface{} {
+	return []interface{}{&info.Name, &info.IconURL, &info.Description, &info.RegistrationOpen, &info.AuthServerURL,
+		&info.MaxUploadSize, &info.StorageQuota, &info.UserStorageQuota}
+}
+
 type PostgresRepository struct {
 	db *sql.DB
 }
@@ -18,8 +25,8 @@ func NewPostgresRepository(db *sql.DB) *PostgresRepository {
 func (r *PostgresRepository) Get() (*InstanceInfo, error) {
 	info := &InstanceInfo{}
 	err := r.db.QueryRow(
-		`SELECT name, icon_url, description, registration_open, auth_server_url FROM instance_settings WHERE id = 1`,
-	).Scan(&info.Name, &info.IconURL, &info.Description, &info.RegistrationOpen, &info.AuthServerURL)
+		`SELECT ` + columns + ` FROM instance_settings WHERE id = 1`,
+	).Scan(info.fields()...)
 	if err != nil {
 		return nil, err
 	}
@@ -34,11 +41,15 @@ func (r *PostgresRepository) Update(req UpdateInstanceRequest) (*InstanceInfo, e
 			name = COALESCE($1, name),
 			icon_url = COALESCE($2, icon_url),
 			description = COALESCE($3, description),
-			registration_open = COALESCE($4, registration_open)
+			registration_open = COALESCE($4, registration_open),
+			max_upload_size = COALESCE($5, max_upload_size),
+			storage_quota = CASE WHEN $6::bigint IS NULL THEN storage_quota ELSE NULLIF($6, 0) END,
+			user_storage_quota = CASE WHEN $7::bigint IS NULL THEN user_storage_quota ELSE NULLIF($7, 0) END
 		 WHERE id = 1
-		 RETURNING name, icon_url, description, registration_open`,
-		req.Name, req.IconURL, req.Description, req.RegistrationOpen,
-	).Scan(&info.Name, &info.IconURL, &info.Description, &info.RegistrationOpen)
+		 RETURNING `+columns,
+		req.Name, req.IconURL, req.Description, req.RegistrationOpen, req.MaxUploadSize,
+		req.StorageQuota, req.UserStorageQuota,
+	).Scan(info.fields()...)
 	if err != nil {
 		return nil, err
 	}
@@ -8,15 +8,17 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/opencord/api/internal/auth"
 	"github.com/opencord/api/internal/member"
+	"github.com/opencord/api/internal/ws"
 )
 
 type Handler struct {
 	repo       Repository
 	memberRepo member.Repository
+	hub        *ws.Hub
 }
 
-func NewHandler(repo Repository, memberRepo member.Repository) *Handler {
-	return &Handler{repo: repo, memberRepo: memberRepo}
+func NewHandler(repo Repository, memberRepo member.Repository, hub *ws.Hub) *Handler {
+	return &Handler{repo: repo, memberRepo: memberRepo, hub: hub}
 }
 
 func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
@@ -90,6 +92,9 @@ func (h *Handler) Join(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Start sharing presence with the user's open connections
+	h.hub.SetMembership(userID, true)
+
 	writeJSON(w, m, http.StatusCreated)
 }
 
@@ -0,0 +1,470 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// ErrMalformed is returned when a media container can't be parsed.
+var ErrMalformed = errors.New("malformed media file")
+
+// Duration reads the playback length of an audio or video file from its
+// container headers, without decoding any samples. contentType is the
+// stored type from Lookup.
+func Duration(r io.ReaderAt, size int64, contentType string) (time.Duration, error) {
+	switch contentType {
+	case "video/mp4", "video/quicktime", "audio/mp4":
+		return mp4Duration(r, size)
+	case "video/webm":
+		return webmDuration(r, size)
+	case "audio/wav":
+		return wavDuration(r, size)
+	case "audio/flac":
+		return flacDuration(r)
+	case "audio/ogg":
+		return oggDuration(r, size)
+	case "audio/mpeg":
+		return mp3Duration(r, size)
+	}
+	return 0, ErrUnsupported
+}
+
+// seconds converts a count of units at rate per second, guarding against
+// the overflow integer maths would hit on long files.
+func seconds(units, rate float64) (time.Duration, error) {
+	if rate <= 0 || units < 0 || math.IsNaN(units) || math.IsInf(units, 0) {
+		return 0, ErrMalformed
+	}
+	d := units / rate * float64(time.Second)
+	if d > math.MaxInt64 {
+		return 0, ErrMalformed
+	}
+	return time.Duration(d), nil
+}
+
+// readFull reads exactly len(buf) bytes at off.
+func readFull(r io.ReaderAt, buf []byte, off int64) error {
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return ErrMalformed
+	}
+	return err
+}
+
+// MP4 and QuickTime: moov/mvhd holds a timescale and a duration in it.
+
+func mp4Duration(r io.ReaderAt, size int64) (time.Duration, error) {
+	moov, moovSize, err := findBox(r, 0, size, "moov")
+	if err != nil {
+		return 0, err
+	}
+	mvhd, _, err := findBox(r, moov, moov+moovSize, "mvhd")
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 32)
+	if err := readFull(r, buf[:20], mvhd); err != nil {
+		return 0, err
+	}
+	var timescale, duration uint64
+	if buf[0] == 1 {
+		if err := readFull(r, buf, mvhd); err != nil {
+			return 0, err
+		}
+		timescale = uint64(binary.BigEndian.Uint32(buf[20:24]))
+		duration = binary.BigEndian.Uint64(buf[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(buf[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(buf[16:20]))
+	}
+	return seconds(float64(duration), float64(timescale))
+}
+
+// findBox scans the boxes in [off, end) and returns the payload offset and
+// size of the first one of type typ.
+func findBox(r io.ReaderAt, off, end int64, typ string) (int64, int64, error) {
+	hdr := make([]byte, 16)
+	for off+8 <= end {
+		if err := readFull(r, hdr[:8], off); err != nil {
+			return 0, 0, err
+		}
+		size, hlen := int64(binary.BigEndian.Uint32(hdr)), int64(8)
+		switch size {
+		case 0: // extends to the end of the file
+			size = end - off
+		case 1: // 64-bit size follows the type
+			if err := readFull(r, hdr[8:16], off+8); err != nil {
+				return 0, 0, err
+			}
+			size, hlen = int64(binary.BigEndian.Uint64(hdr[8:16])), 16
+		}
+		if size < hlen || size > end-off {
+			return 0, 0, ErrMalformed
+		}
+		if string(hdr[4:8]) == typ {
+			return off + hlen, size - hlen, nil
+		}
+		off += size
+	}
+	return 0, 0, ErrMalformed
+}
+
+// WebM: Segment/Info holds Duration as a float in TimecodeScale units.
+
+const (
+	ebmlHeaderID    = 0x1A45DFA3
+	ebmlSegmentID   = 0x18538067
+	ebmlInfoID      = 0x1549A966
+	ebmlClusterID   = 0x1F43B675
+	ebmlTimecodeID  = 0x2AD7B1
+	ebmlDurationID  = 0x4489
+	ebmlUnknownSize = -1
+)
+
+func webmDuration(r io.ReaderAt, size int64) (time.Duration, error) {
+	id, data, n, err := ebmlElement(r, 0)
+	if err != nil || id != ebmlHeaderID || n == ebmlUnknownSize {
+		return 0, ErrMalformed
+	}
+	id, seg, n, err := ebmlElement(r, data+n)
+	if err != nil || id != ebmlSegmentID {
+		return 0, ErrMalformed
+	}
+	end := size
+	if n != ebmlUnknownSize && seg+n < size {
+		end = seg + n
+	}
+
+	for off := seg; off < end; {
+		id, data, n, err := ebmlElement(r, off)
+		if err != nil || id == ebmlClusterID || n == ebmlUnknownSize {
+			// Info always precedes the first cluster
+			return 0, ErrMalformed
+		}
+		if id == ebmlInfoID {
+			return webmInfoDuration(r, data, data+n)
+		}
+		off = data + n
+	}
+	return 0, ErrMalformed
+}
+
+func webmInfoDuration(r io.ReaderAt, off, end int64) (time.Duration, error) {
+	scale := uint64(1000000) // default: millisecond timecodes
+	duration := -1.0
+	buf := make([]byte, 8)
+	for off < end {
+		id, data, n, err := ebmlElement(r, off)
+		if err != nil || n == ebmlUnknownSize || n > 8 && (id == ebmlTimecodeID || id == ebmlDurationID) {
+			return 0, ErrMalformed
+		}
+		switch id {
+		case ebmlTimecodeID:
+			if err := readFull(r, buf[:n], data); err != nil {
+				return 0, err
+			}
+			scale = 0
+			for _, b := range buf[:n] {
+				scale = scale<<8 | uint64(b)
+			}
+		case ebmlDurationID:
+			if err := readFull(r, buf[:n], data); err != nil {
+				return 0, err
+			}
+			switch n {
+			case 4:
+				duration = float64(math.Float32frombits(binary.BigEndian.Uint32(buf)))
+			case 8:
+				duration = math.Float64frombits(binary.BigEndian.Uint64(buf))
+			default:
+				return 0, ErrMalformed
+			}
+		}
+		off = data + n
+	}
+	if duration < 0 {
+		// Live recordings often never write a duration
+		return 0, ErrMalformed
+	}
+	return seconds(duration*float64(scale), float64(time.Second))
+}
+
+// ebmlElement reads the element header at off and returns its ID, data
+// offset and data size, which is ebmlUnknownSize for streamed elements.
+func ebmlElement(r io.ReaderAt, off int64) (uint64, int64, int64, error) {
+	id, idLen, err := ebmlVint(r, off)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	size, sizeLen, err := ebmlVint(r, off+int64(idLen))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	// IDs keep their length marker; sizes don't
+	marker := uint64(1) << (7 * uint(sizeLen))
+	n := int64(size &^ marker)
+	if size&^marker == marker-1 {
+		n = ebmlUnknownSize
+	} else if n < 0 {
+		return 0, 0, 0, ErrMalformed
+	}
+	return id, off + int64(idLen+sizeLen), n, nil
+}
+
+func ebmlVint(r io.ReaderAt, off int64) (uint64, int, error) {
+	buf := make([]byte, 8)
+	if err := readFull(r, buf[:1], off); err != nil {
+		return 0, 0, err
+	}
+	if buf[0] == 0 {
+		return 0, 0, ErrMalformed
+	}
+	n := 1
+	for mask := byte(0x80); buf[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if err := readFull(r, buf[1:n], off+1); err != nil {
+		return 0, 0, err
+	}
+	var v uint64
+	for _, b := range buf[:n] {
+		v = v<<8 | uint64(b)
+	}
+	return v, n, nil
+}
+
+// WAV: the data chunk size divided by the fmt chunk's byte rate.
+
+func wavDuration(r io.ReaderAt, size int64) (time.Duration, error) {
+	hdr := make([]byte, 12)
+	if err := readFull(r, hdr, 0); err != nil {
+		return 0, err
+	}
+	if string(hdr[0:4]) != "RIFF" || string(hdr[8:12]) != "WAVE" {
+		return 0, ErrMalformed
+	}
+	var byteRate uint32
+	chunk := make([]byte, 16)
+	for off := int64(12); off+8 <= size; {
+		if err := readFull(r, chunk[:8], off); err != nil {
+			return 0, err
+		}
+		n := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		switch string(chunk[:4]) {
+		case "fmt ":
+			if err := readFull(r, chunk, off+8); err != nil {
+				return 0, err
+			}
+			byteRate = binary.LittleEndian.Uint32(chunk[8:12])
+		case "data":
+			if byteRate == 0 {
+				return 0, ErrMalformed
+			}
+			// Streaming writers leave the size unset or too large
+			if n > size-off-8 {
+				n = size - off - 8
+			}
+			return seconds(float64(n), float64(byteRate))
+		}
+		off += 8 + n + n&1
+	}
+	return 0, ErrMalformed
+}
+
+// FLAC: STREAMINFO, always the first metadata block, has the sample rate
+// and total sample count.
+
+func flacDuration(r io.ReaderAt) (time.Duration, error) {
+	buf := make([]byte, 8+34)
+	if err := readFull(r, buf, 0); err != nil {
+		return 0, err
+	}
+	if string(buf[:4]) != "fLaC" || buf[4]&0x7f != 0 {
+		return 0, ErrMalformed
+	}
+	info := buf[8:]
+	bits := binary.BigEndian.Uint64(info[10:18])
+	rate := bits >> 44
+	samples := bits & (1<<36 - 1)
+	if samples == 0 {
+		return 0, ErrMalformed // unknown
+	}
+	return seconds(float64(samples), float64(rate))
+}
+
+// Ogg: the last page's granule position counts samples; the first page's
+// codec header gives the rate.
+
+func oggDuration(r io.ReaderAt, size int64) (time.Duration, error) {
+	head := make([]byte, 512)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	head = head[:n]
+	if len(head) < 28 || string(head[:4]) != "OggS" {
+		return 0, ErrMalformed
+	}
+	packet := head[27+int(head[26]):]
+
+	var rate, preSkip float64
+	switch {
+	case bytes.HasPrefix(packet, []byte("OpusHead")) && len(packet) >= 12:
+		rate = 48000 // Opus granules are always 48 kHz
+		preSkip = float64(binary.LittleEndian.Uint16(packet[10:12]))
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 16:
+		rate = float64(binary.LittleEndian.Uint32(packet[12:16]))
+	default:
+		return 0, ErrUnsupported
+	}
+
+	tailSize := int64(64 << 10)
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	if err := readFull(r, tail, size-tailSize); err != nil {
+		return 0, err
+	}
+	for i := len(tail); ; {
+		i = bytes.LastIndex(tail[:i], []byte("OggS"))
+		if i < 0 {
+			return 0, ErrMalformed
+		}
+		if i+14 > len(tail) {
+			continue
+		}
+		granule := int64(binary.LittleEndian.Uint64(tail[i+6 : i+14]))
+		if granule >= 0 {
+			return seconds(math.Max(float64(granule)-preSkip, 0), rate)
+		}
+	}
+}
+
+// MP3: the frame count from a Xing/Info or VBRI header if the encoder
+// wrote one, otherwise an estimate from the first frame's bitrate.
+
+type mp3Frame struct {
+	bitrate    int // bits per second
+	sampleRate int
+	samples    int // per frame
+	sideInfo   int
+	length     int
+}
+
+var (
+	mp3BitratesV1 = [15]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+	mp3BitratesV2 = [15]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+	mp3Rates      = [3]int{44100, 48000, 32000}
+)
+
+// parseMP3Header parses an MPEG audio layer III frame header.
+func parseMP3Header(b []byte) (mp3Frame, bool) {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, false
+	}
+	version := b[1] >> 3 & 3 // 0: MPEG 2.5, 2: MPEG 2, 3: MPEG 1
+	layer := b[1] >> 1 & 3
+	bitrateIdx, rateIdx := b[2]>>4, b[2]>>2&3
+	if version == 1 || layer != 1 || bitrateIdx == 0 || bitrateIdx == 15 || rateIdx == 3 {
+		return mp3Frame{}, false
+	}
+	mono := b[3]>>6 == 3
+
+	f := mp3Frame{sampleRate: mp3Rates[rateIdx]}
+	if version == 3 {
+		f.bitrate = mp3BitratesV1[bitrateIdx] * 1000
+		f.samples = 1152
+		f.sideInfo = 32
+		if mono {
+			f.sideInfo = 17
+		}
+	} else {
+		f.bitrate = mp3BitratesV2[bitrateIdx] * 1000
+		f.sampleRate /= 2
+		if version == 0 {
+			f.sampleRate /= 2
+		}
+		f.samples = 576
+		f.sideInfo = 17
+		if mono {
+			f.sideInfo = 9
+		}
+	}
+	f.length = f.samples/8*f.bitrate/f.sampleRate + int(b[2]>>1&1)
+	return f, true
+}
+
+// isMP3Frame reports whether b starts with an MP3 frame, checking the next
+// frame too when it falls within b, since a single header is easy to hit
+// by chance.
+func isMP3Frame(b []byte) bool {
+	f, ok := parseMP3Header(b)
+	if !ok {
+		return false
+	}
+	if f.length+4 <= len(b) {
+		_, ok = parseMP3Header(b[f.length:])
+	}
+	return ok
+}
+
+func mp3Duration(r io.ReaderAt, size int64) (time.Duration, error) {
+	var off int64
+	hdr := make([]byte, 10)
+	if err := readFull(r, hdr, 0); err != nil {
+		return 0, err
+	}
+	if string(hdr[:3]) == "ID3" {
+		// Sync-safe size excludes the header and the optional footer
+		n := int64(hdr[6])<<21 | int64(hdr[7])<<14 | int64(hdr[8])<<7 | int64(hdr[9])
+		off = 10 + n
+		if hdr[5]&0x10 != 0 {
+			off += 10
+		}
+	}
+
+	// The first frame is expected right after the tag, but allow for some
+	// padding or junk before it
+	window := make([]byte, 4096)
+	n, err := r.ReadAt(window, off)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	window = window[:n]
+	var frame mp3Frame
+	found := false
+	for i := 0; i+4 <= len(window); i++ {
+		if f, ok := parseMP3Header(window[i:]); ok {
+			frame, found = f, true
+			off += int64(i)
+			break
+		}
+	}
+	if !found {
+		return 0, ErrMalformed
+	}
+
+	// Xing/Info sits after the side information, VBRI at a fixed offset
+	buf := make([]byte, 4+frame.sideInfo+12)
+	if readFull(r, buf, off) == nil {
+		x := buf[4+frame.sideInfo:]
+		if tag := string(x[:4]); (tag == "Xing" || tag == "Info") && binary.BigEndian.Uint32(x[4:8])&1 != 0 {
+			frames := binary.BigEndian.Uint32(x[8:12])
+			return seconds(float64(frames)*float64(frame.samples), float64(frame.sampleRate))
+		}
+	}
+	vbri := make([]byte, 18)
+	if readFull(r, vbri, off+36) == nil && string(vbri[:4]) == "VBRI" {
+		frames := binary.BigEndian.Uint32(vbri[14:18])
+		return seconds(float64(frames)*float64(frame.samples), float64(frame.sampleRate))
+	}
+	return seconds(float64(size-off)*8, float64(frame.bitrate))
+}
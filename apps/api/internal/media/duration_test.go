@@ -0,0 +1,152 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+func box(typ string, payload ...[]byte) []byte {
+	b := make([]byte, 8)
+	copy(b[4:], typ)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+func testMP4(brand string, timescale, duration uint32) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], timescale)
+	binary.BigEndian.PutUint32(mvhd[16:], duration)
+	ftyp := append([]byte(brand), 0, 0, 0, 0)
+	return bytes.Join([][]byte{
+		box("ftyp", ftyp, []byte("isommp42")),
+		box("free"),
+		box("moov", box("mvhd", mvhd), box("trak")),
+		box("mdat", make([]byte, 64)),
+	}, nil)
+}
+
+func testWAV(seconds int) []byte {
+	const rate, channels, bits = 8000, 1, 16
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], 1)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], channels)
+	binary.LittleEndian.PutUint32(fmtChunk[4:], rate)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], rate*channels*bits/8)
+	binary.LittleEndian.PutUint16(fmtChunk[12:], channels*bits/8)
+	binary.LittleEndian.PutUint16(fmtChunk[14:], bits)
+	data := make([]byte, seconds*rate*channels*bits/8)
+
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(4+8+len(fmtChunk)+8+len(data)))
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, uint32(len(fmtChunk)))
+	b.Write(fmtChunk)
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	return b.Bytes()
+}
+
+func ebml(id uint64, payload ...[]byte) []byte {
+	var b []byte
+	for shift := 56; shift >= 0; shift -= 8 {
+		if c := byte(id >> uint(shift)); c != 0 || len(b) > 0 {
+			b = append(b, c)
+		}
+	}
+	var data []byte
+	for _, p := range payload {
+		data = append(data, p...)
+	}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(data))|1<<56) // 8-byte size
+	b = append(b, size...)
+	return append(b, data...)
+}
+
+func testWebM(ms float64) []byte {
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(ms))
+	return bytes.Join([][]byte{
+		ebml(ebmlHeaderID, ebml(0x4282, []byte("webm"))),
+		ebml(ebmlSegmentID,
+			ebml(0x114D9B74), // SeekHead
+			ebml(ebmlInfoID,
+				ebml(ebmlTimecodeID, []byte{0x0F, 0x42, 0x40}),
+				ebml(ebmlDurationID, duration)),
+			ebml(ebmlClusterID, make([]byte, 32))),
+	}, nil)
+}
+
+func testFLAC(rate, samples uint64) []byte {
+	b := []byte("fLaC\x80\x00\x00\x22")
+	info := make([]byte, 34)
+	binary.BigEndian.PutUint64(info[10:], rate<<44|1<<41|15<<36|samples)
+	return append(b, info...)
+}
+
+// testMP3 builds a CBR MPEG-1 layer III stream of 128 kbps 44.1 kHz frames.
+func testMP3(frames int) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	return append([]byte("ID3\x03\x00\x00\x00\x00\x00\x0a"+"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"),
+		bytes.Repeat(frame, frames)...)
+}
+
+func TestDuration(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		data        []byte
+		contentType string
+		want        time.Duration
+	}{
+		{"mp4", testMP4("isom", 1000, 61500), "video/mp4", 61500 * time.Millisecond},
+		{"mov", testMP4("qt  ", 600, 1800), "video/quicktime", 3 * time.Second},
+		{"webm", testWebM(4250), "video/webm", 4250 * time.Millisecond},
+		{"wav", testWAV(2), "audio/wav", 2 * time.Second},
+		{"flac", testFLAC(44100, 44100*90), "audio/flac", 90 * time.Second},
+		{"mp3", testMP3(100), "audio/mpeg", 2612 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Duration(bytes.NewReader(tc.data), int64(len(tc.data)), tc.contentType)
+			if err != nil {
+				t.Fatalf("Duration: %v", err)
+			}
+			if diff := got - tc.want; diff < -10*time.Millisecond || diff > 10*time.Millisecond {
+				t.Errorf("Duration = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := Duration(bytes.NewReader([]byte("not a movie")), 11, "video/mp4"); err == nil {
+		t.Error("garbage mp4 accepted")
+	}
+}
+
+func TestSniff(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data []byte
+		want string
+	}{
+		"mov":  {testMP4("qt  ", 600, 1), "video/quicktime"},
+		"m4a":  {testMP4("M4A ", 600, 1), "audio/mp4"},
+		"mp4":  {testMP4("mp42", 600, 1), "video/mp4"},
+		"webm": {testWebM(1), "video/webm"},
+		"wav":  {testWAV(1)[:512], "audio/wave"},
+		"flac": {testFLAC(44100, 1), "audio/flac"},
+		"mp3":  {testMP3(2)[20:], "audio/mpeg"},
+		"text": {[]byte("hello, world\n"), "text/plain"},
+		"html": {[]byte("<!DOCTYPE html><p>hi"), "text/html"},
+	} {
+		if got := Sniff(tc.data); got != tc.want {
+			t.Errorf("%s: Sniff = %q, want %q", name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Package media processes uploaded images: it records dimensions, strips
+// EXIF/GPS and other metadata, renders resized variants and computes a
+// blurhash placeholder.
+//
+// Variants are stored next to the original under VariantKey and served by
+// the uploads route with ?size=<name>. A variant is only generated when the
+// image is larger than its bound, so clients should fall back to the
+// original when a size isn't listed.
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strings"
+
+	"github.com/buckket/go-blurhash"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// MaxPixels bounds the decoded size of an image (about 50 megapixels) so a
+// small, highly compressed file can't exhaust memory.
+const MaxPixels = 50_000_000
+
+const jpegQuality = 85
+
+var (
+	ErrUnsupported = errors.New("unsupported image format")
+	ErrTooLarge    = errors.New("image dimensions too large")
+)
+
+// Size is a named variant bounded to Max pixels on its longest side.
+type Size struct {
+	Name string
+	Max  int
+}
+
+// Sizes are the variants generated for every image, smallest first.
+var Sizes = []Size{
+	{Name: "small", Max: 256},
+	{Name: "medium", Max: 640},
+	{Name: "large", Max: 1280},
+}
+
+// Variant is a resized rendition of an image.
+type Variant struct {
+	Name        string
+	Data        []byte
+	ContentType string
+}
+
+// Image is the result of processing an upload.
+type Image struct {
+	Data     []byte // original with metadata removed
+	Width    int    // after applying EXIF orientation
+	Height   int
+	Blurhash string
+	Variants []Variant
+}
+
+// IsImage reports whether contentType is a format Process handles.
+func IsImage(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// Process strips metadata from an image, measures it and renders variants.
+func Process(data []byte, contentType string) (*Image, error) {
+	if !IsImage(contentType) {
+		return nil, ErrUnsupported
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+
+	out := &Image{}
+	switch format {
+	case "jpeg":
+		orientation := jpegOrientation(data)
+		if orientation > 1 {
+			// Stripping EXIF would lose the rotation, so bake it into the pixels
+			img = orient(img, orientation)
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 92}); err != nil {
+				return nil, err
+			}
+			out.Data = buf.Bytes()
+		} else {
+			out.Data, err = stripJPEG(data)
+		}
+	case "png":
+		out.Data, err = stripPNG(data)
+	case "webp":
+		out.Data, err = stripWebP(data)
+	default:
+		// GIF carries no EXIF; comment and application extensions are harmless
+		out.Data = data
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+
+	b := img.Bounds()
+	out.Width, out.Height = b.Dx(), b.Dy()
+
+	out.Blurhash, err = blurhash.Encode(4, 3, resize(img, 32))
+	if err != nil {
+		return nil, err
+	}
+
+	// Animated GIFs keep their animation; a still variant would replace it
+	if format == "gif" && isAnimatedGIF(data) {
+		return out, nil
+	}
+	for _, size := range Sizes {
+		if out.Width <= size.Max && out.Height <= size.Max {
+			break
+		}
+		v, err := encodeVariant(resize(img, size.Max), format)
+		if err != nil {
+			return nil, err
+		}
+		// A variant that isn't smaller than the original is useless
+		if len(v) >= len(out.Data) {
+			break
+		}
+		out.Variants = append(out.Variants, Variant{
+			Name:        size.Name,
+			Data:        v,
+			ContentType: variantContentType(format),
+		})
+	}
+	return out, nil
+}
+
+// VariantKey is the storage key of a named variant of key, or false if
+// name isn't a known size.
+func VariantKey(key, name string) (string, bool) {
+	for _, size := range Sizes {
+		if size.Name == name {
+			ext := ".png"
+			if e := strings.ToLower(path.Ext(key)); e == ".jpg" || e == ".jpeg" {
+				ext = ".jpg"
+			}
+			return strings.TrimSuffix(key, path.Ext(key)) + "_" + name + ext, true
+		}
+	}
+	return "", false
+}
+
+// Variants from JPEG originals are JPEG; other formats may have
+// transparency and get PNG.
+func variantContentType(format string) string {
+	if format == "jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+func encodeVariant(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// resize scales img so its longest side is at most max pixels.
+func resize(img image.Image, max int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= max && h <= max {
+		return img
+	}
+	if w >= h {
+		h = max * h / w
+		w = max
+	} else {
+		w = max * w / h
+		h = max
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// isAnimatedGIF reports whether a GIF has more than one frame. It walks the
+// block structure rather than decoding: MaxPixels only bounds the first
+// frame, and a small file can hold thousands of full-canvas frames.
+func isAnimatedGIF(data []byte) bool {
+	return gifFrames(data) > 1
+}
+
+// gifFrames counts the image descriptors in a GIF, stopping at the trailer
+// or at the first truncated block.
+func gifFrames(data []byte) int {
+	// Header and logical screen descriptor
+	if len(data) < 13 {
+		return 0
+	}
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+
+	// skipSubBlocks returns the offset after a run of data sub-blocks, or -1
+	skipSubBlocks := func(pos int) int {
+		for pos < len(data) {
+			n := int(data[pos])
+			pos++
+			if n == 0 {
+				return pos
+			}
+			pos += n
+		}
+		return -1
+	}
+
+	frames := 0
+	for pos >= 0 && pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension: label, then sub-blocks
+			pos = skipSubBlocks(pos + 2)
+		case 0x2C: // image descriptor
+			if pos+10 > len(data) {
+				return frames
+			}
+			frames++
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			// LZW minimum code size, then the image data
+			pos = skipSubBlocks(pos + 1)
+		default: // trailer or garbage
+			return frames
+		}
+	}
+	return frames
+}
@@ -0,0 +1,219 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"runtime"
+	"testing"
+)
+
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	return img
+}
+
+// exifSegment builds an APP1 segment with an orientation tag and a GPS IFD
+// pointer, big-endian like most cameras.
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	ifd := make([]byte, 2+2*12+4)
+	binary.BigEndian.PutUint16(ifd, 2)
+	entry := ifd[2:]
+	binary.BigEndian.PutUint16(entry[0:], 0x0112) // Orientation
+	binary.BigEndian.PutUint16(entry[2:], 3)      // SHORT
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	entry = ifd[14:]
+	binary.BigEndian.PutUint16(entry[0:], 0x8825) // GPSInfo
+	binary.BigEndian.PutUint16(entry[2:], 4)      // LONG
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint32(entry[8:], 38)
+	payload := append([]byte("Exif\x00\x00"), append(tiff, ifd...)...)
+	payload = append(payload, []byte("GPS 52.37N 4.89E")...)
+
+	seg := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+func jpegWithExif(t *testing.T, w, h int, orientation uint16) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(w, h), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(out, exifSegment(orientation)...)
+	return append(out, data[2:]...)
+}
+
+func TestProcessJPEGStripsExif(t *testing.T) {
+	for _, tc := range []struct {
+		orientation   uint16
+		width, height int
+	}{
+		{1, 40, 20},
+		{6, 20, 40}, // rotated 90° clockwise
+	} {
+		data := jpegWithExif(t, 40, 20, tc.orientation)
+		if jpegOrientation(data) != int(tc.orientation) {
+			t.Fatalf("orientation = %d, want %d", jpegOrientation(data), tc.orientation)
+		}
+
+		img, err := Process(data, "image/jpeg")
+		if err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+		if bytes.Contains(img.Data, []byte("Exif")) || bytes.Contains(img.Data, []byte("GPS")) {
+			t.Errorf("orientation %d: metadata not stripped", tc.orientation)
+		}
+		if img.Width != tc.width || img.Height != tc.height {
+			t.Errorf("orientation %d: size = %dx%d, want %dx%d", tc.orientation, img.Width, img.Height, tc.width, tc.height)
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(img.Data))
+		if err != nil || cfg.Width != tc.width || cfg.Height != tc.height {
+			t.Errorf("orientation %d: stored image %dx%d, %v", tc.orientation, cfg.Width, cfg.Height, err)
+		}
+		if img.Blurhash == "" {
+			t.Error("missing blurhash")
+		}
+	}
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	c := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(c, uint32(len(data)))
+	copy(c[4:], typ)
+	c = append(c, data...)
+	return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+}
+
+func TestProcessPNGStripsTextChunks(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(30, 10)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// Insert metadata right after IHDR (8 byte signature + 25 byte chunk)
+	withMeta := append([]byte{}, data[:33]...)
+	withMeta = append(withMeta, pngChunk("tEXt", []byte("Comment\x00secret location"))...)
+	withMeta = append(withMeta, pngChunk("eXIf", []byte("MM\x00\x2a"))...)
+	withMeta = append(withMeta, data[33:]...)
+
+	img, err := Process(withMeta, "image/png")
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if bytes.Contains(img.Data, []byte("secret")) || bytes.Contains(img.Data, []byte("eXIf")) {
+		t.Error("metadata not stripped")
+	}
+	if _, err := png.Decode(bytes.NewReader(img.Data)); err != nil {
+		t.Errorf("stripped PNG doesn't decode: %v", err)
+	}
+}
+
+func TestProcessVariants(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(2000, 1000), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Process(buf.Bytes(), "image/jpeg")
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+
+	want := map[string][2]int{"small": {256, 128}, "medium": {640, 320}, "large": {1280, 640}}
+	if len(img.Variants) != len(want) {
+		t.Fatalf("got %d variants, want %d", len(img.Variants), len(want))
+	}
+	for _, v := range img.Variants {
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(v.Data))
+		if err != nil {
+			t.Fatalf("%s: %v", v.Name, err)
+		}
+		if size := want[v.Name]; cfg.Width != size[0] || cfg.Height != size[1] {
+			t.Errorf("%s = %dx%d, want %dx%d", v.Name, cfg.Width, cfg.Height, size[0], size[1])
+		}
+	}
+
+	// Small images get no variants
+	buf.Reset()
+	png.Encode(&buf, testImage(100, 100))
+	img, err = Process(buf.Bytes(), "image/png")
+	if err != nil || len(img.Variants) != 0 {
+		t.Errorf("small image: %d variants, %v", len(img.Variants), err)
+	}
+}
+
+// gifBomb builds a GIF of n full-canvas frames. Each 2000x2000 frame
+// compresses to a few KB, so the file is small but decoding every frame
+// would need n * 4 MB.
+func gifBomb(t *testing.T, n int) []byte {
+	t.Helper()
+	frame := image.NewPaletted(image.Rect(0, 0, 2000, 2000), color.Palette{color.Black, color.White})
+	var one bytes.Buffer
+	if err := gif.EncodeAll(&one, &gif.GIF{Image: []*image.Paletted{frame}, Delay: []int{0}}); err != nil {
+		t.Fatal(err)
+	}
+	// With no global color table the frame's blocks run from the end of
+	// the 13-byte header to the trailer
+	block := one.Bytes()[13 : one.Len()-1]
+	out := append([]byte{}, one.Bytes()[:one.Len()-1]...)
+	for i := 1; i < n; i++ {
+		out = append(out, block...)
+	}
+	return append(out, 0x3B)
+}
+
+func TestProcessGIFBomb(t *testing.T) {
+	data := gifBomb(t, 1000)
+	if got := gifFrames(data); got != 1000 {
+		t.Fatalf("gifFrames = %d, want 1000", got)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	img, err := Process(data, "image/gif")
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if len(img.Variants) != 0 {
+		t.Errorf("animated GIF got %d variants", len(img.Variants))
+	}
+	// One decoded frame plus the blurhash, not a thousand frames
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 256<<20 {
+		t.Errorf("Process allocated %d MB", alloc>>20)
+	}
+
+	if got := gifFrames(gifBomb(t, 1)); got != 1 {
+		t.Errorf("still GIF: gifFrames = %d, want 1", got)
+	}
+}
+
+func TestVariantKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"abc.jpeg": "abc_small.jpg",
+		"abc.png":  "abc_small.png",
+		"abc.webp": "abc_small.png",
+	} {
+		if got, ok := VariantKey(key, "small"); !ok || got != want {
+			t.Errorf("VariantKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+	if _, ok := VariantKey("abc.png", "huge"); ok {
+		t.Error("unknown size accepted")
+	}
+}
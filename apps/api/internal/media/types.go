@@ -0,0 +1,130 @@
+package media
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Category groups file types for upload policy.
+type Category string
+
+const (
+	CategoryImage    Category = "image"
+	CategoryVideo    Category = "video"
+	CategoryAudio    Category = "audio"
+	CategoryDocument Category = "document"
+	CategoryArchive  Category = "archive"
+)
+
+// Categories lists every category, in display order.
+var Categories = []Category{CategoryImage, CategoryVideo, CategoryAudio, CategoryDocument, CategoryArchive}
+
+// FileType is an accepted upload format.
+type FileType struct {
+	ContentType string
+	Category    Category
+	// Inline types are displayed or played by browsers; the rest are only
+	// offered as downloads.
+	Inline bool
+	// sniffs are the results of Sniff the file's bytes may have.
+	sniffs []string
+}
+
+var fileTypes = map[string]FileType{
+	".jpg":  {"image/jpeg", CategoryImage, true, []string{"image/jpeg"}},
+	".jpeg": {"image/jpeg", CategoryImage, true, []string{"image/jpeg"}},
+	".png":  {"image/png", CategoryImage, true, []string{"image/png"}},
+	".gif":  {"image/gif", CategoryImage, true, []string{"image/gif"}},
+	".webp": {"image/webp", CategoryImage, true, []string{"image/webp"}},
+
+	".mp4":  {"video/mp4", CategoryVideo, true, []string{"video/mp4"}},
+	".webm": {"video/webm", CategoryVideo, true, []string{"video/webm"}},
+	".mov":  {"video/quicktime", CategoryVideo, false, []string{"video/quicktime"}},
+
+	".mp3":  {"audio/mpeg", CategoryAudio, true, []string{"audio/mpeg"}},
+	".ogg":  {"audio/ogg", CategoryAudio, true, []string{"application/ogg"}},
+	".opus": {"audio/ogg", CategoryAudio, true, []string{"application/ogg"}},
+	".wav":  {"audio/wav", CategoryAudio, true, []string{"audio/wave"}},
+	".flac": {"audio/flac", CategoryAudio, true, []string{"audio/flac"}},
+	".m4a":  {"audio/mp4", CategoryAudio, true, []string{"audio/mp4", "video/mp4"}},
+
+	".pdf":  {"application/pdf", CategoryDocument, false, []string{"application/pdf"}},
+	".txt":  {"text/plain; charset=utf-8", CategoryDocument, false, []string{"text/plain"}},
+	".log":  {"text/plain; charset=utf-8", CategoryDocument, false, []string{"text/plain"}},
+	".md":   {"text/markdown; charset=utf-8", CategoryDocument, false, []string{"text/plain"}},
+	".csv":  {"text/csv; charset=utf-8", CategoryDocument, false, []string{"text/plain"}},
+	".json": {"application/json", CategoryDocument, false, []string{"text/plain"}},
+
+	".zip": {"application/zip", CategoryArchive, false, []string{"application/zip"}},
+	".gz":  {"application/gzip", CategoryArchive, false, []string{"application/x-gzip"}},
+	".tgz": {"application/gzip", CategoryArchive, false, []string{"application/x-gzip"}},
+	".7z":  {"application/x-7z-compressed", CategoryArchive, false, []string{"application/x-7z-compressed"}},
+	".tar": {"application/x-tar", CategoryArchive, false, []string{"application/x-tar"}},
+}
+
+// Lookup returns the accepted type for a lowercase file extension.
+func Lookup(ext string) (FileType, bool) {
+	ft, ok := fileTypes[ext]
+	return ft, ok
+}
+
+// Matches reports whether the sniffed type of a file is consistent with
+// this type.
+func (ft FileType) Matches(sniffed string) bool {
+	for _, s := range ft.sniffs {
+		if s == sniffed {
+			return true
+		}
+	}
+	return false
+}
+
+// Classify returns the category of a stored content type and whether
+// browsers may show it inline. Unknown types are download-only documents.
+func Classify(contentType string) (Category, bool) {
+	for _, ft := range fileTypes {
+		if ft.ContentType == contentType {
+			return ft.Category, ft.Inline
+		}
+	}
+	return CategoryDocument, false
+}
+
+// ContentTypeByExt is the content type uploads with ext are stored with.
+func ContentTypeByExt(ext string) string {
+	if ft, ok := fileTypes[strings.ToLower(ext)]; ok {
+		return ft.ContentType
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// Sniff detects a media type from a file's leading bytes (512 is enough),
+// without parameters. It extends http.DetectContentType with formats the
+// standard library doesn't recognise.
+func Sniff(head []byte) string {
+	switch {
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		switch string(head[8:12]) {
+		case "qt  ":
+			return "video/quicktime"
+		case "M4A ", "M4B ":
+			return "audio/mp4"
+		}
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(head, []byte("7z\xbc\xaf\x27\x1c")):
+		return "application/x-7z-compressed"
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return "application/x-tar"
+	case len(head) >= 4 && isMP3Frame(head):
+		return "audio/mpeg"
+	}
+
+	t, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return t
+}
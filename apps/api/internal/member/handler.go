@@ -7,6 +7,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/opencord/api/internal/auth"
+	"github.com/opencord/api/internal/presence"
 	"github.com/opencord/api/internal/ws"
 )
 
@@ -29,10 +30,17 @@ func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
 		members = []Member{}
 	}
 
-	// Annotate online status from hub
-	onlineUsers := h.hub.GetOnlineUserIDs()
+	// Annotate presence from hub (invisible users appear offline to others)
+	callerID, _ := auth.UserFromContext(r.Context())
+	presences := h.hub.GetPresences(callerID)
 	for i := range members {
-		members[i].Online = onlineUsers[members[i].UserID]
+		view, ok := presences[members[i].UserID]
+		if !ok {
+			view = presence.View{Status: presence.StatusOffline}
+		}
+		members[i].Status = view.Status
+		members[i].CustomStatus = view.CustomStatus
+		members[i].Online = view.Status != presence.StatusOffline && view.Status != presence.StatusInvisible
 	}
 
 	writeJSON(w, members, http.StatusOK)
@@ -76,6 +84,9 @@ func (h *Handler) Kick(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Stop sharing presence with the removed user's connections
+	h.hub.SetMembership(targetUserID, false)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -4,18 +4,21 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/opencord/api/internal/presence"
 )
 
 type Member struct {
-	ID          uuid.UUID  `json:"id"`
-	UserID      uuid.UUID  `json:"userId"`
-	Username    string     `json:"username"`
-	DisplayName string     `json:"displayName"`
-	AvatarURL   *string    `json:"avatarUrl"`
-	Role        string     `json:"role"`
-	JoinedAt    time.Time  `json:"joinedAt"`
-	Online      bool       `json:"online"`
-	LastSeenAt  *time.Time `json:"lastSeenAt"`
+	ID           uuid.UUID              `json:"id"`
+	UserID       uuid.UUID              `json:"userId"`
+	Username     string                 `json:"username"`
+	DisplayName  string                 `json:"displayName"`
+	AvatarURL    *string                `json:"avatarUrl"`
+	Role         string                 `json:"role"`
+	JoinedAt     time.Time              `json:"joinedAt"`
+	Online       bool                   `json:"online"`
+	Status       presence.Status        `json:"status"`
+	CustomStatus *presence.CustomStatus `json:"customStatus"`
+	LastSeenAt   *time.Time             `json:"lastSeenAt"`
 }
 
 type UpdateMemberRequest struct {
@@ -2,21 +2,25 @@ package message
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/opencord/api/internal/attachment"
 	"github.com/opencord/api/internal/auth"
+	"github.com/opencord/api/internal/storage"
 	"github.com/opencord/api/internal/ws"
 )
 
 type Handler struct {
-	repo Repository
-	hub  *ws.Hub
+	repo   Repository
+	hub    *ws.Hub
+	signer *storage.Signer
 }
 
-func NewHandler(repo Repository, hub *ws.Hub) *Handler {
-	return &Handler{repo: repo, hub: hub}
+func NewHandler(repo Repository, hub *ws.Hub, signer *storage.Signer) *Handler {
+	return &Handler{repo: repo, hub: hub, signer: signer}
 }
 
 func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
@@ -38,16 +42,36 @@ func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Content == "" && req.ImageURL == nil {
-		writeError(w, "content or image is required", http.StatusBadRequest)
+	if req.Content == "" && len(req.AttachmentIDs) == 0 {
+		writeError(w, "content or attachment is required", http.StatusBadRequest)
 		return
 	}
+	if len(req.AttachmentIDs) > attachment.MaxPerMessage {
+		writeError(w, "too many attachments", http.StatusBadRequest)
+		return
+	}
+	seen := make(map[uuid.UUID]bool, len(req.AttachmentIDs))
+	for _, id := range req.AttachmentIDs {
+		if seen[id] {
+			writeError(w, "duplicate attachment", http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+	}
 
-	msg, err := h.repo.Create(channelID, userID, req.Content, req.ImageURL)
+	msg, err := h.repo.Create(channelID, userID, req.Content, req.AttachmentIDs)
+	if errors.Is(err, attachment.ErrNotClaimable) {
+		writeError(w, "attachment not found", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		writeError(w, "failed to create message", http.StatusInternalServerError)
 		return
 	}
+	h.setURLs(msg)
+
+	// Sending a message ends the author's typing indicator
+	h.hub.StopTyping(channelID.String(), userID)
 
 	// Broadcast via WebSocket
 	h.hub.BroadcastToChannel(channelID.String(), ws.Event{
@@ -82,6 +106,9 @@ func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
 	if messages == nil {
 		messages = []Message{}
 	}
+	for i := range messages {
+		h.setURLs(&messages[i])
+	}
 
 	hasMore := len(messages) == limit
 	w.Header().Set("Content-Type", "application/json")
@@ -127,6 +154,7 @@ func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
 		writeError(w, "failed to update message", http.StatusInternalServerError)
 		return
 	}
+	h.setURLs(msg)
 
 	h.hub.BroadcastToChannel(existing.ChannelID.String(), ws.Event{
 		Type: "message_update",
@@ -175,6 +203,14 @@ func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// setURLs signs attachment URLs for the caller, and for the channel's
+// subscribers when the message is broadcast.
+func (h *Handler) setURLs(msg *Message) {
+	for i := range msg.Attachments {
+		msg.Attachments[i].SetURL(h.signer)
+	}
+}
+
 func writeJSON(w http.ResponseWriter, data interface{}, status int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/opencord/api/internal/attachment"
 )
 
 type Message struct {
@@ -11,10 +12,12 @@ type Message struct {
 	ChannelID uuid.UUID  `json:"channelId"`
 	AuthorID  uuid.UUID  `json:"authorId"`
 	Content   string     `json:"content"`
-	ImageURL  *string    `json:"imageUrl"`
+	ImageURL  *string    `json:"imageUrl"` // only set on messages from before attachments
 	CreatedAt time.Time  `json:"createdAt"`
 	UpdatedAt *time.Time `json:"updatedAt"`
 	Author    *Author    `json:"author,omitempty"`
+
+	Attachments []attachment.Attachment `json:"attachments"`
 }
 
 type Author struct {
@@ -25,8 +28,8 @@ type Author struct {
 }
 
 type CreateMessageRequest struct {
-	Content  string  `json:"content"`
-	ImageURL *string `json:"imageUrl"`
+	Content       string      `json:"content"`
+	AttachmentIDs []uuid.UUID `json:"attachmentIds"`
 }
 
 type UpdateMessageRequest struct {
@@ -5,36 +5,56 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/opencord/api/internal/attachment"
 )
 
 type Repository interface {
-	Create(channelID, authorID uuid.UUID, content string, imageURL *string) (*Message, error)
+	Create(channelID, authorID uuid.UUID, content string, attachmentIDs []uuid.UUID) (*Message, error)
 	GetByChannel(channelID uuid.UUID, before *uuid.UUID, limit int) ([]Message, error)
 	GetByID(id uuid.UUID) (*Message, error)
+	ListByAuthor(authorID uuid.UUID) ([]Message, error)
 	Update(id uuid.UUID, content string) (*Message, error)
 	Delete(id uuid.UUID) error
 }
 
 type PostgresRepository struct {
-	db *sql.DB
+	db          *sql.DB
+	attachments *attachment.PostgresRepository
 }
 
 func NewPostgresRepository(db *sql.DB) *PostgresRepository {
-	return &PostgresRepository{db: db}
+	return &PostgresRepository{db: db, attachments: attachment.NewPostgresRepository(db)}
 }
 
-func (r *PostgresRepository) Create(channelID, authorID uuid.UUID, content string, imageURL *string) (*Message, error) {
+// Create inserts the message and claims its attachments in one transaction.
+// It returns attachment.ErrNotClaimable if any attachment ID isn't a
+// pending upload of the author.
+func (r *PostgresRepository) Create(channelID, authorID uuid.UUID, content string, attachmentIDs []uuid.UUID) (*Message, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	msg := &Message{}
-	err := r.db.QueryRow(
-		`INSERT INTO messages (channel_id, author_id, content, image_url)
-		 VALUES ($1, $2, $3, $4)
+	err = tx.QueryRow(
+		`INSERT INTO messages (channel_id, author_id, content)
+		 VALUES ($1, $2, $3)
 		 RETURNING id, channel_id, author_id, content, image_url, created_at, updated_at`,
-		channelID, authorID, content, imageURL,
+		channelID, authorID, content,
 	).Scan(&msg.ID, &msg.ChannelID, &msg.AuthorID, &msg.Content, &msg.ImageURL, &msg.CreatedAt, &msg.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
 
+	msg.Attachments, err = attachment.Claim(tx, msg.ID, authorID, attachmentIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
 	// Fetch author info
 	msg.Author = &Author{}
 	_ = r.db.QueryRow(
@@ -92,6 +112,13 @@ func (r *PostgresRepository) GetByChannel(channelID uuid.UUID, before *uuid.UUID
 		}
 		messages = append(messages, msg)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := r.loadAttachments(messages); err != nil {
+		return nil, err
+	}
 	return messages, nil
 }
 
@@ -104,9 +131,43 @@ func (r *PostgresRepository) GetByID(id uuid.UUID) (*Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := r.loadAttachment(msg); err != nil {
+		return nil, err
+	}
 	return msg, nil
 }
 
+// ListByAuthor returns everything a user has posted, oldest first.
+func (r *PostgresRepository) ListByAuthor(authorID uuid.UUID) ([]Message, error) {
+	rows, err := r.db.Query(
+		`SELECT id, channel_id, author_id, content, image_url, created_at, updated_at
+		 FROM messages WHERE author_id = $1
+		 ORDER BY created_at`,
+		authorID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.ChannelID, &msg.AuthorID, &msg.Content, &msg.ImageURL, &msg.CreatedAt, &msg.UpdatedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := r.loadAttachments(messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
 func (r *PostgresRepository) Update(id uuid.UUID, content string) (*Message, error) {
 	msg := &Message{}
 	now := time.Now()
@@ -118,6 +179,9 @@ func (r *PostgresRepository) Update(id uuid.UUID, content string) (*Message, err
 	if err != nil {
 		return nil, err
 	}
+	if err := r.loadAttachment(msg); err != nil {
+		return nil, err
+	}
 	return msg, nil
 }
 
@@ -125,3 +189,31 @@ func (r *PostgresRepository) Delete(id uuid.UUID) error {
 	_, err := r.db.Exec(`DELETE FROM messages WHERE id = $1`, id)
 	return err
 }
+
+// loadAttachments fills in Attachments for each message with one query.
+func (r *PostgresRepository) loadAttachments(messages []Message) error {
+	ids := make([]uuid.UUID, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].ID
+	}
+	byMessage, err := r.attachments.ListByMessages(ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Attachments = byMessage[messages[i].ID]
+		if messages[i].Attachments == nil {
+			messages[i].Attachments = []attachment.Attachment{}
+		}
+	}
+	return nil
+}
+
+func (r *PostgresRepository) loadAttachment(msg *Message) error {
+	messages := []Message{*msg}
+	if err := r.loadAttachments(messages); err != nil {
+		return err
+	}
+	msg.Attachments = messages[0].Attachments
+	return nil
+}
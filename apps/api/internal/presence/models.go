@@ -0,0 +1,113 @@
+package presence
+
+import (
+	"time"
+	"unicode/utf8"
+)
+
+type Status string
+
+const (
+	StatusOnline    Status = "online"
+	StatusIdle      Status = "idle"
+	StatusDND       Status = "dnd"
+	StatusInvisible Status = "invisible"
+
+	// StatusOffline is never stored; it's what others see when a user has
+	// no connections or is invisible.
+	StatusOffline Status = "offline"
+)
+
+const (
+	maxCustomTextLength  = 128
+	maxCustomEmojiLength = 64
+)
+
+// Valid reports whether s is a status a client may choose.
+func (s Status) Valid() bool {
+	switch s {
+	case StatusOnline, StatusIdle, StatusDND, StatusInvisible:
+		return true
+	}
+	return false
+}
+
+type CustomStatus struct {
+	Text      string     `json:"text"`
+	Emoji     *string    `json:"emoji"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// Expired reports whether the custom status has passed its expiry.
+func (c *CustomStatus) Expired(now time.Time) bool {
+	return c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
+
+// Valid checks the lengths the database accepts.
+func (c *CustomStatus) Valid() bool {
+	if utf8.RuneCountInString(c.Text) > maxCustomTextLength {
+		return false
+	}
+	if c.Emoji != nil && utf8.RuneCountInString(*c.Emoji) > maxCustomEmojiLength {
+		return false
+	}
+	return c.Text != "" || c.Emoji != nil
+}
+
+// Presence is a user's chosen status, persisted across reconnects.
+type Presence struct {
+	Status       Status        `json:"status"`
+	CustomStatus *CustomStatus `json:"customStatus"`
+}
+
+// Default is the presence of a user who has never set one.
+func Default() Presence {
+	return Presence{Status: StatusOnline}
+}
+
+// View is a user's presence as broadcast and returned in the member list.
+type View struct {
+	Status       Status        `json:"status"`
+	CustomStatus *CustomStatus `json:"customStatus"`
+}
+
+// Visible returns what other users may see: invisible users appear offline
+// and their custom status is hidden.
+func (v View) Visible() View {
+	if v.Status == StatusInvisible || v.Status == StatusOffline {
+		return View{Status: StatusOffline}
+	}
+	return v
+}
+
+// Equal compares two views for change detection.
+func (v View) Equal(o View) bool {
+	if v.Status != o.Status {
+		return false
+	}
+	a, b := v.CustomStatus, o.CustomStatus
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Text == b.Text && equalPtr(a.Emoji, b.Emoji) && equalTime(a.ExpiresAt, b.ExpiresAt)
+}
+
+// SetPresenceRequest is the payload of the presence_set WS event.
+type SetPresenceRequest struct {
+	Status       Status        `json:"status"`
+	CustomStatus *CustomStatus `json:"customStatus"`
+}
+
+func equalPtr(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func equalTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,69 @@
+package presence
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Repository interface {
+	Get(userID uuid.UUID) (*Presence, error)
+	Set(userID uuid.UUID, p Presence) error
+}
+
+type PostgresRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresRepository(db *sql.DB) *PostgresRepository {
+	return &PostgresRepository{db: db}
+}
+
+func (r *PostgresRepository) Get(userID uuid.UUID) (*Presence, error) {
+	var (
+		status    string
+		text      sql.NullString
+		emoji     *string
+		expiresAt *time.Time
+	)
+	err := r.db.QueryRow(
+		`SELECT status, custom_status_text, custom_status_emoji, custom_status_expires_at
+		 FROM users WHERE id = $1`, userID,
+	).Scan(&status, &text, &emoji, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Presence{Status: Status(status)}
+	if text.Valid || emoji != nil {
+		cs := &CustomStatus{Text: text.String, Emoji: emoji, ExpiresAt: expiresAt}
+		if !cs.Expired(time.Now()) {
+			p.CustomStatus = cs
+		}
+	}
+	return p, nil
+}
+
+func (r *PostgresRepository) Set(userID uuid.UUID, p Presence) error {
+	var (
+		text      *string
+		emoji     *string
+		expiresAt *time.Time
+	)
+	if p.CustomStatus != nil {
+		text = &p.CustomStatus.Text
+		emoji = p.CustomStatus.Emoji
+		expiresAt = p.CustomStatus.ExpiresAt
+	}
+	_, err := r.db.Exec(
+		`UPDATE users SET
+			status = $2,
+			custom_status_text = $3,
+			custom_status_emoji = $4,
+			custom_status_expires_at = $5
+		 WHERE id = $1`,
+		userID, string(p.Status), text, emoji, expiresAt,
+	)
+	return err
+}
@@ -0,0 +1,43 @@
+package rtc
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/opencord/api/internal/auth"
+)
+
+type Handler struct {
+	ice *ICEConfig
+}
+
+func NewHandler(ice *ICEConfig) *Handler {
+	return &Handler{ice: ice}
+}
+
+// ICEServers handles GET /api/rtc/ice-servers.
+func (h *Handler) ICEServers(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, map[string]interface{}{
+		"iceServers": h.ice.Servers(userID),
+		"ttl":        int(h.ice.ttl().Seconds()),
+	}, http.StatusOK)
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func writeError(w http.ResponseWriter, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
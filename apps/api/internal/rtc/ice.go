@@ -0,0 +1,80 @@
+package rtc
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// DefaultTURNTTL is how long issued TURN credentials stay valid.
+const DefaultTURNTTL = time.Hour
+
+// ICEServer mirrors the browser RTCIceServer dictionary.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEConfig holds the STUN/TURN servers handed to clients. TURN credentials
+// are minted per user with the coturn REST API shared-secret scheme
+// (coturn: use-auth-secret + static-auth-secret).
+type ICEConfig struct {
+	STUNURLs   []string
+	TURNURLs   []string
+	TURNSecret string
+	TURNTTL    time.Duration
+}
+
+// Servers returns the ICE servers for a user, including freshly issued TURN
+// credentials when TURN is configured.
+func (c *ICEConfig) Servers(userID uuid.UUID) []ICEServer {
+	servers := []ICEServer{}
+	if c == nil {
+		return servers
+	}
+	if len(c.STUNURLs) > 0 {
+		servers = append(servers, ICEServer{URLs: c.STUNURLs})
+	}
+	if len(c.TURNURLs) > 0 && c.TURNSecret != "" {
+		username, credential := TURNCredentials(c.TURNSecret, userID.String(), time.Now().Add(c.ttl()))
+		servers = append(servers, ICEServer{
+			URLs:       c.TURNURLs,
+			Username:   username,
+			Credential: credential,
+		})
+	}
+	return servers
+}
+
+// WebRTCServers returns the servers the SFU itself should use. Only STUN is
+// needed server-side; the SFU is expected to have a reachable address.
+func (c *ICEConfig) WebRTCServers() []webrtc.ICEServer {
+	if c == nil || len(c.STUNURLs) == 0 {
+		return nil
+	}
+	return []webrtc.ICEServer{{URLs: c.STUNURLs}}
+}
+
+func (c *ICEConfig) ttl() time.Duration {
+	if c == nil || c.TURNTTL <= 0 {
+		return DefaultTURNTTL
+	}
+	return c.TURNTTL
+}
+
+// TURNCredentials implements the TURN REST API scheme: the username is
+// "<expiry unix time>:<user id>" and the password is
+// base64(HMAC-SHA1(secret, username)).
+func TURNCredentials(secret, userID string, expiresAt time.Time) (username, credential string) {
+	username = strconv.FormatInt(expiresAt.Unix(), 10) + ":" + userID
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return username, credential
+}
@@ -0,0 +1,20 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTURNCredentials(t *testing.T) {
+	username, credential := TURNCredentials(
+		"coturn-secret",
+		"00000000-0000-0000-0000-000000000001",
+		time.Unix(1700000000, 0),
+	)
+	if username != "1700000000:00000000-0000-0000-0000-000000000001" {
+		t.Fatalf("username = %q", username)
+	}
+	if credential != "ideTVk60vfOcOjd65FtAvOwPRrs=" {
+		t.Fatalf("credential = %q", credential)
+	}
+}
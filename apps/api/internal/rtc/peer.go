@@ -0,0 +1,296 @@
+package rtc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// speakingHold is how long a participant stays "speaking" after the last
+// voiced packet. Covers short pauses and Opus DTX gaps.
+const speakingHold = 400 * time.Millisecond
+
+// Peer is one participant's server-side PeerConnection.
+type Peer struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+
+	sfu  *SFU
+	room *room
+	sig  Signaler
+	pc   *webrtc.PeerConnection
+
+	mu                sync.Mutex
+	closed            bool
+	renegotiate       bool // an offer was requested while one was in flight
+	pendingCandidates []webrtc.ICECandidateInit
+
+	senders map[*Peer]*webrtc.RTPSender // guarded by room.mu
+
+	selfMuted   atomic.Bool
+	serverMuted atomic.Bool
+
+	speakingMu    sync.Mutex
+	speaking      bool
+	speakingTimer *time.Timer
+}
+
+func newPeer(s *SFU, r *room, sig Signaler, userID uuid.UUID, pc *webrtc.PeerConnection) *Peer {
+	return &Peer{
+		ID:      uuid.New(),
+		UserID:  userID,
+		sfu:     s,
+		room:    r,
+		sig:     sig,
+		pc:      pc,
+		senders: make(map[*Peer]*webrtc.RTPSender),
+	}
+}
+
+// start wires PeerConnection callbacks and the upstream audio transceiver.
+func (p *Peer) start() error {
+	if _, err := p.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		return fmt.Errorf("failed to add audio transceiver: %w", err)
+	}
+
+	p.pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		p.sig.Signal("rtc:ice_candidate", candidatePayload{
+			ChannelID: p.room.id,
+			Candidate: c.ToJSON(),
+		})
+	})
+
+	p.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed {
+			go p.sfu.dropPeer(p)
+		}
+	})
+
+	p.pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if remote.Kind() != webrtc.RTPCodecTypeAudio {
+			return
+		}
+		p.forward(remote, receiver)
+	})
+
+	return nil
+}
+
+// forward copies the participant's upstream RTP to the track other peers
+// are subscribed to, dropping packets while muted.
+func (p *Peer) forward(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		remote.Codec().RTPCodecCapability,
+		"audio-"+p.ID.String(),
+		p.UserID.String(),
+	)
+	if err != nil {
+		log.Printf("rtc: failed to create forwarding track for peer %s: %v", p.ID, err)
+		return
+	}
+	p.room.publish(p, local)
+
+	levelID := audioLevelExtensionID(receiver)
+	for {
+		pkt, _, err := remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		if p.muted() {
+			continue
+		}
+		if levelID != 0 {
+			p.observeLevel(pkt, levelID)
+		}
+		if err := local.WriteRTP(pkt); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			return
+		}
+	}
+}
+
+// negotiate sends a fresh offer, or defers it until the in-flight offer has
+// been answered.
+func (p *Peer) negotiate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	if p.pc.SignalingState() != webrtc.SignalingStateStable {
+		p.renegotiate = true
+		return
+	}
+
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		log.Printf("rtc: failed to create offer for peer %s: %v", p.ID, err)
+		return
+	}
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		log.Printf("rtc: failed to set local description for peer %s: %v", p.ID, err)
+		return
+	}
+
+	p.sig.Signal("rtc:offer", descriptionPayload{ChannelID: p.room.id, SDP: offer})
+}
+
+func (p *Peer) handleAnswer(answer webrtc.SessionDescription) error {
+	if answer.Type != webrtc.SDPTypeAnswer {
+		return fmt.Errorf("expected answer, got %s", answer.Type)
+	}
+
+	p.mu.Lock()
+	if err := p.pc.SetRemoteDescription(answer); err != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("failed to set remote description: %w", err)
+	}
+	pending := p.pendingCandidates
+	p.pendingCandidates = nil
+	again := p.renegotiate
+	p.renegotiate = false
+	p.mu.Unlock()
+
+	for _, c := range pending {
+		if err := p.pc.AddICECandidate(c); err != nil {
+			log.Printf("rtc: failed to add buffered candidate for peer %s: %v", p.ID, err)
+		}
+	}
+
+	if again {
+		p.negotiate()
+	}
+	return nil
+}
+
+func (p *Peer) addCandidate(c webrtc.ICECandidateInit) error {
+	p.mu.Lock()
+	if p.pc.RemoteDescription() == nil {
+		// Candidates can race ahead of the first answer; apply them later.
+		p.pendingCandidates = append(p.pendingCandidates, c)
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	return p.pc.AddICECandidate(c)
+}
+
+func (p *Peer) setSelfMuted(muted bool) {
+	p.selfMuted.Store(muted)
+	if muted {
+		p.setSpeaking(false)
+	}
+	p.room.broadcast("rtc:mute_update", p.state())
+}
+
+func (p *Peer) muted() bool {
+	return p.selfMuted.Load() || p.serverMuted.Load()
+}
+
+// observeLevel marks the participant as speaking when a packet's RFC 6464
+// audio level is loud enough.
+func (p *Peer) observeLevel(pkt *rtp.Packet, extID uint8) {
+	raw := pkt.GetExtension(extID)
+	if raw == nil {
+		return
+	}
+	var level rtp.AudioLevelExtension
+	if err := level.Unmarshal(raw); err != nil {
+		return
+	}
+	if level.Level > p.room.speakingThreshold {
+		return
+	}
+
+	p.speakingMu.Lock()
+	started := !p.speaking
+	p.speaking = true
+	if p.speakingTimer == nil {
+		p.speakingTimer = time.AfterFunc(speakingHold, func() { p.setSpeaking(false) })
+	} else {
+		p.speakingTimer.Reset(speakingHold)
+	}
+	p.speakingMu.Unlock()
+
+	if started {
+		p.room.broadcast("rtc:speaking", p.speakingState(true))
+	}
+}
+
+func (p *Peer) setSpeaking(speaking bool) {
+	p.speakingMu.Lock()
+	changed := p.speaking != speaking
+	p.speaking = speaking
+	if !speaking && p.speakingTimer != nil {
+		p.speakingTimer.Stop()
+	}
+	p.speakingMu.Unlock()
+
+	if changed {
+		p.room.broadcast("rtc:speaking", p.speakingState(speaking))
+	}
+}
+
+func (p *Peer) speakingState(speaking bool) map[string]interface{} {
+	return map[string]interface{}{
+		"channelId": p.room.id,
+		"userId":    p.UserID,
+		"speaking":  speaking,
+	}
+}
+
+// state is the participant summary sent in peer_joined and mute_update.
+func (p *Peer) state() map[string]interface{} {
+	return map[string]interface{}{
+		"channelId":   p.room.id,
+		"userId":      p.UserID,
+		"selfMuted":   p.selfMuted.Load(),
+		"serverMuted": p.serverMuted.Load(),
+	}
+}
+
+func (p *Peer) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	p.speakingMu.Lock()
+	if p.speakingTimer != nil {
+		p.speakingTimer.Stop()
+	}
+	p.speakingMu.Unlock()
+
+	if err := p.pc.Close(); err != nil {
+		log.Printf("rtc: failed to close peer %s: %v", p.ID, err)
+	}
+}
+
+// audioLevelExtensionID returns the negotiated ID of the RFC 6464 header
+// extension, or 0 if the client didn't negotiate it.
+func audioLevelExtensionID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == sdp.AudioLevelURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,218 @@
+package rtc
+
+import (
+	"log"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// room is the set of participants in one voice channel and the tracks they
+// publish. Lock order: SFU.mu before room.mu.
+type room struct {
+	id                string
+	speakingThreshold uint8
+
+	mu          sync.Mutex
+	peers       map[*Peer]struct{}
+	tracks      map[*Peer]*webrtc.TrackLocalStaticRTP // publisher → forwarded track
+	serverMuted map[uuid.UUID]bool                    // survives rejoin while the room lives
+}
+
+func newRoom(id string, speakingThreshold uint8) *room {
+	return &room{
+		id:                id,
+		speakingThreshold: speakingThreshold,
+		peers:             make(map[*Peer]struct{}),
+		tracks:            make(map[*Peer]*webrtc.TrackLocalStaticRTP),
+		serverMuted:       make(map[uuid.UUID]bool),
+	}
+}
+
+// attach registers the peer as a member of the room. Called with SFU.mu held
+// so an emptying room can't be dropped while someone is joining it.
+func (r *room) attach(p *Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers[p] = struct{}{}
+	p.serverMuted.Store(r.serverMuted[p.UserID])
+}
+
+// welcome subscribes a newly attached peer to every existing track, sends
+// the initial offer and announces the newcomer.
+func (r *room) welcome(p *Peer) {
+	r.mu.Lock()
+	if _, ok := r.peers[p]; !ok {
+		r.mu.Unlock()
+		return
+	}
+	var others []*Peer
+	for other := range r.peers {
+		if other == p {
+			continue
+		}
+		others = append(others, other)
+		if track, ok := r.tracks[other]; ok {
+			r.addSender(p, other, track)
+		}
+	}
+	r.mu.Unlock()
+
+	p.negotiate()
+
+	joined := p.state()
+	for _, other := range others {
+		p.sig.Signal("rtc:peer_joined", other.state())
+		other.sig.Signal("rtc:peer_joined", joined)
+	}
+}
+
+// publish forwards the owner's upstream track to everyone else in the room.
+func (r *room) publish(owner *Peer, track *webrtc.TrackLocalStaticRTP) {
+	r.mu.Lock()
+	if _, ok := r.peers[owner]; !ok {
+		r.mu.Unlock()
+		return
+	}
+	r.tracks[owner] = track
+
+	var renegotiate []*Peer
+	for other := range r.peers {
+		if other == owner {
+			continue
+		}
+		if r.addSender(other, owner, track) {
+			renegotiate = append(renegotiate, other)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, other := range renegotiate {
+		other.negotiate()
+	}
+}
+
+// remove detaches the peer and unsubscribes everyone from its track. It
+// reports whether the room is now empty.
+func (r *room) remove(p *Peer) bool {
+	r.mu.Lock()
+	if _, ok := r.peers[p]; !ok {
+		empty := len(r.peers) == 0
+		r.mu.Unlock()
+		return empty
+	}
+	delete(r.peers, p)
+	delete(r.tracks, p)
+
+	var others, renegotiate []*Peer
+	for other := range r.peers {
+		others = append(others, other)
+		sender, ok := other.senders[p]
+		if !ok {
+			continue
+		}
+		delete(other.senders, p)
+		if err := other.pc.RemoveTrack(sender); err != nil {
+			log.Printf("rtc: failed to remove track from peer %s: %v", other.ID, err)
+			continue
+		}
+		renegotiate = append(renegotiate, other)
+	}
+	empty := len(r.peers) == 0
+	r.mu.Unlock()
+
+	for _, other := range renegotiate {
+		other.negotiate()
+	}
+
+	left := map[string]interface{}{
+		"channelId": r.id,
+		"userId":    p.UserID,
+	}
+	for _, other := range others {
+		other.sig.Signal("rtc:peer_left", left)
+	}
+	return empty
+}
+
+// addSender attaches src's track to dst's connection. Caller holds r.mu.
+func (r *room) addSender(dst, src *Peer, track *webrtc.TrackLocalStaticRTP) bool {
+	sender, err := dst.pc.AddTrack(track)
+	if err != nil {
+		log.Printf("rtc: failed to add track to peer %s: %v", dst.ID, err)
+		return false
+	}
+	dst.senders[src] = sender
+
+	// Drain RTCP so interceptors (NACK, reports) keep working.
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return true
+}
+
+// setServerMuted records a moderator mute for the user and applies it to
+// their current sessions.
+func (r *room) setServerMuted(userID uuid.UUID, muted bool) {
+	r.mu.Lock()
+	if muted {
+		r.serverMuted[userID] = true
+	} else {
+		delete(r.serverMuted, userID)
+	}
+	var affected []*Peer
+	for p := range r.peers {
+		if p.UserID == userID {
+			p.serverMuted.Store(muted)
+			affected = append(affected, p)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, p := range affected {
+		if muted {
+			p.setSpeaking(false)
+		}
+		r.broadcast("rtc:mute_update", p.state())
+	}
+}
+
+func (r *room) broadcast(event string, data interface{}) {
+	r.mu.Lock()
+	peers := make([]*Peer, 0, len(r.peers))
+	for p := range r.peers {
+		peers = append(peers, p)
+	}
+	r.mu.Unlock()
+
+	for _, p := range peers {
+		p.sig.Signal(event, data)
+	}
+}
+
+func (r *room) participants() []uuid.UUID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := make(map[uuid.UUID]bool, len(r.peers))
+	ids := make([]uuid.UUID, 0, len(r.peers))
+	for p := range r.peers {
+		if !seen[p.UserID] {
+			seen[p.UserID] = true
+			ids = append(ids, p.UserID)
+		}
+	}
+	return ids
+}
+
+func (r *room) isEmpty() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.peers) == 0
+}
@@ -1,8 +1,61 @@
 // Package rtc provides WebRTC signaling support.
 //
 // WebRTC signaling is handled via the WebSocket connection.
-// See internal/ws/client.go handleRTCEvent for the signaling relay.
+// See internal/ws/client.go handleRTCEvent for the signaling entry point.
 //
 // RTC events: rtc:join, rtc:offer, rtc:answer, rtc:ice_candidate, rtc:leave
-// These are relayed between peers via the WebSocket hub.
+//
+// Two modes are supported:
+//
+//   - mesh (default): events are relayed between peers via the WebSocket hub
+//     and every participant connects to every other participant.
+//   - sfu (RTC_MODE=sfu): the API terminates the WebRTC connections itself.
+//     Each participant sends a single Opus upstream which the SFU forwards
+//     to everyone else in the voice channel. See SFU.
+//
+// In SFU mode the server is always the offerer. The client sends rtc:join,
+// receives rtc:offer, and replies with rtc:answer; the server re-offers
+// whenever participants come and go. Additional events:
+//
+//   - rtc:mute {channelId, muted} — self mute, enforced by the server
+//   - rtc:server_mute {channelId, targetId, muted} — moderator mute
+//   - rtc:mute_update, rtc:speaking, rtc:peer_joined, rtc:peer_left — server → client
 package rtc
+
+import (
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// DefaultSpeakingThreshold is the RFC 6464 audio level (in -dBov) at or
+	// below which a packet is considered voice. 127 is silence, 0 is loudest.
+	DefaultSpeakingThreshold = 50
+)
+
+// Config configures the SFU's WebRTC stack.
+type Config struct {
+	// ICEServers are offered to the server-side PeerConnections.
+	ICEServers []webrtc.ICEServer
+
+	// UDPPortMin and UDPPortMax restrict the ephemeral UDP port range used
+	// for media. Both zero means any port.
+	UDPPortMin uint16
+	UDPPortMax uint16
+
+	// PublicIPs are advertised as host candidates when the server runs
+	// behind 1:1 NAT (e.g. a cloud VM with an elastic IP).
+	PublicIPs []string
+
+	// SpeakingThreshold overrides DefaultSpeakingThreshold when non-zero.
+	SpeakingThreshold uint8
+
+	// IncludeLoopback gathers candidates on loopback interfaces. Only useful
+	// for in-process tests.
+	IncludeLoopback bool
+}
+
+// Signaler delivers server-originated signaling events to one participant.
+// Implemented by ws.Client.
+type Signaler interface {
+	Signal(event string, data interface{})
+}
@@ -0,0 +1,302 @@
+package rtc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	ErrNotInChannel = errors.New("not in voice channel")
+	ErrForbidden    = errors.New("insufficient permissions")
+)
+
+// SFU is a selective forwarding unit for voice channels. Each participant
+// publishes one Opus track which is forwarded to every other participant in
+// the same room (voice channel).
+type SFU struct {
+	api    *webrtc.API
+	config Config
+
+	mu    sync.Mutex
+	rooms map[string]*room
+	peers map[Signaler]*Peer // one voice session per connection
+
+	// CanModerate reports whether a user may server-mute others.
+	// Wired in main.go to check the member role. Nil denies everyone.
+	CanModerate func(userID uuid.UUID) bool
+}
+
+// Signal payloads. Field names match the mesh-mode client payloads.
+
+type joinPayload struct {
+	ChannelID string `json:"channelId"`
+}
+
+type descriptionPayload struct {
+	ChannelID string                    `json:"channelId"`
+	SDP       webrtc.SessionDescription `json:"sdp"`
+}
+
+type candidatePayload struct {
+	ChannelID string                  `json:"channelId"`
+	Candidate webrtc.ICECandidateInit `json:"candidate"`
+}
+
+type mutePayload struct {
+	ChannelID string `json:"channelId"`
+	TargetID  string `json:"targetId"`
+	Muted     bool   `json:"muted"`
+}
+
+// NewSFU builds the WebRTC API used for all server-side PeerConnections.
+func NewSFU(config Config) (*SFU, error) {
+	if config.SpeakingThreshold == 0 {
+		config.SpeakingThreshold = DefaultSpeakingThreshold
+	}
+
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, fmt.Errorf("failed to register opus codec: %w", err)
+	}
+	if err := m.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI},
+		webrtc.RTPCodecTypeAudio,
+	); err != nil {
+		return nil, fmt.Errorf("failed to register audio level extension: %w", err)
+	}
+
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, registry); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+
+	se := webrtc.SettingEngine{}
+	if config.UDPPortMin != 0 || config.UDPPortMax != 0 {
+		if err := se.SetEphemeralUDPPortRange(config.UDPPortMin, config.UDPPortMax); err != nil {
+			return nil, fmt.Errorf("invalid UDP port range: %w", err)
+		}
+	}
+	if len(config.PublicIPs) > 0 {
+		se.SetNAT1To1IPs(config.PublicIPs, webrtc.ICECandidateTypeHost)
+	}
+	if config.IncludeLoopback {
+		se.SetIncludeLoopbackCandidate(true)
+	}
+
+	return &SFU{
+		api: webrtc.NewAPI(
+			webrtc.WithMediaEngine(m),
+			webrtc.WithInterceptorRegistry(registry),
+			webrtc.WithSettingEngine(se),
+		),
+		config: config,
+		rooms:  make(map[string]*room),
+		peers:  make(map[Signaler]*Peer),
+	}, nil
+}
+
+// HandleSignal processes an rtc: event sent by a participant.
+func (s *SFU) HandleSignal(sig Signaler, userID uuid.UUID, event string, data json.RawMessage) {
+	var err error
+	switch event {
+	case "rtc:join":
+		var payload joinPayload
+		if err = json.Unmarshal(data, &payload); err == nil {
+			err = s.join(sig, userID, payload.ChannelID)
+		}
+
+	case "rtc:answer":
+		var payload descriptionPayload
+		if err = json.Unmarshal(data, &payload); err == nil {
+			err = s.withPeer(sig, payload.ChannelID, func(p *Peer) error {
+				return p.handleAnswer(payload.SDP)
+			})
+		}
+
+	case "rtc:ice_candidate":
+		var payload candidatePayload
+		if err = json.Unmarshal(data, &payload); err == nil {
+			err = s.withPeer(sig, payload.ChannelID, func(p *Peer) error {
+				return p.addCandidate(payload.Candidate)
+			})
+		}
+
+	case "rtc:leave":
+		s.Disconnect(sig)
+
+	case "rtc:mute":
+		var payload mutePayload
+		if err = json.Unmarshal(data, &payload); err == nil {
+			err = s.withPeer(sig, payload.ChannelID, func(p *Peer) error {
+				p.setSelfMuted(payload.Muted)
+				return nil
+			})
+		}
+
+	case "rtc:server_mute":
+		var payload mutePayload
+		if err = json.Unmarshal(data, &payload); err == nil {
+			err = s.serverMute(userID, payload)
+		}
+
+	default:
+		err = fmt.Errorf("unsupported event")
+	}
+
+	if err != nil {
+		log.Printf("rtc: %s from user %s: %v", event, userID, err)
+		sig.Signal("rtc:error", map[string]interface{}{
+			"event":   event,
+			"message": err.Error(),
+		})
+	}
+}
+
+// Disconnect removes the participant's voice session, if any. Called on
+// rtc:leave and when the WebSocket connection goes away.
+func (s *SFU) Disconnect(sig Signaler) {
+	s.mu.Lock()
+	p, ok := s.peers[sig]
+	if ok {
+		delete(s.peers, sig)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.removePeer(p)
+	}
+}
+
+// Participants returns the user IDs currently connected to a voice channel.
+func (s *SFU) Participants(channelID string) []uuid.UUID {
+	s.mu.Lock()
+	r, ok := s.rooms[channelID]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return r.participants()
+}
+
+// Close tears down every voice session.
+func (s *SFU) Close() {
+	s.mu.Lock()
+	peers := make([]*Peer, 0, len(s.peers))
+	for sig, p := range s.peers {
+		peers = append(peers, p)
+		delete(s.peers, sig)
+	}
+	s.mu.Unlock()
+
+	for _, p := range peers {
+		s.removePeer(p)
+	}
+}
+
+func (s *SFU) join(sig Signaler, userID uuid.UUID, channelID string) error {
+	if channelID == "" {
+		return fmt.Errorf("channelId is required")
+	}
+
+	// Switching channels implicitly leaves the previous one.
+	s.Disconnect(sig)
+
+	pc, err := s.api.NewPeerConnection(webrtc.Configuration{ICEServers: s.config.ICEServers})
+	if err != nil {
+		return fmt.Errorf("failed to create peer connection: %w", err)
+	}
+
+	s.mu.Lock()
+	r, ok := s.rooms[channelID]
+	if !ok {
+		r = newRoom(channelID, s.config.SpeakingThreshold)
+		s.rooms[channelID] = r
+	}
+	p := newPeer(s, r, sig, userID, pc)
+	s.peers[sig] = p
+	r.attach(p)
+	s.mu.Unlock()
+
+	if err := p.start(); err != nil {
+		s.dropPeer(p)
+		return err
+	}
+
+	r.welcome(p)
+	return nil
+}
+
+// dropPeer removes p unless the connection has already moved on to a newer
+// session.
+func (s *SFU) dropPeer(p *Peer) {
+	s.mu.Lock()
+	if s.peers[p.sig] != p {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.peers, p.sig)
+	s.mu.Unlock()
+
+	s.removePeer(p)
+}
+
+func (s *SFU) removePeer(p *Peer) {
+	r := p.room
+	empty := r.remove(p)
+	p.close()
+
+	if empty {
+		s.mu.Lock()
+		if s.rooms[r.id] == r && r.isEmpty() {
+			delete(s.rooms, r.id)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *SFU) withPeer(sig Signaler, channelID string, fn func(p *Peer) error) error {
+	s.mu.Lock()
+	p, ok := s.peers[sig]
+	s.mu.Unlock()
+	if !ok || p.room.id != channelID {
+		return ErrNotInChannel
+	}
+	return fn(p)
+}
+
+func (s *SFU) serverMute(callerID uuid.UUID, payload mutePayload) error {
+	if s.CanModerate == nil || !s.CanModerate(callerID) {
+		return ErrForbidden
+	}
+
+	targetID, err := uuid.Parse(payload.TargetID)
+	if err != nil {
+		return fmt.Errorf("invalid target ID")
+	}
+
+	s.mu.Lock()
+	r, ok := s.rooms[payload.ChannelID]
+	s.mu.Unlock()
+	if !ok {
+		return ErrNotInChannel
+	}
+
+	r.setServerMuted(targetID, payload.Muted)
+	return nil
+}
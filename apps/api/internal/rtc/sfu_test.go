@@ -0,0 +1,274 @@
+package rtc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+type signal struct {
+	event string
+	data  []byte
+}
+
+// fakeSignaler stands in for a ws.Client.
+type fakeSignaler struct {
+	events chan signal
+}
+
+func (f *fakeSignaler) Signal(event string, data interface{}) {
+	b, _ := json.Marshal(data)
+	f.events <- signal{event: event, data: b}
+}
+
+// testClient is an in-process Pion participant driven by SFU signaling.
+type testClient struct {
+	t       *testing.T
+	sfu     *SFU
+	userID  uuid.UUID
+	sig     *fakeSignaler
+	pc      *webrtc.PeerConnection
+	other   chan signal // non-negotiation events, for assertions
+	tracks  chan *webrtc.TrackRemote
+	channel string
+}
+
+func newTestClient(t *testing.T, s *SFU, channelID string) *testClient {
+	t.Helper()
+
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	se := webrtc.SettingEngine{}
+	se.SetIncludeLoopbackCandidate(true)
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(se))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testClient{
+		t:       t,
+		sfu:     s,
+		userID:  uuid.New(),
+		sig:     &fakeSignaler{events: make(chan signal, 256)},
+		pc:      pc,
+		other:   make(chan signal, 256),
+		tracks:  make(chan *webrtc.TrackRemote, 4),
+		channel: channelID,
+	}
+
+	pc.OnICECandidate(func(cand *webrtc.ICECandidate) {
+		if cand == nil {
+			return
+		}
+		c.send("rtc:ice_candidate", candidatePayload{ChannelID: channelID, Candidate: cand.ToJSON()})
+	})
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		c.tracks <- track
+	})
+
+	go c.loop()
+	t.Cleanup(func() { pc.Close() })
+	return c
+}
+
+func (c *testClient) send(event string, payload interface{}) {
+	data, _ := json.Marshal(payload)
+	c.sfu.HandleSignal(c.sig, c.userID, event, data)
+}
+
+func (c *testClient) loop() {
+	for ev := range c.sig.events {
+		switch ev.event {
+		case "rtc:offer":
+			var p descriptionPayload
+			if err := json.Unmarshal(ev.data, &p); err != nil {
+				c.t.Error(err)
+				return
+			}
+			if err := c.pc.SetRemoteDescription(p.SDP); err != nil {
+				c.t.Error(err)
+				return
+			}
+			answer, err := c.pc.CreateAnswer(nil)
+			if err != nil {
+				c.t.Error(err)
+				return
+			}
+			if err := c.pc.SetLocalDescription(answer); err != nil {
+				c.t.Error(err)
+				return
+			}
+			c.send("rtc:answer", descriptionPayload{ChannelID: c.channel, SDP: answer})
+
+		case "rtc:ice_candidate":
+			var p candidatePayload
+			if err := json.Unmarshal(ev.data, &p); err != nil {
+				c.t.Error(err)
+				return
+			}
+			_ = c.pc.AddICECandidate(p.Candidate)
+
+		default:
+			c.other <- ev
+		}
+	}
+}
+
+// publish sends loud Opus-shaped packets tagged with an RFC 6464 audio level.
+func (c *testClient) publish(done <-chan struct{}) {
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "mic")
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	sender, err := c.pc.AddTrack(track)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	level, _ := rtp.AudioLevelExtension{Level: 10, Voice: true}.Marshal()
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		var seq uint16
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			seq++
+			pkt := &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					SequenceNumber: seq,
+					Timestamp:      uint32(seq) * 960,
+				},
+				Payload: []byte{0xf8, 0xff, 0xfe},
+			}
+			for _, ext := range sender.GetParameters().HeaderExtensions {
+				if ext.URI == sdp.AudioLevelURI {
+					_ = pkt.Header.SetExtension(uint8(ext.ID), level)
+				}
+			}
+			_ = track.WriteRTP(pkt)
+		}
+	}()
+}
+
+func (c *testClient) waitFor(event string) signal {
+	c.t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev := <-c.other:
+			if ev.event == "rtc:error" {
+				c.t.Fatalf("rtc:error: %s", ev.data)
+			}
+			if ev.event == event {
+				return ev
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %s", event)
+		}
+	}
+}
+
+func TestSFUForwardsAudioBetweenPeers(t *testing.T) {
+	s, err := NewSFU(Config{IncludeLoopback: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	channelID := uuid.NewString()
+	alice := newTestClient(t, s, channelID)
+	bob := newTestClient(t, s, channelID)
+
+	done := make(chan struct{})
+	defer close(done)
+	alice.publish(done)
+
+	alice.send("rtc:join", joinPayload{ChannelID: channelID})
+	bob.send("rtc:join", joinPayload{ChannelID: channelID})
+
+	bob.waitFor("rtc:peer_joined")
+
+	select {
+	case track := <-bob.tracks:
+		if track.StreamID() != alice.userID.String() {
+			t.Fatalf("stream ID = %s, want %s", track.StreamID(), alice.userID)
+		}
+		if _, _, err := track.ReadRTP(); err != nil {
+			t.Fatalf("failed to read forwarded RTP: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("bob never received alice's track")
+	}
+
+	var speaking struct {
+		UserID   uuid.UUID `json:"userId"`
+		Speaking bool      `json:"speaking"`
+	}
+	if err := json.Unmarshal(bob.waitFor("rtc:speaking").data, &speaking); err != nil {
+		t.Fatal(err)
+	}
+	if speaking.UserID != alice.userID || !speaking.Speaking {
+		t.Fatalf("unexpected speaking event: %+v", speaking)
+	}
+
+	got := s.Participants(channelID)
+	if len(got) != 2 {
+		t.Fatalf("participants = %d, want 2", len(got))
+	}
+}
+
+func TestSFUServerMuteRequiresModerator(t *testing.T) {
+	s, err := NewSFU(Config{IncludeLoopback: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	channelID := uuid.NewString()
+	alice := newTestClient(t, s, channelID)
+	bob := newTestClient(t, s, channelID)
+	s.CanModerate = func(userID uuid.UUID) bool { return userID == bob.userID }
+
+	alice.send("rtc:join", joinPayload{ChannelID: channelID})
+	bob.send("rtc:join", joinPayload{ChannelID: channelID})
+	alice.waitFor("rtc:peer_joined")
+
+	alice.send("rtc:server_mute", mutePayload{ChannelID: channelID, TargetID: bob.userID.String(), Muted: true})
+	select {
+	case ev := <-alice.other:
+		if ev.event != "rtc:error" {
+			t.Fatalf("got %s, want rtc:error", ev.event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected rtc:error for non-moderator")
+	}
+
+	bob.send("rtc:server_mute", mutePayload{ChannelID: channelID, TargetID: alice.userID.String(), Muted: true})
+	var update struct {
+		UserID      uuid.UUID `json:"userId"`
+		ServerMuted bool      `json:"serverMuted"`
+	}
+	if err := json.Unmarshal(alice.waitFor("rtc:mute_update").data, &update); err != nil {
+		t.Fatal(err)
+	}
+	if update.UserID != alice.userID || !update.ServerMuted {
+		t.Fatalf("unexpected mute update: %+v", update)
+	}
+}
@@ -0,0 +1,116 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// chunkSize is how much of a file goes into each INSTREAM chunk.
+const chunkSize = 64 << 10
+
+// ClamAV scans files with a clamd daemon using the INSTREAM command, so
+// clamd needs no access to upload storage. Files larger than clamd's
+// StreamMaxLength fail to scan.
+type ClamAV struct {
+	network string
+	addr    string
+	timeout time.Duration
+}
+
+// NewClamAV connects to clamd at addr: host:port for TCP, or the path of
+// a Unix socket. Each scan must finish within timeout.
+func NewClamAV(addr string, timeout time.Duration) *ClamAV {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+	return &ClamAV{network: network, addr: addr, timeout: timeout}
+}
+
+func (c *ClamAV) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return Result{}, fmt.Errorf("connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The z prefix means commands and replies are NUL-terminated
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, fmt.Errorf("send to clamd: %w", err)
+	}
+	if err := sendChunks(conn, r); err != nil {
+		// clamd hangs up when a stream goes over its limit, leaving the
+		// reason in its reply
+		if reply, rerr := readReply(conn); rerr == nil {
+			return parseReply(reply)
+		}
+		return Result{}, err
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return Result{}, fmt.Errorf("read clamd reply: %w", err)
+	}
+	return parseReply(reply)
+}
+
+// sendChunks streams r as length-prefixed chunks followed by an empty
+// chunk marking the end.
+func sendChunks(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := w.Write(buf[:4+n]); werr != nil {
+				return fmt.Errorf("send to clamd: %w", werr)
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read file: %w", err)
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+func readReply(r io.Reader) (string, error) {
+	reply, err := bufio.NewReader(io.LimitReader(r, 4096)).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+// parseReply reads clamd's verdict: "stream: OK", "stream: <name> FOUND"
+// or "<reason> ERROR".
+func parseReply(reply string) (Result, error) {
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(reply, " FOUND")
+		if i := strings.Index(signature, ": "); i >= 0 {
+			signature = signature[i+2:]
+		}
+		return Result{Infected: true, Signature: signature}, nil
+	case strings.HasSuffix(reply, ": OK"):
+		return Result{}, nil
+	default:
+		return Result{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
@@ -0,0 +1,104 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eicar is the standard antivirus test file.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd accepts INSTREAM scans on a local port and flags any stream
+// containing the EICAR string, or answers with reply if it is set.
+func fakeClamd(t *testing.T, reply string) (addr string, received chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received = make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var data []byte
+				for {
+					var n uint32
+					if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+						return
+					}
+					if n == 0 {
+						break
+					}
+					chunk := make([]byte, n)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				received <- data
+				switch {
+				case reply != "":
+					conn.Write([]byte(reply + "\x00"))
+				case bytes.Contains(data, []byte(eicar)):
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				default:
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestClamAV(t *testing.T) {
+	addr, received := fakeClamd(t, "")
+	scanner := NewClamAV(addr, 5*time.Second)
+
+	// Larger than one chunk, to check reassembly
+	clean := bytes.Repeat([]byte("harmless "), 20000)
+	res, err := scanner.Scan(context.Background(), bytes.NewReader(clean))
+	if err != nil || res.Infected {
+		t.Fatalf("clean file: %+v, %v", res, err)
+	}
+	if got := <-received; !bytes.Equal(got, clean) {
+		t.Fatalf("clamd received %d bytes, want %d", len(got), len(clean))
+	}
+
+	res, err = scanner.Scan(context.Background(), strings.NewReader(eicar))
+	if err != nil || !res.Infected || res.Signature != "Eicar-Test-Signature" {
+		t.Fatalf("eicar: %+v, %v", res, err)
+	}
+}
+
+func TestClamAVErrors(t *testing.T) {
+	addr, _ := fakeClamd(t, "INSTREAM size limit exceeded. ERROR")
+	if _, err := NewClamAV(addr, 5*time.Second).Scan(context.Background(), strings.NewReader("x")); err == nil {
+		t.Error("clamd error reported as a verdict")
+	}
+
+	// Nothing listening
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln.Close()
+	if _, err := NewClamAV(ln.Addr().String(), time.Second).Scan(context.Background(), strings.NewReader("x")); err == nil {
+		t.Error("scan succeeded without clamd")
+	}
+}
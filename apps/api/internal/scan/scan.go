@@ -0,0 +1,24 @@
+// Package scan checks uploaded files for malware before they can be used.
+//
+// One backend is provided: ClamAV, spoken to over the clamd protocol
+// (SCANNER=clamav, CLAMAV_ADDR=host:3310). Without a scanner every upload
+// is usable as soon as it's stored.
+package scan
+
+import (
+	"context"
+	"io"
+)
+
+// Scanner inspects a file's content.
+type Scanner interface {
+	// Scan reads r to the end and reports what it found. An error means
+	// the file couldn't be checked, not that it is infected.
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// Result is a scanner's verdict on one file.
+type Result struct {
+	Infected  bool
+	Signature string // what was found, when Infected
+}
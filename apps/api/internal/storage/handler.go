@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/opencord/api/internal/media"
+)
+
+// Handler serves GET /uploads/* from a Storage. Requests need a valid
+// signature from the Signer unless the object is public. Images accept
+// ?size= to get a resized variant (see media.Sizes).
+type Handler struct {
+	store   Storage
+	signer  *Signer
+	uploads Uploads
+}
+
+// Uploads is what the handler needs to know about the attachments behind
+// stored objects.
+type Uploads interface {
+	// IsPublic decides which objects may be served without a signature.
+	IsPublic(key string) (bool, error)
+	// Filename returns the name key was uploaded under, or "" if it isn't
+	// known. Identical files share a key, so id picks the attachment a
+	// signed URL was issued for; unsigned requests pass "".
+	Filename(key, id string) (string, error)
+}
+
+func NewHandler(store Storage, signer *Signer, uploads Uploads) *Handler {
+	return &Handler{store: store, signer: signer, uploads: uploads}
+}
+
+func (h *Handler) Serve(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "*")
+	// Dot-prefixed keys hold internal objects such as partial uploads
+	if !ValidKey(key) || strings.HasPrefix(key, ".") {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	signed := q.Has("sig")
+	if signed && !h.signer.Verify(key, q.Get("id"), q.Get("expires"), q.Get("sig")) {
+		http.Error(w, "link expired or invalid", http.StatusForbidden)
+		return
+	}
+	if !signed {
+		public, err := h.uploads.IsPublic(key)
+		if err != nil {
+			log.Printf("failed to look up upload %s: %v", key, err)
+			http.Error(w, "failed to read file", http.StatusInternalServerError)
+			return
+		}
+		if !public {
+			http.Error(w, "link expired or invalid", http.StatusForbidden)
+			return
+		}
+	}
+
+	obj, err := h.get(r, key)
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload %s: %v", key, err)
+		http.Error(w, "failed to read file", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Body.Close()
+
+	// User content is served from our origin, so never let the browser
+	// guess a type or run anything in it
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	if !Inline(obj.ContentType) {
+		var id string
+		if signed {
+			id = q.Get("id")
+		}
+		name, err := h.uploads.Filename(key, id)
+		if err != nil {
+			log.Printf("failed to look up upload %s: %v", key, err)
+		}
+		if name == "" {
+			name = path.Base(key)
+		}
+		w.Header().Set("Content-Disposition", contentDisposition(name))
+	}
+
+	// Uploads are immutable: every file gets a fresh random key. Signed
+	// URLs are for the requester only, so keep them out of shared caches.
+	if signed {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	http.ServeContent(w, r, "", obj.LastModified, obj.Body)
+}
+
+// Inline reports whether a content type is safe to display or play in the
+// browser. Everything else, including SVG, HTML and PDF, is served as a
+// download.
+func Inline(contentType string) bool {
+	_, inline := media.Classify(contentType)
+	return inline
+}
+
+// contentDisposition returns an attachment header that saves the download
+// as name (RFC 6266). Browsers that only read filename get an ASCII copy;
+// names outside ASCII are also sent in full as filename* (RFC 8187).
+func contentDisposition(name string) string {
+	var fallback strings.Builder
+	ascii := true
+	for _, c := range name {
+		switch {
+		case c == '"' || c == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(c)
+		case c < 0x20 || c == 0x7f:
+			fallback.WriteByte('_')
+		case c > 0x7f:
+			fallback.WriteByte('_')
+			ascii = false
+		default:
+			fallback.WriteRune(c)
+		}
+	}
+	header := `attachment; filename="` + fallback.String() + `"`
+	if !ascii {
+		header += "; filename*=UTF-8''" + encodeExtValue(name)
+	}
+	return header
+}
+
+// encodeExtValue percent-encodes s as an RFC 8187 value, leaving only
+// attr-char unescaped.
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		}
+	}
+	return b.String()
+}
+
+// get opens the variant named by ?size= if there is one, else the original.
+// Images smaller than a size have no variant at that size.
+func (h *Handler) get(r *http.Request, key string) (*Object, error) {
+	if size := r.URL.Query().Get("size"); size != "" {
+		if vkey, ok := media.VariantKey(key, size); ok {
+			obj, err := h.store.Get(r.Context(), vkey)
+			if !errors.Is(err, ErrNotFound) {
+				return obj, err
+			}
+		}
+	}
+	return h.store.Get(r.Context(), key)
+}
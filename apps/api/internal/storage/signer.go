@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Signer issues and checks expiring /uploads URLs, so attachments are only
+// reachable by someone the API handed a URL to. Public objects, such as
+// avatars and the instance icon, get plain URLs instead.
+//
+// Expiry times are rounded to half the TTL, so a file keeps the same URL
+// across requests for a while and browsers can cache it.
+type Signer struct {
+	baseURL string
+	secret  []byte
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+// NewSigner signs URLs under baseURL/uploads/ with secret. URLs stay valid
+// for at least half of ttl and at most ttl.
+func NewSigner(baseURL string, secret []byte, ttl time.Duration) *Signer {
+	return &Signer{baseURL: baseURL, secret: secret, ttl: ttl, now: time.Now}
+}
+
+// URL returns a signed URL for key. id names the attachment it's for, so
+// downloads are saved under that attachment's filename; it may be empty.
+// Add &size=<name> for a variant.
+func (s *Signer) URL(key, id string) string {
+	expires := s.now().Truncate(s.ttl / 2).Add(s.ttl).Unix()
+	u := s.PublicURL(key) + "?"
+	if id != "" {
+		u += "id=" + url.QueryEscape(id) + "&"
+	}
+	return u + "expires=" + strconv.FormatInt(expires, 10) + "&sig=" + s.sign(key, id, expires)
+}
+
+// PublicURL returns the unsigned URL for key. It only works for public
+// objects.
+func (s *Signer) PublicURL(key string) string {
+	return s.baseURL + "/uploads/" + key
+}
+
+// Verify reports whether sig is a valid, unexpired signature for key and id.
+func (s *Signer) Verify(key, id, expires, sig string) bool {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || s.now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(s.sign(key, id, exp)))
+}
+
+func (s *Signer) sign(key, id string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + id + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
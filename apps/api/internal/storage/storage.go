@@ -0,0 +1,59 @@
+// Package storage abstracts where uploaded files live.
+//
+// Two backends are provided:
+//
+//   - local (default): files under a directory on disk. Fine for a single
+//     API instance; replicas would need a shared volume.
+//   - s3 (STORAGE_BACKEND=s3): any S3-compatible object store such as AWS S3
+//     or MinIO, so several API replicas can share media.
+//
+// Files are always served to clients through the API's /uploads/* route
+// (see Handler), so the backend never needs to be publicly reachable.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("object not found")
+	ErrInvalidKey = errors.New("invalid object key")
+)
+
+// Storage stores objects by key. Keys are slash-separated relative paths
+// such as "3f0c….png" and never contain "..".
+type Storage interface {
+	// Put stores size bytes from r under key, replacing any existing object.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+
+	// Get opens an object. The caller must close the returned body.
+	Get(ctx context.Context, key string) (*Object, error)
+
+	// Delete removes an object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// SignedURL returns a URL granting read access to key until expiry.
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// Object is an open stored object. Body supports seeking so range requests
+// can be served without buffering.
+type Object struct {
+	Body         io.ReadSeekCloser
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// ValidKey reports whether key is a clean relative path.
+func ValidKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	return path.Clean(key) == key && key != "." && !strings.HasPrefix(key, "../") && key != ".."
+}
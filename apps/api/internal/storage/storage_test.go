@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// fakeS3 implements the handful of path-style S3 calls the backend makes.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]bool
+	objects map[string]fakeObject // "bucket/key" -> object
+}
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+	modified    time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{buckets: make(map[string]bool), objects: make(map[string]fakeObject)}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if key == "" {
+		switch r.Method {
+		case http.MethodHead:
+			if !f.buckets[bucket] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodPut:
+			f.buckets[bucket] = true
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+		return
+	}
+	if !f.buckets[bucket] {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	id := bucket + "/" + key
+	switch r.Method {
+	case http.MethodPut:
+		body, err := readPayload(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[id] = fakeObject{data: body, contentType: r.Header.Get("Content-Type"), modified: time.Now()}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, len(body)))
+	case http.MethodGet, http.MethodHead:
+		obj, ok := f.objects[id]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, len(obj.data)))
+		w.Header().Set("Content-Type", obj.contentType)
+		http.ServeContent(w, r, "", obj.modified, bytes.NewReader(obj.data))
+	case http.MethodDelete:
+		delete(f.objects, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// readPayload returns the object bytes, decoding aws-chunked bodies.
+func readPayload(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var out bytes.Buffer
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return out.Bytes(), nil
+		}
+		if _, err := io.CopyN(&out, br, size); err != nil {
+			return nil, err
+		}
+		if _, err := br.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func newTestS3(t *testing.T) *S3Storage {
+	t.Helper()
+	srv := httptest.NewServer(newFakeS3())
+	t.Cleanup(srv.Close)
+
+	s, err := NewS3Storage(S3Config{
+		Endpoint:  strings.TrimPrefix(srv.URL, "http://"),
+		Bucket:    "uploads",
+		AccessKey: "test",
+		SecretKey: "testsecret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnsureBucket(context.Background()); err != nil {
+		t.Fatalf("EnsureBucket: %v", err)
+	}
+	return s
+}
+
+// publicKeys is an Uploads with a fixed set of public keys and no
+// filenames.
+type publicKeys map[string]bool
+
+func (p publicKeys) IsPublic(key string) (bool, error) {
+	return p[key], nil
+}
+
+func (p publicKeys) Filename(key, id string) (string, error) {
+	return "", nil
+}
+
+// filenames is an Uploads whose attachments are named by "key id".
+type filenames map[string]string
+
+func (f filenames) IsPublic(key string) (bool, error) {
+	return true, nil
+}
+
+func (f filenames) Filename(key, id string) (string, error) {
+	return f[key+" "+id], nil
+}
+
+// signedPath is the path and query of a signed URL for key.
+func signedPath(s *Signer, key string) string {
+	return strings.TrimPrefix(s.URL(key, ""), "http://api.test")
+}
+
+func TestBackends(t *testing.T) {
+	local, err := NewLocalStorage(t.TempDir(), "http://api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := map[string]Storage{
+		"local": local,
+		"s3":    newTestS3(t),
+	}
+
+	for name, store := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			content := []byte("\x89PNG fake image bytes")
+
+			if err := store.Put(ctx, "a/b.png", bytes.NewReader(content), int64(len(content)), "image/png"); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			obj, err := store.Get(ctx, "a/b.png")
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			got, err := io.ReadAll(obj.Body)
+			obj.Body.Close()
+			if err != nil || !bytes.Equal(got, content) {
+				t.Fatalf("Get body = %q, %v", got, err)
+			}
+			if obj.Size != int64(len(content)) || obj.ContentType != "image/png" {
+				t.Errorf("Get metadata = %d %q", obj.Size, obj.ContentType)
+			}
+
+			u, err := store.SignedURL(ctx, "a/b.png", time.Minute)
+			if err != nil || !strings.Contains(u, "a/b.png") {
+				t.Errorf("SignedURL = %q, %v", u, err)
+			}
+
+			// Served through the handler, with range support
+			signer := NewSigner("http://api.test", []byte("secret"), time.Hour)
+			r := chi.NewRouter()
+			r.Get("/uploads/*", NewHandler(store, signer, publicKeys{}).Serve)
+			req := httptest.NewRequest(http.MethodGet, signedPath(signer, "a/b.png"), nil)
+			req.Header.Set("Range", "bytes=1-3")
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != http.StatusPartialContent || rec.Body.String() != "PNG" {
+				t.Errorf("range GET = %d %q", rec.Code, rec.Body.String())
+			}
+			if rec.Header().Get("X-Content-Type-Options") != "nosniff" || rec.Header().Get("Content-Disposition") != "" {
+				t.Errorf("image headers = %v", rec.Header())
+			}
+
+			// Anything that isn't a plain image is a download
+			html := []byte("<html><script>alert(1)</script></html>")
+			if err := store.Put(ctx, "page.html", bytes.NewReader(html), int64(len(html)), "text/html"); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			rec = httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signedPath(signer, "page.html"), nil))
+			if !strings.HasPrefix(rec.Header().Get("Content-Disposition"), "attachment") ||
+				rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+				t.Errorf("html headers = %v", rec.Header())
+			}
+
+			if err := store.Delete(ctx, "a/b.png"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if err := store.Delete(ctx, "a/b.png"); err != nil {
+				t.Errorf("Delete missing: %v", err)
+			}
+			if _, err := store.Get(ctx, "a/b.png"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get after delete = %v, want ErrNotFound", err)
+			}
+
+			rec = httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signedPath(signer, "a/b.png"), nil))
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("GET after delete = %d", rec.Code)
+			}
+
+			if err := store.Put(ctx, "../escape.png", bytes.NewReader(nil), 0, "image/png"); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Put ../escape.png = %v, want ErrInvalidKey", err)
+			}
+		})
+	}
+}
+
+func TestSignedURLs(t *testing.T) {
+	store, err := NewLocalStorage(t.TempDir(), "http://api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	// legacy.jpg was stored by the old upload endpoint and has no attachment
+	for _, key := range []string{"private.png", "avatar.png", "legacy.jpg"} {
+		if err := store.Put(ctx, key, strings.NewReader("img"), 3, "image/png"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Unix(1700000000, 0)
+	signer := NewSigner("http://api.test", []byte("secret"), time.Hour)
+	signer.now = func() time.Time { return now }
+	r := chi.NewRouter()
+	r.Get("/uploads/*", NewHandler(store, signer, publicKeys{"avatar.png": true, "legacy.jpg": true}).Serve)
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	valid := signedPath(signer, "private.png")
+	if signedPath(signer, "private.png") != valid {
+		t.Error("URL changes between requests")
+	}
+	if rec := get(valid); rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Cache-Control"), "private") {
+		t.Errorf("signed GET = %d, Cache-Control %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	if rec := get(valid + "&size=small"); rec.Code != http.StatusOK {
+		t.Errorf("signed GET with size = %d", rec.Code)
+	}
+
+	for name, target := range map[string]string{
+		"unsigned":     "/uploads/private.png",
+		"tampered":     strings.Replace(valid, "sig=", "sig=x", 1),
+		"other key":    strings.Replace(valid, "private.png", "avatar.png", 1),
+		"other id":     strings.Replace(valid, "?", "?id=other&", 1),
+		"extended":     strings.Replace(valid, "expires=1", "expires=2", 1),
+		"other secret": signedPath(NewSigner("http://api.test", []byte("guess"), time.Hour), "private.png"),
+	} {
+		if rec := get(target); rec.Code != http.StatusForbidden {
+			t.Errorf("%s GET = %d", name, rec.Code)
+		}
+	}
+
+	if rec := get("/uploads/avatar.png"); rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Cache-Control"), "public") {
+		t.Errorf("public GET = %d, Cache-Control %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	if rec := get("/uploads/legacy.jpg"); rec.Code != http.StatusOK {
+		t.Errorf("legacy upload GET = %d", rec.Code)
+	}
+
+	now = now.Add(time.Hour)
+	if rec := get(valid); rec.Code != http.StatusForbidden {
+		t.Errorf("expired GET = %d", rec.Code)
+	}
+}
+
+func TestDownloadNames(t *testing.T) {
+	store, err := NewLocalStorage(t.TempDir(), "http://api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(context.Background(), "ab/0f3c", strings.NewReader("%PDF"), 4, "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+	signer := NewSigner("http://api.test", []byte("secret"), time.Hour)
+	// Two uploads of the same file share its key
+	uploads := filenames{
+		"ab/0f3c 1": `Q3 "final".pdf`,
+		"ab/0f3c 2": "Résumé 2026.pdf",
+		"ab/0f3c ":  "public.pdf",
+	}
+	r := chi.NewRouter()
+	r.Get("/uploads/*", NewHandler(store, signer, uploads).Serve)
+	disposition := func(target string) string {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d", target, rec.Code)
+		}
+		return rec.Header().Get("Content-Disposition")
+	}
+	signed := func(id string) string {
+		return strings.TrimPrefix(signer.URL("ab/0f3c", id), "http://api.test")
+	}
+
+	for target, want := range map[string]string{
+		signed("1"):        `attachment; filename="Q3 \"final\".pdf"`,
+		signed("2"):        `attachment; filename="R_sum_ 2026.pdf"; filename*=UTF-8''R%C3%A9sum%C3%A9%202026.pdf`,
+		signed("3"):        `attachment; filename="0f3c"`,
+		"/uploads/ab/0f3c": `attachment; filename="public.pdf"`,
+		// An id only counts when it's signed
+		"/uploads/ab/0f3c?id=1": `attachment; filename="public.pdf"`,
+	} {
+		if got := disposition(target); got != want {
+			t.Errorf("GET %s Content-Disposition = %s, want %s", target, got, want)
+		}
+	}
+}
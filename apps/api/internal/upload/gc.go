@@ -0,0 +1,60 @@
+package upload
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/opencord/api/internal/media"
+)
+
+// gcBatchSize bounds how many attachments one delete query removes.
+const gcBatchSize = 100
+
+// StartGCLoop deletes unreferenced uploads every interval: attachments no
+// message claims, or whose message was deleted, once they are older than
+// grace. Avatars and the instance icon are never collected.
+func (h *Handler) StartGCLoop(grace, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n := h.collectGarbage(context.Background(), time.Now().Add(-grace)); n > 0 {
+				log.Printf("deleted %d unreferenced uploads", n)
+			}
+		}
+	}()
+}
+
+// collectGarbage deletes unreferenced attachments uploaded before the
+// cutoff and returns how many were removed. Files are only deleted once no
+// attachment shares them.
+func (h *Handler) collectGarbage(ctx context.Context, before time.Time) int {
+	total := 0
+	for {
+		deleted, orphaned, err := h.attachments.DeleteUnreferenced(before, gcBatchSize)
+		if err != nil {
+			log.Printf("failed to delete unreferenced uploads: %v", err)
+			return total
+		}
+		for _, b := range orphaned {
+			h.deleteAll(ctx, fileKeys(b.StorageKey, b.Variants))
+		}
+		total += deleted
+		if deleted < gcBatchSize {
+			return total
+		}
+	}
+}
+
+// fileKeys lists the stored objects of a blob: the original and its
+// variants.
+func fileKeys(key string, variants []string) []string {
+	keys := []string{key}
+	for _, v := range variants {
+		if vkey, ok := media.VariantKey(key, v); ok {
+			keys = append(keys, vkey)
+		}
+	}
+	return keys
+}
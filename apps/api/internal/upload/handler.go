@@ -1,28 +1,136 @@
 package upload
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/google/uuid"
+	"github.com/opencord/api/internal/attachment"
+	"github.com/opencord/api/internal/auth"
+	"github.com/opencord/api/internal/instance"
+	"github.com/opencord/api/internal/media"
+	"github.com/opencord/api/internal/scan"
+	"github.com/opencord/api/internal/storage"
 )
 
+const (
+	maxFilenameLength = 255
+
+	// maxMemory is how much of a multipart form is buffered in memory;
+	// larger files spill to a temp file
+	maxMemory = 10 << 20
+
+	// multipartOverhead allows for boundaries and part headers on top of
+	// the file itself
+	multipartOverhead = 64 << 10
+)
+
+// Policy decides which categories of files may be uploaded and the largest
+// size for each. Categories missing from Limits are rejected.
+type Policy struct {
+	Limits map[media.Category]int64
+}
+
+// DefaultPolicy accepts every category.
+func DefaultPolicy() Policy {
+	return Policy{Limits: map[media.Category]int64{
+		media.CategoryImage:    10 << 20,
+		media.CategoryVideo:    100 << 20,
+		media.CategoryAudio:    50 << 20,
+		media.CategoryDocument: 25 << 20,
+		media.CategoryArchive:  50 << 20,
+	}}
+}
+
+func (p Policy) maxSize() int64 {
+	var max int64
+	for _, n := range p.Limits {
+		if n > max {
+			max = n
+		}
+	}
+	return max
+}
+
 type Handler struct {
-	uploadPath string
-	baseURL    string
+	store       storage.Storage
+	attachments attachment.Repository
+	instances   instance.Repository
+	policy      Policy
+	signer      *storage.Signer
+	baseURL     string
+	scans       chan struct{} // limits concurrent scans
+
+	// Scanner checks new files before they become usable. Nil makes
+	// uploads ready as soon as they're stored.
+	Scanner scan.Scanner
+
+	// OnScanned is called when a scan moves an attachment out of the
+	// processing state. Wired in main.go to notify the uploader.
+	OnScanned func(a *attachment.Attachment)
+
+	// Pending counts the space promised to unfinished resumable uploads
+	// against the quotas, so several started at once can't exceed them
+	// together. Wired in main.go to the tus upload repository.
+	Pending PendingUsage
+}
+
+// PendingUsage reports the declared lengths of unfinished uploads.
+type PendingUsage interface {
+	// PendingUsage sums the lengths of the user's unfinished uploads and
+	// of everyone's, leaving out the upload except.
+	PendingUsage(userID, except uuid.UUID) (user, total int64, err error)
 }
 
-func NewHandler(uploadPath, baseURL string) *Handler {
-	os.MkdirAll(uploadPath, 0755)
-	return &Handler{uploadPath: uploadPath, baseURL: baseURL}
+func NewHandler(store storage.Storage, attachments attachment.Repository, instances instance.Repository, policy Policy, signer *storage.Signer, baseURL string) *Handler {
+	return &Handler{store: store, attachments: attachments, instances: instances, policy: policy, signer: signer, baseURL: baseURL,
+		scans: make(chan struct{}, maxConcurrentScans)}
 }
 
+// Upload stores a file and records it as a pending attachment, to be
+// referenced from a message via attachmentIds. Its URL is signed and
+// expires. With a scanner configured, the attachment is returned
+// processing, without a URL, and the uploader gets an attachment_update
+// event once the scan is done.
 func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
-	r.ParseMultipartForm(10 << 20) // 10 MB max
+	h.upload(w, r, false)
+}
+
+// UploadPublic stores an image anyone may fetch without a signed URL, for
+// use as an avatar or the instance icon.
+func (h *Handler) UploadPublic(w http.ResponseWriter, r *http.Request) {
+	h.upload(w, r, true)
+}
+
+func (h *Handler) upload(w http.ResponseWriter, r *http.Request, public bool) {
+	userID, ok := auth.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxUploadSize()+multipartOverhead)
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, "file too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeError(w, "invalid multipart form", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
@@ -31,36 +139,304 @@ func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Validate file type
-	ext := strings.ToLower(filepath.Ext(header.Filename))
-	allowed := map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
-	if !allowed[ext] {
-		writeError(w, "unsupported file type", http.StatusBadRequest)
+	// The attachment ID doubles as the storage key
+	a, err := h.save(r.Context(), uuid.New(), userID, header.Filename, file, header.Size, public)
+	if err != nil {
+		writeUploadError(w, err)
 		return
 	}
+	writeJSON(w, a, http.StatusCreated)
+}
 
-	// Generate unique filename
-	filename := fmt.Sprintf("%s%s", uuid.New().String(), ext)
-	dst, err := os.Create(filepath.Join(h.uploadPath, filename))
-	if err != nil {
-		writeError(w, "failed to save file", http.StatusInternalServerError)
+// uploadError rejects an upload with a message for the client.
+type uploadError struct {
+	message string
+	status  int
+}
+
+func (e *uploadError) Error() string { return e.message }
+
+// writeUploadError reports an uploadError as is and anything else as a
+// server failure.
+func writeUploadError(w http.ResponseWriter, err error) {
+	var rejected *uploadError
+	if errors.As(err, &rejected) {
+		writeError(w, rejected.message, rejected.status)
 		return
 	}
-	defer dst.Close()
+	log.Printf("failed to save upload: %v", err)
+	writeError(w, "failed to save file", http.StatusInternalServerError)
+}
 
-	if _, err := io.Copy(dst, file); err != nil {
-		writeError(w, "failed to save file", http.StatusInternalServerError)
-		return
+// checkType validates a file's name and size against the upload policy
+// before any of its content is looked at.
+func (h *Handler) checkType(filename string, size int64) (media.FileType, error) {
+	ft, ok := media.Lookup(strings.ToLower(filepath.Ext(filename)))
+	if !ok {
+		return ft, &uploadError{"unsupported file type", http.StatusBadRequest}
+	}
+	limit, ok := h.policy.Limits[ft.Category]
+	if !ok {
+		return ft, &uploadError{string(ft.Category) + " uploads are not allowed", http.StatusBadRequest}
+	}
+	if max := h.maxUploadSize(); max < limit {
+		limit = max
+	}
+	if size > limit {
+		return ft, &uploadError{"file too large", http.StatusRequestEntityTooLarge}
+	}
+	return ft, nil
+}
+
+// checkQuota rejects an upload of size bytes that would take the user or
+// the instance over its storage quota. Unfinished resumable uploads other
+// than id count as used.
+func (h *Handler) checkQuota(userID, id uuid.UUID, size int64) error {
+	info, err := h.instances.Get()
+	if err != nil {
+		return fmt.Errorf("read storage quotas: %w", err)
+	}
+	if info.UserStorageQuota == nil && info.StorageQuota == nil {
+		return nil
+	}
+	var pendingUser, pendingTotal int64
+	if h.Pending != nil {
+		pendingUser, pendingTotal, err = h.Pending.PendingUsage(userID, id)
+		if err != nil {
+			return fmt.Errorf("read pending uploads: %w", err)
+		}
+	}
+	if info.UserStorageQuota != nil {
+		used, err := h.attachments.UsageByUser(userID)
+		if err != nil {
+			return fmt.Errorf("read storage usage: %w", err)
+		}
+		if used+pendingUser+size > *info.UserStorageQuota {
+			return &uploadError{"storage quota exceeded", http.StatusRequestEntityTooLarge}
+		}
+	}
+	if info.StorageQuota != nil {
+		used, err := h.attachments.TotalUsage()
+		if err != nil {
+			return fmt.Errorf("read storage usage: %w", err)
+		}
+		if used+pendingTotal+size > *info.StorageQuota {
+			return &uploadError{"instance storage is full", http.StatusRequestEntityTooLarge}
+		}
+	}
+	return nil
+}
+
+// file is an upload's content, either a multipart part or an assembled
+// resumable upload.
+type file interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// save checks, processes and stores a complete upload and records it as a
+// pending attachment with the given ID.
+func (h *Handler) save(ctx context.Context, id, userID uuid.UUID, filename string, f file, size int64, public bool) (*attachment.Attachment, error) {
+	ft, err := h.checkType(filename, size)
+	if err != nil {
+		return nil, err
+	}
+	if public && ft.Category != media.CategoryImage {
+		return nil, &uploadError{"only images can be public", http.StatusBadRequest}
+	}
+	if err := h.checkQuota(userID, id, size); err != nil {
+		return nil, err
+	}
+
+	// The extension is only a claim; the bytes decide what the file is
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, &uploadError{"failed to read file", http.StatusBadRequest}
+	}
+	if !ft.Matches(media.Sniff(head[:n])) {
+		return nil, &uploadError{"file content does not match its extension", http.StatusUnsupportedMediaType}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
 	}
 
-	url := fmt.Sprintf("%s/uploads/%s", h.baseURL, filename)
+	key := id.String() + strings.ToLower(filepath.Ext(filename))
+	a := &attachment.Attachment{
+		ID:          id,
+		UploaderID:  userID,
+		Filename:    cleanFilename(filename),
+		ContentType: ft.ContentType,
+		Category:    ft.Category,
+		Inline:      ft.Inline,
+		Public:      public,
+		StorageKey:  key,
+	}
+
+	var body io.ReadSeeker = f
+	var variants []media.Variant
+	if ft.Category == media.CategoryImage {
+		// Images are stored without metadata, along with resized variants
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return nil, &uploadError{"failed to read file", http.StatusBadRequest}
+		}
+		img, err := media.Process(data, ft.ContentType)
+		if errors.Is(err, media.ErrTooLarge) {
+			return nil, &uploadError{"image dimensions too large", http.StatusBadRequest}
+		}
+		if err != nil {
+			return nil, &uploadError{"invalid image", http.StatusBadRequest}
+		}
+		body, size = bytes.NewReader(img.Data), int64(len(img.Data))
+		a.Width, a.Height = &img.Width, &img.Height
+		a.Blurhash = &img.Blurhash
+		variants = img.Variants
+	}
+
+	// Identical content is stored once and shared between attachments
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return nil, &uploadError{"failed to read file", http.StatusBadRequest}
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	a.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	a.Size = size
+	shared, err := h.share(a)
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		return a, nil
+	}
+
+	if ft.Category == media.CategoryAudio || ft.Category == media.CategoryVideo {
+		// Players cope with files whose headers we can't read, so a
+		// missing duration isn't fatal
+		if d, err := media.Duration(f, size, ft.ContentType); err == nil {
+			ms := d.Milliseconds()
+			a.DurationMS = &ms
+		}
+	}
+
+	if err := h.store.Put(ctx, key, body, size, ft.ContentType); err != nil {
+		return nil, fmt.Errorf("store upload: %w", err)
+	}
+	stored := []string{key}
+	for _, v := range variants {
+		vkey, _ := media.VariantKey(key, v.Name)
+		if err := h.store.Put(ctx, vkey, bytes.NewReader(v.Data), int64(len(v.Data)), v.ContentType); err != nil {
+			h.deleteAll(ctx, stored)
+			return nil, fmt.Errorf("store %s variant: %w", v.Name, err)
+		}
+		stored = append(stored, vkey)
+		a.Variants = append(a.Variants, v.Name)
+	}
+
+	// Content nobody has checked yet stays unusable until scanned
+	if h.Scanner != nil {
+		a.Status = attachment.StatusProcessing
+	}
+	if err := h.attachments.Create(a); err != nil {
+		h.deleteAll(ctx, stored)
+		return nil, fmt.Errorf("record attachment: %w", err)
+	}
+	if a.Status == attachment.StatusProcessing {
+		h.scanInBackground(*a)
+	}
+	h.setURL(a)
+	return a, nil
+}
+
+// share points a at an existing blob with the same content, if there is
+// one, and records it. It reports false when the file must be stored.
+func (h *Handler) share(a *attachment.Attachment) (bool, error) {
+	existing, err := h.attachments.FindBySHA256(a.SHA256, a.ContentType, a.Public)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("look up blob: %w", err)
+	}
+
+	shared := *a
+	shared.StorageKey = existing.StorageKey
+	shared.Width, shared.Height = existing.Width, existing.Height
+	shared.Blurhash = existing.Blurhash
+	shared.Variants = existing.Variants
+	shared.DurationMS = existing.DurationMS
+	if err := h.attachments.CreateShared(&shared); errors.Is(err, attachment.ErrBlobGone) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("record attachment: %w", err)
+	}
+	*a = shared
+	h.setURL(a)
+	return true, nil
+}
+
+// setURL fills in where a is served from, if it's ready to be used.
+func (h *Handler) setURL(a *attachment.Attachment) {
+	a.SetURL(h.signer)
+}
+
+// maxUploadSize is the largest file any category accepts, capped by the
+// instance-wide setting.
+func (h *Handler) maxUploadSize() int64 {
+	limit := h.policy.maxSize()
+	info, err := h.instances.Get()
+	if err != nil {
+		log.Printf("failed to read instance upload limit: %v", err)
+		return limit
+	}
+	if info.MaxUploadSize < limit {
+		return info.MaxUploadSize
+	}
+	return limit
+}
+
+func (h *Handler) deleteAll(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := h.store.Delete(ctx, key); err != nil {
+			log.Printf("failed to clean up %s: %v", key, err)
+		}
+	}
+}
+
+// cleanFilename keeps the client's base name for display, trimmed to what
+// the attachments table accepts.
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if runes := []rune(name); len(runes) > maxFilenameLength {
+		ext := []rune(filepath.Ext(name))
+		if len(ext) > 16 {
+			ext = nil
+		}
+		name = string(runes[:maxFilenameLength-len(ext)]) + string(ext)
+	}
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}, status int) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, `{"data":{"url":"%s"}}`, url)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
 }
 
 func writeError(w http.ResponseWriter, message string, status int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	fmt.Fprintf(w, `{"error":"%s"}`, message)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
 }
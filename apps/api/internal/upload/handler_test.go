@@ -0,0 +1,432 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/opencord/api/internal/attachment"
+	"github.com/opencord/api/internal/auth"
+	"github.com/opencord/api/internal/instance"
+	"github.com/opencord/api/internal/media"
+	"github.com/opencord/api/internal/storage"
+)
+
+var testSigner = storage.NewSigner("http://api.test", []byte("secret"), time.Hour)
+
+type memoryAttachments struct {
+	created []*attachment.Attachment
+	blobs   map[string]*attachment.Blob
+}
+
+func (m *memoryAttachments) Create(a *attachment.Attachment) error {
+	if m.blobs == nil {
+		m.blobs = make(map[string]*attachment.Blob)
+	}
+	m.blobs[a.StorageKey] = &attachment.Blob{StorageKey: a.StorageKey, SHA256: a.SHA256, Size: a.Size, Variants: a.Variants, RefCount: 1}
+	if a.Status == "" {
+		a.Status = attachment.StatusReady
+	}
+	a.CreatedAt = time.Now()
+	stored := *a
+	m.created = append(m.created, &stored)
+	return nil
+}
+
+func (m *memoryAttachments) CreateShared(a *attachment.Attachment) error {
+	b, ok := m.blobs[a.StorageKey]
+	if !ok {
+		return attachment.ErrBlobGone
+	}
+	b.RefCount++
+	a.CreatedAt = time.Now()
+	stored := *a
+	m.created = append(m.created, &stored)
+	return nil
+}
+
+func (m *memoryAttachments) FindBySHA256(sha256, contentType string, public bool) (*attachment.Attachment, error) {
+	for _, a := range m.created {
+		if a.SHA256 == sha256 && a.ContentType == contentType && a.Status == attachment.StatusReady && a.Public == public && m.blobs[a.StorageKey] != nil {
+			copied := *a
+			return &copied, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryAttachments) GetByID(id uuid.UUID) (*attachment.Attachment, error) {
+	for _, a := range m.created {
+		if a.ID == id {
+			copied := *a
+			return &copied, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryAttachments) ListByMessages(ids []uuid.UUID) (map[uuid.UUID][]attachment.Attachment, error) {
+	return nil, nil
+}
+
+func (m *memoryAttachments) ListByUploader(uploaderID uuid.UUID) ([]attachment.Attachment, error) {
+	out := []attachment.Attachment{}
+	for _, a := range m.created {
+		if a.UploaderID == uploaderID {
+			out = append(out, *a)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryAttachments) UsageByUser(userID uuid.UUID) (int64, error) {
+	var n int64
+	for _, a := range m.created {
+		if a.UploaderID == userID {
+			n += a.Size
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryAttachments) TotalUsage() (int64, error) {
+	var n int64
+	for _, b := range m.blobs {
+		n += b.Size
+	}
+	return n, nil
+}
+
+func (m *memoryAttachments) ListUsage() ([]attachment.Usage, error) {
+	return nil, nil
+}
+
+func (m *memoryAttachments) DeleteUnreferenced(before time.Time, limit int) (int, []attachment.Blob, error) {
+	var orphaned []attachment.Blob
+	deleted := 0
+	kept := m.created[:0]
+	for _, a := range m.created {
+		if a.MessageID != nil || !a.CreatedAt.Before(before) || a.Status == attachment.StatusQuarantined || deleted == limit {
+			kept = append(kept, a)
+			continue
+		}
+		deleted++
+		if b := m.release(a.StorageKey); b != nil {
+			orphaned = append(orphaned, *b)
+		}
+	}
+	m.created = kept
+	return deleted, orphaned, nil
+}
+
+func (m *memoryAttachments) release(key string) *attachment.Blob {
+	b := m.blobs[key]
+	if b.RefCount--; b.RefCount > 0 {
+		return nil
+	}
+	delete(m.blobs, key)
+	return b
+}
+
+func (m *memoryAttachments) ListByStatus(status string) ([]attachment.Attachment, error) {
+	var out []attachment.Attachment
+	for _, a := range m.created {
+		if a.Status == status {
+			out = append(out, *a)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryAttachments) setStatus(id uuid.UUID, from, to string) (*attachment.Attachment, error) {
+	for _, a := range m.created {
+		if a.ID == id && a.Status == from {
+			a.Status = to
+			copied := *a
+			return &copied, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryAttachments) SetScanResult(id uuid.UUID, status string, signature *string) (*attachment.Attachment, error) {
+	return m.setStatus(id, attachment.StatusProcessing, status)
+}
+
+func (m *memoryAttachments) ListQuarantined() ([]attachment.Quarantined, error) {
+	out := []attachment.Quarantined{}
+	for _, a := range m.created {
+		if a.Status == attachment.StatusQuarantined {
+			out = append(out, attachment.Quarantined{Attachment: *a})
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryAttachments) Release(id uuid.UUID) (*attachment.Attachment, error) {
+	return m.setStatus(id, attachment.StatusQuarantined, attachment.StatusReady)
+}
+
+func (m *memoryAttachments) DeleteQuarantined(id uuid.UUID) (*attachment.Blob, error) {
+	for i, a := range m.created {
+		if a.ID == id && a.Status == attachment.StatusQuarantined {
+			m.created = append(m.created[:i], m.created[i+1:]...)
+			return m.release(a.StorageKey), nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+type fixedInstance struct {
+	info instance.InstanceInfo
+}
+
+func (f fixedInstance) Get() (*instance.InstanceInfo, error) {
+	info := f.info
+	return &info, nil
+}
+
+func (f fixedInstance) Update(req instance.UpdateInstanceRequest) (*instance.InstanceInfo, error) {
+	return f.Get()
+}
+
+// testWAV is one second of 8 kHz 8-bit mono silence.
+func testWAV() []byte {
+	data := make([]byte, 44+8000)
+	copy(data, "RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x01\x00")
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	binary.LittleEndian.PutUint32(data[24:], 8000) // sample rate
+	binary.LittleEndian.PutUint32(data[28:], 8000) // byte rate
+	binary.LittleEndian.PutUint16(data[32:], 1)
+	binary.LittleEndian.PutUint16(data[34:], 8)
+	copy(data[36:], "data")
+	binary.LittleEndian.PutUint32(data[40:], 8000)
+	return data
+}
+
+func uploadRequest(t *testing.T, filename string, content []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req.WithContext(auth.SetUserContext(req.Context(), uuid.New()))
+}
+
+func TestUploadChecksContent(t *testing.T) {
+	store, err := storage.NewLocalStorage(t.TempDir(), "http://api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &memoryAttachments{}
+	policy := DefaultPolicy()
+	delete(policy.Limits, media.CategoryArchive)
+	h := NewHandler(store, repo, fixedInstance{instance.InstanceInfo{MaxUploadSize: 1 << 20}}, policy, testSigner, "http://api.test")
+
+	var pngData bytes.Buffer
+	png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+
+	for _, tc := range []struct {
+		name     string
+		filename string
+		content  []byte
+		status   int
+	}{
+		{"real png", "cat.png", pngData.Bytes(), http.StatusCreated},
+		{"html renamed to png", "cat.png", []byte("<html><script>alert(1)</script></html>"), http.StatusUnsupportedMediaType},
+		{"svg", "cat.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), http.StatusBadRequest},
+		{"png renamed to jpg", "cat.jpg", pngData.Bytes(), http.StatusUnsupportedMediaType},
+		{"too large for the instance", "big.png", make([]byte, 1<<20+multipartOverhead), http.StatusRequestEntityTooLarge},
+		{"text", "notes.txt", []byte("shopping list\n"), http.StatusCreated},
+		{"binary renamed to txt", "notes.txt", []byte{0, 1, 2, 3, 0xff}, http.StatusUnsupportedMediaType},
+		{"audio", "beep.wav", testWAV(), http.StatusCreated},
+		{"disabled category", "files.zip", []byte("PK\x03\x04"), http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.Upload(rec, uploadRequest(t, tc.filename, tc.content))
+			if rec.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tc.status, rec.Body.String())
+			}
+			var body map[string]interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Errorf("response is not JSON: %q", rec.Body.String())
+			}
+		})
+	}
+	if len(repo.created) != 3 {
+		t.Fatalf("created %d attachments, want 3", len(repo.created))
+	}
+	if doc := repo.created[1]; doc.Category != media.CategoryDocument || doc.Inline {
+		t.Errorf("text file classified as %s, inline %v", doc.Category, doc.Inline)
+	}
+	wav := repo.created[2]
+	if wav.DurationMS == nil || *wav.DurationMS != 1000 || !wav.Inline {
+		t.Errorf("wav duration %v, inline %v", wav.DurationMS, wav.Inline)
+	}
+}
+
+func TestUploadQuotaAndGC(t *testing.T) {
+	store, err := storage.NewLocalStorage(t.TempDir(), "http://api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &memoryAttachments{}
+	quota := int64(1000)
+	h := NewHandler(store, repo, fixedInstance{instance.InstanceInfo{MaxUploadSize: 1 << 20, UserStorageQuota: &quota}},
+		DefaultPolicy(), testSigner, "http://api.test")
+
+	userID := uuid.New()
+	upload := func() int {
+		// Each image differs so none are deduplicated
+		img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+		img.Set(0, 0, color.Gray{uint8(len(repo.created))})
+		var pngData bytes.Buffer
+		png.Encode(&pngData, img)
+		req := uploadRequest(t, "cat.png", pngData.Bytes())
+		rec := httptest.NewRecorder()
+		h.Upload(rec, req.WithContext(auth.SetUserContext(req.Context(), userID)))
+		return rec.Code
+	}
+	status := upload()
+	for status == http.StatusCreated && len(repo.created) < 1000 {
+		status = upload()
+	}
+	if status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload over quota = %d", status)
+	}
+	if used, _ := repo.UsageByUser(userID); used > quota {
+		t.Errorf("usage %d exceeds quota %d", used, quota)
+	}
+
+	// Claimed attachments survive; pending ones are collected with their files
+	messageID := uuid.New()
+	repo.created[0].MessageID = &messageID
+	pending := repo.created[1]
+	before := len(repo.created)
+	if n := h.collectGarbage(context.Background(), time.Now().Add(time.Minute)); n != before-1 || len(repo.created) != 1 {
+		t.Errorf("collected %d of %d, %d left", n, before, len(repo.created))
+	}
+	if _, err := store.Get(context.Background(), pending.StorageKey); err != storage.ErrNotFound {
+		t.Errorf("collected file still stored: %v", err)
+	}
+	if _, err := store.Get(context.Background(), repo.created[0].StorageKey); err != nil {
+		t.Errorf("claimed file deleted: %v", err)
+	}
+}
+
+func TestUploadDeduplicates(t *testing.T) {
+	store, err := storage.NewLocalStorage(t.TempDir(), "http://api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &memoryAttachments{}
+	h := NewHandler(store, repo, fixedInstance{instance.InstanceInfo{MaxUploadSize: 1 << 20}}, DefaultPolicy(), testSigner, "http://api.test")
+
+	var pngData bytes.Buffer
+	png.Encode(&pngData, testImage())
+	for _, name := range []string{"meme.png", "meme (1).png", "notes.txt"} {
+		content := pngData.Bytes()
+		if name == "notes.txt" {
+			content = []byte("different content")
+		}
+		rec := httptest.NewRecorder()
+		h.Upload(rec, uploadRequest(t, name, content))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("%s: status %d", name, rec.Code)
+		}
+	}
+
+	first, second := repo.created[0], repo.created[1]
+	if first.ID == second.ID || first.StorageKey != second.StorageKey || second.Filename != "meme (1).png" {
+		t.Fatalf("duplicate not shared: %+v %+v", first, second)
+	}
+	if len(first.Variants) == 0 || len(second.Variants) != len(first.Variants) || second.Width == nil {
+		t.Error("shared attachment lost the image metadata")
+	}
+	if len(repo.blobs) != 2 || repo.blobs[first.StorageKey].RefCount != 2 {
+		t.Errorf("blobs = %d, refcount %d", len(repo.blobs), repo.blobs[first.StorageKey].RefCount)
+	}
+
+	// Deleting one reference keeps the file; deleting the last removes it
+	messageID := uuid.New()
+	first.MessageID = &messageID
+	h.collectGarbage(context.Background(), time.Now().Add(time.Minute))
+	if _, err := store.Get(context.Background(), first.StorageKey); err != nil {
+		t.Fatalf("shared file deleted while referenced: %v", err)
+	}
+	first.MessageID = nil
+	h.collectGarbage(context.Background(), time.Now().Add(time.Minute))
+	for _, key := range []string{first.StorageKey, strings.TrimSuffix(first.StorageKey, ".png") + "_small.png"} {
+		if _, err := store.Get(context.Background(), key); err != storage.ErrNotFound {
+			t.Errorf("%s still stored: %v", key, err)
+		}
+	}
+}
+
+// testImage is noisy enough that resizing it saves space, so it gets a
+// small variant.
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	x := uint32(1)
+	for i := range img.Pix {
+		x = x*1664525 + 1013904223
+		img.Pix[i] = uint8(x >> 24)
+	}
+	return img
+}
+
+func TestUploadPublic(t *testing.T) {
+	store, err := storage.NewLocalStorage(t.TempDir(), "http://api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &memoryAttachments{}
+	h := NewHandler(store, repo, fixedInstance{instance.InstanceInfo{MaxUploadSize: 1 << 20}}, DefaultPolicy(), testSigner, "http://api.test")
+
+	var pngData bytes.Buffer
+	png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	upload := func(handler http.HandlerFunc, filename string, content []byte) (int, attachment.Attachment) {
+		rec := httptest.NewRecorder()
+		handler(rec, uploadRequest(t, filename, content))
+		var body struct{ Data attachment.Attachment }
+		json.NewDecoder(rec.Body).Decode(&body)
+		return rec.Code, body.Data
+	}
+
+	status, private := upload(h.Upload, "cat.png", pngData.Bytes())
+	if status != http.StatusCreated || private.Public || !strings.Contains(private.URL, "&sig=") {
+		t.Fatalf("private upload = %d, public %v, URL %q", status, private.Public, private.URL)
+	}
+	status, public := upload(h.UploadPublic, "avatar.png", pngData.Bytes())
+	if status != http.StatusCreated || !public.Public || public.URL != "http://api.test/uploads/"+repo.created[1].StorageKey {
+		t.Fatalf("public upload = %d, public %v, URL %q", status, public.Public, public.URL)
+	}
+	// Sharing a blob would make the private copy public too
+	if repo.created[0].StorageKey == repo.created[1].StorageKey {
+		t.Error("public upload shares a private blob")
+	}
+
+	if status, _ := upload(h.UploadPublic, "notes.txt", []byte("hello")); status != http.StatusBadRequest {
+		t.Errorf("public text upload = %d", status)
+	}
+}
@@ -0,0 +1,22 @@
+package upload
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Resumable is a tus upload. Its ID becomes the attachment ID once all
+// Length bytes have arrived and the file has been saved.
+type Resumable struct {
+	ID         uuid.UUID
+	UploaderID uuid.UUID
+	Filename   string
+	Length     int64
+	Offset     int64
+	// Chunks are the storage keys of the received byte ranges, in order.
+	Chunks    []string
+	Completed bool
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,122 @@
+package upload
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/opencord/api/internal/attachment"
+	"github.com/opencord/api/internal/auth"
+	"github.com/opencord/api/internal/member"
+)
+
+// QuarantineHandler lets admins review uploads the scanner flagged: list
+// them, release false positives or delete them for good.
+type QuarantineHandler struct {
+	uploads    *Handler
+	memberRepo member.Repository
+}
+
+func NewQuarantineHandler(uploads *Handler, memberRepo member.Repository) *QuarantineHandler {
+	return &QuarantineHandler{uploads: uploads, memberRepo: memberRepo}
+}
+
+// List handles GET /api/upload/quarantine.
+func (q *QuarantineHandler) List(w http.ResponseWriter, r *http.Request) {
+	if !q.isAdmin(r) {
+		writeError(w, "insufficient permissions", http.StatusForbidden)
+		return
+	}
+	flagged, err := q.uploads.attachments.ListQuarantined()
+	if err != nil {
+		writeError(w, "failed to list quarantined uploads", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, flagged, http.StatusOK)
+}
+
+// Release handles POST /api/upload/quarantine/{id}/release: the file is
+// restored and becomes ready, and the uploader is notified.
+func (q *QuarantineHandler) Release(w http.ResponseWriter, r *http.Request) {
+	a, ok := q.load(w, r)
+	if !ok {
+		return
+	}
+	h := q.uploads
+	if err := h.moveAll(r.Context(), fileKeys(a.StorageKey, a.Variants), quarantinePrefix, ""); err != nil {
+		log.Printf("failed to restore upload %s: %v", a.ID, err)
+		writeError(w, "failed to release upload", http.StatusInternalServerError)
+		return
+	}
+	released, err := h.attachments.Release(a.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, "failed to release upload", http.StatusInternalServerError)
+		return
+	}
+	h.setURL(released)
+	if h.OnScanned != nil {
+		h.OnScanned(released)
+	}
+	writeJSON(w, released, http.StatusOK)
+}
+
+// Delete handles DELETE /api/upload/quarantine/{id}.
+func (q *QuarantineHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	a, ok := q.load(w, r)
+	if !ok {
+		return
+	}
+	blob, err := q.uploads.attachments.DeleteQuarantined(a.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, "failed to delete upload", http.StatusInternalServerError)
+		return
+	}
+	if blob != nil {
+		keys := fileKeys(blob.StorageKey, blob.Variants)
+		for i := range keys {
+			keys[i] = quarantinePrefix + keys[i]
+		}
+		q.uploads.deleteAll(r.Context(), keys)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// load checks the caller is an admin and fetches the quarantined
+// attachment named in the URL.
+func (q *QuarantineHandler) load(w http.ResponseWriter, r *http.Request) (*attachment.Attachment, bool) {
+	if !q.isAdmin(r) {
+		writeError(w, "insufficient permissions", http.StatusForbidden)
+		return nil, false
+	}
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, "invalid upload ID", http.StatusBadRequest)
+		return nil, false
+	}
+	a, err := q.uploads.attachments.GetByID(id)
+	if err != nil || a.Status != attachment.StatusQuarantined {
+		writeError(w, "upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	return a, true
+}
+
+func (q *QuarantineHandler) isAdmin(r *http.Request) bool {
+	userID, ok := auth.UserFromContext(r.Context())
+	if !ok {
+		return false
+	}
+	caller, err := q.memberRepo.GetByUserID(userID)
+	return err == nil && (caller.Role == "admin" || caller.Role == "owner")
+}
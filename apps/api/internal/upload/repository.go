@@ -0,0 +1,120 @@
+package upload
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ErrOffsetConflict means another request appended to the upload first.
+var ErrOffsetConflict = errors.New("upload offset conflict")
+
+type Repository interface {
+	Create(u *Resumable) error
+	GetByID(id uuid.UUID) (*Resumable, error)
+	// AppendChunk records n bytes stored under key at offset, provided
+	// nothing else was appended since the caller read the upload.
+	AppendChunk(id uuid.UUID, offset, n int64, key string, expiresAt time.Time) (*Resumable, error)
+	MarkCompleted(id uuid.UUID) error
+	Delete(id uuid.UUID) error
+	ListExpired(now time.Time) ([]Resumable, error)
+	PendingUsage
+}
+
+const columns = `id, uploader_id, filename, length, received, chunks, completed, expires_at, created_at`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanResumable(row scanner, u *Resumable) error {
+	return row.Scan(&u.ID, &u.UploaderID, &u.Filename, &u.Length, &u.Offset,
+		(*pq.StringArray)(&u.Chunks), &u.Completed, &u.ExpiresAt, &u.CreatedAt)
+}
+
+type PostgresRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresRepository(db *sql.DB) *PostgresRepository {
+	return &PostgresRepository{db: db}
+}
+
+func (r *PostgresRepository) Create(u *Resumable) error {
+	return r.db.QueryRow(
+		`INSERT INTO resumable_uploads (id, uploader_id, filename, length, expires_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING created_at`,
+		u.ID, u.UploaderID, u.Filename, u.Length, u.ExpiresAt,
+	).Scan(&u.CreatedAt)
+}
+
+func (r *PostgresRepository) GetByID(id uuid.UUID) (*Resumable, error) {
+	u := &Resumable{}
+	if err := scanResumable(r.db.QueryRow(`SELECT `+columns+` FROM resumable_uploads WHERE id = $1`, id), u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (r *PostgresRepository) AppendChunk(id uuid.UUID, offset, n int64, key string, expiresAt time.Time) (*Resumable, error) {
+	u := &Resumable{}
+	err := scanResumable(r.db.QueryRow(
+		`UPDATE resumable_uploads
+		 SET received = received + $3, chunks = array_append(chunks, $4), expires_at = $5
+		 WHERE id = $1 AND received = $2 AND received + $3 <= length AND NOT completed
+		 RETURNING `+columns,
+		id, offset, n, key, expiresAt,
+	), u)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOffsetConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (r *PostgresRepository) MarkCompleted(id uuid.UUID) error {
+	_, err := r.db.Exec(`UPDATE resumable_uploads SET completed = TRUE, chunks = '{}' WHERE id = $1`, id)
+	return err
+}
+
+func (r *PostgresRepository) Delete(id uuid.UUID) error {
+	_, err := r.db.Exec(`DELETE FROM resumable_uploads WHERE id = $1`, id)
+	return err
+}
+
+// PendingUsage counts uploads that haven't completed or expired.
+func (r *PostgresRepository) PendingUsage(userID, except uuid.UUID) (int64, int64, error) {
+	var user, total int64
+	err := r.db.QueryRow(
+		`SELECT COALESCE(SUM(length) FILTER (WHERE uploader_id = $1), 0), COALESCE(SUM(length), 0)
+		 FROM resumable_uploads
+		 WHERE NOT completed AND expires_at > NOW() AND id <> $2`,
+		userID, except,
+	).Scan(&user, &total)
+	return user, total, err
+}
+
+// ListExpired returns uploads whose expiry has passed, completed or not.
+func (r *PostgresRepository) ListExpired(now time.Time) ([]Resumable, error) {
+	rows, err := r.db.Query(`SELECT `+columns+` FROM resumable_uploads WHERE expires_at < $1`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Resumable
+	for rows.Next() {
+		var u Resumable
+		if err := scanResumable(rows, &u); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
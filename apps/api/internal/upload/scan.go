@@ -0,0 +1,132 @@
+package upload
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/opencord/api/internal/attachment"
+	"github.com/opencord/api/internal/scan"
+)
+
+const (
+	// maxConcurrentScans bounds how many files are being scanned at once.
+	maxConcurrentScans = 4
+
+	// scanAttempts is how many times a file is offered to the scanner
+	// before it's marked failed.
+	scanAttempts = 3
+
+	// quarantinePrefix is where flagged files are moved. Like every
+	// dot-prefixed key, it isn't served by the /uploads route.
+	quarantinePrefix = ".quarantine/"
+)
+
+// scanRetryDelay is the wait before the second attempt; it doubles after
+// each failure.
+var scanRetryDelay = 5 * time.Second
+
+// ResumeScans scans attachments left processing by a restart. Without a
+// scanner they're made ready.
+func (h *Handler) ResumeScans() {
+	pending, err := h.attachments.ListByStatus(attachment.StatusProcessing)
+	if err != nil {
+		log.Printf("failed to list unscanned uploads: %v", err)
+		return
+	}
+	for _, a := range pending {
+		h.scanInBackground(a)
+	}
+}
+
+func (h *Handler) scanInBackground(a attachment.Attachment) {
+	go func() {
+		h.scans <- struct{}{}
+		defer func() { <-h.scans }()
+		h.scan(context.Background(), &a)
+	}()
+}
+
+// scan decides whether a processing attachment becomes ready or is
+// quarantined. A file that can't be scanned is marked failed rather than
+// let through; the uploader can try again.
+func (h *Handler) scan(ctx context.Context, a *attachment.Attachment) {
+	status := attachment.StatusReady
+	var signature *string
+	if h.Scanner != nil {
+		res, err := h.scanFile(ctx, a.StorageKey)
+		switch {
+		case err != nil:
+			log.Printf("failed to scan upload %s: %v", a.ID, err)
+			status = attachment.StatusFailed
+		case res.Infected:
+			log.Printf("upload %s quarantined: %s", a.ID, res.Signature)
+			if err := h.moveAll(ctx, fileKeys(a.StorageKey, a.Variants), "", quarantinePrefix); err != nil {
+				// Stay processing, so the file has no URL and can't be
+				// sent, rather than claim it's locked away
+				log.Printf("failed to quarantine upload %s: %v", a.ID, err)
+				return
+			}
+			status, signature = attachment.StatusQuarantined, &res.Signature
+		}
+	}
+
+	updated, err := h.attachments.SetScanResult(a.ID, status, signature)
+	if errors.Is(err, sql.ErrNoRows) {
+		return // deleted while it was being scanned
+	}
+	if err != nil {
+		log.Printf("failed to record scan of upload %s: %v", a.ID, err)
+		return
+	}
+	h.setURL(updated)
+	if h.OnScanned != nil {
+		h.OnScanned(updated)
+	}
+}
+
+// scanFile runs the scanner over a stored object, retrying errors with
+// backoff.
+func (h *Handler) scanFile(ctx context.Context, key string) (scan.Result, error) {
+	delay := scanRetryDelay
+	for attempt := 1; ; attempt++ {
+		res, err := h.scanObject(ctx, key)
+		if err == nil || attempt == scanAttempts {
+			return res, err
+		}
+		log.Printf("scan of %s failed (attempt %d): %v", key, attempt, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (h *Handler) scanObject(ctx context.Context, key string) (scan.Result, error) {
+	obj, err := h.store.Get(ctx, key)
+	if err != nil {
+		return scan.Result{}, fmt.Errorf("open file: %w", err)
+	}
+	defer obj.Body.Close()
+	return h.Scanner.Scan(ctx, obj.Body)
+}
+
+// moveAll moves stored objects from one key prefix to another.
+func (h *Handler) moveAll(ctx context.Context, keys []string, from, to string) error {
+	for _, key := range keys {
+		obj, err := h.store.Get(ctx, from+key)
+		if err != nil {
+			return err
+		}
+		err = h.store.Put(ctx, to+key, obj.Body, obj.Size, obj.ContentType)
+		obj.Body.Close()
+		if err != nil {
+			return err
+		}
+		if err := h.store.Delete(ctx, from+key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/opencord/api/internal/attachment"
+	"github.com/opencord/api/internal/auth"
+	"github.com/opencord/api/internal/instance"
+	"github.com/opencord/api/internal/member"
+	"github.com/opencord/api/internal/scan"
+	"github.com/opencord/api/internal/storage"
+)
+
+// fakeScanner flags files containing "VIRUS" and fails on "BROKEN".
+type fakeScanner struct{}
+
+func (fakeScanner) Scan(ctx context.Context, r io.Reader) (scan.Result, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return scan.Result{}, err
+	}
+	if bytes.Contains(data, []byte("BROKEN")) {
+		return scan.Result{}, errors.New("scanner unavailable")
+	}
+	if bytes.Contains(data, []byte("VIRUS")) {
+		return scan.Result{Infected: true, Signature: "Test-Signature"}, nil
+	}
+	return scan.Result{}, nil
+}
+
+type adminMembers struct {
+	member.Repository
+	admin uuid.UUID
+}
+
+func (m adminMembers) GetByUserID(userID uuid.UUID) (*member.Member, error) {
+	role := "member"
+	if userID == m.admin {
+		role = "admin"
+	}
+	return &member.Member{UserID: userID, Role: role}, nil
+}
+
+func TestUploadScanning(t *testing.T) {
+	store, err := storage.NewLocalStorage(t.TempDir(), "http://api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &memoryAttachments{}
+	h := NewHandler(store, repo, fixedInstance{instance.InstanceInfo{MaxUploadSize: 1 << 20}}, DefaultPolicy(), testSigner, "http://api.test")
+	h.Scanner = fakeScanner{}
+	scanned := make(chan *attachment.Attachment, 1)
+	h.OnScanned = func(a *attachment.Attachment) { scanned <- a }
+	scanRetryDelay = time.Millisecond
+
+	upload := func(content string) (*attachment.Attachment, *attachment.Attachment) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.Upload(rec, uploadRequest(t, "notes.txt", []byte(content)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("upload = %d", rec.Code)
+		}
+		var body struct{ Data attachment.Attachment }
+		json.NewDecoder(rec.Body).Decode(&body)
+		if body.Data.Status != attachment.StatusProcessing || body.Data.URL != "" {
+			t.Fatalf("new upload is %s with URL %q", body.Data.Status, body.Data.URL)
+		}
+		select {
+		case a := <-scanned:
+			return &body.Data, a
+		case <-time.After(5 * time.Second):
+			t.Fatal("scan never finished")
+			return nil, nil
+		}
+	}
+
+	if _, a := upload("hello"); a.Status != attachment.StatusReady || a.URL == "" {
+		t.Errorf("clean file is %s with URL %q", a.Status, a.URL)
+	}
+	if _, a := upload("BROKEN"); a.Status != attachment.StatusFailed || a.URL != "" {
+		t.Errorf("unscannable file is %s with URL %q", a.Status, a.URL)
+	}
+
+	_, flagged := upload("VIRUS")
+	if flagged.Status != attachment.StatusQuarantined || flagged.URL != "" {
+		t.Fatalf("infected file is %s with URL %q", flagged.Status, flagged.URL)
+	}
+	if _, err := store.Get(context.Background(), flagged.StorageKey); err != storage.ErrNotFound {
+		t.Errorf("infected file still servable: %v", err)
+	}
+
+	// Quarantined files survive garbage collection until an admin decides
+	h.collectGarbage(context.Background(), time.Now().Add(time.Minute))
+	if _, err := repo.GetByID(flagged.ID); err != nil {
+		t.Fatalf("quarantined upload collected: %v", err)
+	}
+
+	adminID := uuid.New()
+	q := NewQuarantineHandler(h, adminMembers{admin: adminID})
+	review := func(method, path string, handler http.HandlerFunc, userID uuid.UUID, id uuid.UUID) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", id.String())
+		ctx := context.WithValue(auth.SetUserContext(req.Context(), userID), chi.RouteCtxKey, rctx)
+		rec := httptest.NewRecorder()
+		handler(rec, req.WithContext(ctx))
+		return rec
+	}
+
+	if rec := review(http.MethodGet, "/api/upload/quarantine", q.List, uuid.New(), uuid.Nil); rec.Code != http.StatusForbidden {
+		t.Errorf("non-admin list = %d", rec.Code)
+	}
+	rec := review(http.MethodGet, "/api/upload/quarantine", q.List, adminID, uuid.Nil)
+	var list struct{ Data []attachment.Quarantined }
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list.Data) != 1 || list.Data[0].ID != flagged.ID {
+		t.Fatalf("quarantine list = %+v", list.Data)
+	}
+
+	rec = review(http.MethodPost, "/api/upload/quarantine/x/release", q.Release, adminID, flagged.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("release = %d: %s", rec.Code, rec.Body)
+	}
+	if a := <-scanned; a.Status != attachment.StatusReady || a.URL == "" {
+		t.Errorf("released file is %s with URL %q", a.Status, a.URL)
+	}
+	if _, err := store.Get(context.Background(), flagged.StorageKey); err != nil {
+		t.Errorf("released file not restored: %v", err)
+	}
+
+	_, flagged = upload("VIRUS again")
+	if rec := review(http.MethodDelete, "/api/upload/quarantine/x", q.Delete, adminID, flagged.ID); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d", rec.Code)
+	}
+	if _, err := store.Get(context.Background(), quarantinePrefix+flagged.StorageKey); err != storage.ErrNotFound {
+		t.Errorf("deleted file still in quarantine: %v", err)
+	}
+}
@@ -0,0 +1,443 @@
+package upload
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/opencord/api/internal/auth"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+
+	// tusExpiry is how long an upload may sit without progress before
+	// its chunks are removed
+	tusExpiry = 24 * time.Hour
+
+	// tusChunkPrefix keeps partial uploads apart from servable files
+	tusChunkPrefix = ".tus/"
+
+	// tusMinChunkSize bounds how many chunks an upload can be split into.
+	// Only the chunk that finishes an upload may be smaller.
+	tusMinChunkSize = 1 << 20
+)
+
+// errChunkTooSmall rejects a PATCH that would store a tiny chunk.
+var errChunkTooSmall = errors.New("chunk too small")
+
+// TusHandler implements the tus 1.0 resumable upload protocol
+// (https://tus.io/protocols/resumable-upload) under /api/upload/tus.
+// Each PATCH is stored as a chunk in upload storage, so an upload survives
+// restarts and can continue on another replica. Once every byte has
+// arrived the chunks are assembled and saved exactly like a multipart
+// upload; GET on the upload URL then returns the attachment.
+type TusHandler struct {
+	uploads      *Handler
+	repo         Repository
+	minChunkSize int64
+}
+
+func NewTusHandler(uploads *Handler, repo Repository) *TusHandler {
+	return &TusHandler{uploads: uploads, repo: repo, minChunkSize: tusMinChunkSize}
+}
+
+// Options advertises the protocol version, extensions and size limit.
+func (t *TusHandler) Options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(t.uploads.maxUploadSize(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create starts an upload from Upload-Length and the filename in
+// Upload-Metadata, rejecting types and sizes the policy won't accept
+// before any data is sent.
+func (t *TusHandler) Create(w http.ResponseWriter, r *http.Request) {
+	userID, ok := t.begin(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeError(w, "Upload-Defer-Length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length == 0 {
+		writeError(w, "file is empty", http.StatusBadRequest)
+		return
+	}
+	meta, err := parseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, "invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	filename := meta["filename"]
+	if filename == "" {
+		writeError(w, "filename metadata is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := t.uploads.checkType(filename, length); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	id := uuid.New()
+	if err := t.uploads.checkQuota(userID, id, length); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	u := &Resumable{
+		ID:         id,
+		UploaderID: userID,
+		Filename:   cleanFilename(filename),
+		Length:     length,
+		ExpiresAt:  time.Now().Add(tusExpiry),
+	}
+	if err := t.repo.Create(u); err != nil {
+		log.Printf("failed to create resumable upload: %v", err)
+		writeError(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", t.uploads.baseURL+"/api/upload/tus/"+u.ID.String())
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Head reports how many bytes have been received.
+func (t *TusHandler) Head(w http.ResponseWriter, r *http.Request) {
+	userID, ok := t.begin(w, r)
+	if !ok {
+		return
+	}
+	u, ok := t.load(w, r, userID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Patch appends the request body at Upload-Offset. Every chunk but the
+// last must be at least minChunkSize bytes. A connection that drops
+// mid-chunk keeps whatever arrived if that's enough, so the client resumes
+// from there. The final chunk saves the file; an empty PATCH at the full
+// length retries a save that failed.
+func (t *TusHandler) Patch(w http.ResponseWriter, r *http.Request) {
+	userID, ok := t.begin(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	u, ok := t.load(w, r, userID)
+	if !ok {
+		return
+	}
+	if u.Completed || offset != u.Offset {
+		writeError(w, "Upload-Offset does not match the upload", http.StatusConflict)
+		return
+	}
+
+	if u.Offset < u.Length {
+		u, err = t.receive(w, r, u)
+		if errors.Is(err, ErrOffsetConflict) {
+			writeError(w, "Upload-Offset does not match the upload", http.StatusConflict)
+			return
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, "chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, errChunkTooSmall) {
+			writeError(w, fmt.Sprintf("chunks before the last must be at least %d bytes", t.minChunkSize), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("failed to store upload chunk: %v", err)
+			writeError(w, "failed to store chunk", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if u.Offset == u.Length {
+		if err := t.complete(r.Context(), u); err != nil {
+			writeUploadError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Get returns the attachment of a completed upload.
+func (t *TusHandler) Get(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	u, ok := t.load(w, r, userID)
+	if !ok {
+		return
+	}
+	if !u.Completed {
+		writeError(w, "upload is not complete", http.StatusConflict)
+		return
+	}
+	a, err := t.uploads.attachments.GetByID(u.ID)
+	if err != nil {
+		writeError(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	t.uploads.setURL(a)
+	writeJSON(w, a, http.StatusOK)
+}
+
+// Delete abandons an upload and removes its chunks. A completed upload's
+// attachment is left alone.
+func (t *TusHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	userID, ok := t.begin(w, r)
+	if !ok {
+		return
+	}
+	u, ok := t.load(w, r, userID)
+	if !ok {
+		return
+	}
+	t.remove(r.Context(), u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StartCleanupLoop removes expired uploads every interval.
+func (t *TusHandler) StartCleanupLoop(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			t.cleanup(context.Background(), time.Now())
+		}
+	}()
+}
+
+func (t *TusHandler) cleanup(ctx context.Context, now time.Time) {
+	expired, err := t.repo.ListExpired(now)
+	if err != nil {
+		log.Printf("failed to list expired uploads: %v", err)
+		return
+	}
+	for i := range expired {
+		t.remove(ctx, &expired[i])
+	}
+}
+
+// begin authenticates a tus request and checks its protocol version.
+func (t *TusHandler) begin(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return uuid.UUID{}, false
+	}
+	userID, ok := auth.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return uuid.UUID{}, false
+	}
+	return userID, true
+}
+
+// load fetches the caller's upload named in the URL. Other users' uploads
+// are reported as missing.
+func (t *TusHandler) load(w http.ResponseWriter, r *http.Request, userID uuid.UUID) (*Resumable, bool) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, "upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	u, err := t.repo.GetByID(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && u.UploaderID != userID) {
+		writeError(w, "upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("failed to load upload %s: %v", id, err)
+		writeError(w, "failed to load upload", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !u.Completed && time.Now().After(u.ExpiresAt) {
+		writeError(w, "upload expired", http.StatusGone)
+		return nil, false
+	}
+	return u, true
+}
+
+// receive stores the request body as the next chunk. The body is spooled
+// to disk first so a dropped connection still leaves a complete chunk of
+// everything that arrived.
+func (t *TusHandler) receive(w http.ResponseWriter, r *http.Request, u *Resumable) (*Resumable, error) {
+	tmp, err := os.CreateTemp("", "opencord-tus-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	body := http.MaxBytesReader(w, r.Body, u.Length-u.Offset)
+	n, copyErr := io.Copy(tmp, body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(copyErr, &tooLarge) {
+		return nil, copyErr
+	}
+	if copyErr != nil {
+		log.Printf("upload %s: chunk interrupted after %d bytes: %v", u.ID, n, copyErr)
+	}
+	if n == 0 {
+		return u, nil
+	}
+	if n < t.minChunkSize && u.Offset+n < u.Length {
+		if copyErr != nil {
+			// Too little to keep; the client resends it
+			return u, nil
+		}
+		return nil, errChunkTooSmall
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%s%s/%020d-%s", tusChunkPrefix, u.ID, u.Offset, uuid.NewString()[:8])
+	ctx := r.Context()
+	if copyErr != nil {
+		// The client is gone; the chunk is still worth keeping
+		ctx = context.WithoutCancel(ctx)
+	}
+	if err := t.uploads.store.Put(ctx, key, tmp, n, "application/octet-stream"); err != nil {
+		return nil, err
+	}
+	updated, err := t.repo.AppendChunk(u.ID, u.Offset, n, key, time.Now().Add(tusExpiry))
+	if err != nil {
+		t.uploads.deleteAll(ctx, []string{key})
+		return nil, err
+	}
+	return updated, nil
+}
+
+// complete assembles the chunks and saves the file as an attachment with
+// the upload's ID. Files the policy rejects are discarded; storage errors
+// leave the chunks for a retry. A retry after the file was saved only
+// marks the upload completed.
+func (t *TusHandler) complete(ctx context.Context, u *Resumable) error {
+	_, err := t.uploads.attachments.GetByID(u.ID)
+	if err == nil {
+		return t.finish(ctx, u)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	tmp, err := os.CreateTemp("", "opencord-tus-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	for _, key := range u.Chunks {
+		obj, err := t.uploads.store.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("read chunk %s: %w", key, err)
+		}
+		_, err = io.Copy(tmp, obj.Body)
+		obj.Body.Close()
+		if err != nil {
+			return fmt.Errorf("read chunk %s: %w", key, err)
+		}
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := t.uploads.save(ctx, u.ID, u.UploaderID, u.Filename, tmp, u.Length, false); err != nil {
+		var rejected *uploadError
+		if errors.As(err, &rejected) {
+			t.remove(ctx, u)
+		}
+		return err
+	}
+	return t.finish(ctx, u)
+}
+
+// finish marks a saved upload completed and removes its chunks.
+func (t *TusHandler) finish(ctx context.Context, u *Resumable) error {
+	if err := t.repo.MarkCompleted(u.ID); err != nil {
+		return fmt.Errorf("mark upload %s completed: %w", u.ID, err)
+	}
+	t.uploads.deleteAll(ctx, u.Chunks)
+	u.Completed = true
+	return nil
+}
+
+func (t *TusHandler) remove(ctx context.Context, u *Resumable) {
+	if err := t.repo.Delete(u.ID); err != nil {
+		log.Printf("failed to delete upload %s: %v", u.ID, err)
+		return
+	}
+	if !u.Completed {
+		t.uploads.deleteAll(ctx, u.Chunks)
+	}
+}
+
+// parseMetadata decodes Upload-Metadata: comma-separated pairs of a key
+// and an optional base64 value.
+func parseMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
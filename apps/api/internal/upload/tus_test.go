@@ -0,0 +1,342 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/opencord/api/internal/auth"
+	"github.com/opencord/api/internal/instance"
+	"github.com/opencord/api/internal/storage"
+)
+
+type memoryResumables struct {
+	mu      sync.Mutex
+	uploads map[uuid.UUID]Resumable
+	// failComplete makes MarkCompleted fail, like a dropped database
+	failComplete bool
+}
+
+func (m *memoryResumables) Create(u *Resumable) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u.CreatedAt = time.Now()
+	m.uploads[u.ID] = *u
+	return nil
+}
+
+func (m *memoryResumables) GetByID(id uuid.UUID) (*Resumable, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.uploads[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	u.Chunks = append([]string(nil), u.Chunks...)
+	return &u, nil
+}
+
+func (m *memoryResumables) AppendChunk(id uuid.UUID, offset, n int64, key string, expiresAt time.Time) (*Resumable, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.uploads[id]
+	if !ok || u.Offset != offset || u.Completed || offset+n > u.Length {
+		return nil, ErrOffsetConflict
+	}
+	u.Offset += n
+	u.Chunks = append(append([]string(nil), u.Chunks...), key)
+	u.ExpiresAt = expiresAt
+	m.uploads[id] = u
+	return &u, nil
+}
+
+func (m *memoryResumables) MarkCompleted(id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failComplete {
+		return errors.New("connection refused")
+	}
+	u := m.uploads[id]
+	u.Completed, u.Chunks = true, nil
+	m.uploads[id] = u
+	return nil
+}
+
+func (m *memoryResumables) Delete(id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.uploads, id)
+	return nil
+}
+
+func (m *memoryResumables) ListExpired(now time.Time) ([]Resumable, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []Resumable
+	for _, u := range m.uploads {
+		if u.ExpiresAt.Before(now) {
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryResumables) PendingUsage(userID, except uuid.UUID) (int64, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var user, total int64
+	for _, u := range m.uploads {
+		if u.Completed || u.ID == except {
+			continue
+		}
+		if u.UploaderID == userID {
+			user += u.Length
+		}
+		total += u.Length
+	}
+	return user, total, nil
+}
+
+type tusTest struct {
+	t       *testing.T
+	router  chi.Router
+	userID  uuid.UUID
+	store   *storage.LocalStorage
+	repo    *memoryResumables
+	handler *TusHandler
+}
+
+func newTusTest(t *testing.T) *tusTest {
+	store, err := storage.NewLocalStorage(t.TempDir(), "http://api.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads := NewHandler(store, &memoryAttachments{}, fixedInstance{instance.InstanceInfo{MaxUploadSize: 1 << 20}}, DefaultPolicy(), testSigner, "http://api.test")
+	repo := &memoryResumables{uploads: make(map[uuid.UUID]Resumable)}
+	uploads.Pending = repo
+	tus := NewTusHandler(uploads, repo)
+	tus.minChunkSize = 500
+
+	r := chi.NewRouter()
+	r.Options("/api/upload/tus", tus.Options)
+	r.Post("/api/upload/tus", tus.Create)
+	r.Head("/api/upload/tus/{id}", tus.Head)
+	r.Patch("/api/upload/tus/{id}", tus.Patch)
+	r.Get("/api/upload/tus/{id}", tus.Get)
+	r.Delete("/api/upload/tus/{id}", tus.Delete)
+	return &tusTest{t: t, router: r, userID: uuid.New(), store: store, repo: repo, handler: tus}
+}
+
+func (tt *tusTest) do(method, target string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req = req.WithContext(auth.SetUserContext(req.Context(), tt.userID))
+	rec := httptest.NewRecorder()
+	tt.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func (tt *tusTest) create(filename string, length int) string {
+	rec := tt.do(http.MethodPost, "/api/upload/tus", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(filename)),
+	})
+	if rec.Code != http.StatusCreated {
+		tt.t.Fatalf("create = %d: %s", rec.Code, rec.Body.String())
+	}
+	return strings.TrimPrefix(rec.Header().Get("Location"), "http://api.test")
+}
+
+func (tt *tusTest) patch(loc string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	return tt.do(http.MethodPatch, loc, bytes.NewReader(chunk), map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	})
+}
+
+// failingReader returns its data, then an error, like a dropped connection.
+type failingReader struct {
+	data []byte
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestTusResumesAfterInterruption(t *testing.T) {
+	tt := newTusTest(t)
+	content := testWAV()
+	loc := tt.create("beep.wav", len(content))
+
+	// First chunk arrives whole
+	if rec := tt.patch(loc, 0, content[:1000]); rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "1000" {
+		t.Fatalf("patch 1 = %d offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+
+	// Second chunk drops after 500 bytes
+	tt.do(http.MethodPatch, loc, &failingReader{data: content[1000:1500]}, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "1000",
+	})
+
+	rec := tt.do(http.MethodHead, loc, nil, nil)
+	if rec.Header().Get("Upload-Offset") != "1500" || rec.Header().Get("Upload-Length") != strconv.Itoa(len(content)) {
+		t.Fatalf("HEAD offset %q length %q", rec.Header().Get("Upload-Offset"), rec.Header().Get("Upload-Length"))
+	}
+
+	// A stale offset is refused
+	if rec := tt.patch(loc, 1000, content[1000:]); rec.Code != http.StatusConflict {
+		t.Errorf("stale patch = %d, want 409", rec.Code)
+	}
+
+	if rec := tt.patch(loc, 1500, content[1500:]); rec.Code != http.StatusNoContent {
+		t.Fatalf("final patch = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = tt.do(http.MethodGet, loc, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET = %d: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Data struct {
+			ID         string `json:"id"`
+			URL        string `json:"url"`
+			Size       int64  `json:"size"`
+			DurationMS int64  `json:"durationMs"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(loc, body.Data.ID) || body.Data.Size != int64(len(content)) || body.Data.DurationMS != 1000 {
+		t.Errorf("attachment = %+v", body.Data)
+	}
+
+	// The assembled file is stored and the chunks are gone
+	obj, err := tt.store.Get(context.Background(), storageKey(body.Data.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if !bytes.Equal(got, content) {
+		t.Error("stored file differs from the upload")
+	}
+	u, _ := tt.repo.GetByID(uuid.MustParse(body.Data.ID))
+	if !u.Completed || len(u.Chunks) != 0 {
+		t.Errorf("upload state = %+v", u)
+	}
+}
+
+func TestTusRejectsBeforeData(t *testing.T) {
+	tt := newTusTest(t)
+	for name, headers := range map[string]map[string]string{
+		"too large":   {"Upload-Length": strconv.Itoa(2 << 20), "Upload-Metadata": "filename YS50eHQ="},
+		"bad type":    {"Upload-Length": "10", "Upload-Metadata": "filename YS5leGU="},
+		"no filename": {"Upload-Length": "10"},
+	} {
+		if rec := tt.do(http.MethodPost, "/api/upload/tus", nil, headers); rec.Code == http.StatusCreated {
+			t.Errorf("%s: upload created", name)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/upload/tus", nil)
+	req.Header.Set("Upload-Length", "10")
+	rec := httptest.NewRecorder()
+	tt.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPreconditionFailed || rec.Header().Get("Tus-Version") != tusVersion {
+		t.Errorf("missing Tus-Resumable = %d", rec.Code)
+	}
+
+	// Content that doesn't match the extension is discarded at the end
+	loc := tt.create("a.wav", 12)
+	if rec := tt.patch(loc, 0, []byte("<html></html")); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("html as wav = %d", rec.Code)
+	}
+	if rec := tt.do(http.MethodHead, loc, nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("rejected upload HEAD = %d, want 404", rec.Code)
+	}
+}
+
+func TestTusExpiry(t *testing.T) {
+	tt := newTusTest(t)
+	loc := tt.create("notes.txt", 1000)
+	if rec := tt.patch(loc, 0, bytes.Repeat([]byte("a"), 500)); rec.Code != http.StatusNoContent {
+		t.Fatalf("patch = %d", rec.Code)
+	}
+	id := uuid.MustParse(loc[strings.LastIndex(loc, "/")+1:])
+	u, _ := tt.repo.GetByID(id)
+
+	tt.handler.cleanup(context.Background(), time.Now().Add(tusExpiry+time.Minute))
+	if _, err := tt.repo.GetByID(id); err != sql.ErrNoRows {
+		t.Errorf("expired upload still recorded")
+	}
+	if _, err := tt.store.Get(context.Background(), u.Chunks[0]); err != storage.ErrNotFound {
+		t.Errorf("expired chunk still stored: %v", err)
+	}
+}
+
+func TestTusLimits(t *testing.T) {
+	tt := newTusTest(t)
+	quota := int64(10000)
+	tt.handler.uploads.instances = fixedInstance{instance.InstanceInfo{MaxUploadSize: 1 << 20, UserStorageQuota: &quota}}
+	content := testWAV()
+
+	// Unfinished uploads count against the quota
+	loc := tt.create("beep.wav", len(content))
+	rec := tt.do(http.MethodPost, "/api/upload/tus", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(content)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("beep.wav")),
+	})
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("second upload over quota = %d, want 413", rec.Code)
+	}
+
+	// Tiny chunks are refused unless they finish the upload
+	if rec := tt.patch(loc, 0, content[:1]); rec.Code != http.StatusBadRequest {
+		t.Errorf("1-byte chunk = %d, want 400", rec.Code)
+	}
+	if rec := tt.patch(loc, 0, content[:len(content)-1]); rec.Code != http.StatusNoContent {
+		t.Fatalf("patch = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// A save whose completion wasn't recorded is finished by a retry
+	tt.repo.failComplete = true
+	if rec := tt.patch(loc, len(content)-1, content[len(content)-1:]); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("final patch = %d, want 500", rec.Code)
+	}
+	tt.repo.failComplete = false
+	if rec := tt.patch(loc, len(content), nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("retry = %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := tt.do(http.MethodGet, loc, nil, nil); rec.Code != http.StatusOK {
+		t.Errorf("GET = %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// storageKey extracts the key from a signed /uploads URL.
+func storageKey(url string) string {
+	key, _, _ := strings.Cut(strings.TrimPrefix(url, "http://api.test/uploads/"), "?")
+	return key
+}
@@ -0,0 +1,183 @@
+package user
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/opencord/api/internal/attachment"
+	"github.com/opencord/api/internal/auth"
+	"github.com/opencord/api/internal/message"
+	"github.com/opencord/api/internal/storage"
+)
+
+// MessageSource is the part of message.Repository an export reads.
+type MessageSource interface {
+	ListByAuthor(authorID uuid.UUID) ([]message.Message, error)
+}
+
+// AttachmentSource is the part of attachment.Repository an export reads.
+type AttachmentSource interface {
+	ListByUploader(uploaderID uuid.UUID) ([]attachment.Attachment, error)
+}
+
+// SessionLister is implemented by auth.LocalAuthService.
+type SessionLister interface {
+	ListSessions(userID, current uuid.UUID) ([]auth.Session, error)
+}
+
+// ExportHandler builds a ZIP of what this instance keeps about a user:
+// their profile, messages and uploads. The auth server exports the
+// account itself.
+type ExportHandler struct {
+	users       Repository
+	messages    MessageSource
+	attachments AttachmentSource
+	store       storage.Storage
+	signer      *storage.Signer
+
+	// Sessions adds the user's sessions on local auth instances, which
+	// have no auth server to export them.
+	Sessions SessionLister
+}
+
+func NewExportHandler(users Repository, messages MessageSource, attachments AttachmentSource, store storage.Storage, signer *storage.Signer) *ExportHandler {
+	return &ExportHandler{users: users, messages: messages, attachments: attachments, store: store, signer: signer}
+}
+
+// Export handles GET /api/users/me/export. Uploaded files are streamed
+// into the archive, so a storage failure partway through truncates it
+// rather than turning into an error response.
+func (h *ExportHandler) Export(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.users.GetByID(userID)
+	if err != nil {
+		writeError(w, "user not found", http.StatusNotFound)
+		return
+	}
+	messages, err := h.messages.ListByAuthor(userID)
+	if err != nil {
+		log.Printf("failed to export messages of user %s: %v", userID, err)
+		writeError(w, "failed to export data", http.StatusInternalServerError)
+		return
+	}
+	uploads, err := h.attachments.ListByUploader(userID)
+	if err != nil {
+		log.Printf("failed to export uploads of user %s: %v", userID, err)
+		writeError(w, "failed to export data", http.StatusInternalServerError)
+		return
+	}
+	// Ready uploads link to their files like they do in the app. The links
+	// expire; the copies under uploads/ in the archive don't
+	for i := range messages {
+		for j := range messages[i].Attachments {
+			messages[i].Attachments[j].SetURL(h.signer)
+		}
+	}
+	for i := range uploads {
+		uploads[i].SetURL(h.signer)
+	}
+
+	files := []exportFile{
+		{"profile.json", user},
+		{"messages.json", messages},
+		{"uploads.json", uploads},
+	}
+	if claims, ok := auth.ClaimsFromContext(r.Context()); ok && h.Sessions != nil {
+		sessions, err := h.Sessions.ListSessions(userID, claims.SessionID)
+		if err != nil {
+			log.Printf("failed to export sessions of user %s: %v", userID, err)
+			writeError(w, "failed to export data", http.StatusInternalServerError)
+			return
+		}
+		files = append(files, exportFile{"sessions.json", sessions})
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="opencord-export.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(w)
+	if err := h.writeArchive(r.Context(), zw, files, uploads); err != nil {
+		log.Printf("failed to export data of user %s: %v", userID, err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("failed to export data of user %s: %v", userID, err)
+	}
+}
+
+type exportFile struct {
+	name string
+	data interface{}
+}
+
+// writeArchive writes the JSON files, then each ready upload's original
+// file as uploads/<id>/<filename>. Uploads that are still being scanned
+// or were quarantined are only listed.
+func (h *ExportHandler) writeArchive(ctx context.Context, zw *zip.Writer, files []exportFile, uploads []attachment.Attachment) error {
+	for _, f := range files {
+		out, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.data); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range uploads {
+		if a.Status != attachment.StatusReady {
+			continue
+		}
+		obj, err := h.store.Get(ctx, a.StorageKey)
+		if errors.Is(err, storage.ErrNotFound) {
+			log.Printf("export: upload %s is missing from storage", a.ID)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Media is compressed already
+		out, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     "uploads/" + a.ID.String() + "/" + exportFilename(a.Filename),
+			Method:   zip.Store,
+			Modified: a.CreatedAt,
+		})
+		if err == nil {
+			_, err = io.Copy(out, obj.Body)
+		}
+		obj.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportFilename makes an uploaded file's name safe to use as a path in
+// the archive.
+func exportFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		return "file"
+	}
+	return name
+}
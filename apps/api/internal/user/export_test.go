@@ -0,0 +1,113 @@
+package user
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/opencord/api/internal/attachment"
+	"github.com/opencord/api/internal/auth"
+	"github.com/opencord/api/internal/message"
+	"github.com/opencord/api/internal/storage"
+)
+
+type fakeUsers struct {
+	Repository
+	user *User
+}
+
+func (f fakeUsers) GetByID(id uuid.UUID) (*User, error) {
+	return f.user, nil
+}
+
+type fakeMessages []message.Message
+
+func (f fakeMessages) ListByAuthor(authorID uuid.UUID) ([]message.Message, error) {
+	return f, nil
+}
+
+type fakeAttachments []attachment.Attachment
+
+func (f fakeAttachments) ListByUploader(uploaderID uuid.UUID) ([]attachment.Attachment, error) {
+	return f, nil
+}
+
+func TestExport(t *testing.T) {
+	store, err := storage.NewLocalStorage(t.TempDir(), "http://localhost:8080/uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.Put(ctx, "ab/cat.png", strings.NewReader("meow"), 4, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{ID: uuid.New(), Username: "alice", DisplayName: "Alice", CreatedAt: time.Now()}
+	uploads := fakeAttachments{
+		{ID: uuid.New(), Filename: "../../cat.png", Status: attachment.StatusReady, StorageKey: "ab/cat.png"},
+		{ID: uuid.New(), Filename: "virus.exe", Status: attachment.StatusQuarantined, StorageKey: "cd/virus.exe"},
+	}
+	messages := fakeMessages{{ID: uuid.New(), AuthorID: user.ID, Content: "hello", Attachments: uploads[:1]}}
+	signer := storage.NewSigner("https://chat.example.com", []byte("secret"), time.Hour)
+	h := NewExportHandler(fakeUsers{user: user}, messages, uploads, store, signer)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/me/export", nil)
+	req = req.WithContext(auth.SetUserContext(req.Context(), user.ID))
+	rec := httptest.NewRecorder()
+	h.Export(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("export = %d %s", rec.Code, rec.Body)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+
+	if !strings.Contains(files["profile.json"], `"username": "alice"`) || !strings.Contains(files["messages.json"], `"content": "hello"`) {
+		t.Errorf("profile and messages = %q, %q", files["profile.json"], files["messages.json"])
+	}
+	if !strings.Contains(files["uploads.json"], "virus.exe") {
+		t.Errorf("uploads.json = %q", files["uploads.json"])
+	}
+	// Ready uploads link to their files, in both lists
+	var listed []attachment.Attachment
+	if err := json.Unmarshal([]byte(files["uploads.json"]), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || !strings.HasPrefix(listed[0].URL, "https://chat.example.com/uploads/ab/cat.png?") || listed[1].URL != "" {
+		t.Errorf("upload URLs = %+v", listed)
+	}
+	if !strings.Contains(files["messages.json"], "https://chat.example.com/uploads/ab/cat.png?") {
+		t.Errorf("messages.json = %q", files["messages.json"])
+	}
+	// Only ready files are included, under names that stay in the archive
+	if got := files["uploads/"+uploads[0].ID.String()+"/cat.png"]; got != "meow" {
+		t.Errorf("files = %v", files)
+	}
+	if len(files) != 4 {
+		t.Errorf("archive has %d files, want 4", len(files))
+	}
+	if _, ok := files["sessions.json"]; ok {
+		t.Error("sessions exported without local auth")
+	}
+}
@@ -11,6 +11,7 @@ type Repository interface {
 	GetByID(id uuid.UUID) (*User, error)
 	Update(id uuid.UUID, req UpdateUserRequest) (*User, error)
 	UpsertFromClaims(claims *auth.TokenClaims) error
+	Anonymize(id uuid.UUID) error
 	UpdateLastSeen(id uuid.UUID) error
 }
 
@@ -25,7 +26,7 @@ func NewPostgresRepository(db *sql.DB) *PostgresRepository {
 func (r *PostgresRepository) GetByID(id uuid.UUID) (*User, error) {
 	u := &User{}
 	err := r.db.QueryRow(
-		`SELECT id, email, username, display_name, avatar_url, created_at, last_seen_at FROM users WHERE id = $1`, id,
+		`SELECT id, COALESCE(email, ''), username, display_name, avatar_url, created_at, last_seen_at FROM users WHERE id = $1`, id,
 	).Scan(&u.ID, &u.Email, &u.Username, &u.DisplayName, &u.AvatarURL, &u.CreatedAt, &u.LastSeenAt)
 	if err != nil {
 		return nil, err
@@ -40,7 +41,7 @@ func (r *PostgresRepository) Update(id uuid.UUID, req UpdateUserRequest) (*User,
 			display_name = COALESCE($2, display_name),
 			avatar_url = COALESCE($3, avatar_url)
 		 WHERE id = $1
-		 RETURNING id, email, username, display_name, avatar_url, created_at, last_seen_at`,
+		 RETURNING id, COALESCE(email, ''), username, display_name, avatar_url, created_at, last_seen_at`,
 		id, req.DisplayName, req.AvatarURL,
 	).Scan(&u.ID, &u.Email, &u.Username, &u.DisplayName, &u.AvatarURL, &u.CreatedAt, &u.LastSeenAt)
 	if err != nil {
@@ -50,17 +51,44 @@ func (r *PostgresRepository) Update(id uuid.UUID, req UpdateUserRequest) (*User,
 }
 
 // UpsertFromClaims inserts or updates the local user cache from central auth JWT claims.
+// Users that were anonymized stay that way: tokens issued before the
+// deletion get auth.ErrUserDeleted.
 func (r *PostgresRepository) UpsertFromClaims(claims *auth.TokenClaims) error {
-	_, err := r.db.Exec(
+	res, err := r.db.Exec(
 		`INSERT INTO users (id, username, display_name, avatar_url)
 		 VALUES ($1, $2, $3, $4)
 		 ON CONFLICT (id) DO UPDATE SET
 			username = $2,
 			display_name = $3,
 			avatar_url = $4,
-			updated_at = NOW()`,
+			updated_at = NOW()
+		 WHERE users.deleted_at IS NULL`,
 		claims.UserID, claims.Username, claims.DisplayName, claims.AvatarURL,
 	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return auth.ErrUserDeleted
+	}
+	return nil
+}
+
+// Anonymize strips a deleted account's cached profile, leaving a
+// placeholder so its messages still have an author.
+func (r *PostgresRepository) Anonymize(id uuid.UUID) error {
+	_, err := r.db.Exec(
+		`UPDATE users SET
+			email = NULL,
+			username = 'deleted-' || LEFT(REPLACE(id::text, '-', ''), 12),
+			display_name = 'Deleted User',
+			avatar_url = NULL,
+			password_hash = NULL,
+			deleted_at = NOW(),
+			updated_at = NOW()
+		 WHERE id = $1`,
+		id,
+	)
 	return err
 }
 
@@ -7,6 +7,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/opencord/api/internal/presence"
 )
 
 const (
@@ -22,6 +23,12 @@ type Client struct {
 	send     chan []byte
 	UserID   uuid.UUID
 	Username string
+
+	initialPresence presence.Presence // loaded before registration
+	idle            bool              // owned by the hub goroutine
+	member          bool              // owned by the hub goroutine
+	closeCode       int               // set by the hub before closing done
+	done            chan struct{}     // closed by the hub when it drops the client
 }
 
 type IncomingEvent struct {
@@ -34,14 +41,20 @@ func NewClient(hub *Hub, conn *websocket.Conn, userID uuid.UUID, username string
 		hub:      hub,
 		conn:     conn,
 		send:     make(chan []byte, 256),
+		done:     make(chan struct{}),
 		UserID:   userID,
 		Username: username,
+
+		initialPresence: presence.Default(),
 	}
 }
 
 func (c *Client) ReadPump() {
 	defer func() {
-		c.hub.unregister <- c
+		if c.hub.SFU != nil {
+			c.hub.SFU.Disconnect(c)
+		}
+		c.hub.unregister(c)
 		c.conn.Close()
 	}()
 
@@ -75,14 +88,26 @@ func (c *Client) WritePump() {
 	}()
 
 	for {
+		// Checked first so a slow client's backlog isn't flushed after the
+		// hub dropped it
+		select {
+		case <-c.done:
+			c.writeClose()
+			return
+		default:
+		}
+
 		select {
+		case <-c.done:
+			c.writeClose()
+			return
+
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+				// Closed right after done; the check above catches it
+				continue
 			}
-
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
@@ -99,8 +124,7 @@ func (c *Client) WritePump() {
 func (c *Client) handleEvent(event IncomingEvent) {
 	switch event.Event {
 	case "ping":
-		data, _ := json.Marshal(Event{Type: "pong", Data: nil})
-		c.send <- data
+		c.Signal("pong", nil)
 
 	case "subscribe_channel":
 		var payload struct {
@@ -109,6 +133,10 @@ func (c *Client) handleEvent(event IncomingEvent) {
 		if err := json.Unmarshal(event.Data, &payload); err != nil {
 			return
 		}
+		if !c.hub.canAccessChannel(c.UserID, payload.ChannelID) {
+			c.sendError(event.Event, "channel not found")
+			return
+		}
 		c.hub.SubscribeToChannel(c, payload.ChannelID)
 
 	case "unsubscribe_channel":
@@ -127,14 +155,34 @@ func (c *Client) handleEvent(event IncomingEvent) {
 		if err := json.Unmarshal(event.Data, &payload); err != nil {
 			return
 		}
-		c.hub.BroadcastToChannel(payload.ChannelID, Event{
-			Type: "typing_start",
-			Data: map[string]interface{}{
-				"userId":    c.UserID,
-				"username":  c.Username,
-				"channelId": payload.ChannelID,
-			},
-		})
+		c.hub.StartTyping(c, payload.ChannelID)
+
+	case "typing_stop":
+		var payload struct {
+			ChannelID string `json:"channelId"`
+		}
+		if err := json.Unmarshal(event.Data, &payload); err != nil {
+			return
+		}
+		c.hub.StopTyping(payload.ChannelID, c.UserID)
+
+	case "presence_set":
+		var payload presence.SetPresenceRequest
+		if err := json.Unmarshal(event.Data, &payload); err != nil {
+			return
+		}
+		if err := c.hub.SetPresence(c, payload); err != nil {
+			c.sendError(event.Event, err.Error())
+		}
+
+	case "presence_activity":
+		var payload struct {
+			Idle bool `json:"idle"`
+		}
+		if err := json.Unmarshal(event.Data, &payload); err != nil {
+			return
+		}
+		c.hub.SetIdle(c, payload.Idle)
 
 	default:
 		// Handle RTC events
@@ -147,7 +195,6 @@ func (c *Client) handleEvent(event IncomingEvent) {
 }
 
 func (c *Client) handleRTCEvent(event IncomingEvent) {
-	// Relay RTC signaling messages to the target peer
 	var payload struct {
 		ChannelID string `json:"channelId"`
 		TargetID  string `json:"targetId"`
@@ -156,9 +203,48 @@ func (c *Client) handleRTCEvent(event IncomingEvent) {
 		return
 	}
 
+	// SFU mode: the server terminates the PeerConnection itself
+	if c.hub.SFU != nil {
+		if event.Event == "rtc:join" && !c.hub.canAccessChannel(c.UserID, payload.ChannelID) {
+			c.sendError(event.Event, "channel not found")
+			return
+		}
+		c.hub.SFU.HandleSignal(c, c.UserID, event.Event, event.Data)
+		return
+	}
+
+	// Mesh mode: relay RTC signaling messages to the target peer, but only
+	// within a channel the sender has been allowed to subscribe to
+	if !c.hub.IsSubscribed(c, payload.ChannelID) {
+		return
+	}
+
 	// Add sender info and broadcast to channel
 	c.hub.BroadcastToChannel(payload.ChannelID, Event{
 		Type: event.Event,
 		Data: json.RawMessage(event.Data),
 	})
 }
+
+// Signal queues a server-originated event for this client. Implements
+// rtc.Signaler so the SFU can signal participants directly.
+func (c *Client) Signal(event string, data interface{}) {
+	c.hub.SendToClient(c, Event{Type: event, Data: data})
+}
+
+func (c *Client) sendError(event, message string) {
+	c.Signal("error", map[string]interface{}{
+		"event":   event,
+		"message": message,
+	})
+}
+
+// writeClose sends the close frame with the code the hub dropped us with.
+func (c *Client) writeClose() {
+	reason := ""
+	if c.closeCode == CloseSlowConsumer {
+		reason = "slow consumer"
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, reason))
+}
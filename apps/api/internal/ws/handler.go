@@ -1,6 +1,7 @@
 package ws
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 
@@ -40,9 +41,39 @@ func HandleWebSocket(hub *Hub, validateToken AuthValidator) http.HandlerFunc {
 		}
 
 		client := NewClient(hub, conn, userID, username)
-		hub.register <- client
+		client.member = hub.isMember(userID)
+		if hub.Presence != nil {
+			if p, err := hub.Presence.Get(userID); err == nil {
+				client.initialPresence = *p
+			}
+		}
+
+		// Ready is queued before registration so it is always the first event.
+		if data, err := json.Marshal(hub.readyEvent(client)); err == nil {
+			client.send <- data
+		}
+		hub.register(client)
 
 		go client.WritePump()
 		go client.ReadPump()
 	}
 }
+
+// readyEvent is the first event on every connection: the session identity
+// plus what the client needs to start voice.
+func (h *Hub) readyEvent(client *Client) Event {
+	rtcMode := "mesh"
+	if h.SFU != nil {
+		rtcMode = "sfu"
+	}
+	return Event{
+		Type: "ready",
+		Data: map[string]interface{}{
+			"userId":     client.UserID,
+			"username":   client.Username,
+			"presence":   client.initialPresence,
+			"rtcMode":    rtcMode,
+			"iceServers": h.ICE.Servers(client.UserID),
+		},
+	}
+}
@@ -3,192 +3,360 @@ package ws
 import (
 	"encoding/json"
 	"log"
-	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/opencord/api/internal/presence"
+	"github.com/opencord/api/internal/rtc"
 )
 
+// CloseSlowConsumer is the close code sent to a client whose send buffer
+// filled up. 1013 (Try Again Later) tells the client it may reconnect.
+const CloseSlowConsumer = websocket.CloseTryAgainLater
+
 type Event struct {
 	Type string      `json:"event"`
 	Data interface{} `json:"data"`
 }
 
+// Hub tracks connections, channel subscriptions, presence and typing.
+//
+// All of that state is owned by the goroutine running Run: every other
+// goroutine goes through h.ops, so no locks are needed and a client's send
+// channel is closed exactly once, by the owner, when it's removed.
 type Hub struct {
-	clients    map[*Client]bool
-	channels   map[string]map[*Client]bool   // channelID -> clients
-	users      map[uuid.UUID]map[*Client]bool // userID -> clients (multi-tab)
-	register   chan *Client
-	unregister chan *Client
-	broadcast  chan channelEvent
-	mu         sync.RWMutex
+	clients  map[*Client]bool
+	channels map[string]map[*Client]bool    // channelID -> clients
+	users    map[uuid.UUID]map[*Client]bool // userID -> clients (multi-tab)
+	presence map[uuid.UUID]*userPresence    // userID -> presence (connected users only)
+	typing   map[typingKey]*typingState     // active typing indicators
+	slow     []*Client                      // clients to evict after the current op
+
+	ops chan func()
 
 	// OnUserOffline is called when a user's last connection disconnects.
 	// Wired in main.go to persist last_seen_at.
 	OnUserOffline func(userID uuid.UUID)
-}
 
-type channelEvent struct {
-	channelID string
-	event     Event
+	// IsMember reports whether a user belongs to the instance. Presence is
+	// only exchanged between members. Nil treats everyone as a member.
+	IsMember func(userID uuid.UUID) bool
+
+	// CanAccessChannel gates subscribe_channel and rtc:join. Typing and
+	// mesh signaling are only relayed to channels the client subscribed to.
+	// Nil allows every channel.
+	CanAccessChannel func(userID uuid.UUID, channelID string) bool
+
+	// SFU terminates rtc: signaling when voice runs in SFU mode.
+	// Nil means mesh mode: rtc: events are relayed to the channel.
+	SFU *rtc.SFU
+
+	// Presence persists chosen statuses across reconnects.
+	// Nil keeps everyone at the default (online).
+	Presence presence.Repository
+
+	// ICE supplies the STUN/TURN servers sent in the ready payload.
+	ICE *rtc.ICEConfig
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		clients:    make(map[*Client]bool),
-		channels:   make(map[string]map[*Client]bool),
-		users:      make(map[uuid.UUID]map[*Client]bool),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		broadcast:  make(chan channelEvent, 256),
+		clients:  make(map[*Client]bool),
+		channels: make(map[string]map[*Client]bool),
+		users:    make(map[uuid.UUID]map[*Client]bool),
+		presence: make(map[uuid.UUID]*userPresence),
+		typing:   make(map[typingKey]*typingState),
+		ops:      make(chan func(), 1024),
 	}
 }
 
+// Run is the owner goroutine. It must be running for any other Hub method
+// to make progress.
 func (h *Hub) Run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.mu.Lock()
-			h.clients[client] = true
-
-			// Track user presence
-			wasOffline := len(h.users[client.UserID]) == 0
-			if h.users[client.UserID] == nil {
-				h.users[client.UserID] = make(map[*Client]bool)
-			}
-			h.users[client.UserID][client] = true
-			h.mu.Unlock()
-
-			// Broadcast online if user was offline
-			if wasOffline {
-				h.BroadcastToAll(Event{
-					Type: "presence_update",
-					Data: map[string]interface{}{
-						"userId": client.UserID,
-						"status": "online",
-					},
-				})
-			}
+	for op := range h.ops {
+		op()
+		h.evictSlow()
+	}
+}
 
-		case client := <-h.unregister:
-			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-				// Remove from all channel subscriptions
-				for chID, clients := range h.channels {
-					delete(clients, client)
-					if len(clients) == 0 {
-						delete(h.channels, chID)
-					}
-				}
-
-				// Remove from user presence tracking
-				if userClients, ok := h.users[client.UserID]; ok {
-					delete(userClients, client)
-					if len(userClients) == 0 {
-						delete(h.users, client.UserID)
-						h.mu.Unlock()
-
-						// Broadcast offline
-						h.BroadcastToAll(Event{
-							Type: "presence_update",
-							Data: map[string]interface{}{
-								"userId": client.UserID,
-								"status": "offline",
-							},
-						})
-
-						// Persist last_seen_at
-						if h.OnUserOffline != nil {
-							go h.OnUserOffline(client.UserID)
-						}
-						continue
-					}
-				}
-			}
-			h.mu.Unlock()
-
-		case ce := <-h.broadcast:
-			h.mu.RLock()
-			if clients, ok := h.channels[ce.channelID]; ok {
-				data, err := json.Marshal(ce.event)
-				if err != nil {
-					log.Printf("failed to marshal event: %v", err)
-					h.mu.RUnlock()
-					continue
-				}
-				for client := range clients {
-					select {
-					case client.send <- data:
-					default:
-						close(client.send)
-						delete(clients, client)
-					}
-				}
-			}
-			h.mu.RUnlock()
+// post queues fn to run on the owner goroutine.
+func (h *Hub) post(fn func()) {
+	h.ops <- fn
+}
+
+// do runs fn on the owner goroutine and waits for it. Never call it from
+// the owner goroutine itself.
+func (h *Hub) do(fn func()) {
+	done := make(chan struct{})
+	h.ops <- func() {
+		fn()
+		close(done)
+	}
+	<-done
+}
+
+func (h *Hub) register(client *Client) {
+	h.post(func() { h.addClient(client) })
+}
+
+func (h *Hub) unregister(client *Client) {
+	h.post(func() { h.removeClient(client, websocket.CloseNormalClosure) })
+}
+
+func (h *Hub) addClient(client *Client) {
+	h.clients[client] = true
+
+	// Track user presence
+	if h.users[client.UserID] == nil {
+		h.users[client.UserID] = make(map[*Client]bool)
+	}
+	h.users[client.UserID][client] = true
+	if h.presence[client.UserID] == nil {
+		up := &userPresence{chosen: client.initialPresence, member: client.member}
+		h.presence[client.UserID] = up
+		h.scheduleExpiry(client.UserID, up)
+	}
+	member := h.isMemberOnline(client.UserID)
+	if view, changed := h.refreshPresence(client.UserID); changed {
+		h.broadcastPresence(client.UserID, view, member)
+	}
+}
+
+// removeClient drops a connection from every map and closes its send
+// channel with the given close code. Removing a client that's already gone
+// is a no-op, so eviction and the later unregister from ReadPump can't
+// close it twice.
+func (h *Hub) removeClient(client *Client, closeCode int) {
+	if !h.clients[client] {
+		return
+	}
+	delete(h.clients, client)
+	client.closeCode = closeCode
+	close(client.done)
+	close(client.send)
+
+	// Remove from all channel subscriptions
+	for chID, clients := range h.channels {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(h.channels, chID)
+		}
+	}
+
+	// Remove from user presence tracking
+	if userClients, ok := h.users[client.UserID]; ok {
+		delete(userClients, client)
+		if len(userClients) == 0 {
+			delete(h.users, client.UserID)
 		}
 	}
+	for _, channelID := range h.staleTyping(client.UserID) {
+		h.stopTyping(channelID, client.UserID)
+	}
+
+	member := h.isMemberOnline(client.UserID)
+	view, changed := h.refreshPresence(client.UserID)
+	if changed {
+		h.broadcastPresence(client.UserID, view, member)
+	}
+
+	// Persist last_seen_at
+	if view.Status == presence.StatusOffline && h.OnUserOffline != nil {
+		go h.OnUserOffline(client.UserID)
+	}
 }
 
-func (h *Hub) BroadcastToChannel(channelID string, event Event) {
-	h.broadcast <- channelEvent{channelID: channelID, event: event}
+// deliver queues data on a client without blocking the owner. A client
+// whose buffer is full is a slow consumer and gets evicted once the current
+// op finishes, so maps aren't modified mid-iteration by a nested removal.
+func (h *Hub) deliver(client *Client, data []byte) {
+	select {
+	case client.send <- data:
+	default:
+		h.slow = append(h.slow, client)
+	}
+}
+
+func (h *Hub) evictSlow() {
+	for len(h.slow) > 0 {
+		client := h.slow[0]
+		h.slow = h.slow[1:]
+		if h.clients[client] {
+			log.Printf("evicting slow websocket client for user %s", client.UserID)
+			h.removeClient(client, CloseSlowConsumer)
+		}
+	}
+	h.slow = nil
 }
 
-func (h *Hub) BroadcastToAll(event Event) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+func (h *Hub) BroadcastToChannel(channelID string, event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to marshal event: %v", err)
+		return
+	}
+	h.post(func() { h.broadcastToChannel(channelID, data) })
+}
 
+// broadcastEvent is BroadcastToChannel for use on the owner goroutine.
+func (h *Hub) broadcastEvent(channelID string, event Event) {
 	data, err := json.Marshal(event)
 	if err != nil {
+		log.Printf("failed to marshal event: %v", err)
 		return
 	}
+	h.broadcastToChannel(channelID, data)
+}
+
+func (h *Hub) broadcastToChannel(channelID string, data []byte) {
+	for client := range h.channels[channelID] {
+		h.deliver(client, data)
+	}
+}
 
-	for client := range h.clients {
-		select {
-		case client.send <- data:
-		default:
-			close(client.send)
-			delete(h.clients, client)
+// SendToClient delivers an event to a single connection.
+func (h *Hub) SendToClient(client *Client, event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to marshal event: %v", err)
+		return
+	}
+	h.post(func() {
+		if h.clients[client] {
+			h.deliver(client, data)
 		}
+	})
+}
+
+// SendToUser delivers an event to every connection of a user.
+func (h *Hub) SendToUser(userID uuid.UUID, event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to marshal event: %v", err)
+		return
 	}
+	h.post(func() {
+		for client := range h.users[userID] {
+			h.deliver(client, data)
+		}
+	})
 }
 
 func (h *Hub) SubscribeToChannel(client *Client, channelID string) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	if h.channels[channelID] == nil {
-		h.channels[channelID] = make(map[*Client]bool)
-	}
-	h.channels[channelID][client] = true
+	h.post(func() {
+		if !h.clients[client] {
+			return
+		}
+		if h.channels[channelID] == nil {
+			h.channels[channelID] = make(map[*Client]bool)
+		}
+		h.channels[channelID][client] = true
+	})
 }
 
 func (h *Hub) UnsubscribeFromChannel(client *Client, channelID string) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	if clients, ok := h.channels[channelID]; ok {
-		delete(clients, client)
+	h.post(func() {
+		if clients, ok := h.channels[channelID]; ok {
+			delete(clients, client)
+			if len(clients) == 0 {
+				delete(h.channels, channelID)
+			}
+		}
+		for _, ch := range h.staleTyping(client.UserID) {
+			if ch == channelID {
+				h.stopTyping(channelID, client.UserID)
+			}
+		}
+	})
+}
+
+// IsSubscribed reports whether the client is subscribed to the channel.
+func (h *Hub) IsSubscribed(client *Client, channelID string) bool {
+	var subscribed bool
+	h.do(func() { subscribed = h.channels[channelID][client] })
+	return subscribed
+}
+
+func (h *Hub) canAccessChannel(userID uuid.UUID, channelID string) bool {
+	return h.CanAccessChannel == nil || h.CanAccessChannel(userID, channelID)
+}
+
+func (h *Hub) isMember(userID uuid.UUID) bool {
+	return h.IsMember == nil || h.IsMember(userID)
+}
+
+// SetMembership updates a user's membership after they join or are removed,
+// so presence starts or stops flowing to and from their connections. A
+// removed user's connections also lose their channel subscriptions, and
+// with them messages and typing in those channels.
+func (h *Hub) SetMembership(userID uuid.UUID, member bool) {
+	h.post(func() {
+		for c := range h.users[userID] {
+			c.member = member
+		}
+		if !member {
+			h.unsubscribeUser(userID)
+		}
+		up, ok := h.presence[userID]
+		if !ok {
+			return
+		}
+		up.member = member
+
+		view := up.view
+		if !member {
+			// Tell remaining members the user is gone from their view
+			view = presence.View{Status: presence.StatusOffline}
+		}
+		h.broadcastPresence(userID, view, true)
+	})
+}
+
+// unsubscribeUser drops every subscription of the user's connections and
+// ends their typing indicators.
+func (h *Hub) unsubscribeUser(userID uuid.UUID) {
+	for chID, clients := range h.channels {
+		for c := range clients {
+			if c.UserID == userID {
+				delete(clients, c)
+			}
+		}
 		if len(clients) == 0 {
-			delete(h.channels, channelID)
+			delete(h.channels, chID)
 		}
 	}
+	for _, channelID := range h.staleTyping(userID) {
+		h.stopTyping(channelID, userID)
+	}
 }
 
-// GetOnlineUserIDs returns a set of user IDs that currently have at least one connected client.
+// GetOnlineUserIDs returns a set of user IDs that appear online to others.
+// Invisible users are excluded.
 func (h *Hub) GetOnlineUserIDs() map[uuid.UUID]bool {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
-	online := make(map[uuid.UUID]bool, len(h.users))
-	for userID := range h.users {
-		online[userID] = true
-	}
+	var online map[uuid.UUID]bool
+	h.do(func() {
+		online = make(map[uuid.UUID]bool, len(h.presence))
+		for userID, up := range h.presence {
+			if up.view.Visible().Status != presence.StatusOffline {
+				online[userID] = true
+			}
+		}
+	})
 	return online
 }
 
-// IsUserOnline returns true if the user has at least one connected client.
+// IsUserOnline returns true if the user appears online to others.
 func (h *Hub) IsUserOnline(userID uuid.UUID) bool {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return len(h.users[userID]) > 0
+	var online bool
+	h.do(func() {
+		up, ok := h.presence[userID]
+		online = ok && up.view.Visible().Status != presence.StatusOffline
+	})
+	return online
+}
+
+// afterFunc arms a timer whose callback runs on the owner goroutine.
+func (h *Hub) afterFunc(d time.Duration, fn func()) *time.Timer {
+	return time.AfterFunc(d, func() { h.post(fn) })
 }
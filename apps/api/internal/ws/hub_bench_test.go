@@ -0,0 +1,103 @@
+package ws
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// benchClients registers n simulated connections (no socket) whose send
+// buffers are drained by goroutines that count delivered events.
+func benchClients(b *testing.B, h *Hub, n int, delivered *atomic.Int64) []*Client {
+	b.Helper()
+	clients := make([]*Client, n)
+	for i := range clients {
+		c := newTestClient(h, uuid.New(), 256)
+		// Joined as non-members so registration doesn't fan out n² presence
+		// events; membership is switched on below.
+		c.member = false
+		go func() {
+			for range c.send {
+				delivered.Add(1)
+			}
+		}()
+		h.register(c)
+		clients[i] = c
+	}
+	h.do(func() {
+		for _, c := range clients {
+			c.member = true
+			h.presence[c.UserID].member = true
+		}
+	})
+	return clients
+}
+
+// settle waits until want events have been delivered or delivery stalls.
+// A client whose buffer fills is evicted with close code 1013, and its
+// remaining events are never delivered, so want may never be met.
+func settle(delivered *atomic.Int64, want int64) int64 {
+	last := delivered.Load()
+	stalled := time.Now()
+	for last < want && time.Since(stalled) < 200*time.Millisecond {
+		time.Sleep(time.Millisecond)
+		if n := delivered.Load(); n != last {
+			last = n
+			stalled = time.Now()
+		}
+	}
+	return last
+}
+
+// BenchmarkHubPresenceFanout measures one presence change delivered to every
+// connected member.
+func BenchmarkHubPresenceFanout(b *testing.B) {
+	for _, n := range []int{1000, 5000} {
+		b.Run(fmt.Sprintf("clients=%d", n), func(b *testing.B) {
+			h := NewHub()
+			go h.Run()
+
+			var delivered atomic.Int64
+			clients := benchClients(b, h, n, &delivered)
+			start := settle(&delivered, int64(n))
+
+			subject := clients[0]
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.SetIdle(subject, i%2 == 0)
+			}
+			end := settle(&delivered, start+int64(b.N)*int64(n))
+			b.ReportMetric(float64(end-start)/float64(b.N), "events/op")
+		})
+	}
+}
+
+// BenchmarkHubChannelBroadcast measures a message event delivered to every
+// subscriber of one channel.
+func BenchmarkHubChannelBroadcast(b *testing.B) {
+	for _, n := range []int{1000, 5000} {
+		b.Run(fmt.Sprintf("clients=%d", n), func(b *testing.B) {
+			h := NewHub()
+			go h.Run()
+
+			var delivered atomic.Int64
+			clients := benchClients(b, h, n, &delivered)
+			channelID := uuid.NewString()
+			for _, c := range clients {
+				h.SubscribeToChannel(c, channelID)
+			}
+			start := settle(&delivered, int64(n))
+
+			event := Event{Type: "message_create", Data: map[string]string{"content": "hello"}}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.BroadcastToChannel(channelID, event)
+			}
+			end := settle(&delivered, start+int64(b.N)*int64(n))
+			b.ReportMetric(float64(end-start)/float64(b.N), "events/op")
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/opencord/api/internal/presence"
+)
+
+// newTestClient is a connection without a socket; tests read c.send.
+func newTestClient(h *Hub, userID uuid.UUID, buffer int) *Client {
+	return &Client{
+		hub:             h,
+		send:            make(chan []byte, buffer),
+		done:            make(chan struct{}),
+		UserID:          userID,
+		Username:        userID.String()[:8],
+		initialPresence: presence.Default(),
+		member:          true,
+	}
+}
+
+func drain(c *Client) (count int) {
+	for range c.send {
+		count++
+	}
+	return count
+}
+
+// flush waits until every op queued so far has run.
+func (h *Hub) flush() { h.do(func() {}) }
+
+func TestHubConcurrentClients(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	channels := []string{uuid.NewString(), uuid.NewString(), uuid.NewString()}
+	users := make([]uuid.UUID, 20)
+	for i := range users {
+		users[i] = uuid.New()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := newTestClient(h, users[i%len(users)], 16)
+			drained := make(chan struct{})
+			go func() {
+				drain(c)
+				close(drained)
+			}()
+
+			h.register(c)
+			channelID := channels[i%len(channels)]
+			for j := 0; j < 20; j++ {
+				h.SubscribeToChannel(c, channelID)
+				h.BroadcastToChannel(channelID, Event{Type: "message_create", Data: j})
+				h.StartTyping(c, channelID)
+				h.SetIdle(c, j%2 == 0)
+				h.SendToClient(c, Event{Type: "pong"})
+				if j%5 == 0 {
+					h.GetPresences(c.UserID)
+					h.IsUserOnline(c.UserID)
+					h.IsSubscribed(c, channelID)
+				}
+				if j%7 == 0 {
+					h.UnsubscribeFromChannel(c, channelID)
+				}
+			}
+			h.unregister(c)
+			// Unregistering again, as ReadPump does after an eviction, is harmless
+			h.unregister(c)
+			<-drained
+		}(i)
+	}
+	wg.Wait()
+	h.flush()
+
+	h.do(func() {
+		if len(h.clients) != 0 || len(h.channels) != 0 || len(h.users) != 0 ||
+			len(h.presence) != 0 || len(h.typing) != 0 {
+			t.Errorf("hub not empty: %d clients, %d channels, %d users, %d presence, %d typing",
+				len(h.clients), len(h.channels), len(h.users), len(h.presence), len(h.typing))
+		}
+	})
+}
+
+func TestHubSetMembershipUnsubscribesRemovedUser(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	channelID := uuid.NewString()
+	kicked := uuid.New()
+	tabs := []*Client{newTestClient(h, kicked, 64), newTestClient(h, kicked, 64)}
+	other := newTestClient(h, uuid.New(), 64)
+	for _, c := range append(tabs, other) {
+		h.register(c)
+		h.SubscribeToChannel(c, channelID)
+	}
+	h.StartTyping(tabs[0], channelID)
+	h.flush()
+	for _, c := range append(tabs, other) {
+		for len(c.send) > 0 {
+			<-c.send
+		}
+	}
+
+	h.SetMembership(kicked, false)
+	h.BroadcastToChannel(channelID, Event{Type: "message_create"})
+	h.StartTyping(tabs[1], channelID)
+	h.flush()
+
+	for i, c := range tabs {
+		if h.IsSubscribed(c, channelID) {
+			t.Errorf("tab %d still subscribed", i)
+		}
+		for len(c.send) > 0 {
+			var event Event
+			if err := json.Unmarshal(<-c.send, &event); err == nil && event.Type != "presence_update" {
+				t.Errorf("tab %d got %s after removal", i, event.Type)
+			}
+		}
+	}
+	var events []string
+	for len(other.send) > 0 {
+		var event Event
+		if err := json.Unmarshal(<-other.send, &event); err == nil {
+			events = append(events, event.Type)
+		}
+	}
+	if !slices.Contains(events, "typing_stop") || !slices.Contains(events, "message_create") || slices.Contains(events, "typing_start") {
+		t.Errorf("remaining member got %v", events)
+	}
+}
+
+func TestHubEvictsSlowConsumerOnce(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	channelID := uuid.NewString()
+	slow := newTestClient(h, uuid.New(), 8)
+	fast := newTestClient(h, uuid.New(), 256)
+	received := make(chan int)
+	go func() { received <- drain(fast) }()
+
+	h.register(slow)
+	h.register(fast)
+	h.SubscribeToChannel(slow, channelID)
+	h.SubscribeToChannel(fast, channelID)
+	h.flush()
+
+	// Broadcast from several goroutines while the slow client never reads
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				h.BroadcastToChannel(channelID, Event{Type: "message_create", Data: fmt.Sprint(i, j)})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case <-slow.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow client was not evicted")
+	}
+	if slow.closeCode != CloseSlowConsumer {
+		t.Errorf("close code = %d, want %d", slow.closeCode, CloseSlowConsumer)
+	}
+	if n := drain(slow); n > cap(slow.send) {
+		t.Errorf("slow client buffered %d events, cap %d", n, cap(slow.send))
+	}
+
+	// ReadPump unregisters once the socket closes; that must not close again
+	h.unregister(slow)
+	h.BroadcastToChannel(channelID, Event{Type: "message_create"})
+	h.flush()
+
+	var subscribed, online bool
+	h.do(func() {
+		subscribed = h.channels[channelID][slow]
+		online = h.clients[slow]
+	})
+	if subscribed || online {
+		t.Errorf("evicted client still tracked: subscribed=%v online=%v", subscribed, online)
+	}
+
+	h.unregister(fast)
+	<-received
+	if fast.closeCode != websocket.CloseNormalClosure {
+		t.Errorf("fast client close code = %d, want %d", fast.closeCode, websocket.CloseNormalClosure)
+	}
+}
@@ -0,0 +1,193 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/opencord/api/internal/presence"
+)
+
+var ErrInvalidPresence = errors.New("invalid presence")
+
+// userPresence is the hub's state for a connected user.
+type userPresence struct {
+	chosen presence.Presence // persisted choice
+	member bool              // presence is shared with other members only
+	view   presence.View     // last broadcast effective presence
+	expiry *time.Timer       // clears an expiring custom status
+}
+
+// refreshPresence recomputes the user's effective presence from their
+// chosen status and the activity of each of their connections. Most active
+// wins: an online user is only idle when every tab is idle; dnd, idle and
+// invisible apply regardless of activity.
+func (h *Hub) refreshPresence(userID uuid.UUID) (presence.View, bool) {
+	up, ok := h.presence[userID]
+	if !ok {
+		return presence.View{Status: presence.StatusOffline}, false
+	}
+
+	clients := h.users[userID]
+	if len(clients) == 0 {
+		if up.expiry != nil {
+			up.expiry.Stop()
+		}
+		delete(h.presence, userID)
+		return presence.View{Status: presence.StatusOffline}, true
+	}
+
+	view := presence.View{Status: up.chosen.Status, CustomStatus: up.chosen.CustomStatus}
+	if view.Status == presence.StatusOnline {
+		view.Status = presence.StatusIdle
+		for c := range clients {
+			if !c.idle {
+				view.Status = presence.StatusOnline
+				break
+			}
+		}
+	}
+
+	if view.Equal(up.view) {
+		return view, false
+	}
+	up.view = view
+	return view, true
+}
+
+// broadcastPresence sends the user's real presence to their own connections
+// and, when toMembers is set, the visible presence (invisible → offline) to
+// other members. Users who aren't members share presence with nobody but
+// themselves.
+func (h *Hub) broadcastPresence(userID uuid.UUID, view presence.View, toMembers bool) {
+	own, err := json.Marshal(presenceEvent(userID, view))
+	if err != nil {
+		log.Printf("failed to marshal presence: %v", err)
+		return
+	}
+	others, err := json.Marshal(presenceEvent(userID, view.Visible()))
+	if err != nil {
+		log.Printf("failed to marshal presence: %v", err)
+		return
+	}
+
+	for client := range h.clients {
+		switch {
+		case client.UserID == userID:
+			h.deliver(client, own)
+		case toMembers && client.member:
+			h.deliver(client, others)
+		}
+	}
+}
+
+func presenceEvent(userID uuid.UUID, view presence.View) Event {
+	return Event{
+		Type: "presence_update",
+		Data: map[string]interface{}{
+			"userId":       userID,
+			"status":       view.Status,
+			"customStatus": view.CustomStatus,
+		},
+	}
+}
+
+// SetPresence changes the user's chosen status and custom status for all of
+// their connections and persists it.
+func (h *Hub) SetPresence(client *Client, req presence.SetPresenceRequest) error {
+	if !req.Status.Valid() {
+		return ErrInvalidPresence
+	}
+	if cs := req.CustomStatus; cs != nil && (!cs.Valid() || cs.Expired(time.Now())) {
+		return ErrInvalidPresence
+	}
+
+	p := presence.Presence{Status: req.Status, CustomStatus: req.CustomStatus}
+	if h.Presence != nil {
+		if err := h.Presence.Set(client.UserID, p); err != nil {
+			log.Printf("failed to persist presence for user %s: %v", client.UserID, err)
+		}
+	}
+
+	h.post(func() {
+		up, ok := h.presence[client.UserID]
+		if !ok {
+			return
+		}
+		up.chosen = p
+		h.scheduleExpiry(client.UserID, up)
+		if view, changed := h.refreshPresence(client.UserID); changed {
+			h.broadcastPresence(client.UserID, view, up.member)
+		}
+	})
+	return nil
+}
+
+// SetIdle records whether one connection (tab) is idle.
+func (h *Hub) SetIdle(client *Client, idle bool) {
+	h.post(func() {
+		if !h.clients[client] {
+			return
+		}
+		client.idle = idle
+		member := h.isMemberOnline(client.UserID)
+		if view, changed := h.refreshPresence(client.UserID); changed {
+			h.broadcastPresence(client.UserID, view, member)
+		}
+	})
+}
+
+// GetPresences returns the presence of every connected user as seen by
+// viewerID: the viewer sees their own real status, invisible users appear
+// offline to everyone else.
+func (h *Hub) GetPresences(viewerID uuid.UUID) map[uuid.UUID]presence.View {
+	var views map[uuid.UUID]presence.View
+	h.do(func() {
+		views = make(map[uuid.UUID]presence.View, len(h.presence))
+		for userID, up := range h.presence {
+			if userID == viewerID {
+				views[userID] = up.view
+			} else if up.member {
+				views[userID] = up.view.Visible()
+			}
+		}
+	})
+	return views
+}
+
+// isMemberOnline reports the cached membership of a connected user.
+func (h *Hub) isMemberOnline(userID uuid.UUID) bool {
+	up, ok := h.presence[userID]
+	return ok && up.member
+}
+
+// scheduleExpiry arms a timer that clears the custom status when it expires.
+func (h *Hub) scheduleExpiry(userID uuid.UUID, up *userPresence) {
+	if up.expiry != nil {
+		up.expiry.Stop()
+		up.expiry = nil
+	}
+	cs := up.chosen.CustomStatus
+	if cs == nil || cs.ExpiresAt == nil {
+		return
+	}
+	expiresAt := *cs.ExpiresAt
+	up.expiry = h.afterFunc(time.Until(expiresAt), func() {
+		h.expireCustomStatus(userID, expiresAt)
+	})
+}
+
+func (h *Hub) expireCustomStatus(userID uuid.UUID, expiresAt time.Time) {
+	up, ok := h.presence[userID]
+	if !ok || up.chosen.CustomStatus == nil || up.chosen.CustomStatus.ExpiresAt == nil ||
+		!up.chosen.CustomStatus.ExpiresAt.Equal(expiresAt) {
+		return
+	}
+	up.chosen.CustomStatus = nil
+	up.expiry = nil
+	if view, changed := h.refreshPresence(userID); changed {
+		h.broadcastPresence(userID, view, up.member)
+	}
+}
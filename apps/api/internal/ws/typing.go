@@ -0,0 +1,103 @@
+package ws
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// typingTimeout is how long a typing indicator lasts without a refresh.
+// Clients re-send typing_start every few seconds while typing.
+const typingTimeout = 10 * time.Second
+
+type typingKey struct {
+	channelID string
+	userID    uuid.UUID
+}
+
+type typingState struct {
+	timer   *time.Timer
+	expires time.Time
+}
+
+// StartTyping marks the client's user as typing in a channel the client is
+// subscribed to. Only the first typing_start is broadcast; repeats just
+// extend the server-side timeout.
+func (h *Hub) StartTyping(client *Client, channelID string) {
+	h.post(func() {
+		if !h.channels[channelID][client] {
+			return
+		}
+		key := typingKey{channelID: channelID, userID: client.UserID}
+		expires := time.Now().Add(typingTimeout)
+		if t, ok := h.typing[key]; ok {
+			t.expires = expires
+			t.timer.Reset(typingTimeout)
+			return
+		}
+		t := &typingState{expires: expires}
+		t.timer = h.afterFunc(typingTimeout, func() {
+			// A timer that fired just before a Reset lands here early
+			if h.typing[key] == t && !time.Now().Before(t.expires) {
+				h.stopTyping(channelID, client.UserID)
+			}
+		})
+		h.typing[key] = t
+
+		h.broadcastEvent(channelID, Event{
+			Type: "typing_start",
+			Data: map[string]interface{}{
+				"userId":    client.UserID,
+				"username":  client.Username,
+				"channelId": channelID,
+			},
+		})
+	})
+}
+
+// StopTyping clears a typing indicator and tells the channel. Called on
+// typing_stop, on timeout, when the user sends a message and when they
+// disconnect.
+func (h *Hub) StopTyping(channelID string, userID uuid.UUID) {
+	h.post(func() { h.stopTyping(channelID, userID) })
+}
+
+func (h *Hub) stopTyping(channelID string, userID uuid.UUID) {
+	key := typingKey{channelID: channelID, userID: userID}
+	t, ok := h.typing[key]
+	if !ok {
+		return
+	}
+	t.timer.Stop()
+	delete(h.typing, key)
+
+	h.broadcastEvent(channelID, Event{
+		Type: "typing_stop",
+		Data: map[string]interface{}{
+			"userId":    userID,
+			"channelId": channelID,
+		},
+	})
+}
+
+// staleTyping returns the channels where the user is typing and no longer
+// has a subscribed connection.
+func (h *Hub) staleTyping(userID uuid.UUID) []string {
+	var stale []string
+	for key := range h.typing {
+		if key.userID != userID {
+			continue
+		}
+		subscribed := false
+		for c := range h.channels[key.channelID] {
+			if c.UserID == userID {
+				subscribed = true
+				break
+			}
+		}
+		if !subscribed {
+			stale = append(stale, key.channelID)
+		}
+	}
+	return stale
+}
@@ -0,0 +1,4 @@
+ALTER TABLE users DROP COLUMN custom_status_expires_at;
+ALTER TABLE users DROP COLUMN custom_status_emoji;
+ALTER TABLE users DROP COLUMN custom_status_text;
+ALTER TABLE users DROP COLUMN status;
@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN status VARCHAR(10) NOT NULL DEFAULT 'online'
+    CHECK (status IN ('online', 'idle', 'dnd', 'invisible'));
+ALTER TABLE users ADD COLUMN custom_status_text VARCHAR(128);
+ALTER TABLE users ADD COLUMN custom_status_emoji VARCHAR(64);
+ALTER TABLE users ADD COLUMN custom_status_expires_at TIMESTAMPTZ;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS attachments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    uploader_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    message_id UUID REFERENCES messages(id) ON DELETE SET NULL,
+    position SMALLINT NOT NULL DEFAULT 0,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL,
+    width INTEGER,
+    height INTEGER,
+    sha256 CHAR(64) NOT NULL,
+    storage_key TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments(message_id, position);
+CREATE INDEX IF NOT EXISTS idx_attachments_pending ON attachments(uploader_id, created_at) WHERE message_id IS NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE attachments DROP COLUMN variants;
+ALTER TABLE attachments DROP COLUMN blurhash;
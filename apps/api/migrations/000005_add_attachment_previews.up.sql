@@ -0,0 +1,2 @@
+ALTER TABLE attachments ADD COLUMN blurhash TEXT;
+ALTER TABLE attachments ADD COLUMN variants TEXT[] NOT NULL DEFAULT '{}';
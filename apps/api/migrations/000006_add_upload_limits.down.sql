@@ -0,0 +1,2 @@
+ALTER TABLE attachments DROP COLUMN duration_ms;
+ALTER TABLE instance_settings DROP COLUMN max_upload_size;
@@ -0,0 +1,2 @@
+ALTER TABLE instance_settings ADD COLUMN max_upload_size BIGINT NOT NULL DEFAULT 104857600;
+ALTER TABLE attachments ADD COLUMN duration_ms INTEGER;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_attachments_uploader;
+ALTER TABLE instance_settings DROP COLUMN user_storage_quota;
+ALTER TABLE instance_settings DROP COLUMN storage_quota;
@@ -0,0 +1,3 @@
+ALTER TABLE instance_settings ADD COLUMN storage_quota BIGINT;
+ALTER TABLE instance_settings ADD COLUMN user_storage_quota BIGINT;
+CREATE INDEX IF NOT EXISTS idx_attachments_uploader ON attachments(uploader_id);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_attachments_storage_key;
+ALTER TABLE attachments DROP CONSTRAINT IF EXISTS attachments_storage_key_fkey;
+ALTER TABLE attachments ADD CONSTRAINT attachments_storage_key_key UNIQUE (storage_key);
+DROP TABLE IF EXISTS blobs;
@@ -0,0 +1,19 @@
+-- Stored files, shared by every attachment with the same content
+CREATE TABLE IF NOT EXISTS blobs (
+    storage_key TEXT PRIMARY KEY,
+    sha256 CHAR(64) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL,
+    variants TEXT[] NOT NULL DEFAULT '{}',
+    refcount INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_blobs_sha256 ON blobs(sha256, content_type) WHERE refcount > 0;
+
+INSERT INTO blobs (storage_key, sha256, content_type, size, variants, refcount, created_at)
+SELECT storage_key, sha256, content_type, size, variants, 1, created_at FROM attachments;
+
+ALTER TABLE attachments DROP CONSTRAINT IF EXISTS attachments_storage_key_key;
+ALTER TABLE attachments ADD CONSTRAINT attachments_storage_key_fkey
+    FOREIGN KEY (storage_key) REFERENCES blobs(storage_key);
+CREATE INDEX IF NOT EXISTS idx_attachments_storage_key ON attachments(storage_key);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_attachments_status;
+ALTER TABLE attachments DROP COLUMN IF EXISTS scanned_at;
+ALTER TABLE attachments DROP COLUMN IF EXISTS scan_signature;
+ALTER TABLE attachments DROP COLUMN IF EXISTS status;
@@ -0,0 +1,5 @@
+-- Uploads wait in 'processing' until the malware scanner has checked them
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'ready';
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS scan_signature TEXT;
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS scanned_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_attachments_status ON attachments(status) WHERE status <> 'ready';
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS legacy_uploads;
+ALTER TABLE attachments DROP COLUMN IF EXISTS public;
@@ -0,0 +1,22 @@
+-- Public attachments are served without a signed URL
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS public BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Existing avatars and instance icons stay reachable at their stored URLs
+UPDATE attachments a SET public = TRUE
+WHERE EXISTS (SELECT 1 FROM users u WHERE u.avatar_url LIKE '%/uploads/' || a.storage_key)
+   OR EXISTS (SELECT 1 FROM instance_settings s WHERE s.icon_url LIKE '%/uploads/' || a.storage_key);
+
+-- Files uploaded before attachments were tracked have no attachments row.
+-- The avatars, icons and message images among them stay public too.
+CREATE TABLE IF NOT EXISTS legacy_uploads (
+    storage_key TEXT PRIMARY KEY
+);
+INSERT INTO legacy_uploads (storage_key)
+SELECT DISTINCT substring(url FROM '/uploads/([^?#]+)') FROM (
+    SELECT avatar_url AS url FROM users
+    UNION SELECT icon_url FROM instance_settings
+    UNION SELECT image_url FROM messages
+) refs
+WHERE substring(url FROM '/uploads/([^?#]+)') IS NOT NULL
+  AND NOT EXISTS (SELECT 1 FROM blobs b WHERE b.storage_key = substring(url FROM '/uploads/([^?#]+)'))
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,4 @@
+DELETE FROM refresh_tokens WHERE used_at IS NOT NULL;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS used_at;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS session_id;
+DROP TABLE IF EXISTS sessions;
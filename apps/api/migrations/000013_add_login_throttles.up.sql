@@ -0,0 +1,8 @@
+-- Failed logins per account ("account:<email>") and per IP ("ip:<addr>").
+-- Rows go stale an hour after their last failure
+CREATE TABLE IF NOT EXISTS login_throttles (
+    key TEXT PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    locked_until TIMESTAMPTZ,
+    last_failure_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,3 @@
+-- Set when the auth server reports the account deleted. Cached profiles of
+-- deleted users are never refreshed from tokens again.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
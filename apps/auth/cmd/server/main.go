@@ -1,9 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	chimw "github.com/go-chi/chi/v5/middleware"
@@ -11,6 +16,10 @@ import (
 
 	"github.com/opencord/auth/internal/auth"
 	"github.com/opencord/auth/internal/database"
+	"github.com/opencord/auth/internal/mail"
+	"github.com/opencord/auth/internal/webauthn"
+	"github.com/opencord/shared/breach"
+	"github.com/opencord/shared/clientip"
 )
 
 func main() {
@@ -19,6 +28,32 @@ func main() {
 	port := getEnv("PORT", "9090")
 	keyDir := getEnv("KEY_DIR", "./keys")
 	issuer := getEnv("ISSUER", "http://localhost:9090")
+	appURL := getEnv("APP_URL", "http://localhost:3000")
+	adminToken := getEnv("ADMIN_TOKEN", "")
+	rotationHours, err := strconv.Atoi(getEnv("KEY_ROTATION_INTERVAL_HOURS", "720"))
+	if err != nil || rotationHours < 0 {
+		log.Fatalf("invalid KEY_ROTATION_INTERVAL_HOURS: %q", os.Getenv("KEY_ROTATION_INTERVAL_HOURS"))
+	}
+
+	// ES256 signing keys
+	keys, err := auth.LoadKeyRing(keyDir)
+	if err != nil {
+		log.Fatalf("failed to load signing keys: %v", err)
+	}
+
+	// `server rotate-keys` rotates the keys in KEY_DIR and exits; running
+	// servers pick up the change within a minute
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		if err := keys.Rotate(); err != nil {
+			log.Fatalf("failed to rotate signing keys: %v", err)
+		}
+		for _, k := range keys.Info() {
+			fmt.Printf("%s\t%s\n", k.KID, k.State)
+		}
+		return
+	}
+	log.Printf("loaded ES256 signing keys (active kid: %s)", keys.Active().KID)
+	keys.StartRotationLoop(time.Duration(rotationHours) * time.Hour)
 
 	// Database
 	db, err := database.Connect(databaseURL)
@@ -32,19 +67,36 @@ func main() {
 		log.Printf("migration warning: %v", err)
 	}
 
-	// ES256 key pair
-	keyPair, err := auth.LoadOrGenerateKeyPair(keyDir)
+	// Mailer
+	mailer, err := newMailer()
 	if err != nil {
-		log.Fatalf("failed to load key pair: %v", err)
+		log.Fatalf("failed to configure mailer: %v", err)
 	}
-	log.Printf("loaded ES256 key pair (kid: %s)", keyPair.KID)
 
 	// Repository & service
 	authRepo := auth.NewPostgresRepository(db)
-	authService := auth.NewService(authRepo, keyPair, issuer)
+	authService := auth.NewService(authRepo, keys, mailer, issuer, appURL)
+	if authService.WebAuthn, err = newRelyingParty(appURL); err != nil {
+		log.Fatalf("failed to configure passkeys: %v", err)
+	}
+	if dir := os.Getenv("BREACHED_PASSWORDS_DIR"); dir != "" {
+		if authService.BreachedPasswords, err = breach.Open(dir); err != nil {
+			log.Fatalf("failed to open breached password list: %v", err)
+		}
+		log.Printf("checking new passwords against the breached password list in %s", dir)
+	}
+
+	authService.StartAccountDeletionLoop(time.Hour)
 
-	// Handler
+	// Handlers
 	authHandler := auth.NewHandler(authService)
+	keysHandler := auth.NewKeysHandler(keys)
+
+	// Forwarded client addresses are only believed from these proxies
+	proxies, err := clientip.ParseProxies(getEnv("TRUSTED_PROXIES", "private"))
+	if err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
 
 	// Router
 	r := chi.NewRouter()
@@ -52,7 +104,7 @@ func main() {
 	// Middleware
 	r.Use(chimw.Logger)
 	r.Use(chimw.Recoverer)
-	r.Use(chimw.RealIP)
+	r.Use(proxies.Middleware)
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"},
@@ -63,14 +115,30 @@ func main() {
 	}))
 
 	// JWKS endpoint (public, well-known)
-	r.Get("/.well-known/jwks.json", auth.JWKSHandler(keyPair))
+	r.Get("/.well-known/jwks.json", auth.JWKSHandler(keys))
+
+	// OpenID Connect provider for third-party apps
+	r.Get("/.well-known/openid-configuration", authHandler.OpenIDConfiguration)
+	r.Route("/oauth", func(r chi.Router) {
+		r.Get("/authorize", authHandler.Authorize)
+		r.Post("/token", authHandler.Token)
+		r.Get("/userinfo", authHandler.UserInfo)
+		r.Post("/userinfo", authHandler.UserInfo)
+	})
 
 	// Public auth routes
 	r.Route("/api", func(r chi.Router) {
 		r.Route("/auth", func(r chi.Router) {
 			r.Post("/register", authHandler.Register)
 			r.Post("/login", authHandler.Login)
+			r.Post("/login/mfa", authHandler.LoginMFA)
+			r.Post("/login/mfa/passkey", authHandler.BeginMFAPasskey)
+			r.Post("/passkey/begin", authHandler.BeginPasskeyLogin)
+			r.Post("/passkey/finish", authHandler.FinishPasskeyLogin)
 			r.Post("/refresh", authHandler.Refresh)
+			r.Post("/forgot-password", authHandler.ForgotPassword)
+			r.Post("/reset-password", authHandler.ResetPassword)
+			r.Post("/verify-email", authHandler.VerifyEmail)
 		})
 
 		// Authenticated routes
@@ -78,9 +146,45 @@ func main() {
 			r.Use(authHandler.Middleware)
 
 			r.Delete("/auth/logout", authHandler.Logout)
+			r.Post("/auth/instance-token", authHandler.InstanceToken)
+			r.Post("/auth/resend-verification", authHandler.ResendVerification)
 			r.Get("/users/me", authHandler.GetMe)
 			r.Patch("/users/me", authHandler.UpdateMe)
+			r.Delete("/users/me", authHandler.DeleteAccount)
+			r.Get("/users/me/export", authHandler.ExportAccount)
+			r.Post("/users/me/email", authHandler.ChangeEmail)
+			r.Get("/users/me/mfa", authHandler.MFAStatus)
+			r.Post("/users/me/mfa/totp", authHandler.BeginTOTPSetup)
+			r.Post("/users/me/mfa/totp/confirm", authHandler.ConfirmTOTPSetup)
+			r.Delete("/users/me/mfa/totp", authHandler.DisableTOTP)
+			r.Post("/users/me/mfa/recovery-codes", authHandler.RegenerateRecoveryCodes)
+			r.Get("/users/me/passkeys", authHandler.ListPasskeys)
+			r.Post("/users/me/passkeys/begin", authHandler.BeginPasskeyRegistration)
+			r.Post("/users/me/passkeys", authHandler.FinishPasskeyRegistration)
+			r.Delete("/users/me/passkeys/{id}", authHandler.DeletePasskey)
+			r.Get("/users/me/instances", authHandler.ListInstances)
+			r.Post("/users/me/instances", authHandler.AuthorizeInstance)
+			r.Delete("/users/me/instances/{id}", authHandler.RevokeInstance)
+			r.Get("/sessions", authHandler.ListSessions)
+			r.Delete("/sessions/{id}", authHandler.RevokeSession)
+			r.Get("/oauth/authorize", authHandler.GetConsent)
+			r.Post("/oauth/authorize", authHandler.Consent)
+			r.Get("/oauth/clients", authHandler.ListOAuthClients)
+			r.Post("/oauth/clients", authHandler.CreateOAuthClient)
+			r.Delete("/oauth/clients/{id}", authHandler.DeleteOAuthClient)
+			r.Get("/oauth/consents", authHandler.ListOAuthConsents)
+			r.Delete("/oauth/consents/{clientId}", authHandler.RevokeOAuthConsent)
 		})
+
+		// Operator routes, only enabled with ADMIN_TOKEN set
+		if adminToken != "" {
+			r.Route("/admin", func(r chi.Router) {
+				r.Use(auth.AdminMiddleware(adminToken))
+
+				r.Get("/keys", keysHandler.List)
+				r.Post("/keys/rotate", keysHandler.Rotate)
+			})
+		}
 	})
 
 	log.Printf("OpenCord Auth starting on :%s", port)
@@ -89,6 +193,60 @@ func main() {
 	}
 }
 
+// newMailer picks how emails are sent from MAILER: "smtp", "file" (one
+// .eml file per email in MAIL_DIR) or "log" (the default).
+func newMailer() (mail.Mailer, error) {
+	from := getEnv("MAIL_FROM", "OpenCord <no-reply@localhost>")
+	switch backend := getEnv("MAILER", "log"); backend {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required with MAILER=smtp")
+		}
+		port, err := strconv.Atoi(getEnv("SMTP_PORT", "587"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP_PORT: %w", err)
+		}
+		log.Printf("sending mail via SMTP (%s:%d)", host, port)
+		return mail.NewSMTPMailer(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from), nil
+	case "file":
+		dir := getEnv("MAIL_DIR", "./mail")
+		log.Printf("writing mail to %s", dir)
+		return mail.NewFileMailer(dir, from)
+	case "log":
+		log.Println("mail is logged, not sent (set MAILER=smtp to send it)")
+		return mail.LogMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", backend)
+	}
+}
+
+// newRelyingParty configures passkeys. They're bound to WEBAUTHN_RP_ID, a
+// domain the web app is served from (default: APP_URL's host), and only
+// work on the pages listed in WEBAUTHN_ORIGINS (default: APP_URL).
+func newRelyingParty(appURL string) (*webauthn.RelyingParty, error) {
+	u, err := url.Parse(appURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid APP_URL %q", appURL)
+	}
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		rpID = u.Hostname()
+	}
+	allowed := os.Getenv("WEBAUTHN_ORIGINS")
+	if allowed == "" {
+		allowed = u.Scheme + "://" + u.Host
+	}
+	var origins []string
+	for _, origin := range strings.Split(allowed, ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	log.Printf("passkeys enabled for %s (origins: %s)", rpID, strings.Join(origins, ", "))
+	return webauthn.NewRelyingParty(rpID, getEnv("WEBAUTHN_RP_NAME", "OpenCord"), origins), nil
+}
+
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
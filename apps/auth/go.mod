@@ -15,5 +15,8 @@ require (
 require (
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	github.com/opencord/shared v0.0.0-00010101000000-000000000000
 	go.uber.org/atomic v1.7.0 // indirect
 )
+
+replace github.com/opencord/shared => ../../packages/shared-go
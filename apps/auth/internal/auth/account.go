@@ -0,0 +1,314 @@
+package auth
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"github.com/opencord/auth/internal/mail"
+)
+
+// Deleting an account takes two steps. DeleteAccount schedules it and logs
+// the user out everywhere; signing in again within accountDeletionGrace
+// cancels it. After that the deletion loop removes the account and sends
+// each instance the user authorized an account_deleted security event
+// (RFC 8417), so the instance can anonymize its copy of the profile.
+const (
+	accountDeletionGrace = 14 * 24 * time.Hour
+
+	EventAccountDeleted = "account_deleted"
+	securityEventType   = "secevent+jwt"
+	securityEventTTL    = 5 * time.Minute
+
+	// Notices an instance doesn't accept are retried with doubling delays,
+	// then dropped after maxNoticeAttempts (about 15 hours).
+	noticeBatchSize   = 100
+	noticeRetryBase   = time.Minute
+	maxNoticeRetry    = 6 * time.Hour
+	maxNoticeAttempts = 10
+)
+
+// noticeClient posts deletion notices. Instance URLs are whatever users
+// authorized, so it only connects to public addresses, checked after DNS
+// resolution, and doesn't follow redirects; otherwise anyone could make
+// the auth server call services on its own network. It ignores proxy
+// settings, which would hide the real destination from the check.
+var noticeClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: dialPublicOnly}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// nonPublicRanges are special-purpose networks that net/netip's checks
+// don't cover.
+var nonPublicRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, which can reach private IPv4
+}
+
+// dialPublicOnly refuses connections to loopback, private, link-local
+// (which holds cloud metadata services) and other non-public addresses.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return fmt.Errorf("refusing to connect to non-public address %s", addr)
+	}
+	for _, prefix := range nonPublicRanges {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("refusing to connect to non-public address %s", addr)
+		}
+	}
+	return nil
+}
+
+// DeleteAccount schedules the user's account for deletion once they've
+// confirmed who they are, returning when it will happen.
+func (s *Service) DeleteAccount(userID uuid.UUID, req ReauthRequest) (time.Time, error) {
+	user, err := s.reauthenticate(userID, req)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	at := time.Now().Add(accountDeletionGrace)
+	if err := s.repo.ScheduleAccountDeletion(userID, at); err != nil {
+		return time.Time{}, err
+	}
+	if err := s.repo.DeleteUserSessions(userID); err != nil {
+		return time.Time{}, err
+	}
+
+	err = s.mailer.Send(context.Background(), mail.Message{
+		To:      user.Email,
+		Subject: "Your OpenCord account will be deleted",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Your OpenCord account and everything in it will be deleted on %s. "+
+			"Instances you've joined will be told, and will show your messages as from a deleted user.\n\n"+
+			"To keep your account, sign in again before then at %s/auth.\n",
+			user.DisplayName, at.UTC().Format("January 2, 2006"), s.appURL),
+	})
+	if err != nil {
+		log.Printf("failed to send account deletion email to user %s: %v", userID, err)
+	}
+	return at, nil
+}
+
+// cancelAccountDeletion keeps the account of a user who signs in during
+// the grace period.
+func (s *Service) cancelAccountDeletion(user *User) error {
+	cancelled, err := s.repo.CancelAccountDeletion(user.ID)
+	if err != nil {
+		return err
+	}
+	if cancelled {
+		s.notifySecurityChange(user.ID, "Your OpenCord account won't be deleted",
+			"You signed in to your OpenCord account, so it will no longer be deleted.")
+	}
+	return nil
+}
+
+// StartAccountDeletionLoop deletes accounts whose grace period has ended
+// and delivers the resulting notices to instances every interval.
+func (s *Service) StartAccountDeletionLoop(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.deleteDueAccounts(time.Now())
+			s.deliverDeletionNotices(time.Now())
+		}
+	}()
+}
+
+func (s *Service) deleteDueAccounts(now time.Time) {
+	ids, err := s.repo.DeleteDueAccounts(now)
+	if err != nil {
+		log.Printf("failed to delete accounts: %v", err)
+		return
+	}
+	for _, id := range ids {
+		log.Printf("deleted user %s at the end of the grace period", id)
+	}
+}
+
+// deliverDeletionNotices sends the notices that are due. Each is deleted
+// once its instance accepts it, or rescheduled.
+func (s *Service) deliverDeletionNotices(now time.Time) {
+	for {
+		notices, err := s.repo.DueDeletionNotices(now, noticeBatchSize)
+		if err != nil {
+			log.Printf("failed to load account deletion notices: %v", err)
+			return
+		}
+		for _, n := range notices {
+			err := s.sendDeletionNotice(n)
+			if err == nil || n.Attempts+1 >= maxNoticeAttempts {
+				if err != nil {
+					log.Printf("giving up telling %s that user %s was deleted: %v", n.InstanceURL, n.UserID, err)
+				}
+				err = s.repo.DeleteDeletionNotice(n.ID)
+			} else {
+				err = s.repo.RetryDeletionNotice(n.ID, now.Add(noticeRetry(n.Attempts+1)))
+			}
+			if err != nil {
+				log.Printf("failed to update account deletion notice %s: %v", n.ID, err)
+			}
+		}
+		if len(notices) < noticeBatchSize {
+			return
+		}
+	}
+}
+
+// sendDeletionNotice pushes a signed account_deleted event to the
+// instance's events endpoint (RFC 8935). Instances check it against the
+// JWKS like an access token; the typ header keeps one from passing for the
+// other.
+func (s *Service) sendDeletionNotice(n DeletionNotice) error {
+	now := time.Now()
+	token, err := s.signJWT(jwt.MapClaims{
+		"iss":    s.issuer,
+		"sub":    n.UserID.String(),
+		"aud":    n.InstanceURL,
+		"iat":    now.Unix(),
+		"exp":    now.Add(securityEventTTL).Unix(),
+		"jti":    n.ID.String(),
+		"events": map[string]interface{}{EventAccountDeleted: map[string]interface{}{}},
+	}, securityEventType)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.InstanceURL+"/api/auth/events", strings.NewReader(token))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/secevent+jwt")
+	resp, err := noticeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("instance responded %s", resp.Status)
+	}
+	return nil
+}
+
+// noticeRetry is how long to wait before a notice's next attempt.
+func noticeRetry(attempts int) time.Duration {
+	return min(noticeRetryBase<<min(attempts-1, 10), maxNoticeRetry)
+}
+
+// accountExport is profile.json in an account export.
+type accountExport struct {
+	UserResponse
+	TwoFactorEnabled bool `json:"twoFactorEnabled"`
+}
+
+// ExportAccount returns a ZIP of everything the auth server keeps about
+// the user, one JSON file per kind. Secrets (password hash, TOTP secret,
+// passkey keys, tokens) are left out.
+func (s *Service) ExportAccount(userID uuid.UUID) ([]byte, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	mfa, err := s.MFAStatus(userID)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := s.repo.ListSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := s.repo.ListInstanceGrants(userID)
+	if err != nil {
+		return nil, err
+	}
+	passkeys, err := s.repo.ListPasskeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	apps, err := s.repo.ListOAuthConsents(userID)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := s.repo.ListOAuthClients(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := accountExport{
+		UserResponse: UserResponse{
+			ID:            user.ID,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			Username:      user.Username,
+			DisplayName:   user.DisplayName,
+			AvatarURL:     user.AvatarURL,
+			CreatedAt:     user.CreatedAt,
+		},
+		TwoFactorEnabled: mfa.TOTPEnabled,
+	}
+	return writeZIP([]zipEntry{
+		{"profile.json", profile},
+		{"sessions.json", sessions},
+		{"instances.json", instances},
+		{"passkeys.json", passkeys},
+		{"authorized-apps.json", apps},
+		{"oauth-clients.json", clients},
+	})
+}
+
+type zipEntry struct {
+	name string
+	data interface{}
+}
+
+func writeZIP(entries []zipEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(e.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// KeysHandler lets an operator inspect and rotate the signing keys.
+type KeysHandler struct {
+	keys *KeyRing
+}
+
+func NewKeysHandler(keys *KeyRing) *KeysHandler {
+	return &KeysHandler{keys: keys}
+}
+
+func (h *KeysHandler) List(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.keys.Info(), http.StatusOK)
+}
+
+// Rotate makes the next key active straight away, e.g. after a suspected
+// key compromise. Tokens signed by the old key stay valid until they expire.
+func (h *KeysHandler) Rotate(w http.ResponseWriter, r *http.Request) {
+	if err := h.keys.Rotate(); err != nil {
+		log.Printf("failed to rotate signing keys: %v", err)
+		writeError(w, "failed to rotate keys", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("rotated signing keys (active kid: %s)", h.keys.Active().KID)
+	writeJSON(w, h.keys.Info(), http.StatusOK)
+}
+
+// AdminMiddleware only lets through requests bearing the operator token.
+func AdminMiddleware(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				writeError(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -14,3 +14,14 @@ func UserFromContext(ctx context.Context) (uuid.UUID, bool) {
 	userID, ok := ctx.Value(UserContextKey).(uuid.UUID)
 	return userID, ok
 }
+
+func SetSessionContext(ctx context.Context, sessionID uuid.UUID) context.Context {
+	return context.WithValue(ctx, SessionContextKey, sessionID)
+}
+
+// SessionFromContext returns the session the request's access token
+// belongs to, or the zero UUID.
+func SessionFromContext(ctx context.Context) uuid.UUID {
+	sessionID, _ := ctx.Value(SessionContextKey).(uuid.UUID)
+	return sessionID
+}
@@ -1,9 +1,22 @@
 package auth
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"github.com/opencord/shared/loginthrottle"
+	"github.com/opencord/shared/validation"
 )
 
 type Handler struct {
@@ -26,14 +39,11 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := h.service.Register(req)
+	resp, err := h.service.Register(req, clientInfo(r, req.DeviceName))
 	if err != nil {
-		if err == ErrEmailTaken {
-			writeError(w, "email already taken", http.StatusConflict)
-			return
-		}
-		if err == ErrUsernameTaken {
-			writeError(w, "username already taken", http.StatusConflict)
+		var fieldErr *validation.FieldError
+		if errors.As(err, &fieldErr) {
+			writeFieldError(w, fieldErr)
 			return
 		}
 		writeError(w, "registration failed", http.StatusInternalServerError)
@@ -50,16 +60,55 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := h.service.Login(req)
+	resp, challenge, err := h.service.Login(req, clientInfo(r, req.DeviceName))
 	if err != nil {
 		if err == ErrInvalidCredentials {
 			writeError(w, "invalid email or password", http.StatusUnauthorized)
 			return
 		}
+		var throttled *loginthrottle.ThrottledError
+		if errors.As(err, &throttled) {
+			writeThrottled(w, throttled)
+			return
+		}
 		writeError(w, "login failed", http.StatusInternalServerError)
 		return
 	}
 
+	if challenge != nil {
+		writeJSON(w, challenge, http.StatusOK)
+		return
+	}
+	writeJSON(w, resp, http.StatusOK)
+}
+
+// LoginMFA completes a login that returned an MFA challenge.
+func (h *Handler) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.service.CompleteMFALogin(req, clientInfo(r, ""))
+	if err != nil {
+		switch err {
+		case ErrInvalidToken:
+			writeError(w, "login expired, sign in again", http.StatusUnauthorized)
+		case ErrMFARequired:
+			writeError(w, err.Error(), http.StatusBadRequest)
+		case ErrInvalidMFACode, ErrInvalidPasskey:
+			writeError(w, err.Error(), http.StatusUnauthorized)
+		default:
+			var throttled *loginthrottle.ThrottledError
+			if errors.As(err, &throttled) {
+				writeThrottled(w, throttled)
+				return
+			}
+			writeError(w, "login failed", http.StatusInternalServerError)
+		}
+		return
+	}
 	writeJSON(w, resp, http.StatusOK)
 }
 
@@ -70,7 +119,7 @@ func (h *Handler) Refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := h.service.RefreshTokens(req.RefreshToken)
+	resp, err := h.service.RefreshTokens(req.RefreshToken, clientInfo(r, ""))
 	if err != nil {
 		writeError(w, "invalid refresh token", http.StatusUnauthorized)
 		return
@@ -104,12 +153,13 @@ func (h *Handler) GetMe(w http.ResponseWriter, r *http.Request) {
 	}
 
 	writeJSON(w, UserResponse{
-		ID:          user.ID,
-		Email:       user.Email,
-		Username:    user.Username,
-		DisplayName: user.DisplayName,
-		AvatarURL:   user.AvatarURL,
-		CreatedAt:   user.CreatedAt,
+		ID:            user.ID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Username:      user.Username,
+		DisplayName:   user.DisplayName,
+		AvatarURL:     user.AvatarURL,
+		CreatedAt:     user.CreatedAt,
 	}, http.StatusOK)
 }
 
@@ -133,49 +183,949 @@ func (h *Handler) UpdateMe(w http.ResponseWriter, r *http.Request) {
 	}
 
 	writeJSON(w, UserResponse{
-		ID:          user.ID,
-		Email:       user.Email,
-		Username:    user.Username,
-		DisplayName: user.DisplayName,
-		AvatarURL:   user.AvatarURL,
-		CreatedAt:   user.CreatedAt,
+		ID:            user.ID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Username:      user.Username,
+		DisplayName:   user.DisplayName,
+		AvatarURL:     user.AvatarURL,
+		CreatedAt:     user.CreatedAt,
 	}, http.StatusOK)
 }
 
-// Middleware authenticates requests using Bearer tokens.
-func (h *Handler) Middleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			writeError(w, "authorization header required", http.StatusUnauthorized)
+// BeginMFAPasskey returns the WebAuthn options for answering a login
+// challenge with a passkey.
+func (h *Handler) BeginMFAPasskey(w http.ResponseWriter, r *http.Request) {
+	var req MFAPasskeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := h.service.BeginMFAPasskey(req.Ticket)
+	if err != nil {
+		switch err {
+		case ErrInvalidToken:
+			writeError(w, "login expired, sign in again", http.StatusUnauthorized)
+		case ErrInvalidPasskey:
+			writeError(w, "no passkeys registered", http.StatusBadRequest)
+		case ErrPasskeysDisabled:
+			writeError(w, err.Error(), http.StatusNotFound)
+		default:
+			writeError(w, "failed to start passkey login", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, opts, http.StatusOK)
+}
+
+// BeginPasskeyLogin returns the WebAuthn options for a passwordless
+// login.
+func (h *Handler) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	opts, err := h.service.BeginPasskeyLogin()
+	if err != nil {
+		if err == ErrPasskeysDisabled {
+			writeError(w, err.Error(), http.StatusNotFound)
 			return
 		}
+		writeError(w, "failed to start passkey login", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, opts, http.StatusOK)
+}
 
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			writeError(w, "invalid authorization header", http.StatusUnauthorized)
+func (h *Handler) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var req PasskeyLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.service.FinishPasskeyLogin(req, clientInfo(r, req.DeviceName))
+	if err != nil {
+		switch err {
+		case ErrInvalidPasskey:
+			writeError(w, err.Error(), http.StatusUnauthorized)
+		case ErrPasskeysDisabled:
+			writeError(w, err.Error(), http.StatusNotFound)
+		default:
+			writeError(w, "login failed", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, resp, http.StatusOK)
+}
+
+// ListPasskeys lists the passkeys registered to the user.
+func (h *Handler) ListPasskeys(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	passkeys, err := h.service.ListPasskeys(userID)
+	if err != nil {
+		writeError(w, "failed to list passkeys", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, passkeys, http.StatusOK)
+}
+
+// BeginPasskeyRegistration returns the WebAuthn options for creating a
+// passkey. It requires the password and, with 2FA on, a code.
+func (h *Handler) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ReauthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Client = clientInfo(r, "")
+
+	opts, err := h.service.BeginPasskeyRegistration(userID, req)
+	if err != nil {
+		if err == ErrPasskeysDisabled {
+			writeError(w, err.Error(), http.StatusNotFound)
 			return
 		}
+		writeReauthError(w, err, "failed to start passkey registration")
+		return
+	}
+	writeJSON(w, opts, http.StatusOK)
+}
 
-		claims, err := h.service.ValidateAccessToken(parts[1])
-		if err != nil {
-			writeError(w, "invalid token", http.StatusUnauthorized)
+// FinishPasskeyRegistration stores the passkey the browser created.
+func (h *Handler) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req PasskeyRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	passkey, err := h.service.FinishPasskeyRegistration(userID, req)
+	if err != nil {
+		switch err {
+		case ErrInvalidPasskey:
+			writeError(w, "passkey could not be verified", http.StatusBadRequest)
+		case ErrPasskeysDisabled:
+			writeError(w, err.Error(), http.StatusNotFound)
+		default:
+			writeError(w, "failed to register passkey", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, passkey, http.StatusCreated)
+}
+
+func (h *Handler) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	passkeyID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, "invalid passkey id", http.StatusBadRequest)
+		return
+	}
+
+	var req ReauthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Client = clientInfo(r, "")
+
+	if err := h.service.DeletePasskey(userID, passkeyID, req); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, "passkey not found", http.StatusNotFound)
 			return
 		}
+		writeReauthError(w, err, "failed to delete passkey")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-		ctx := SetUserContext(r.Context(), claims.UserID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+// ChangeEmail moves the account to a new email address. It requires the
+// password and, with 2FA on, a code.
+func (h *Handler) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ChangeEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Client = clientInfo(r, "")
+
+	user, err := h.service.ChangeEmail(userID, req)
+	if err != nil {
+		var fieldErr *validation.FieldError
+		if errors.As(err, &fieldErr) {
+			writeFieldError(w, fieldErr)
+		} else {
+			writeReauthError(w, err, "failed to change email")
+		}
+		return
+	}
+
+	writeJSON(w, UserResponse{
+		ID:            user.ID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Username:      user.Username,
+		DisplayName:   user.DisplayName,
+		AvatarURL:     user.AvatarURL,
+		CreatedAt:     user.CreatedAt,
+	}, http.StatusOK)
 }
 
-func writeJSON(w http.ResponseWriter, data interface{}, status int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+// MFAStatus reports whether the user has two-factor authentication on.
+func (h *Handler) MFAStatus(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	status, err := h.service.MFAStatus(userID)
+	if err != nil {
+		writeError(w, "failed to get two-factor status", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status, http.StatusOK)
 }
 
-func writeError(w http.ResponseWriter, message string, status int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
+// BeginTOTPSetup returns a new TOTP secret and its otpauth URI.
+func (h *Handler) BeginTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ReauthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Client = clientInfo(r, "")
+
+	setup, err := h.service.BeginTOTPSetup(userID, req)
+	if err != nil {
+		if err == ErrMFAAlreadyEnabled {
+			writeError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeReauthError(w, err, "failed to start two-factor setup")
+		return
+	}
+	writeJSON(w, setup, http.StatusOK)
+}
+
+// ConfirmTOTPSetup turns TOTP on and returns the recovery codes.
+func (h *Handler) ConfirmTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ConfirmTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := h.service.ConfirmTOTPSetup(userID, req.Code)
+	if err != nil {
+		switch err {
+		case ErrInvalidMFACode, ErrNoMFASetup:
+			writeError(w, err.Error(), http.StatusBadRequest)
+		case ErrMFAAlreadyEnabled:
+			writeError(w, err.Error(), http.StatusConflict)
+		default:
+			writeError(w, "failed to enable two-factor authentication", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, codes, http.StatusOK)
+}
+
+func (h *Handler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ReauthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Client = clientInfo(r, "")
+
+	if err := h.service.DisableTOTP(userID, req); err != nil {
+		if err == ErrMFANotEnabled {
+			writeError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeReauthError(w, err, "failed to disable two-factor authentication")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ReauthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Client = clientInfo(r, "")
+
+	codes, err := h.service.RegenerateRecoveryCodes(userID, req)
+	if err != nil {
+		if err == ErrMFANotEnabled {
+			writeError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeReauthError(w, err, "failed to generate recovery codes")
+		return
+	}
+	writeJSON(w, codes, http.StatusOK)
+}
+
+// ListInstances lists the instances the user has authorized.
+func (h *Handler) ListInstances(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	grants, err := h.service.ListInstances(userID)
+	if err != nil {
+		writeError(w, "failed to list instances", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, grants, http.StatusOK)
+}
+
+// AuthorizeInstance allows an instance to receive tokens for the user.
+func (h *Handler) AuthorizeInstance(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req InstanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	grant, err := h.service.AuthorizeInstance(userID, req.InstanceURL)
+	if err != nil {
+		if err == ErrInvalidInstanceURL {
+			writeError(w, "invalid instance URL", http.StatusBadRequest)
+			return
+		}
+		writeError(w, "failed to authorize instance", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, grant, http.StatusCreated)
+}
+
+// RevokeInstance stops an instance from receiving new tokens. Tokens it
+// already holds expire within minutes.
+func (h *Handler) RevokeInstance(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	grantID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, "invalid instance id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.RevokeInstance(userID, grantID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, "instance not found", http.StatusNotFound)
+			return
+		}
+		writeError(w, "failed to revoke instance", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// InstanceToken exchanges the caller's token for one scoped to an
+// authorized instance.
+func (h *Handler) InstanceToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req InstanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.service.IssueInstanceToken(userID, req.InstanceURL)
+	if err != nil {
+		switch err {
+		case ErrInvalidInstanceURL:
+			writeError(w, "invalid instance URL", http.StatusBadRequest)
+		case ErrInstanceNotAllowed:
+			writeError(w, "instance not authorized", http.StatusForbidden)
+		default:
+			writeError(w, "failed to issue token", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, resp, http.StatusOK)
+}
+
+// ForgotPassword emails a reset link. The response is the same whether or
+// not the email has an account.
+func (h *Handler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		writeError(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.ForgotPassword(req.Email, clientInfo(r, "")); err != nil {
+		var throttled *loginthrottle.ThrottledError
+		if errors.As(err, &throttled) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			writeError(w, "too many password reset requests, try again later", http.StatusTooManyRequests)
+			return
+		}
+		log.Printf("failed to send password reset: %v", err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.ResetPassword(req.Token, req.Password); err != nil {
+		var fieldErr *validation.FieldError
+		switch {
+		case errors.As(err, &fieldErr):
+			writeFieldError(w, fieldErr)
+		case err == ErrInvalidToken:
+			writeError(w, "reset link is invalid or has expired", http.StatusBadRequest)
+		default:
+			writeError(w, "failed to reset password", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.VerifyEmail(req.Token); err != nil {
+		if err == ErrInvalidToken {
+			writeError(w, "verification link is invalid or has expired", http.StatusBadRequest)
+			return
+		}
+		writeError(w, "failed to verify email", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.service.ResendVerification(userID); err != nil {
+		if err == ErrAlreadyVerified {
+			writeError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("failed to resend verification email: %v", err)
+		writeError(w, "failed to send verification email", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ListSessions lists the devices the user is logged in on.
+// DeleteAccount schedules the user's account for deletion and logs them
+// out everywhere. It needs their password, and a 2FA code if they use one.
+func (h *Handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ReauthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Client = clientInfo(r, "")
+
+	at, err := h.service.DeleteAccount(userID, req)
+	if err != nil {
+		writeReauthError(w, err, "failed to delete account")
+		return
+	}
+	writeJSON(w, AccountDeletionResponse{DeletionScheduledAt: at}, http.StatusAccepted)
+}
+
+// ExportAccount downloads a ZIP of the user's account data.
+func (h *Handler) ExportAccount(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	archive, err := h.service.ExportAccount(userID)
+	if err != nil {
+		writeError(w, "failed to export account", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="opencord-account.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(archive)
+}
+
+func (h *Handler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := h.service.ListSessions(userID, SessionFromContext(r.Context()))
+	if err != nil {
+		writeError(w, "failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, sessions, http.StatusOK)
+}
+
+// RevokeSession logs one of the user's devices out.
+func (h *Handler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessionID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.RevokeSession(userID, sessionID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, "session not found", http.StatusNotFound)
+			return
+		}
+		writeError(w, "failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// OpenIDConfiguration serves the OpenID Provider metadata.
+func (h *Handler) OpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	writeOAuthJSON(w, h.service.Discovery(), http.StatusOK)
+}
+
+// Authorize is the OIDC authorization endpoint. It sends the browser to
+// the web app, where the user logs in if need be and gives consent.
+func (h *Handler) Authorize(w http.ResponseWriter, r *http.Request) {
+	location, err := h.service.StartAuthorization(AuthorizeRequestFromQuery(r.URL.Query()))
+	if err != nil {
+		switch err {
+		case ErrInvalidClient, ErrInvalidRedirectURI:
+			writeError(w, err.Error(), http.StatusBadRequest)
+		default:
+			writeError(w, "authorization failed", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// Token is the OIDC token endpoint. Clients authenticate with HTTP Basic
+// or client_id and client_secret in the form; public clients only send
+// client_id.
+func (h *Handler) Token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthJSON(w, &OAuthError{"invalid_request", "invalid form body"}, http.StatusBadRequest)
+		return
+	}
+	req := TokenRequest{
+		GrantType:    r.PostForm.Get("grant_type"),
+		Code:         r.PostForm.Get("code"),
+		RedirectURI:  r.PostForm.Get("redirect_uri"),
+		ClientID:     r.PostForm.Get("client_id"),
+		ClientSecret: r.PostForm.Get("client_secret"),
+		CodeVerifier: r.PostForm.Get("code_verifier"),
+	}
+	if id, secret, ok := r.BasicAuth(); ok {
+		// Both parts are form-encoded (RFC 6749 section 2.3.1)
+		req.ClientID, _ = url.QueryUnescape(id)
+		req.ClientSecret, _ = url.QueryUnescape(secret)
+	}
+
+	resp, err := h.service.ExchangeAuthorizationCode(req)
+	if err != nil {
+		var oauthErr *OAuthError
+		if !errors.As(err, &oauthErr) {
+			log.Printf("token request from client %s failed: %v", req.ClientID, err)
+			writeOAuthJSON(w, &OAuthError{Code: "server_error"}, http.StatusInternalServerError)
+			return
+		}
+		status := http.StatusBadRequest
+		if oauthErr.Code == "invalid_client" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="opencord"`)
+			status = http.StatusUnauthorized
+		}
+		writeOAuthJSON(w, oauthErr, status)
+		return
+	}
+	writeOAuthJSON(w, resp, http.StatusOK)
+}
+
+// UserInfo is the OIDC userinfo endpoint, for access tokens issued at
+// the token endpoint.
+func (h *Handler) UserInfo(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="opencord"`)
+		writeOAuthJSON(w, &OAuthError{"invalid_request", "bearer token required"}, http.StatusUnauthorized)
+		return
+	}
+
+	info, err := h.service.UserInfo(parts[1])
+	if err != nil {
+		if err == ErrInvalidToken {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="opencord", error="invalid_token"`)
+			writeOAuthJSON(w, &OAuthError{Code: "invalid_token"}, http.StatusUnauthorized)
+			return
+		}
+		writeOAuthJSON(w, &OAuthError{Code: "server_error"}, http.StatusInternalServerError)
+		return
+	}
+	writeOAuthJSON(w, info, http.StatusOK)
+}
+
+// GetConsent describes the authorization request in the query string for
+// the consent page.
+func (h *Handler) GetConsent(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	prompt, err := h.service.ConsentPrompt(userID, AuthorizeRequestFromQuery(r.URL.Query()))
+	if err != nil {
+		writeAuthorizeError(w, err)
+		return
+	}
+	writeJSON(w, prompt, http.StatusOK)
+}
+
+// Consent records the user's answer to the authorization request in the
+// query string and returns where to send the browser.
+func (h *Handler) Consent(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ConsentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	location, err := h.service.Authorize(userID, AuthorizeRequestFromQuery(r.URL.Query()), req.Approve)
+	if err != nil {
+		writeAuthorizeError(w, err)
+		return
+	}
+	writeJSON(w, ConsentResponse{RedirectURI: location}, http.StatusOK)
+}
+
+// ListOAuthClients lists the apps the user has registered.
+func (h *Handler) ListOAuthClients(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	clients, err := h.service.ListOAuthClients(userID)
+	if err != nil {
+		writeError(w, "failed to list clients", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, clients, http.StatusOK)
+}
+
+func (h *Handler) CreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateOAuthClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	client, err := h.service.RegisterOAuthClient(userID, req)
+	if err != nil {
+		if err == ErrClientNameRequired || err == ErrInvalidRedirectURIs {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeError(w, "failed to register client", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, client, http.StatusCreated)
+}
+
+func (h *Handler) DeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	clientID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, "invalid client id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.DeleteOAuthClient(userID, clientID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, "client not found", http.StatusNotFound)
+			return
+		}
+		writeError(w, "failed to delete client", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListOAuthConsents lists the apps the user has let log them in.
+func (h *Handler) ListOAuthConsents(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	consents, err := h.service.ListOAuthConsents(userID)
+	if err != nil {
+		writeError(w, "failed to list authorized apps", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, consents, http.StatusOK)
+}
+
+func (h *Handler) RevokeOAuthConsent(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserFromContext(r.Context())
+	if !ok {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	clientID, err := uuid.Parse(chi.URLParam(r, "clientId"))
+	if err != nil {
+		writeError(w, "invalid client id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.RevokeOAuthConsent(userID, clientID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, "app not authorized", http.StatusNotFound)
+			return
+		}
+		writeError(w, "failed to revoke app", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Middleware authenticates requests using Bearer tokens.
+func (h *Handler) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			writeError(w, "authorization header required", http.StatusUnauthorized)
+			return
+		}
+
+		parts := strings.SplitN(authHeader, " ", 2)
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			writeError(w, "invalid authorization header", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := h.service.ValidateAccessToken(parts[1])
+		if err != nil {
+			writeError(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := SetUserContext(r.Context(), claims.UserID)
+		ctx = SetSessionContext(ctx, claims.SessionID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientInfo describes the device making a login or refresh request.
+func clientInfo(r *http.Request, deviceName string) ClientInfo {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ClientInfo{
+		DeviceName: truncate(deviceName, 64),
+		IP:         ip,
+		UserAgent:  truncate(r.UserAgent(), 512),
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return strings.ToValidUTF8(s[:n], "")
+	}
+	return s
+}
+
+// writeReauthError responds to a failed re-authentication. These are 403s
+// rather than 401s so clients don't take them for an expired token.
+func writeReauthError(w http.ResponseWriter, err error, fallback string) {
+	var throttled *loginthrottle.ThrottledError
+	switch {
+	case err == ErrInvalidCredentials:
+		writeError(w, "incorrect password", http.StatusForbidden)
+	case err == ErrMFARequired, err == ErrInvalidMFACode:
+		writeError(w, err.Error(), http.StatusForbidden)
+	case errors.As(err, &throttled):
+		writeThrottled(w, throttled)
+	default:
+		writeError(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+// writeAuthorizeError responds to a consent page request the client got
+// wrong. The page shows the message rather than going back to the client.
+func writeAuthorizeError(w http.ResponseWriter, err error) {
+	var oauthErr *OAuthError
+	switch {
+	case err == ErrInvalidClient, err == ErrInvalidRedirectURI:
+		writeError(w, err.Error(), http.StatusBadRequest)
+	case errors.As(err, &oauthErr):
+		writeError(w, oauthErr.Description, http.StatusBadRequest)
+	default:
+		writeError(w, "authorization failed", http.StatusInternalServerError)
+	}
+}
+
+// writeThrottled tells a client to wait before trying to log in again.
+func writeThrottled(w http.ResponseWriter, err *loginthrottle.ThrottledError) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds()))))
+	writeError(w, "too many failed login attempts, try again later", http.StatusTooManyRequests)
+}
+
+// writeOAuthJSON writes a response defined by OAuth or OpenID Connect,
+// which clients expect without our data envelope.
+func writeOAuthJSON(w http.ResponseWriter, data interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func writeError(w http.ResponseWriter, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// writeFieldError adds the field and code to the error envelope so clients
+// can point at the offending input. Values already in use are conflicts.
+func writeFieldError(w http.ResponseWriter, err *validation.FieldError) {
+	status := http.StatusBadRequest
+	if err == validation.ErrEmailTaken || err == validation.ErrUsernameTaken {
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Message, "field": err.Field, "code": err.Code})
 }
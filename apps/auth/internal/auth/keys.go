@@ -0,0 +1,479 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// KeyState is where a signing key is in its lifecycle. A key is published
+// in the JWKS as next before it signs anything, so instances have it cached
+// by the time it becomes active, and stays published while retiring until
+// every token it signed has expired.
+type KeyState string
+
+const (
+	KeyNext     KeyState = "next"
+	KeyActive   KeyState = "active"
+	KeyRetiring KeyState = "retiring"
+)
+
+const (
+	// retiredKeyTTL is how long a key stays published after it stops
+	// signing; longer than any token it signed can live.
+	retiredKeyTTL = 24 * time.Hour
+
+	// manifestFile lists the keys in KEY_DIR and their states. Each key's
+	// private half is stored next to it as <kid>.pem.
+	manifestFile = "keys.json"
+
+	// lockFile serializes changes between processes sharing KEY_DIR.
+	lockFile = "keys.lock"
+
+	// staleLock is how old a lock file must be before it's assumed to be
+	// left over from a crashed process.
+	staleLock = time.Minute
+)
+
+type KeyPair struct {
+	PrivateKey *ecdsa.PrivateKey
+	PublicKey  *ecdsa.PublicKey
+	KID        string
+}
+
+// Key is a signing key and its lifecycle state.
+type Key struct {
+	*KeyPair
+	State       KeyState
+	CreatedAt   time.Time
+	ActivatedAt *time.Time // when it started signing
+	ExpiresAt   *time.Time // retiring keys: when it's removed
+}
+
+// KeyInfo describes a key without its private half.
+type KeyInfo struct {
+	KID         string     `json:"kid"`
+	State       KeyState   `json:"state"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ActivatedAt *time.Time `json:"activatedAt,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+}
+
+// KeyRing holds the ES256 keys in KEY_DIR: exactly one active key that
+// signs tokens, a next key waiting to replace it and any retiring keys
+// still needed to verify older tokens.
+type KeyRing struct {
+	dir string
+
+	mu      sync.RWMutex
+	keys    []*Key
+	modTime time.Time // of the manifest when last read
+}
+
+// LoadKeyRing loads the keys in dir, creating the directory and a first
+// active and next key if needed. A single private.pem from before key
+// rotation becomes the active key, so tokens it signed stay valid.
+func LoadKeyRing(dir string) (*KeyRing, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
+	}
+	kr := &KeyRing{dir: dir}
+	err := kr.withLock(func() error {
+		if err := kr.load(); err != nil {
+			return err
+		}
+		return kr.save()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// Active returns the key that signs new tokens.
+func (kr *KeyRing) Active() *KeyPair {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, k := range kr.keys {
+		if k.State == KeyActive {
+			return k.KeyPair
+		}
+	}
+	return nil // load guarantees an active key
+}
+
+// PublicKey returns the published key with the given ID.
+func (kr *KeyRing) PublicKey(kid string) (*ecdsa.PublicKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, k := range kr.keys {
+		if k.KID == kid && !k.expired(time.Now()) {
+			return k.PublicKey, true
+		}
+	}
+	return nil, false
+}
+
+// JWKS returns every published public key.
+func (kr *KeyRing) JWKS() JWKS {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	set := JWKS{Keys: []JWK{}}
+	for _, k := range kr.keys {
+		if !k.expired(time.Now()) {
+			set.Keys = append(set.Keys, PublicKeyToJWK(k.PublicKey, k.KID))
+		}
+	}
+	return set
+}
+
+// Info lists the keys and their states.
+func (kr *KeyRing) Info() []KeyInfo {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	out := make([]KeyInfo, len(kr.keys))
+	for i, k := range kr.keys {
+		out[i] = k.info()
+	}
+	return out
+}
+
+// Rotate promotes the next key to active, retires the active key and
+// generates a new next key. Keys whose retirement is over are deleted.
+func (kr *KeyRing) Rotate() error {
+	return kr.withLock(func() error {
+		// Another process may have rotated since we last looked
+		if err := kr.load(); err != nil {
+			return err
+		}
+		return kr.rotate(time.Now())
+	})
+}
+
+// RotateIfDue rotates when the active key has been signing for longer
+// than interval.
+func (kr *KeyRing) RotateIfDue(interval time.Duration) (bool, error) {
+	rotated := false
+	err := kr.withLock(func() error {
+		if err := kr.load(); err != nil {
+			return err
+		}
+		now := time.Now()
+		active := kr.find(KeyActive)
+		if active.ActivatedAt != nil && now.Sub(*active.ActivatedAt) < interval {
+			return kr.prune(now)
+		}
+		rotated = true
+		return kr.rotate(now)
+	})
+	return rotated, err
+}
+
+// StartRotationLoop picks up rotations made by other processes sharing
+// KEY_DIR, such as the rotate-keys command, and rotates automatically
+// once the active key is interval old. Zero interval disables automatic
+// rotation.
+func (kr *KeyRing) StartRotationLoop(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			if interval > 0 {
+				if rotated, err := kr.RotateIfDue(interval); err != nil {
+					log.Printf("failed to rotate signing keys: %v", err)
+				} else if rotated {
+					log.Printf("rotated signing keys (active kid: %s)", kr.Active().KID)
+				}
+				continue
+			}
+			if err := kr.reload(); err != nil {
+				log.Printf("failed to reload signing keys: %v", err)
+			}
+		}
+	}()
+}
+
+func (kr *KeyRing) rotate(now time.Time) error {
+	next, err := generateKey(KeyNext, now)
+	if err != nil {
+		return err
+	}
+	if err := kr.writePrivateKey(next.KeyPair); err != nil {
+		return err
+	}
+
+	kr.mu.Lock()
+	for _, k := range kr.keys {
+		switch k.State {
+		case KeyActive:
+			expires := now.Add(retiredKeyTTL)
+			k.State, k.ExpiresAt = KeyRetiring, &expires
+		case KeyNext:
+			k.State, k.ActivatedAt = KeyActive, &now
+		}
+	}
+	kr.keys = append(kr.keys, next)
+	kr.mu.Unlock()
+	return kr.prune(now)
+}
+
+// prune deletes keys whose retirement is over and saves the ring.
+func (kr *KeyRing) prune(now time.Time) error {
+	kr.mu.Lock()
+	kept := kr.keys[:0]
+	var removed []*Key
+	for _, k := range kr.keys {
+		if k.expired(now) {
+			removed = append(removed, k)
+		} else {
+			kept = append(kept, k)
+		}
+	}
+	kr.keys = kept
+	kr.mu.Unlock()
+
+	if err := kr.save(); err != nil {
+		return err
+	}
+	for _, k := range removed {
+		if err := os.Remove(kr.keyPath(k.KID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to delete retired key %s: %v", k.KID, err)
+		}
+	}
+	return nil
+}
+
+func (k *Key) expired(now time.Time) bool {
+	return k.State == KeyRetiring && k.ExpiresAt != nil && now.After(*k.ExpiresAt)
+}
+
+func (k *Key) info() KeyInfo {
+	return KeyInfo{KID: k.KID, State: k.State, CreatedAt: k.CreatedAt, ActivatedAt: k.ActivatedAt, ExpiresAt: k.ExpiresAt}
+}
+
+func (kr *KeyRing) find(state KeyState) *Key {
+	for _, k := range kr.keys {
+		if k.State == state {
+			return k
+		}
+	}
+	return nil
+}
+
+// reload rereads the manifest if another process changed it.
+func (kr *KeyRing) reload() error {
+	info, err := os.Stat(filepath.Join(kr.dir, manifestFile))
+	if err != nil {
+		return err
+	}
+	kr.mu.RLock()
+	unchanged := info.ModTime().Equal(kr.modTime)
+	kr.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	return kr.withLock(kr.load)
+}
+
+// load reads the manifest and key files, importing a legacy key or
+// generating keys so there is always one active and one next key.
+func (kr *KeyRing) load() error {
+	now := time.Now()
+	manifestPath := filepath.Join(kr.dir, manifestFile)
+
+	var keys []*Key
+	data, err := os.ReadFile(manifestPath)
+	switch {
+	case err == nil:
+		var infos []KeyInfo
+		if err := json.Unmarshal(data, &infos); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", manifestFile, err)
+		}
+		for _, info := range infos {
+			kp, err := readPrivateKey(kr.keyPath(info.KID))
+			if err != nil {
+				return err
+			}
+			if kp.KID != info.KID {
+				return fmt.Errorf("key file %s.pem holds key %s", info.KID, kp.KID)
+			}
+			keys = append(keys, &Key{KeyPair: kp, State: info.State, CreatedAt: info.CreatedAt,
+				ActivatedAt: info.ActivatedAt, ExpiresAt: info.ExpiresAt})
+		}
+	case os.IsNotExist(err):
+		legacy := filepath.Join(kr.dir, "private.pem")
+		if _, err := os.Stat(legacy); err == nil {
+			kp, err := readPrivateKey(legacy)
+			if err != nil {
+				return err
+			}
+			if err := kr.writePrivateKey(kp); err != nil {
+				return err
+			}
+			keys = append(keys, &Key{KeyPair: kp, State: KeyActive, CreatedAt: now, ActivatedAt: &now})
+		}
+	default:
+		return fmt.Errorf("failed to read %s: %w", manifestFile, err)
+	}
+
+	for _, state := range []KeyState{KeyActive, KeyNext} {
+		n := 0
+		for _, k := range keys {
+			if k.State == state {
+				n++
+			}
+		}
+		if n > 1 {
+			return fmt.Errorf("%s lists %d %s keys", manifestFile, n, state)
+		}
+		if n == 0 {
+			k, err := generateKey(state, now)
+			if err != nil {
+				return err
+			}
+			if err := kr.writePrivateKey(k.KeyPair); err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+	}
+
+	kr.mu.Lock()
+	kr.keys = keys
+	kr.mu.Unlock()
+	return nil
+}
+
+// save writes the manifest atomically.
+func (kr *KeyRing) save() error {
+	kr.mu.RLock()
+	infos := make([]KeyInfo, len(kr.keys))
+	for i, k := range kr.keys {
+		infos[i] = k.info()
+	}
+	kr.mu.RUnlock()
+
+	data, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(kr.dir, manifestFile)
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", manifestFile, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	kr.modTime = info.ModTime()
+	kr.mu.Unlock()
+	return nil
+}
+
+// withLock runs fn holding the KEY_DIR lock file.
+func (kr *KeyRing) withLock(fn func() error) error {
+	path := filepath.Join(kr.dir, lockFile)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to lock key directory: %w", err)
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for key directory lock")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer os.Remove(path)
+	return fn()
+}
+
+func (kr *KeyRing) keyPath(kid string) string {
+	return filepath.Join(kr.dir, kid+".pem")
+}
+
+func (kr *KeyRing) writePrivateKey(kp *KeyPair) error {
+	der, err := x509.MarshalECPrivateKey(kp.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := writeFileAtomic(kr.keyPath(kp.KID), data, 0600); err != nil {
+		return fmt.Errorf("failed to write private key: %w", err)
+	}
+	return nil
+}
+
+func generateKey(state KeyState, now time.Time) (*Key, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	k := &Key{KeyPair: newKeyPair(privateKey), State: state, CreatedAt: now}
+	if state == KeyActive {
+		k.ActivatedAt = &now
+	}
+	return k, nil
+}
+
+func newKeyPair(privateKey *ecdsa.PrivateKey) *KeyPair {
+	return &KeyPair{
+		PrivateKey: privateKey,
+		PublicKey:  &privateKey.PublicKey,
+		KID:        computeKID(&privateKey.PublicKey),
+	}
+}
+
+func readPrivateKey(path string) (*KeyPair, error) {
+	privPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	block, _ := pem.Decode(privPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key PEM %s", filepath.Base(path))
+	}
+	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return newKeyPair(privateKey), nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
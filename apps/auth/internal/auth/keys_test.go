@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func kids(set JWKS) map[string]bool {
+	out := map[string]bool{}
+	for _, k := range set.Keys {
+		out[k.KID] = true
+	}
+	return out
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	dir := t.TempDir()
+	kr, err := LoadKeyRing(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := kr.Active().KID
+	var next string
+	for _, k := range kr.Info() {
+		if k.State == KeyNext {
+			next = k.KID
+		}
+	}
+	if next == "" || len(kr.JWKS().Keys) != 2 {
+		t.Fatalf("new ring = %+v", kr.Info())
+	}
+
+	if err := kr.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if kr.Active().KID != next {
+		t.Errorf("active after rotation = %s, want the next key %s", kr.Active().KID, next)
+	}
+	published := kids(kr.JWKS())
+	if len(published) != 3 || !published[first] {
+		t.Errorf("published after rotation = %v, want the retiring key kept", published)
+	}
+	if _, ok := kr.PublicKey(first); !ok {
+		t.Error("retiring key no longer verifies")
+	}
+
+	// A second process sharing the directory sees the same keys
+	other, err := LoadKeyRing(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Active().KID != next || len(other.JWKS().Keys) != 3 {
+		t.Errorf("reloaded ring = %+v", other.Info())
+	}
+
+	// Once its tokens have expired the retired key is removed
+	if err := kr.withLock(func() error { return kr.prune(time.Now().Add(retiredKeyTTL + time.Minute)) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kr.PublicKey(first); ok || len(kr.JWKS().Keys) != 2 {
+		t.Errorf("retired key still published: %+v", kr.Info())
+	}
+	if _, err := os.Stat(filepath.Join(dir, first+".pem")); !os.IsNotExist(err) {
+		t.Errorf("retired key file kept: %v", err)
+	}
+}
+
+func TestKeyRingRotateIfDue(t *testing.T) {
+	kr, err := LoadKeyRing(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated, err := kr.RotateIfDue(time.Hour); err != nil || rotated {
+		t.Fatalf("fresh key rotated = %v, %v", rotated, err)
+	}
+	if rotated, err := kr.RotateIfDue(0); err != nil || !rotated {
+		t.Fatalf("due key rotated = %v, %v", rotated, err)
+	}
+}
+
+func TestKeyRingImportsLegacyKey(t *testing.T) {
+	dir := t.TempDir()
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(privateKey)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, "private.pem"), pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kr, err := LoadKeyRing(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := computeKID(&privateKey.PublicKey); kr.Active().KID != kid {
+		t.Errorf("active kid = %s, want the existing key %s", kr.Active().KID, kid)
+	}
+}
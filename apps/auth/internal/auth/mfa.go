@@ -0,0 +1,408 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/opencord/auth/internal/mail"
+	"github.com/opencord/shared/validation"
+)
+
+// Second factors a login challenge can be answered with.
+const (
+	MFAMethodTOTP         = "totp"
+	MFAMethodRecoveryCode = "recovery_code"
+)
+
+const (
+	totpIssuer = "OpenCord"
+
+	mfaTicketTTL = 5 * time.Minute
+
+	// mfaTicketAttempts is how many wrong codes a ticket survives before
+	// the user has to enter their password again.
+	mfaTicketAttempts = 5
+
+	recoveryCodeCount = 10
+)
+
+// CompleteMFALogin finishes a two-step login with a TOTP code, a recovery
+// code or a passkey. Wrong codes count against the account and IP address
+// like wrong passwords, so fetching new tickets doesn't allow more guesses.
+func (s *Service) CompleteMFALogin(req MFALoginRequest, client ClientInfo) (*AuthResponse, error) {
+	ticket, err := s.repo.GetMFATicket(hashToken(req.Ticket))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	user, err := s.repo.GetUserByID(ticket.UserID)
+	if err != nil {
+		return nil, err
+	}
+	attempt, err := s.beginLogin(user.Email, client)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.WebAuthn != nil && s.WebAuthn != nil {
+		_, err = s.verifyPasskey(ceremonyMFA, ticket.UserID, req.WebAuthn, false)
+	} else {
+		err = s.verifySecondFactor(ticket.UserID, req.Code)
+	}
+	if err != nil {
+		if err == ErrInvalidMFACode || err == ErrInvalidPasskey {
+			s.loginFailed(attempt, user, client)
+			if attempts, _ := s.repo.RecordMFATicketFailure(ticket.ID); attempts >= mfaTicketAttempts {
+				_, _ = s.repo.DeleteMFATicket(ticket.ID)
+			}
+		}
+		return nil, err
+	}
+	if ok, err := s.repo.DeleteMFATicket(ticket.ID); err != nil || !ok {
+		return nil, ErrInvalidToken
+	}
+
+	if client.DeviceName == "" {
+		client.DeviceName = ticket.DeviceName
+	}
+	resp, err := s.startSession(user, client)
+	if err != nil {
+		return nil, err
+	}
+	s.loginSucceeded(attempt, user, client)
+	return resp, nil
+}
+
+// MFAStatus reports which second factors the user has set up.
+func (s *Service) MFAStatus(userID uuid.UUID) (*MFAStatusResponse, error) {
+	enabled, err := s.totpEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	remaining, err := s.repo.CountRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &MFAStatusResponse{TOTPEnabled: enabled, RecoveryCodesRemaining: remaining}, nil
+}
+
+// BeginTOTPSetup generates a new TOTP secret for the user to add to their
+// authenticator app. It isn't required at login until confirmed.
+func (s *Service) BeginTOTPSetup(userID uuid.UUID, req ReauthRequest) (*TOTPSetupResponse, error) {
+	enabled, err := s.totpEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	user, err := s.reauthenticate(userID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.SavePendingTOTPSecret(userID, secret); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMFAAlreadyEnabled
+		}
+		return nil, err
+	}
+	return &TOTPSetupResponse{Secret: secret, URI: totpURI(totpIssuer, user.Email, secret)}, nil
+}
+
+// ConfirmTOTPSetup enables TOTP once the user proves their app generates
+// the right codes, and returns their recovery codes. This is the only time
+// the codes are shown.
+func (s *Service) ConfirmTOTPSetup(userID uuid.UUID, code string) (*RecoveryCodesResponse, error) {
+	totp, err := s.repo.GetTOTPSecret(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoMFASetup
+		}
+		return nil, err
+	}
+	if totp.EnabledAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	step, ok := matchTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.EnableTOTP(userID, hashes); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMFAAlreadyEnabled
+		}
+		return nil, err
+	}
+	if _, err := s.repo.UseTOTPStep(userID, step); err != nil {
+		return nil, err
+	}
+
+	s.notifySecurityChange(userID, "Two-factor authentication turned on",
+		"Two-factor authentication was turned on for your OpenCord account. You'll need a code from your authenticator app to log in.")
+	return &RecoveryCodesResponse{RecoveryCodes: codes}, nil
+}
+
+// DisableTOTP turns two-factor authentication off and deletes the user's
+// recovery codes.
+func (s *Service) DisableTOTP(userID uuid.UUID, req ReauthRequest) error {
+	enabled, err := s.totpEnabled(userID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return ErrMFANotEnabled
+	}
+	if _, err := s.reauthenticate(userID, req); err != nil {
+		return err
+	}
+	if err := s.repo.DisableTOTP(userID); err != nil {
+		return err
+	}
+
+	s.notifySecurityChange(userID, "Two-factor authentication turned off",
+		"Two-factor authentication was turned off for your OpenCord account. Only your password is needed to log in now.")
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes, invalidating
+// the old ones.
+func (s *Service) RegenerateRecoveryCodes(userID uuid.UUID, req ReauthRequest) (*RecoveryCodesResponse, error) {
+	enabled, err := s.totpEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrMFANotEnabled
+	}
+	if _, err := s.reauthenticate(userID, req); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return &RecoveryCodesResponse{RecoveryCodes: codes}, nil
+}
+
+// ChangeEmail moves the account to a new address, which then has to be
+// verified. The old address is told about the change.
+func (s *Service) ChangeEmail(userID uuid.UUID, req ChangeEmailRequest) (*User, error) {
+	email := strings.TrimSpace(req.Email)
+	if err := validation.Email(email); err != nil {
+		return nil, err
+	}
+	user, err := s.reauthenticate(userID, req.ReauthRequest)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(email, user.Email) {
+		return user, nil
+	}
+	if _, err := s.repo.GetUserByEmail(email); err == nil {
+		return nil, validation.ErrEmailTaken
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if err := s.repo.UpdateEmail(userID, email); err != nil {
+		return nil, err
+	}
+	s.notifySecurityChange(userID, "Your OpenCord email was changed",
+		fmt.Sprintf("The email address on your OpenCord account was changed to %s.", email))
+
+	user.Email, user.EmailVerified = email, false
+	if err := s.sendVerification(user); err != nil {
+		log.Printf("failed to send verification email to user %s: %v", user.ID, err)
+	}
+	return user, nil
+}
+
+// reauthenticate checks the password, and the second factor if the user
+// has one, before a sensitive action. Wrong ones count against the login
+// throttle, so a stolen access token doesn't allow unlimited guesses.
+func (s *Service) reauthenticate(userID uuid.UUID, req ReauthRequest) (*User, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	attempt, err := s.beginLogin(user.Email, req.Client)
+	if err != nil {
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		s.loginFailed(attempt, user, req.Client)
+		return nil, ErrInvalidCredentials
+	}
+
+	enabled, err := s.totpEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		if err := s.verifySecondFactor(userID, req.Code); err != nil {
+			if err == ErrInvalidMFACode {
+				s.loginFailed(attempt, user, req.Client)
+			}
+			return nil, err
+		}
+	}
+	if err := attempt.Succeeded(); err != nil {
+		log.Printf("failed to clear login failures for user %s: %v", user.ID, err)
+	}
+	return user, nil
+}
+
+// verifySecondFactor accepts a TOTP code, each at most once, or uses up one
+// of the user's recovery codes.
+func (s *Service) verifySecondFactor(userID uuid.UUID, code string) error {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return ErrMFARequired
+	}
+
+	totp, err := s.repo.GetTOTPSecret(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidMFACode
+		}
+		return err
+	}
+	if totp.EnabledAt == nil {
+		return ErrInvalidMFACode
+	}
+
+	if step, ok := matchTOTP(totp.Secret, code, time.Now()); ok {
+		fresh, err := s.repo.UseTOTPStep(userID, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	used, err := s.repo.ConsumeRecoveryCode(userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// mfaMethods lists the second factors a login has to be completed with;
+// none if the user hasn't set up two-factor authentication. Passkeys only
+// count once 2FA is on, since that's when the user gets recovery codes to
+// fall back on.
+func (s *Service) mfaMethods(userID uuid.UUID) ([]string, error) {
+	enabled, err := s.totpEnabled(userID)
+	if err != nil || !enabled {
+		return nil, err
+	}
+	methods := []string{MFAMethodTOTP, MFAMethodRecoveryCode}
+	if s.WebAuthn != nil {
+		passkeys, err := s.repo.ListPasskeys(userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(passkeys) > 0 {
+			methods = append(methods, MFAMethodWebAuthn)
+		}
+	}
+	return methods, nil
+}
+
+func (s *Service) totpEnabled(userID uuid.UUID) (bool, error) {
+	totp, err := s.repo.GetTOTPSecret(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return totp.EnabledAt != nil, nil
+}
+
+func (s *Service) createMFATicket(userID uuid.UUID, client ClientInfo, methods []string) (*MFAChallenge, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate ticket: %w", err)
+	}
+	ticket := hex.EncodeToString(b)
+	expiresAt := time.Now().Add(mfaTicketTTL)
+	if err := s.repo.CreateMFATicket(userID, hashToken(ticket), client.DeviceName, expiresAt); err != nil {
+		return nil, fmt.Errorf("failed to store ticket: %w", err)
+	}
+	return &MFAChallenge{MFARequired: true, Ticket: ticket, Methods: methods, ExpiresAt: expiresAt}, nil
+}
+
+// notifySecurityChange emails the user about a change to how their
+// account is protected. Failures are only logged.
+func (s *Service) notifySecurityChange(userID uuid.UUID, subject, what string) {
+	user, err := s.repo.GetUserByID(userID)
+	if err == nil {
+		err = s.mailer.Send(context.Background(), mail.Message{
+			To:      user.Email,
+			Subject: subject,
+			Body: fmt.Sprintf("Hi %s,\n\n%s\n\n"+
+				"If this wasn't you, reset your password right away at %s/auth.\n",
+				user.DisplayName, what, s.appURL),
+		})
+	}
+	if err != nil {
+		log.Printf("failed to send security notification to user %s: %v", userID, err)
+	}
+}
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateRecoveryCodes returns new single-use recovery codes, formatted
+// like "abcd-efgh-ijkl-mnop", and their hashes for storage.
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		raw := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		codes = append(codes, raw[0:4]+"-"+raw[4:8]+"-"+raw[8:12]+"-"+raw[12:16])
+		hashes = append(hashes, hashRecoveryCode(raw))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code however the user typed it.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashToken(code)
+}
@@ -1,9 +1,12 @@
 package auth
 
 import (
+	"net/url"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/opencord/auth/internal/webauthn"
 )
 
 type RegisterRequest struct {
@@ -11,11 +14,43 @@ type RegisterRequest struct {
 	Username    string `json:"username"`
 	DisplayName string `json:"displayName"`
 	Password    string `json:"password"`
+	DeviceName  string `json:"deviceName,omitempty"`
 }
 
 type LoginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	DeviceName string `json:"deviceName,omitempty"`
+}
+
+// MFALoginRequest answers the challenge returned by a login with a TOTP
+// code, a recovery code or a passkey.
+type MFALoginRequest struct {
+	Ticket   string                      `json:"ticket"`
+	Code     string                      `json:"code,omitempty"`
+	WebAuthn *webauthn.AssertionResponse `json:"webauthn,omitempty"`
+}
+
+type MFAPasskeyRequest struct {
+	Ticket string `json:"ticket"`
+}
+
+type PasskeyLoginRequest struct {
+	Credential webauthn.AssertionResponse `json:"credential"`
+	DeviceName string                     `json:"deviceName,omitempty"`
+}
+
+type PasskeyRegistrationRequest struct {
+	Name       string                       `json:"name"`
+	Credential webauthn.AttestationResponse `json:"credential"`
+}
+
+// MFAChallenge is returned by a login that needs a second factor.
+type MFAChallenge struct {
+	MFARequired bool      `json:"mfaRequired"`
+	Ticket      string    `json:"ticket"`
+	Methods     []string  `json:"methods"`
+	ExpiresAt   time.Time `json:"expiresAt"`
 }
 
 type AuthResponse struct {
@@ -25,12 +60,65 @@ type AuthResponse struct {
 }
 
 type UserResponse struct {
-	ID          uuid.UUID `json:"id"`
-	Email       string    `json:"email"`
-	Username    string    `json:"username"`
-	DisplayName string    `json:"displayName"`
-	AvatarURL   *string   `json:"avatarUrl"`
-	CreatedAt   time.Time `json:"createdAt"`
+	ID            uuid.UUID `json:"id"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"emailVerified"`
+	Username      string    `json:"username"`
+	DisplayName   string    `json:"displayName"`
+	AvatarURL     *string   `json:"avatarUrl"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// ReauthRequest confirms the user's identity before a sensitive action:
+// their password, plus a TOTP or recovery code if they use 2FA.
+type ReauthRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code,omitempty"`
+
+	// Client is filled in by the handler for the login throttle.
+	Client ClientInfo `json:"-"`
+}
+
+// AccountDeletionResponse says when a deleted account will be gone for
+// good. Signing in before then cancels the deletion.
+type AccountDeletionResponse struct {
+	DeletionScheduledAt time.Time `json:"deletionScheduledAt"`
+}
+
+type ChangeEmailRequest struct {
+	Email string `json:"email"`
+	ReauthRequest
+}
+
+type ConfirmTOTPRequest struct {
+	Code string `json:"code"`
+}
+
+type TOTPSetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauthUri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type MFAStatusResponse struct {
+	TOTPEnabled            bool `json:"totpEnabled"`
+	RecoveryCodesRemaining int  `json:"recoveryCodesRemaining"`
 }
 
 type RefreshRequest struct {
@@ -42,13 +130,149 @@ type UpdateUserRequest struct {
 	AvatarURL   *string `json:"avatarUrl"`
 }
 
+type InstanceRequest struct {
+	InstanceURL string `json:"instanceUrl"`
+}
+
+type InstanceTokenResponse struct {
+	AccessToken string    `json:"accessToken"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+type CreateOAuthClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirectUris"`
+	Public       bool     `json:"public"`
+}
+
+// OAuthClientResponse is a newly registered client, the only time its
+// secret is shown.
+type OAuthClientResponse struct {
+	OAuthClient
+	ClientSecret string `json:"clientSecret,omitempty"`
+}
+
+// AuthorizeRequest is an OpenID Connect authentication request. The
+// authorization endpoint passes it on to the consent page unchanged.
+type AuthorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+func AuthorizeRequestFromQuery(q url.Values) AuthorizeRequest {
+	return AuthorizeRequest{
+		ResponseType:        q.Get("response_type"),
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		Nonce:               q.Get("nonce"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+	}
+}
+
+// Values returns the request's query parameters.
+func (r AuthorizeRequest) Values() url.Values {
+	q := url.Values{}
+	for k, v := range map[string]string{
+		"response_type":         r.ResponseType,
+		"client_id":             r.ClientID,
+		"redirect_uri":          r.RedirectURI,
+		"scope":                 r.Scope,
+		"state":                 r.State,
+		"nonce":                 r.Nonce,
+		"code_challenge":        r.CodeChallenge,
+		"code_challenge_method": r.CodeChallengeMethod,
+	} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	return q
+}
+
+// ConsentPrompt describes an authorization request to the user.
+// Consented is set if they already allowed all of Scopes.
+type ConsentPrompt struct {
+	ClientID    uuid.UUID `json:"clientId"`
+	ClientName  string    `json:"clientName"`
+	RedirectURI string    `json:"redirectUri"`
+	Scopes      []string  `json:"scopes"`
+	Consented   bool      `json:"consented"`
+}
+
+type ConsentRequest struct {
+	Approve bool `json:"approve"`
+}
+
+// ConsentResponse is where the consent page sends the browser next.
+type ConsentResponse struct {
+	RedirectURI string `json:"redirectUri"`
+}
+
+// TokenRequest is a form posted to the token endpoint.
+type TokenRequest struct {
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	ClientID     string
+	ClientSecret string
+	CodeVerifier string
+}
+
+// TokenResponse is the token endpoint's response. Like the other OAuth
+// and OIDC responses it uses the spec's field names and no data envelope.
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+	IDToken     string `json:"id_token,omitempty"`
+}
+
+// DiscoveryDocument is the OpenID Provider metadata served at
+// /.well-known/openid-configuration.
+type DiscoveryDocument struct {
+	Issuer                                     string   `json:"issuer"`
+	AuthorizationEndpoint                      string   `json:"authorization_endpoint"`
+	TokenEndpoint                              string   `json:"token_endpoint"`
+	UserInfoEndpoint                           string   `json:"userinfo_endpoint"`
+	JWKSURI                                    string   `json:"jwks_uri"`
+	ScopesSupported                            []string `json:"scopes_supported"`
+	ResponseTypesSupported                     []string `json:"response_types_supported"`
+	GrantTypesSupported                        []string `json:"grant_types_supported"`
+	SubjectTypesSupported                      []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                            []string `json:"claims_supported"`
+	AuthorizationResponseIssParameterSupported bool     `json:"authorization_response_iss_parameter_supported"`
+}
+
 type TokenClaims struct {
-	UserID      uuid.UUID
-	Username    string
-	DisplayName string
-	AvatarURL   *string
+	UserID        uuid.UUID
+	SessionID     uuid.UUID // zero if the token isn't tied to a session
+	Username      string
+	DisplayName   string
+	AvatarURL     *string
+	EmailVerified bool
+}
+
+// ClientInfo describes the device a session belongs to.
+type ClientInfo struct {
+	DeviceName string
+	IP         string
+	UserAgent  string
 }
 
 type contextKey string
 
 const UserContextKey contextKey = "user"
+const SessionContextKey contextKey = "session"
@@ -0,0 +1,515 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// OpenID Connect scopes. openid is required; profile and email each
+// release some of the claims in our own access tokens.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+const (
+	oauthCodeTTL        = time.Minute
+	oauthAccessTokenTTL = time.Hour
+	maxRedirectURIs     = 10
+
+	// accessTokenType marks the access tokens we issue to OAuth clients
+	// (RFC 9068), so an ID token for the same client can't stand in for
+	// one.
+	accessTokenType = "at+jwt"
+)
+
+var supportedScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+
+var (
+	ErrInvalidClient       = errors.New("unknown client")
+	ErrInvalidRedirectURI  = errors.New("redirect URI not registered for this client")
+	ErrClientNameRequired  = errors.New("client name is required")
+	ErrInvalidRedirectURIs = errors.New("invalid redirect URIs")
+)
+
+// OAuthError is an error defined by OAuth 2.0, reported to clients in the
+// error and error_description parameters.
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// RegisterOAuthClient registers an app owned by the user. Confidential
+// clients get a secret, returned only this once.
+func (s *Service) RegisterOAuthClient(ownerID uuid.UUID, req CreateOAuthClientRequest) (*OAuthClientResponse, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return nil, ErrClientNameRequired
+	}
+	if len(req.RedirectURIs) == 0 || len(req.RedirectURIs) > maxRedirectURIs {
+		return nil, ErrInvalidRedirectURIs
+	}
+	for _, uri := range req.RedirectURIs {
+		if !validRedirectURI(uri, req.Public) {
+			return nil, ErrInvalidRedirectURIs
+		}
+	}
+
+	client := &OAuthClient{OwnerID: ownerID, Name: truncate(name, 64), RedirectURIs: req.RedirectURIs}
+	var secret string
+	if !req.Public {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate client secret: %w", err)
+		}
+		secret = hex.EncodeToString(b)
+		hash := hashToken(secret)
+		client.SecretHash = &hash
+	}
+
+	client, err := s.repo.CreateOAuthClient(client)
+	if err != nil {
+		return nil, err
+	}
+	return &OAuthClientResponse{OAuthClient: *client, ClientSecret: secret}, nil
+}
+
+func (s *Service) ListOAuthClients(ownerID uuid.UUID) ([]OAuthClient, error) {
+	return s.repo.ListOAuthClients(ownerID)
+}
+
+func (s *Service) DeleteOAuthClient(ownerID, id uuid.UUID) error {
+	return s.repo.DeleteOAuthClient(ownerID, id)
+}
+
+// ListOAuthConsents lists the apps the user has let log them in.
+func (s *Service) ListOAuthConsents(userID uuid.UUID) ([]OAuthConsent, error) {
+	return s.repo.ListOAuthConsents(userID)
+}
+
+// RevokeOAuthConsent withdraws a client's access. Its access tokens stop
+// working at the userinfo endpoint straight away.
+func (s *Service) RevokeOAuthConsent(userID, clientID uuid.UUID) error {
+	return s.repo.DeleteOAuthConsent(userID, clientID)
+}
+
+// StartAuthorization handles a request to the authorization endpoint. It
+// returns where to send the browser: the web app's consent page, or back
+// to the client if the request is invalid.
+func (s *Service) StartAuthorization(req AuthorizeRequest) (string, error) {
+	if _, _, err := s.checkAuthorizeRequest(req); err != nil {
+		var oauthErr *OAuthError
+		if errors.As(err, &oauthErr) {
+			return s.authorizationResponse(req, oauthErr.values()), nil
+		}
+		return "", err
+	}
+	return s.appURL + "/oauth/authorize?" + req.Values().Encode(), nil
+}
+
+// ConsentPrompt describes an authorization request for the consent page.
+func (s *Service) ConsentPrompt(userID uuid.UUID, req AuthorizeRequest) (*ConsentPrompt, error) {
+	client, scopes, err := s.checkAuthorizeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	consented := false
+	consent, err := s.repo.GetOAuthConsent(userID, client.ID)
+	if err == nil {
+		consented = coversScopes(consent.Scopes, scopes)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return &ConsentPrompt{
+		ClientID:    client.ID,
+		ClientName:  client.Name,
+		RedirectURI: req.RedirectURI,
+		Scopes:      scopes,
+		Consented:   consented,
+	}, nil
+}
+
+// Authorize records the user's answer on the consent page and returns the
+// client's redirect URI with either an authorization code or an error.
+func (s *Service) Authorize(userID uuid.UUID, req AuthorizeRequest, approve bool) (string, error) {
+	client, scopes, err := s.checkAuthorizeRequest(req)
+	if err != nil {
+		var oauthErr *OAuthError
+		if errors.As(err, &oauthErr) {
+			return s.authorizationResponse(req, oauthErr.values()), nil
+		}
+		return "", err
+	}
+	if !approve {
+		return s.authorizationResponse(req, url.Values{"error": {"access_denied"}}), nil
+	}
+
+	// Consent only grows, so allowing profile doesn't take back email
+	granted := scopes
+	consent, err := s.repo.GetOAuthConsent(userID, client.ID)
+	if err == nil {
+		granted = mergeScopes(consent.Scopes, scopes)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if err := s.repo.SaveOAuthConsent(userID, client.ID, granted); err != nil {
+		return "", fmt.Errorf("failed to save consent: %w", err)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate authorization code: %w", err)
+	}
+	code := hex.EncodeToString(b)
+	err = s.repo.CreateOAuthCode(&OAuthCode{
+		ClientID:      client.ID,
+		UserID:        userID,
+		CodeHash:      hashToken(code),
+		RedirectURI:   req.RedirectURI,
+		Scopes:        scopes,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().Add(oauthCodeTTL),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store authorization code: %w", err)
+	}
+	return s.authorizationResponse(req, url.Values{"code": {code}}), nil
+}
+
+// ExchangeAuthorizationCode implements the token endpoint. Every client
+// must prove it holds the PKCE verifier; confidential clients also
+// authenticate with their secret.
+func (s *Service) ExchangeAuthorizationCode(req TokenRequest) (*TokenResponse, error) {
+	if req.GrantType != "authorization_code" {
+		return nil, &OAuthError{"unsupported_grant_type", "only authorization_code is supported"}
+	}
+	client, err := s.authenticateClient(req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := s.repo.ConsumeOAuthCode(hashToken(req.Code))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &OAuthError{"invalid_grant", "authorization code is invalid or expired"}
+		}
+		return nil, err
+	}
+	if code.ClientID != client.ID || code.RedirectURI != req.RedirectURI {
+		return nil, &OAuthError{"invalid_grant", "authorization code was issued to another client or redirect URI"}
+	}
+	if !verifyCodeChallenge(req.CodeVerifier, code.CodeChallenge) {
+		return nil, &OAuthError{"invalid_grant", "code_verifier doesn't match the code_challenge"}
+	}
+
+	user, err := s.repo.GetUserByID(code.UserID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	expiresAt := now.Add(oauthAccessTokenTTL)
+	audience := client.ID.String()
+
+	accessToken, err := s.signJWT(jwt.MapClaims{
+		"iss":       s.issuer,
+		"sub":       user.ID.String(),
+		"aud":       audience,
+		"client_id": audience,
+		"scope":     strings.Join(code.Scopes, " "),
+		"jti":       uuid.NewString(),
+		"exp":       expiresAt.Unix(),
+		"iat":       now.Unix(),
+	}, accessTokenType)
+	if err != nil {
+		return nil, err
+	}
+
+	idClaims := jwt.MapClaims{
+		"iss": s.issuer,
+		"sub": user.ID.String(),
+		"aud": audience,
+		"exp": expiresAt.Unix(),
+		"iat": now.Unix(),
+	}
+	if code.Nonce != "" {
+		idClaims["nonce"] = code.Nonce
+	}
+	for k, v := range scopeClaims(user, code.Scopes) {
+		idClaims[k] = v
+	}
+	idToken, err := s.signJWT(idClaims, "JWT")
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(oauthAccessTokenTTL.Seconds()),
+		Scope:       strings.Join(code.Scopes, " "),
+		IDToken:     idToken,
+	}, nil
+}
+
+// UserInfo returns the claims an OAuth access token's scopes allow, as
+// long as the user hasn't since revoked the client's access.
+func (s *Service) UserInfo(accessToken string) (map[string]interface{}, error) {
+	token, err := jwt.Parse(accessToken, s.verificationKey, jwt.WithIssuer(s.issuer))
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	if typ, _ := token.Header["typ"].(string); typ != accessTokenType {
+		return nil, ErrInvalidToken
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	sub, _ := claims["sub"].(string)
+	clientIDStr, _ := claims["client_id"].(string)
+	userID, err := uuid.Parse(sub)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	clientID, err := uuid.Parse(clientIDStr)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if aud, err := claims.GetAudience(); err != nil || len(aud) != 1 || aud[0] != clientIDStr {
+		return nil, ErrInvalidToken
+	}
+
+	if _, err := s.repo.GetOAuthConsent(userID, clientID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	scope, _ := claims["scope"].(string)
+	info := scopeClaims(user, strings.Fields(scope))
+	info["sub"] = user.ID.String()
+	return info, nil
+}
+
+// Discovery returns the OpenID Provider metadata.
+func (s *Service) Discovery() *DiscoveryDocument {
+	return &DiscoveryDocument{
+		Issuer:                            s.issuer,
+		AuthorizationEndpoint:             s.issuer + "/oauth/authorize",
+		TokenEndpoint:                     s.issuer + "/oauth/token",
+		UserInfoEndpoint:                  s.issuer + "/oauth/userinfo",
+		JWKSURI:                           s.issuer + "/.well-known/jwks.json",
+		ScopesSupported:                   supportedScopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"ES256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported: []string{
+			"iss", "sub", "aud", "exp", "iat", "nonce",
+			"name", "preferred_username", "picture", "email", "email_verified",
+		},
+		AuthorizationResponseIssParameterSupported: true,
+	}
+}
+
+// scopeClaims returns the user claims that scopes release. They're the
+// claims in our own access tokens under their OIDC names: profile covers
+// username, display_name and avatar_url; email adds the address to
+// email_verified.
+func scopeClaims(user *User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{}
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeProfile:
+			claims["preferred_username"] = user.Username
+			claims["name"] = user.DisplayName
+			if user.AvatarURL != nil {
+				claims["picture"] = *user.AvatarURL
+			}
+		case ScopeEmail:
+			claims["email"] = user.Email
+			claims["email_verified"] = user.EmailVerified
+		}
+	}
+	return claims
+}
+
+// checkAuthorizeRequest validates an authorization request. Problems with
+// the client or redirect URI are returned as is, since the browser can't
+// safely be sent back to the client; anything else is an *OAuthError to
+// report to the client.
+func (s *Service) checkAuthorizeRequest(req AuthorizeRequest) (*OAuthClient, []string, error) {
+	clientID, err := uuid.Parse(req.ClientID)
+	if err != nil {
+		return nil, nil, ErrInvalidClient
+	}
+	client, err := s.repo.GetOAuthClient(clientID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrInvalidClient
+		}
+		return nil, nil, err
+	}
+	if !contains(client.RedirectURIs, req.RedirectURI) {
+		return nil, nil, ErrInvalidRedirectURI
+	}
+
+	if req.ResponseType != "code" {
+		return nil, nil, &OAuthError{"unsupported_response_type", "only the authorization code flow is supported"}
+	}
+	scopes := parseScopes(req.Scope)
+	if !contains(scopes, ScopeOpenID) {
+		return nil, nil, &OAuthError{"invalid_scope", "the openid scope is required"}
+	}
+	if req.CodeChallengeMethod != "S256" || !validCodeChallenge(req.CodeChallenge) {
+		return nil, nil, &OAuthError{"invalid_request", "PKCE with code_challenge_method S256 is required"}
+	}
+	return client, scopes, nil
+}
+
+// authenticateClient checks the credentials a client presented at the
+// token endpoint. Public clients have nothing to present.
+func (s *Service) authenticateClient(clientID, secret string) (*OAuthClient, error) {
+	failed := &OAuthError{"invalid_client", "client authentication failed"}
+	id, err := uuid.Parse(clientID)
+	if err != nil {
+		return nil, failed
+	}
+	client, err := s.repo.GetOAuthClient(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, failed
+		}
+		return nil, err
+	}
+	if client.SecretHash != nil && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(*client.SecretHash)) != 1 {
+		return nil, failed
+	}
+	return client, nil
+}
+
+// authorizationResponse adds params to the client's redirect URI, along
+// with the request's state and our issuer (RFC 9207).
+func (s *Service) authorizationResponse(req AuthorizeRequest, params url.Values) string {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		// Only registered URIs get here, and those were parsed before
+		return req.RedirectURI
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	q.Set("iss", s.issuer)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (e *OAuthError) values() url.Values {
+	v := url.Values{"error": {e.Code}}
+	if e.Description != "" {
+		v.Set("error_description", e.Description)
+	}
+	return v
+}
+
+// validRedirectURI accepts https URLs, http URLs on the loopback interface
+// and, for native apps, private-use schemes (RFC 8252).
+func validRedirectURI(raw string, public bool) bool {
+	if len(raw) > 2048 {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Fragment != "" || u.User != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return public && strings.Contains(u.Scheme, ".")
+	}
+}
+
+// parseScopes returns the supported scopes in a scope parameter, in a
+// fixed order. Scopes we don't know are ignored, as OAuth allows.
+func parseScopes(scope string) []string {
+	requested := strings.Fields(scope)
+	scopes := []string{}
+	for _, s := range supportedScopes {
+		if contains(requested, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+func mergeScopes(granted, requested []string) []string {
+	return parseScopes(strings.Join(granted, " ") + " " + strings.Join(requested, " "))
+}
+
+func coversScopes(granted, requested []string) bool {
+	for _, s := range requested {
+		if !contains(granted, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// validCodeChallenge checks for a base64url-encoded SHA-256 hash.
+func validCodeChallenge(challenge string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(challenge)
+	return err == nil && len(b) == sha256.Size
+}
+
+// verifyCodeChallenge checks a PKCE verifier (RFC 7636) against the S256
+// challenge sent with the authorization request.
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
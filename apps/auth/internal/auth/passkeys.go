@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/opencord/auth/internal/webauthn"
+)
+
+// MFAMethodWebAuthn answers a login challenge with a passkey.
+const MFAMethodWebAuthn = "webauthn"
+
+const (
+	ceremonyRegister = "register"
+	ceremonyLogin    = "login"
+	ceremonyMFA      = "mfa"
+
+	webauthnChallengeTTL = 5 * time.Minute
+)
+
+var (
+	ErrPasskeysDisabled = errors.New("passkeys are not enabled")
+	ErrInvalidPasskey   = errors.New("passkey not recognized")
+)
+
+// BeginPasskeyRegistration starts adding a passkey to the user's account.
+// Like other sign-in changes it needs the password and, with 2FA on, a
+// code.
+func (s *Service) BeginPasskeyRegistration(userID uuid.UUID, req ReauthRequest) (*webauthn.CreationOptions, error) {
+	if s.WebAuthn == nil {
+		return nil, ErrPasskeysDisabled
+	}
+	user, err := s.reauthenticate(userID, req)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := s.repo.ListPasskeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := s.createWebAuthnChallenge(ceremonyRegister, &userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.WebAuthn.CreationOptions(challenge, webauthn.UserEntity{
+		ID:          webauthn.EncodeID(userID[:]),
+		Name:        user.Email,
+		DisplayName: user.DisplayName,
+	}, credentialDescriptors(existing)), nil
+}
+
+// FinishPasskeyRegistration verifies and stores the passkey created for
+// BeginPasskeyRegistration's options.
+func (s *Service) FinishPasskeyRegistration(userID uuid.UUID, req PasskeyRegistrationRequest) (*Passkey, error) {
+	if s.WebAuthn == nil {
+		return nil, ErrPasskeysDisabled
+	}
+	challenge, err := webauthn.Challenge(req.Credential.Response.ClientDataJSON)
+	if err != nil {
+		return nil, ErrInvalidPasskey
+	}
+	state, err := s.repo.ConsumeWebAuthnChallenge(challenge, ceremonyRegister)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidPasskey
+		}
+		return nil, err
+	}
+	if state.UserID == nil || *state.UserID != userID {
+		return nil, ErrInvalidPasskey
+	}
+
+	cred, err := s.WebAuthn.VerifyRegistration(&req.Credential, challenge)
+	if err != nil {
+		log.Printf("passkey registration for user %s rejected: %v", userID, err)
+		return nil, ErrInvalidPasskey
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	passkey, err := s.repo.CreatePasskey(&Passkey{
+		UserID:       userID,
+		CredentialID: cred.ID,
+		PublicKey:    cred.PublicKey,
+		SignCount:    cred.SignCount,
+		AAGUID:       cred.AAGUID,
+		Transports:   cred.Transports,
+		Name:         truncate(name, 64),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.notifySecurityChange(userID, "A passkey was added to your account",
+		"A passkey named \""+passkey.Name+"\" was added to your OpenCord account. It can be used to log in without a password.")
+	return passkey, nil
+}
+
+func (s *Service) ListPasskeys(userID uuid.UUID) ([]Passkey, error) {
+	return s.repo.ListPasskeys(userID)
+}
+
+// DeletePasskey removes one of the user's passkeys. Like adding one, it
+// needs the password and, with 2FA on, a code, and the user is told.
+func (s *Service) DeletePasskey(userID, id uuid.UUID, req ReauthRequest) error {
+	if _, err := s.reauthenticate(userID, req); err != nil {
+		return err
+	}
+	passkeys, err := s.repo.ListPasskeys(userID)
+	if err != nil {
+		return err
+	}
+	var name string
+	for _, p := range passkeys {
+		if p.ID == id {
+			name = p.Name
+		}
+	}
+	if err := s.repo.DeletePasskey(userID, id); err != nil {
+		return err
+	}
+
+	s.notifySecurityChange(userID, "A passkey was removed from your account",
+		"The passkey named \""+name+"\" was removed from your OpenCord account and can no longer be used to log in.")
+	return nil
+}
+
+// BeginPasskeyLogin starts a passwordless login. The user picks any of
+// their passkeys for this site, so no account is named up front.
+func (s *Service) BeginPasskeyLogin() (*webauthn.RequestOptions, error) {
+	if s.WebAuthn == nil {
+		return nil, ErrPasskeysDisabled
+	}
+	challenge, err := s.createWebAuthnChallenge(ceremonyLogin, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.WebAuthn.RequestOptions(challenge, nil, webauthn.VerificationRequired), nil
+}
+
+// FinishPasskeyLogin logs in with a passkey. The authenticator must have
+// verified the user (PIN or biometrics), which makes the passkey enough on
+// its own even for accounts with 2FA.
+func (s *Service) FinishPasskeyLogin(req PasskeyLoginRequest, client ClientInfo) (*AuthResponse, error) {
+	if s.WebAuthn == nil {
+		return nil, ErrPasskeysDisabled
+	}
+	passkey, err := s.verifyPasskey(ceremonyLogin, uuid.Nil, &req.Credential, true)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.repo.GetUserByID(passkey.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return s.startSession(user, client)
+}
+
+// BeginMFAPasskey returns the options for answering a login challenge
+// with one of the user's passkeys.
+func (s *Service) BeginMFAPasskey(ticket string) (*webauthn.RequestOptions, error) {
+	if s.WebAuthn == nil {
+		return nil, ErrPasskeysDisabled
+	}
+	t, err := s.repo.GetMFATicket(hashToken(ticket))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	passkeys, err := s.repo.ListPasskeys(t.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if len(passkeys) == 0 {
+		return nil, ErrInvalidPasskey
+	}
+
+	challenge, err := s.createWebAuthnChallenge(ceremonyMFA, &t.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return s.WebAuthn.RequestOptions(challenge, credentialDescriptors(passkeys), webauthn.VerificationPreferred), nil
+}
+
+// verifyPasskey checks an assertion for a ceremony, made by userID's
+// passkey unless userID is zero, and records the new signature counter.
+func (s *Service) verifyPasskey(ceremony string, userID uuid.UUID, resp *webauthn.AssertionResponse, requireUV bool) (*Passkey, error) {
+	challenge, err := webauthn.Challenge(resp.Response.ClientDataJSON)
+	if err != nil {
+		return nil, ErrInvalidPasskey
+	}
+	state, err := s.repo.ConsumeWebAuthnChallenge(challenge, ceremony)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidPasskey
+		}
+		return nil, err
+	}
+
+	credentialID, err := webauthn.DecodeID(resp.RawID)
+	if err != nil {
+		return nil, ErrInvalidPasskey
+	}
+	passkey, err := s.repo.GetPasskeyByCredentialID(credentialID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidPasskey
+		}
+		return nil, err
+	}
+	if (state.UserID != nil && *state.UserID != passkey.UserID) || (userID != uuid.Nil && userID != passkey.UserID) {
+		return nil, ErrInvalidPasskey
+	}
+
+	signCount, err := s.WebAuthn.VerifyAssertion(resp, challenge, passkey.PublicKey, passkey.UserID[:], passkey.SignCount, requireUV)
+	if err != nil {
+		log.Printf("passkey %s of user %s rejected: %v", passkey.ID, passkey.UserID, err)
+		return nil, ErrInvalidPasskey
+	}
+	updated, err := s.repo.UpdatePasskeySignCount(passkey.ID, signCount)
+	if err != nil {
+		return nil, err
+	}
+	if !updated {
+		log.Printf("passkey %s of user %s reused a signature counter", passkey.ID, passkey.UserID)
+		return nil, ErrInvalidPasskey
+	}
+	return passkey, nil
+}
+
+func (s *Service) createWebAuthnChallenge(ceremony string, userID *uuid.UUID) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	err = s.repo.CreateWebAuthnChallenge(&WebAuthnChallenge{
+		Challenge: challenge,
+		Ceremony:  ceremony,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(webauthnChallengeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+func credentialDescriptors(passkeys []Passkey) []webauthn.CredentialDescriptor {
+	out := make([]webauthn.CredentialDescriptor, 0, len(passkeys))
+	for _, p := range passkeys {
+		out = append(out, webauthn.CredentialDescriptor{
+			Type:       "public-key",
+			ID:         webauthn.EncodeID(p.CredentialID),
+			Transports: p.Transports,
+		})
+	}
+	return out
+}
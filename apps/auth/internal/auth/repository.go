@@ -5,43 +5,212 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"github.com/opencord/shared/loginthrottle"
+	"github.com/opencord/shared/validation"
 )
 
 type User struct {
-	ID           uuid.UUID
-	Email        string
-	Username     string
-	DisplayName  string
-	AvatarURL    *string
-	PasswordHash string
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	ID            uuid.UUID
+	Email         string
+	Username      string
+	DisplayName   string
+	AvatarURL     *string
+	PasswordHash  string
+	EmailVerified bool
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
+// RefreshToken is a refresh token row. Tokens are kept after rotation
+// with UsedAt set.
 type RefreshToken struct {
 	ID        uuid.UUID
 	UserID    uuid.UUID
+	SessionID uuid.UUID
 	TokenHash string
 	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// Session is a login on one device: the family of refresh tokens rotated
+// from the one issued at login.
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	UserID     uuid.UUID `json:"-"`
+	DeviceName string    `json:"deviceName"`
+	IPAddress  string    `json:"ipAddress"`
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	Current    bool      `json:"current"`
+}
+
+// InstanceGrant records that a user allowed an instance to receive tokens
+// on their behalf.
+type InstanceGrant struct {
+	ID          uuid.UUID  `json:"id"`
+	UserID      uuid.UUID  `json:"-"`
+	InstanceURL string     `json:"instanceUrl"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastUsedAt  *time.Time `json:"lastUsedAt"`
+}
+
+// TOTPSecret is a user's authenticator app secret. EnabledAt is nil until
+// the user confirms enrollment with a code.
+type TOTPSecret struct {
+	UserID    uuid.UUID
+	Secret    string
+	EnabledAt *time.Time
+	LastStep  int64
 	CreatedAt time.Time
 }
 
+// MFATicket stands in for a user who passed the password step of a login
+// and still has to give a second factor.
+type MFATicket struct {
+	ID         uuid.UUID
+	UserID     uuid.UUID
+	DeviceName string
+	Attempts   int
+	ExpiresAt  time.Time
+}
+
+// Passkey is a WebAuthn credential registered to a user.
+type Passkey struct {
+	ID           uuid.UUID  `json:"id"`
+	UserID       uuid.UUID  `json:"-"`
+	CredentialID []byte     `json:"-"`
+	PublicKey    []byte     `json:"-"`
+	SignCount    uint32     `json:"-"`
+	AAGUID       []byte     `json:"-"`
+	Transports   []string   `json:"-"`
+	Name         string     `json:"name"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	LastUsedAt   *time.Time `json:"lastUsedAt"`
+}
+
+// WebAuthnChallenge is the state of a ceremony in progress. UserID is nil
+// for passwordless logins.
+type WebAuthnChallenge struct {
+	Challenge string
+	Ceremony  string
+	UserID    *uuid.UUID
+	ExpiresAt time.Time
+}
+
+// OAuthClient is an app registered to log users in through OpenID
+// Connect. Public clients have no secret.
+type OAuthClient struct {
+	ID           uuid.UUID `json:"clientId"`
+	OwnerID      uuid.UUID `json:"-"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirectUris"`
+	SecretHash   *string   `json:"-"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// OAuthConsent records the scopes a user allowed a client.
+type OAuthConsent struct {
+	UserID     uuid.UUID `json:"-"`
+	ClientID   uuid.UUID `json:"clientId"`
+	ClientName string    `json:"clientName"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// OAuthCode is an authorization code and the request it was issued for.
+type OAuthCode struct {
+	ClientID      uuid.UUID
+	UserID        uuid.UUID
+	CodeHash      string
+	RedirectURI   string
+	Scopes        []string
+	Nonce         string
+	CodeChallenge string
+	ExpiresAt     time.Time
+}
+
+// DeletionNotice is an account_deleted event waiting to be delivered to
+// an instance the deleted user had authorized.
+type DeletionNotice struct {
+	ID          uuid.UUID
+	UserID      uuid.UUID
+	InstanceURL string
+	Attempts    int
+}
+
 type Repository interface {
 	CreateUser(email, username, displayName, passwordHash string) (*User, error)
 	GetUserByEmail(email string) (*User, error)
 	GetUserByID(id uuid.UUID) (*User, error)
 	UpdateUser(id uuid.UUID, req UpdateUserRequest) (*User, error)
-	CreateRefreshToken(userID uuid.UUID, tokenHash string, expiresAt time.Time) error
+	UpdatePassword(id uuid.UUID, passwordHash string) error
+	UpdateEmail(id uuid.UUID, email string) error
+	SetEmailVerified(id uuid.UUID) error
+	CreateEmailToken(userID uuid.UUID, purpose, tokenHash string, expiresAt time.Time) error
+	ConsumeEmailToken(purpose, tokenHash string) (uuid.UUID, error)
+	DeleteUserSessions(userID uuid.UUID) error
+	CreateSession(userID uuid.UUID, client ClientInfo) (*Session, error)
+	TouchSession(id uuid.UUID, client ClientInfo) error
+	ListSessions(userID uuid.UUID) ([]Session, error)
+	DeleteSession(userID, id uuid.UUID) error
+	CreateRefreshToken(userID, sessionID uuid.UUID, tokenHash string, expiresAt time.Time) error
 	GetRefreshToken(tokenHash string) (*RefreshToken, error)
-	DeleteRefreshToken(tokenHash string) error
+	MarkRefreshTokenUsed(id uuid.UUID) (bool, error)
+	CreateInstanceGrant(userID uuid.UUID, instanceURL string) (*InstanceGrant, error)
+	ListInstanceGrants(userID uuid.UUID) ([]InstanceGrant, error)
+	TouchInstanceGrant(userID uuid.UUID, instanceURL string) error
+	DeleteInstanceGrant(userID, id uuid.UUID) error
+	GetTOTPSecret(userID uuid.UUID) (*TOTPSecret, error)
+	SavePendingTOTPSecret(userID uuid.UUID, secret string) error
+	EnableTOTP(userID uuid.UUID, recoveryCodeHashes []string) error
+	UseTOTPStep(userID uuid.UUID, step int64) (bool, error)
+	DisableTOTP(userID uuid.UUID) error
+	ReplaceRecoveryCodes(userID uuid.UUID, codeHashes []string) error
+	ConsumeRecoveryCode(userID uuid.UUID, codeHash string) (bool, error)
+	CountRecoveryCodes(userID uuid.UUID) (int, error)
+	CreateMFATicket(userID uuid.UUID, tokenHash, deviceName string, expiresAt time.Time) error
+	GetMFATicket(tokenHash string) (*MFATicket, error)
+	RecordMFATicketFailure(id uuid.UUID) (int, error)
+	DeleteMFATicket(id uuid.UUID) (bool, error)
+	CreateWebAuthnChallenge(c *WebAuthnChallenge) error
+	ConsumeWebAuthnChallenge(challenge, ceremony string) (*WebAuthnChallenge, error)
+	CreatePasskey(p *Passkey) (*Passkey, error)
+	ListPasskeys(userID uuid.UUID) ([]Passkey, error)
+	GetPasskeyByCredentialID(credentialID []byte) (*Passkey, error)
+	UpdatePasskeySignCount(id uuid.UUID, signCount uint32) (bool, error)
+	DeletePasskey(userID, id uuid.UUID) error
+	CreateOAuthClient(c *OAuthClient) (*OAuthClient, error)
+	GetOAuthClient(id uuid.UUID) (*OAuthClient, error)
+	ListOAuthClients(ownerID uuid.UUID) ([]OAuthClient, error)
+	DeleteOAuthClient(ownerID, id uuid.UUID) error
+	GetOAuthConsent(userID, clientID uuid.UUID) (*OAuthConsent, error)
+	SaveOAuthConsent(userID, clientID uuid.UUID, scopes []string) error
+	ListOAuthConsents(userID uuid.UUID) ([]OAuthConsent, error)
+	DeleteOAuthConsent(userID, clientID uuid.UUID) error
+	CreateOAuthCode(c *OAuthCode) error
+	ConsumeOAuthCode(codeHash string) (*OAuthCode, error)
+	loginthrottle.Store
+	ScheduleAccountDeletion(userID uuid.UUID, at time.Time) error
+	CancelAccountDeletion(userID uuid.UUID) (bool, error)
+	DeleteDueAccounts(now time.Time) ([]uuid.UUID, error)
+	DueDeletionNotices(now time.Time, limit int) ([]DeletionNotice, error)
+	DeleteDeletionNotice(id uuid.UUID) error
+	RetryDeletionNotice(id uuid.UUID, next time.Time) error
 }
 
 type PostgresRepository struct {
 	db *sql.DB
+	*loginthrottle.PostgresStore
 }
 
 func NewPostgresRepository(db *sql.DB) *PostgresRepository {
-	return &PostgresRepository{db: db}
+	return &PostgresRepository{db: db, PostgresStore: loginthrottle.NewPostgresStore(db)}
 }
 
 func (r *PostgresRepository) CreateUser(email, username, displayName, passwordHash string) (*User, error) {
@@ -49,11 +218,11 @@ func (r *PostgresRepository) CreateUser(email, username, displayName, passwordHa
 	err := r.db.QueryRow(
 		`INSERT INTO users (email, username, display_name, password_hash)
 		 VALUES ($1, $2, $3, $4)
-		 RETURNING id, email, username, display_name, avatar_url, password_hash, created_at, updated_at`,
+		 RETURNING id, email, username, display_name, avatar_url, password_hash, email_verified, created_at, updated_at`,
 		email, username, displayName, passwordHash,
-	).Scan(&user.ID, &user.Email, &user.Username, &user.DisplayName, &user.AvatarURL, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Email, &user.Username, &user.DisplayName, &user.AvatarURL, &user.PasswordHash, &user.EmailVerified, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
-		return nil, err
+		return nil, validation.UserConflict(err)
 	}
 	return user, nil
 }
@@ -61,10 +230,10 @@ func (r *PostgresRepository) CreateUser(email, username, displayName, passwordHa
 func (r *PostgresRepository) GetUserByEmail(email string) (*User, error) {
 	user := &User{}
 	err := r.db.QueryRow(
-		`SELECT id, email, username, display_name, avatar_url, password_hash, created_at, updated_at
-		 FROM users WHERE email = $1`,
+		`SELECT id, email, username, display_name, avatar_url, password_hash, email_verified, created_at, updated_at
+		 FROM users WHERE LOWER(email) = LOWER($1)`,
 		email,
-	).Scan(&user.ID, &user.Email, &user.Username, &user.DisplayName, &user.AvatarURL, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Email, &user.Username, &user.DisplayName, &user.AvatarURL, &user.PasswordHash, &user.EmailVerified, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -74,10 +243,10 @@ func (r *PostgresRepository) GetUserByEmail(email string) (*User, error) {
 func (r *PostgresRepository) GetUserByID(id uuid.UUID) (*User, error) {
 	user := &User{}
 	err := r.db.QueryRow(
-		`SELECT id, email, username, display_name, avatar_url, password_hash, created_at, updated_at
+		`SELECT id, email, username, display_name, avatar_url, password_hash, email_verified, created_at, updated_at
 		 FROM users WHERE id = $1`,
 		id,
-	).Scan(&user.ID, &user.Email, &user.Username, &user.DisplayName, &user.AvatarURL, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Email, &user.Username, &user.DisplayName, &user.AvatarURL, &user.PasswordHash, &user.EmailVerified, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -92,19 +261,147 @@ func (r *PostgresRepository) UpdateUser(id uuid.UUID, req UpdateUserRequest) (*U
 			avatar_url = COALESCE($3, avatar_url),
 			updated_at = NOW()
 		 WHERE id = $1
-		 RETURNING id, email, username, display_name, avatar_url, password_hash, created_at, updated_at`,
+		 RETURNING id, email, username, display_name, avatar_url, password_hash, email_verified, created_at, updated_at`,
 		id, req.DisplayName, req.AvatarURL,
-	).Scan(&user.ID, &user.Email, &user.Username, &user.DisplayName, &user.AvatarURL, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Email, &user.Username, &user.DisplayName, &user.AvatarURL, &user.PasswordHash, &user.EmailVerified, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
-func (r *PostgresRepository) CreateRefreshToken(userID uuid.UUID, tokenHash string, expiresAt time.Time) error {
+func (r *PostgresRepository) UpdatePassword(id uuid.UUID, passwordHash string) error {
+	_, err := r.db.Exec(`UPDATE users SET password_hash = $2, updated_at = NOW() WHERE id = $1`, id, passwordHash)
+	return err
+}
+
+// UpdateEmail changes the user's email, which then needs verifying again.
+func (r *PostgresRepository) UpdateEmail(id uuid.UUID, email string) error {
+	_, err := r.db.Exec(
+		`UPDATE users SET email = $2, email_verified = FALSE, updated_at = NOW() WHERE id = $1`,
+		id, email,
+	)
+	return validation.UserConflict(err)
+}
+
+func (r *PostgresRepository) SetEmailVerified(id uuid.UUID) error {
+	_, err := r.db.Exec(`UPDATE users SET email_verified = TRUE, updated_at = NOW() WHERE id = $1`, id)
+	return err
+}
+
+// CreateEmailToken stores a mailed token, replacing any earlier token for
+// the same purpose so only the latest email works.
+func (r *PostgresRepository) CreateEmailToken(userID uuid.UUID, purpose, tokenHash string, expiresAt time.Time) error {
+	_, err := r.db.Exec(
+		`WITH replaced AS (DELETE FROM email_tokens WHERE user_id = $1 AND purpose = $2)
+		 INSERT INTO email_tokens (user_id, purpose, token_hash, expires_at) VALUES ($1, $2, $3, $4)`,
+		userID, purpose, tokenHash, expiresAt,
+	)
+	return err
+}
+
+// ConsumeEmailToken deletes a mailed token and returns its user, or
+// sql.ErrNoRows if it doesn't exist or has expired.
+func (r *PostgresRepository) ConsumeEmailToken(purpose, tokenHash string) (uuid.UUID, error) {
+	var userID uuid.UUID
+	var expiresAt time.Time
+	err := r.db.QueryRow(
+		`DELETE FROM email_tokens WHERE purpose = $1 AND token_hash = $2 RETURNING user_id, expires_at`,
+		purpose, tokenHash,
+	).Scan(&userID, &expiresAt)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if time.Now().After(expiresAt) {
+		return uuid.Nil, sql.ErrNoRows
+	}
+	return userID, nil
+}
+
+// DeleteUserSessions logs the user out everywhere.
+func (r *PostgresRepository) DeleteUserSessions(userID uuid.UUID) error {
+	_, err := r.db.Exec(`DELETE FROM sessions WHERE user_id = $1`, userID)
+	return err
+}
+
+// CreateSession starts a session, first clearing out the user's sessions
+// whose tokens have all expired.
+func (r *PostgresRepository) CreateSession(userID uuid.UUID, client ClientInfo) (*Session, error) {
+	if _, err := r.db.Exec(
+		`DELETE FROM sessions s WHERE s.user_id = $1 AND NOT EXISTS (
+			SELECT 1 FROM refresh_tokens t WHERE t.session_id = s.id AND t.expires_at > NOW())`,
+		userID,
+	); err != nil {
+		return nil, err
+	}
+
+	s := &Session{}
+	err := r.db.QueryRow(
+		`INSERT INTO sessions (user_id, device_name, ip_address, user_agent)
+		 VALUES ($1, $2, $3, $4)
+		 RETURNING id, user_id, device_name, ip_address, user_agent, created_at, last_used_at`,
+		userID, client.DeviceName, client.IP, client.UserAgent,
+	).Scan(&s.ID, &s.UserID, &s.DeviceName, &s.IPAddress, &s.UserAgent, &s.CreatedAt, &s.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// TouchSession records where a session was last used from.
+func (r *PostgresRepository) TouchSession(id uuid.UUID, client ClientInfo) error {
 	_, err := r.db.Exec(
-		`INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
-		userID, tokenHash, expiresAt,
+		`UPDATE sessions SET ip_address = $2, user_agent = $3, last_used_at = NOW() WHERE id = $1`,
+		id, client.IP, client.UserAgent,
+	)
+	return err
+}
+
+// ListSessions returns the user's sessions that can still be refreshed,
+// most recently used first.
+func (r *PostgresRepository) ListSessions(userID uuid.UUID) ([]Session, error) {
+	rows, err := r.db.Query(
+		`SELECT s.id, s.user_id, s.device_name, s.ip_address, s.user_agent, s.created_at, s.last_used_at
+		 FROM sessions s
+		 WHERE s.user_id = $1 AND EXISTS (
+			SELECT 1 FROM refresh_tokens t
+			WHERE t.session_id = s.id AND t.used_at IS NULL AND t.expires_at > NOW())
+		 ORDER BY s.last_used_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.DeviceName, &s.IPAddress, &s.UserAgent, &s.CreatedAt, &s.LastUsedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSession ends a session, deleting its refresh tokens. It returns
+// sql.ErrNoRows if the user has no such session.
+func (r *PostgresRepository) DeleteSession(userID, id uuid.UUID) error {
+	res, err := r.db.Exec(`DELETE FROM sessions WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *PostgresRepository) CreateRefreshToken(userID, sessionID uuid.UUID, tokenHash string, expiresAt time.Time) error {
+	_, err := r.db.Exec(
+		`INSERT INTO refresh_tokens (user_id, session_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)`,
+		userID, sessionID, tokenHash, expiresAt,
 	)
 	return err
 }
@@ -112,17 +409,614 @@ func (r *PostgresRepository) CreateRefreshToken(userID uuid.UUID, tokenHash stri
 func (r *PostgresRepository) GetRefreshToken(tokenHash string) (*RefreshToken, error) {
 	rt := &RefreshToken{}
 	err := r.db.QueryRow(
-		`SELECT id, user_id, token_hash, expires_at, created_at
+		`SELECT id, user_id, session_id, token_hash, expires_at, used_at, created_at
 		 FROM refresh_tokens WHERE token_hash = $1`,
 		tokenHash,
-	).Scan(&rt.ID, &rt.UserID, &rt.TokenHash, &rt.ExpiresAt, &rt.CreatedAt)
+	).Scan(&rt.ID, &rt.UserID, &rt.SessionID, &rt.TokenHash, &rt.ExpiresAt, &rt.UsedAt, &rt.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return rt, nil
 }
 
-func (r *PostgresRepository) DeleteRefreshToken(tokenHash string) error {
-	_, err := r.db.Exec(`DELETE FROM refresh_tokens WHERE token_hash = $1`, tokenHash)
+// MarkRefreshTokenUsed marks a token as rotated. It reports false if the
+// token had already been used, which means it was replayed.
+func (r *PostgresRepository) MarkRefreshTokenUsed(id uuid.UUID) (bool, error) {
+	res, err := r.db.Exec(`UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1 AND used_at IS NULL`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// CreateInstanceGrant authorizes an instance, returning the existing grant
+// if there is one.
+func (r *PostgresRepository) CreateInstanceGrant(userID uuid.UUID, instanceURL string) (*InstanceGrant, error) {
+	g := &InstanceGrant{}
+	err := r.db.QueryRow(
+		`INSERT INTO instance_grants (user_id, instance_url) VALUES ($1, $2)
+		 ON CONFLICT (user_id, instance_url) DO UPDATE SET instance_url = EXCLUDED.instance_url
+		 RETURNING id, user_id, instance_url, created_at, last_used_at`,
+		userID, instanceURL,
+	).Scan(&g.ID, &g.UserID, &g.InstanceURL, &g.CreatedAt, &g.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (r *PostgresRepository) ListInstanceGrants(userID uuid.UUID) ([]InstanceGrant, error) {
+	rows, err := r.db.Query(
+		`SELECT id, user_id, instance_url, created_at, last_used_at
+		 FROM instance_grants WHERE user_id = $1 ORDER BY created_at`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []InstanceGrant{}
+	for rows.Next() {
+		var g InstanceGrant
+		if err := rows.Scan(&g.ID, &g.UserID, &g.InstanceURL, &g.CreatedAt, &g.LastUsedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// TouchInstanceGrant records that a grant was used, returning
+// sql.ErrNoRows if the instance isn't authorized.
+func (r *PostgresRepository) TouchInstanceGrant(userID uuid.UUID, instanceURL string) error {
+	res, err := r.db.Exec(
+		`UPDATE instance_grants SET last_used_at = NOW() WHERE user_id = $1 AND instance_url = $2`,
+		userID, instanceURL,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *PostgresRepository) DeleteInstanceGrant(userID, id uuid.UUID) error {
+	res, err := r.db.Exec(`DELETE FROM instance_grants WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *PostgresRepository) GetTOTPSecret(userID uuid.UUID) (*TOTPSecret, error) {
+	t := &TOTPSecret{}
+	err := r.db.QueryRow(
+		`SELECT user_id, secret, enabled_at, last_step, created_at FROM totp_secrets WHERE user_id = $1`,
+		userID,
+	).Scan(&t.UserID, &t.Secret, &t.EnabledAt, &t.LastStep, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// SavePendingTOTPSecret starts (or restarts) enrollment with a new secret.
+// It returns sql.ErrNoRows if TOTP is already enabled.
+func (r *PostgresRepository) SavePendingTOTPSecret(userID uuid.UUID, secret string) error {
+	res, err := r.db.Exec(
+		`INSERT INTO totp_secrets (user_id, secret) VALUES ($1, $2)
+		 ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_step = 0, created_at = NOW()
+		 WHERE totp_secrets.enabled_at IS NULL`,
+		userID, secret,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// EnableTOTP completes enrollment and stores the user's first recovery
+// codes.
+func (r *PostgresRepository) EnableTOTP(userID uuid.UUID, recoveryCodeHashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE totp_secrets SET enabled_at = NOW() WHERE user_id = $1 AND enabled_at IS NULL`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a code for step was accepted. It returns false
+// if that step (or a later one) was already used.
+func (r *PostgresRepository) UseTOTPStep(userID uuid.UUID, step int64) (bool, error) {
+	res, err := r.db.Exec(`UPDATE totp_secrets SET last_step = $2 WHERE user_id = $1 AND last_step < $2`, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// DisableTOTP removes the user's secret and recovery codes.
+func (r *PostgresRepository) DisableTOTP(userID uuid.UUID) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM totp_secrets WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *PostgresRepository) ReplaceRecoveryCodes(userID uuid.UUID, codeHashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID uuid.UUID, codeHashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConsumeRecoveryCode deletes a recovery code, returning false if the user
+// has no such code.
+func (r *PostgresRepository) ConsumeRecoveryCode(userID uuid.UUID, codeHash string) (bool, error) {
+	res, err := r.db.Exec(`DELETE FROM recovery_codes WHERE user_id = $1 AND code_hash = $2`, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (r *PostgresRepository) CountRecoveryCodes(userID uuid.UUID) (int, error) {
+	var n int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1`, userID).Scan(&n)
+	return n, err
+}
+
+// CreateMFATicket stores a two-step login ticket, clearing out the user's
+// expired ones.
+func (r *PostgresRepository) CreateMFATicket(userID uuid.UUID, tokenHash, deviceName string, expiresAt time.Time) error {
+	_, err := r.db.Exec(
+		`WITH expired AS (DELETE FROM mfa_tickets WHERE user_id = $1 AND expires_at < NOW())
+		 INSERT INTO mfa_tickets (user_id, token_hash, device_name, expires_at) VALUES ($1, $2, $3, $4)`,
+		userID, tokenHash, deviceName, expiresAt,
+	)
+	return err
+}
+
+// GetMFATicket returns an unexpired ticket, or sql.ErrNoRows.
+func (r *PostgresRepository) GetMFATicket(tokenHash string) (*MFATicket, error) {
+	t := &MFATicket{}
+	err := r.db.QueryRow(
+		`SELECT id, user_id, device_name, attempts, expires_at FROM mfa_tickets
+		 WHERE token_hash = $1 AND expires_at > NOW()`,
+		tokenHash,
+	).Scan(&t.ID, &t.UserID, &t.DeviceName, &t.Attempts, &t.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// RecordMFATicketFailure counts a wrong code against a ticket and returns
+// the number of failed attempts so far.
+func (r *PostgresRepository) RecordMFATicketFailure(id uuid.UUID) (int, error) {
+	var attempts int
+	err := r.db.QueryRow(
+		`UPDATE mfa_tickets SET attempts = attempts + 1 WHERE id = $1 RETURNING attempts`, id,
+	).Scan(&attempts)
+	return attempts, err
+}
+
+// DeleteMFATicket uses up a ticket, returning false if it was already
+// used.
+func (r *PostgresRepository) DeleteMFATicket(id uuid.UUID) (bool, error) {
+	res, err := r.db.Exec(`DELETE FROM mfa_tickets WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// CreateWebAuthnChallenge stores a ceremony's challenge, clearing out
+// abandoned ones.
+func (r *PostgresRepository) CreateWebAuthnChallenge(c *WebAuthnChallenge) error {
+	_, err := r.db.Exec(
+		`WITH expired AS (DELETE FROM webauthn_challenges WHERE expires_at < NOW())
+		 INSERT INTO webauthn_challenges (challenge, ceremony, user_id, expires_at) VALUES ($1, $2, $3, $4)`,
+		c.Challenge, c.Ceremony, c.UserID, c.ExpiresAt,
+	)
+	return err
+}
+
+// ConsumeWebAuthnChallenge deletes a challenge and returns it, or
+// sql.ErrNoRows if it doesn't exist or has expired.
+func (r *PostgresRepository) ConsumeWebAuthnChallenge(challenge, ceremony string) (*WebAuthnChallenge, error) {
+	c := &WebAuthnChallenge{}
+	err := r.db.QueryRow(
+		`DELETE FROM webauthn_challenges WHERE challenge = $1 AND ceremony = $2
+		 RETURNING challenge, ceremony, user_id, expires_at`,
+		challenge, ceremony,
+	).Scan(&c.Challenge, &c.Ceremony, &c.UserID, &c.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(c.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+const passkeyColumns = `id, user_id, credential_id, public_key, sign_count, aaguid, transports, name, created_at, last_used_at`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPasskey(row scanner) (*Passkey, error) {
+	p := &Passkey{}
+	var signCount int64
+	err := row.Scan(&p.ID, &p.UserID, &p.CredentialID, &p.PublicKey, &signCount, &p.AAGUID,
+		(*pq.StringArray)(&p.Transports), &p.Name, &p.CreatedAt, &p.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.SignCount = uint32(signCount)
+	return p, nil
+}
+
+func (r *PostgresRepository) CreatePasskey(p *Passkey) (*Passkey, error) {
+	if p.Transports == nil {
+		p.Transports = []string{}
+	}
+	return scanPasskey(r.db.QueryRow(
+		`INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, aaguid, transports, name)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 RETURNING `+passkeyColumns,
+		p.UserID, p.CredentialID, p.PublicKey, int64(p.SignCount), p.AAGUID, pq.Array(p.Transports), p.Name,
+	))
+}
+
+func (r *PostgresRepository) ListPasskeys(userID uuid.UUID) ([]Passkey, error) {
+	rows, err := r.db.Query(
+		`SELECT `+passkeyColumns+` FROM webauthn_credentials WHERE user_id = $1 ORDER BY created_at`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []Passkey{}
+	for rows.Next() {
+		p, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, *p)
+	}
+	return passkeys, rows.Err()
+}
+
+func (r *PostgresRepository) GetPasskeyByCredentialID(credentialID []byte) (*Passkey, error) {
+	return scanPasskey(r.db.QueryRow(
+		`SELECT `+passkeyColumns+` FROM webauthn_credentials WHERE credential_id = $1`,
+		credentialID,
+	))
+}
+
+// UpdatePasskeySignCount records a use of the passkey. It returns false if
+// another login with a later counter value got there first.
+func (r *PostgresRepository) UpdatePasskeySignCount(id uuid.UUID, signCount uint32) (bool, error) {
+	res, err := r.db.Exec(
+		`UPDATE webauthn_credentials SET sign_count = $2, last_used_at = NOW()
+		 WHERE id = $1 AND (sign_count < $2 OR (sign_count = 0 AND $2 = 0))`,
+		id, int64(signCount),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (r *PostgresRepository) DeletePasskey(userID, id uuid.UUID) error {
+	res, err := r.db.Exec(`DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+const oauthClientColumns = `id, owner_id, name, redirect_uris, secret_hash, created_at`
+
+func scanOAuthClient(row scanner) (*OAuthClient, error) {
+	c := &OAuthClient{}
+	err := row.Scan(&c.ID, &c.OwnerID, &c.Name, (*pq.StringArray)(&c.RedirectURIs), &c.SecretHash, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	c.Public = c.SecretHash == nil
+	return c, nil
+}
+
+func (r *PostgresRepository) CreateOAuthClient(c *OAuthClient) (*OAuthClient, error) {
+	return scanOAuthClient(r.db.QueryRow(
+		`INSERT INTO oauth_clients (owner_id, name, redirect_uris, secret_hash)
+		 VALUES ($1, $2, $3, $4)
+		 RETURNING `+oauthClientColumns,
+		c.OwnerID, c.Name, pq.Array(c.RedirectURIs), c.SecretHash,
+	))
+}
+
+func (r *PostgresRepository) GetOAuthClient(id uuid.UUID) (*OAuthClient, error) {
+	return scanOAuthClient(r.db.QueryRow(`SELECT `+oauthClientColumns+` FROM oauth_clients WHERE id = $1`, id))
+}
+
+func (r *PostgresRepository) ListOAuthClients(ownerID uuid.UUID) ([]OAuthClient, error) {
+	rows, err := r.db.Query(
+		`SELECT `+oauthClientColumns+` FROM oauth_clients WHERE owner_id = $1 ORDER BY created_at`,
+		ownerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []OAuthClient{}
+	for rows.Next() {
+		c, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, *c)
+	}
+	return clients, rows.Err()
+}
+
+// DeleteOAuthClient removes a client along with its users' consents and
+// outstanding codes.
+func (r *PostgresRepository) DeleteOAuthClient(ownerID, id uuid.UUID) error {
+	res, err := r.db.Exec(`DELETE FROM oauth_clients WHERE id = $1 AND owner_id = $2`, id, ownerID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+const oauthConsentQuery = `SELECT oc.user_id, oc.client_id, c.name, oc.scopes, oc.created_at, oc.updated_at
+	FROM oauth_consents oc JOIN oauth_clients c ON c.id = oc.client_id`
+
+func scanOAuthConsent(row scanner) (*OAuthConsent, error) {
+	c := &OAuthConsent{}
+	err := row.Scan(&c.UserID, &c.ClientID, &c.ClientName, (*pq.StringArray)(&c.Scopes), &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *PostgresRepository) GetOAuthConsent(userID, clientID uuid.UUID) (*OAuthConsent, error) {
+	return scanOAuthConsent(r.db.QueryRow(
+		oauthConsentQuery+` WHERE oc.user_id = $1 AND oc.client_id = $2`,
+		userID, clientID,
+	))
+}
+
+// SaveOAuthConsent records the scopes the user has allowed the client,
+// replacing any earlier consent.
+func (r *PostgresRepository) SaveOAuthConsent(userID, clientID uuid.UUID, scopes []string) error {
+	_, err := r.db.Exec(
+		`INSERT INTO oauth_consents (user_id, client_id, scopes) VALUES ($1, $2, $3)
+		 ON CONFLICT (user_id, client_id) DO UPDATE SET scopes = EXCLUDED.scopes, updated_at = NOW()`,
+		userID, clientID, pq.Array(scopes),
+	)
+	return err
+}
+
+func (r *PostgresRepository) ListOAuthConsents(userID uuid.UUID) ([]OAuthConsent, error) {
+	rows, err := r.db.Query(oauthConsentQuery+` WHERE oc.user_id = $1 ORDER BY oc.updated_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consents := []OAuthConsent{}
+	for rows.Next() {
+		c, err := scanOAuthConsent(rows)
+		if err != nil {
+			return nil, err
+		}
+		consents = append(consents, *c)
+	}
+	return consents, rows.Err()
+}
+
+// DeleteOAuthConsent revokes a client's access, including codes it has
+// yet to exchange.
+func (r *PostgresRepository) DeleteOAuthConsent(userID, clientID uuid.UUID) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM oauth_consents WHERE user_id = $1 AND client_id = $2`, userID, clientID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec(`DELETE FROM oauth_codes WHERE user_id = $1 AND client_id = $2`, userID, clientID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateOAuthCode stores an authorization code, clearing out expired
+// ones.
+func (r *PostgresRepository) CreateOAuthCode(c *OAuthCode) error {
+	_, err := r.db.Exec(
+		`WITH expired AS (DELETE FROM oauth_codes WHERE expires_at < NOW())
+		 INSERT INTO oauth_codes (code_hash, client_id, user_id, redirect_uri, scopes, nonce, code_challenge, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		c.CodeHash, c.ClientID, c.UserID, c.RedirectURI, pq.Array(c.Scopes), c.Nonce, c.CodeChallenge, c.ExpiresAt,
+	)
+	return err
+}
+
+// ConsumeOAuthCode deletes a code and returns it, or sql.ErrNoRows if it
+// doesn't exist or has expired.
+func (r *PostgresRepository) ConsumeOAuthCode(codeHash string) (*OAuthCode, error) {
+	c := &OAuthCode{}
+	err := r.db.QueryRow(
+		`DELETE FROM oauth_codes WHERE code_hash = $1
+		 RETURNING code_hash, client_id, user_id, redirect_uri, scopes, nonce, code_challenge, expires_at`,
+		codeHash,
+	).Scan(&c.CodeHash, &c.ClientID, &c.UserID, &c.RedirectURI, (*pq.StringArray)(&c.Scopes), &c.Nonce, &c.CodeChallenge, &c.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(c.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+func (r *PostgresRepository) ScheduleAccountDeletion(userID uuid.UUID, at time.Time) error {
+	_, err := r.db.Exec(`UPDATE users SET deletion_scheduled_at = $2, updated_at = NOW() WHERE id = $1`, userID, at)
+	return err
+}
+
+// CancelAccountDeletion reports whether the user's account was scheduled
+// for deletion.
+func (r *PostgresRepository) CancelAccountDeletion(userID uuid.UUID) (bool, error) {
+	res, err := r.db.Exec(
+		`UPDATE users SET deletion_scheduled_at = NULL, updated_at = NOW()
+		 WHERE id = $1 AND deletion_scheduled_at IS NOT NULL`,
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteDueAccounts deletes the accounts whose grace period has ended,
+// queueing an account_deleted notice for each instance they authorized in
+// the same statement. Everything else of theirs goes with the cascade.
+func (r *PostgresRepository) DeleteDueAccounts(now time.Time) ([]uuid.UUID, error) {
+	rows, err := r.db.Query(
+		`WITH due AS (
+			SELECT id FROM users WHERE deletion_scheduled_at <= $1 FOR UPDATE SKIP LOCKED
+		 ), notices AS (
+			INSERT INTO account_deletion_notices (user_id, instance_url)
+			SELECT g.user_id, g.instance_url FROM instance_grants g JOIN due ON due.id = g.user_id
+		 )
+		 DELETE FROM users WHERE id IN (SELECT id FROM due)
+		 RETURNING id`,
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (r *PostgresRepository) DueDeletionNotices(now time.Time, limit int) ([]DeletionNotice, error) {
+	rows, err := r.db.Query(
+		`SELECT id, user_id, instance_url, attempts FROM account_deletion_notices
+		 WHERE next_attempt_at <= $1 ORDER BY next_attempt_at LIMIT $2`,
+		now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notices []DeletionNotice
+	for rows.Next() {
+		var n DeletionNotice
+		if err := rows.Scan(&n.ID, &n.UserID, &n.InstanceURL, &n.Attempts); err != nil {
+			return nil, err
+		}
+		notices = append(notices, n)
+	}
+	return notices, rows.Err()
+}
+
+func (r *PostgresRepository) DeleteDeletionNotice(id uuid.UUID) error {
+	_, err := r.db.Exec(`DELETE FROM account_deletion_notices WHERE id = $1`, id)
+	return err
+}
+
+func (r *PostgresRepository) RetryDeletionNotice(id uuid.UUID, next time.Time) error {
+	_, err := r.db.Exec(
+		`UPDATE account_deletion_notices SET attempts = attempts + 1, next_attempt_at = $2 WHERE id = $1`,
+		id, next,
+	)
 	return err
 }
@@ -1,36 +1,98 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
+
+	"github.com/opencord/auth/internal/mail"
+	"github.com/opencord/auth/internal/webauthn"
+	"github.com/opencord/shared/breach"
+	"github.com/opencord/shared/loginthrottle"
+	"github.com/opencord/shared/validation"
 )
 
 var (
 	ErrInvalidCredentials = errors.New("invalid credentials")
-	ErrEmailTaken         = errors.New("email already taken")
-	ErrUsernameTaken      = errors.New("username already taken")
 	ErrInvalidToken       = errors.New("invalid token")
+	ErrInvalidInstanceURL = errors.New("invalid instance URL")
+	ErrInstanceNotAllowed = errors.New("instance not authorized")
+	ErrAlreadyVerified    = errors.New("email already verified")
+	ErrMFARequired        = errors.New("two-factor code required")
+	ErrInvalidMFACode     = errors.New("invalid two-factor code")
+	ErrMFAAlreadyEnabled  = errors.New("two-factor authentication already enabled")
+	ErrMFANotEnabled      = errors.New("two-factor authentication not enabled")
+	ErrNoMFASetup         = errors.New("two-factor setup not started")
+)
+
+const (
+	accessTokenTTL = 15 * time.Minute
+
+	// instanceTokenTTL is kept short so a token leaked by one instance
+	// is only briefly useful even there.
+	instanceTokenTTL = 5 * time.Minute
+
+	resetTokenTTL  = time.Hour
+	verifyTokenTTL = 48 * time.Hour
+
+	purposeReset  = "reset"
+	purposeVerify = "verify"
 )
 
 type Service struct {
-	repo    Repository
-	keyPair *KeyPair
-	issuer  string
+	repo   Repository
+	keys   *KeyRing
+	mailer mail.Mailer
+	issuer string
+	appURL string // web app that handles the links in emails
+
+	// WebAuthn enables passkeys when set.
+	WebAuthn *webauthn.RelyingParty
+
+	// BreachedPasswords, when set, is checked for every new password.
+	BreachedPasswords *breach.List
+
+	// background tracks emails sent after the response, so tests can wait
+	// for them.
+	background sync.WaitGroup
 }
 
-func NewService(repo Repository, keyPair *KeyPair, issuer string) *Service {
-	return &Service{repo: repo, keyPair: keyPair, issuer: issuer}
+func NewService(repo Repository, keys *KeyRing, mailer mail.Mailer, issuer, appURL string) *Service {
+	return &Service{repo: repo, keys: keys, mailer: mailer, issuer: issuer, appURL: strings.TrimRight(appURL, "/")}
 }
 
-func (s *Service) Register(req RegisterRequest) (*AuthResponse, error) {
+// Register creates an account. Every field is validated, and the errors
+// for bad or taken values are *FieldErrors.
+func (s *Service) Register(req RegisterRequest, client ClientInfo) (*AuthResponse, error) {
+	req.Email = strings.TrimSpace(req.Email)
+	req.Username = strings.TrimSpace(req.Username)
+	req.DisplayName = strings.TrimSpace(req.DisplayName)
+	if err := validation.Email(req.Email); err != nil {
+		return nil, err
+	}
+	if err := validation.Username(req.Username); err != nil {
+		return nil, err
+	}
+	if err := validation.DisplayName(req.DisplayName); err != nil {
+		return nil, err
+	}
+	if err := validation.Password(req.Password, s.BreachedPasswords, req.Username, req.Email); err != nil {
+		return nil, err
+	}
+
 	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash password: %w", err)
@@ -41,23 +103,58 @@ func (s *Service) Register(req RegisterRequest) (*AuthResponse, error) {
 		return nil, err
 	}
 
-	return s.generateTokens(user)
+	if err := s.sendVerification(user); err != nil {
+		// The user can ask for another email
+		log.Printf("failed to send verification email to user %s: %v", user.ID, err)
+	}
+	return s.startSession(user, client)
 }
 
-func (s *Service) Login(req LoginRequest) (*AuthResponse, error) {
+// Login checks the user's password. Users with two-factor authentication
+// get a challenge to answer with CompleteMFALogin instead of tokens.
+// Repeated failures lock the account and IP address out for a while (see
+// loginthrottle); the response never says whether the email has an account.
+func (s *Service) Login(req LoginRequest, client ClientInfo) (*AuthResponse, *MFAChallenge, error) {
+	attempt, err := s.beginLogin(req.Email, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	user, err := s.repo.GetUserByEmail(req.Email)
 	if err != nil {
-		return nil, ErrInvalidCredentials
+		_ = bcrypt.CompareHashAndPassword(loginthrottle.DummyPasswordHash, []byte(req.Password))
+		s.loginFailed(attempt, nil, client)
+		return nil, nil, ErrInvalidCredentials
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		return nil, ErrInvalidCredentials
+		s.loginFailed(attempt, user, client)
+		return nil, nil, ErrInvalidCredentials
 	}
 
-	return s.generateTokens(user)
+	methods, err := s.mfaMethods(user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(methods) > 0 {
+		// The attempt stays counted until the second factor is right too
+		challenge, err := s.createMFATicket(user.ID, client, methods)
+		return nil, challenge, err
+	}
+
+	resp, err := s.startSession(user, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.loginSucceeded(attempt, user, client)
+	return resp, nil, nil
 }
 
-func (s *Service) RefreshTokens(refreshToken string) (*AuthResponse, error) {
+// RefreshTokens rotates a refresh token within its session. Presenting a
+// token that was already rotated means it was copied, so the whole session
+// is revoked: whichever of the thief and the user refreshes next is logged
+// out.
+func (s *Service) RefreshTokens(refreshToken string, client ClientInfo) (*AuthResponse, error) {
 	tokenHash := hashToken(refreshToken)
 
 	rt, err := s.repo.GetRefreshToken(tokenHash)
@@ -65,7 +162,20 @@ func (s *Service) RefreshTokens(refreshToken string) (*AuthResponse, error) {
 		return nil, ErrInvalidToken
 	}
 
-	if time.Now().After(rt.ExpiresAt) {
+	if rt.UsedAt == nil && time.Now().After(rt.ExpiresAt) {
+		_ = s.repo.DeleteSession(rt.UserID, rt.SessionID)
+		return nil, ErrInvalidToken
+	}
+
+	fresh := rt.UsedAt == nil
+	if fresh {
+		if fresh, err = s.repo.MarkRefreshTokenUsed(rt.ID); err != nil {
+			return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+		}
+	}
+	if !fresh {
+		log.Printf("refresh token reused for user %s; revoking session %s", rt.UserID, rt.SessionID)
+		_ = s.repo.DeleteSession(rt.UserID, rt.SessionID)
 		return nil, ErrInvalidToken
 	}
 
@@ -74,24 +184,165 @@ func (s *Service) RefreshTokens(refreshToken string) (*AuthResponse, error) {
 		return nil, err
 	}
 
-	// Delete old refresh token (rotation)
-	_ = s.repo.DeleteRefreshToken(tokenHash)
-
-	return s.generateTokens(user)
+	_ = s.repo.TouchSession(rt.SessionID, client)
+	return s.generateTokens(user, rt.SessionID)
 }
 
+// Logout ends the session the refresh token belongs to.
 func (s *Service) Logout(refreshToken string) error {
-	tokenHash := hashToken(refreshToken)
-	return s.repo.DeleteRefreshToken(tokenHash)
+	rt, err := s.repo.GetRefreshToken(hashToken(refreshToken))
+	if err != nil {
+		return nil // already invalid
+	}
+	return s.repo.DeleteSession(rt.UserID, rt.SessionID)
 }
 
-func (s *Service) ValidateAccessToken(tokenString string) (*TokenClaims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// ListSessions lists the user's active sessions, marking the one current
+// belongs to.
+func (s *Service) ListSessions(userID, current uuid.UUID) ([]Session, error) {
+	sessions, err := s.repo.ListSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	return sessions, nil
+}
+
+// RevokeSession ends one of the user's sessions. Access tokens already
+// issued to it stay valid until they expire.
+func (s *Service) RevokeSession(userID, sessionID uuid.UUID) error {
+	return s.repo.DeleteSession(userID, sessionID)
+}
+
+// ForgotPassword emails a password reset link. It returns before the
+// address is even looked up, so neither the response nor how long it takes
+// says whether the address has an account. Requests are throttled per
+// address and IP address like logins, so it can't flood an inbox.
+func (s *Service) ForgotPassword(email string, client ClientInfo) error {
+	keys := loginthrottle.NewKeys(email, client.IP).Scoped("reset")
+	if _, err := loginthrottle.Begin(s.repo, keys); err != nil {
+		return err
+	}
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		if err := s.sendPasswordReset(email); err != nil {
+			log.Printf("failed to send password reset: %v", err)
 		}
-		return s.keyPair.PublicKey, nil
+	}()
+	return nil
+}
+
+func (s *Service) sendPasswordReset(email string) error {
+	user, err := s.repo.GetUserByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := s.createEmailToken(user.ID, purposeReset, resetTokenTTL)
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(context.Background(), mail.Message{
+		To:      user.Email,
+		Subject: "Reset your OpenCord password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password for your OpenCord account. To choose a new password, open this link within the next hour:\n\n"+
+			"%s/reset-password?token=%s\n\n"+
+			"If it wasn't you, ignore this email; your password won't change.\n",
+			user.DisplayName, s.appURL, token),
 	})
+}
+
+// ResetPassword sets a new password using a mailed reset token and logs
+// the user out everywhere. The reset also proves the user owns the email.
+func (s *Service) ResetPassword(token, password string) error {
+	if err := validation.Password(password, s.BreachedPasswords); err != nil {
+		return err
+	}
+	userID, err := s.repo.ConsumeEmailToken(purposeReset, hashToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	if err := s.repo.UpdatePassword(userID, string(hash)); err != nil {
+		return err
+	}
+	if err := s.repo.SetEmailVerified(userID); err != nil {
+		return err
+	}
+	return s.repo.DeleteUserSessions(userID)
+}
+
+// VerifyEmail marks the user's email verified using a mailed token.
+func (s *Service) VerifyEmail(token string) error {
+	userID, err := s.repo.ConsumeEmailToken(purposeVerify, hashToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		return err
+	}
+	return s.repo.SetEmailVerified(userID)
+}
+
+// ResendVerification sends a new verification email, invalidating the
+// link in the previous one.
+func (s *Service) ResendVerification(userID uuid.UUID) error {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return ErrAlreadyVerified
+	}
+	return s.sendVerification(user)
+}
+
+func (s *Service) sendVerification(user *User) error {
+	token, err := s.createEmailToken(user.ID, purposeVerify, verifyTokenTTL)
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(context.Background(), mail.Message{
+		To:      user.Email,
+		Subject: "Verify your OpenCord email",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Confirm this is your email address by opening this link:\n\n"+
+			"%s/verify-email?token=%s\n\n"+
+			"If you didn't create an OpenCord account, ignore this email.\n",
+			user.DisplayName, s.appURL, token),
+	})
+}
+
+// createEmailToken stores a new single-use token and returns it.
+func (s *Service) createEmailToken(userID uuid.UUID, purpose string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := hex.EncodeToString(b)
+	if err := s.repo.CreateEmailToken(userID, purpose, hashToken(token), time.Now().Add(ttl)); err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+	return token, nil
+}
+
+func (s *Service) ValidateAccessToken(tokenString string) (*TokenClaims, error) {
+	token, err := jwt.Parse(tokenString, s.verificationKey, jwt.WithIssuer(s.issuer), jwt.WithAudience(s.issuer))
 	if err != nil || !token.Valid {
 		return nil, ErrInvalidToken
 	}
@@ -112,6 +363,9 @@ func (s *Service) ValidateAccessToken(tokenString string) (*TokenClaims, error)
 	}
 
 	tc := &TokenClaims{UserID: userID}
+	if sid, ok := claims["sid"].(string); ok {
+		tc.SessionID, _ = uuid.Parse(sid)
+	}
 	if username, ok := claims["username"].(string); ok {
 		tc.Username = username
 	}
@@ -121,6 +375,7 @@ func (s *Service) ValidateAccessToken(tokenString string) (*TokenClaims, error)
 	if avatarURL, ok := claims["avatar_url"].(string); ok {
 		tc.AvatarURL = &avatarURL
 	}
+	tc.EmailVerified, _ = claims["email_verified"].(bool)
 
 	return tc, nil
 }
@@ -133,26 +388,117 @@ func (s *Service) UpdateUser(id uuid.UUID, req UpdateUserRequest) (*User, error)
 	return s.repo.UpdateUser(id, req)
 }
 
-func (s *Service) generateTokens(user *User) (*AuthResponse, error) {
-	// Access token — ES256, 15 minutes
-	now := time.Now()
+// AuthorizeInstance lets an instance exchange the user's tokens for its
+// own. Clients call it when the user chooses to join an instance.
+func (s *Service) AuthorizeInstance(userID uuid.UUID, instanceURL string) (*InstanceGrant, error) {
+	audience, err := NormalizeInstanceURL(instanceURL)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.CreateInstanceGrant(userID, audience)
+}
+
+func (s *Service) ListInstances(userID uuid.UUID) ([]InstanceGrant, error) {
+	return s.repo.ListInstanceGrants(userID)
+}
+
+func (s *Service) RevokeInstance(userID, grantID uuid.UUID) error {
+	return s.repo.DeleteInstanceGrant(userID, grantID)
+}
+
+// IssueInstanceToken exchanges a central access token for a short-lived
+// one that only the given, previously authorized instance accepts.
+func (s *Service) IssueInstanceToken(userID uuid.UUID, instanceURL string) (*InstanceTokenResponse, error) {
+	audience, err := NormalizeInstanceURL(instanceURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.TouchInstanceGrant(userID, audience); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInstanceNotAllowed
+		}
+		return nil, err
+	}
+
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(instanceTokenTTL)
+	token, err := s.signAccessToken(user, audience, uuid.Nil, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &InstanceTokenResponse{AccessToken: token, ExpiresAt: expiresAt}, nil
+}
+
+// signAccessToken signs an ES256 access token that only audience accepts,
+// naming the session it was issued to unless sessionID is zero.
+func (s *Service) signAccessToken(user *User, audience string, sessionID uuid.UUID, expiresAt time.Time) (string, error) {
 	tokenClaims := jwt.MapClaims{
-		"iss":          s.issuer,
-		"sub":          user.ID.String(),
-		"exp":          now.Add(15 * time.Minute).Unix(),
-		"iat":          now.Unix(),
-		"username":     user.Username,
-		"display_name": user.DisplayName,
+		"iss":            s.issuer,
+		"sub":            user.ID.String(),
+		"aud":            audience,
+		"exp":            expiresAt.Unix(),
+		"iat":            time.Now().Unix(),
+		"username":       user.Username,
+		"display_name":   user.DisplayName,
+		"email_verified": user.EmailVerified,
+	}
+	if sessionID != uuid.Nil {
+		tokenClaims["sid"] = sessionID.String()
 	}
 	if user.AvatarURL != nil {
 		tokenClaims["avatar_url"] = *user.AvatarURL
 	}
 
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodES256, tokenClaims)
-	accessToken.Header["kid"] = s.keyPair.KID
-	accessTokenString, err := accessToken.SignedString(s.keyPair.PrivateKey)
+	return s.signJWT(tokenClaims, "JWT")
+}
+
+// signJWT signs claims with the active key, setting the typ header.
+func (s *Service) signJWT(claims jwt.MapClaims, typ string) (string, error) {
+	key := s.keys.Active()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = key.KID
+	token.Header["typ"] = typ
+	signed, err := token.SignedString(key.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %w", err)
+	}
+	return signed, nil
+}
+
+// verificationKey finds the public key for a token we signed, by kid.
+func (s *Service) verificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	pub, ok := s.keys.PublicKey(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key: %s", kid)
+	}
+	return pub, nil
+}
+
+func (s *Service) startSession(user *User, client ClientInfo) (*AuthResponse, error) {
+	// Signing in keeps an account that's due to be deleted
+	if err := s.cancelAccountDeletion(user); err != nil {
+		return nil, fmt.Errorf("failed to cancel account deletion: %w", err)
+	}
+	session, err := s.repo.CreateSession(user.ID, client)
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign access token: %w", err)
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+	return s.generateTokens(user, session.ID)
+}
+
+func (s *Service) generateTokens(user *User, sessionID uuid.UUID) (*AuthResponse, error) {
+	// Access token for this server only; instances get their own
+	now := time.Now()
+	accessTokenString, err := s.signAccessToken(user, s.issuer, sessionID, now.Add(accessTokenTTL))
+	if err != nil {
+		return nil, err
 	}
 
 	// Refresh token — random 32 bytes
@@ -165,7 +511,7 @@ func (s *Service) generateTokens(user *User) (*AuthResponse, error) {
 	// Store hashed refresh token
 	tokenHash := hashToken(refreshTokenString)
 	expiresAt := now.Add(30 * 24 * time.Hour) // 30 days
-	if err := s.repo.CreateRefreshToken(user.ID, tokenHash, expiresAt); err != nil {
+	if err := s.repo.CreateRefreshToken(user.ID, sessionID, tokenHash, expiresAt); err != nil {
 		return nil, fmt.Errorf("failed to store refresh token: %w", err)
 	}
 
@@ -173,12 +519,13 @@ func (s *Service) generateTokens(user *User) (*AuthResponse, error) {
 		AccessToken:  accessTokenString,
 		RefreshToken: refreshTokenString,
 		User: UserResponse{
-			ID:          user.ID,
-			Email:       user.Email,
-			Username:    user.Username,
-			DisplayName: user.DisplayName,
-			AvatarURL:   user.AvatarURL,
-			CreatedAt:   user.CreatedAt,
+			ID:            user.ID,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			Username:      user.Username,
+			DisplayName:   user.DisplayName,
+			AvatarURL:     user.AvatarURL,
+			CreatedAt:     user.CreatedAt,
 		},
 	}, nil
 }
@@ -187,3 +534,14 @@ func hashToken(token string) string {
 	h := sha256.Sum256([]byte(token))
 	return hex.EncodeToString(h[:])
 }
+
+// NormalizeInstanceURL returns the canonical form of an instance's base
+// URL, which instance tokens carry as their audience.
+func NormalizeInstanceURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", ErrInvalidInstanceURL
+	}
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + strings.TrimRight(u.EscapedPath(), "/"), nil
+}
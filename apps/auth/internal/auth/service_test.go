@@ -0,0 +1,1623 @@
+package auth
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"github.com/opencord/auth/internal/mail"
+	"github.com/opencord/auth/internal/webauthn"
+	"github.com/opencord/auth/internal/webauthn/webauthntest"
+	"github.com/opencord/shared/breach"
+	"github.com/opencord/shared/loginthrottle"
+	"github.com/opencord/shared/validation"
+)
+
+// memoryRepo is an in-memory Repository.
+type memoryRepo struct {
+	mu       sync.Mutex
+	users    map[uuid.UUID]*User
+	sessions map[uuid.UUID]*Session
+	tokens   map[string]*RefreshToken
+	grants   map[uuid.UUID]*InstanceGrant
+	mailed   map[string]emailToken // by hash
+	totp     map[uuid.UUID]*TOTPSecret
+	recovery map[uuid.UUID]map[string]bool // hashes by user
+	tickets  map[string]*MFATicket         // by hash
+	passkeys map[uuid.UUID]*Passkey
+	ceremony map[string]*WebAuthnChallenge // by challenge
+	clients  map[uuid.UUID]*OAuthClient
+	consents map[[2]uuid.UUID]*OAuthConsent // by user and client
+	codes    map[string]*OAuthCode          // by hash
+	deletion map[uuid.UUID]time.Time        // scheduled deletions by user
+	notices  map[uuid.UUID]*DeletionNotice
+	*loginthrottle.MemoryStore
+}
+
+type emailToken struct {
+	userID    uuid.UUID
+	purpose   string
+	expiresAt time.Time
+}
+
+func newMemoryRepo() *memoryRepo {
+	return &memoryRepo{
+		users:    map[uuid.UUID]*User{},
+		sessions: map[uuid.UUID]*Session{},
+		tokens:   map[string]*RefreshToken{},
+		grants:   map[uuid.UUID]*InstanceGrant{},
+		mailed:   map[string]emailToken{},
+		totp:     map[uuid.UUID]*TOTPSecret{},
+		recovery: map[uuid.UUID]map[string]bool{},
+		tickets:  map[string]*MFATicket{},
+		passkeys: map[uuid.UUID]*Passkey{},
+		ceremony: map[string]*WebAuthnChallenge{},
+		clients:  map[uuid.UUID]*OAuthClient{},
+		consents: map[[2]uuid.UUID]*OAuthConsent{},
+		codes:    map[string]*OAuthCode{},
+		deletion: map[uuid.UUID]time.Time{},
+		notices:  map[uuid.UUID]*DeletionNotice{},
+
+		MemoryStore: loginthrottle.NewMemoryStore(),
+	}
+}
+
+func (m *memoryRepo) CreateUser(email, username, displayName, passwordHash string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, email) {
+			return nil, validation.ErrEmailTaken
+		}
+		if strings.EqualFold(u.Username, username) {
+			return nil, validation.ErrUsernameTaken
+		}
+	}
+	u := &User{ID: uuid.New(), Email: email, Username: username, DisplayName: displayName,
+		PasswordHash: passwordHash, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	m.users[u.ID] = u
+	stored := *u
+	return &stored, nil
+}
+
+func (m *memoryRepo) GetUserByEmail(email string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, email) {
+			stored := *u
+			return &stored, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRepo) GetUserByID(id uuid.UUID) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.users[id]; ok {
+		stored := *u
+		return &stored, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRepo) UpdateUser(id uuid.UUID, req UpdateUserRequest) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if req.DisplayName != nil {
+		u.DisplayName = *req.DisplayName
+	}
+	if req.AvatarURL != nil {
+		u.AvatarURL = req.AvatarURL
+	}
+	stored := *u
+	return &stored, nil
+}
+
+func (m *memoryRepo) UpdatePassword(id uuid.UUID, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[id].PasswordHash = passwordHash
+	return nil
+}
+
+func (m *memoryRepo) UpdateEmail(id uuid.UUID, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[id].Email, m.users[id].EmailVerified = email, false
+	return nil
+}
+
+func (m *memoryRepo) SetEmailVerified(id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[id].EmailVerified = true
+	return nil
+}
+
+func (m *memoryRepo) CreateEmailToken(userID uuid.UUID, purpose, tokenHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, t := range m.mailed {
+		if t.userID == userID && t.purpose == purpose {
+			delete(m.mailed, hash)
+		}
+	}
+	m.mailed[tokenHash] = emailToken{userID, purpose, expiresAt}
+	return nil
+}
+
+func (m *memoryRepo) ConsumeEmailToken(purpose, tokenHash string) (uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.mailed[tokenHash]
+	if !ok || t.purpose != purpose {
+		return uuid.Nil, sql.ErrNoRows
+	}
+	delete(m.mailed, tokenHash)
+	if time.Now().After(t.expiresAt) {
+		return uuid.Nil, sql.ErrNoRows
+	}
+	return t.userID, nil
+}
+
+func (m *memoryRepo) DeleteUserSessions(userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.sessions {
+		if s.UserID == userID {
+			delete(m.sessions, id)
+			for hash, t := range m.tokens {
+				if t.SessionID == id {
+					delete(m.tokens, hash)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memoryRepo) CreateSession(userID uuid.UUID, client ClientInfo) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &Session{ID: uuid.New(), UserID: userID, DeviceName: client.DeviceName, IPAddress: client.IP,
+		UserAgent: client.UserAgent, CreatedAt: time.Now(), LastUsedAt: time.Now()}
+	m.sessions[s.ID] = s
+	return s, nil
+}
+
+func (m *memoryRepo) TouchSession(id uuid.UUID, client ClientInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; ok {
+		s.IPAddress, s.UserAgent, s.LastUsedAt = client.IP, client.UserAgent, time.Now()
+	}
+	return nil
+}
+
+func (m *memoryRepo) ListSessions(userID uuid.UUID) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []Session{}
+	for _, s := range m.sessions {
+		if s.UserID == userID {
+			out = append(out, *s)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryRepo) DeleteSession(userID, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; !ok || s.UserID != userID {
+		return sql.ErrNoRows
+	}
+	delete(m.sessions, id)
+	for hash, t := range m.tokens {
+		if t.SessionID == id {
+			delete(m.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (m *memoryRepo) CreateRefreshToken(userID, sessionID uuid.UUID, tokenHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[tokenHash] = &RefreshToken{ID: uuid.New(), UserID: userID, SessionID: sessionID,
+		TokenHash: tokenHash, ExpiresAt: expiresAt, CreatedAt: time.Now()}
+	return nil
+}
+
+func (m *memoryRepo) GetRefreshToken(tokenHash string) (*RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tokens[tokenHash]; ok {
+		stored := *t
+		return &stored, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRepo) MarkRefreshTokenUsed(id uuid.UUID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tokens {
+		if t.ID == id {
+			if t.UsedAt != nil {
+				return false, nil
+			}
+			now := time.Now()
+			t.UsedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryRepo) CreateInstanceGrant(userID uuid.UUID, instanceURL string) (*InstanceGrant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, g := range m.grants {
+		if g.UserID == userID && g.InstanceURL == instanceURL {
+			return g, nil
+		}
+	}
+	g := &InstanceGrant{ID: uuid.New(), UserID: userID, InstanceURL: instanceURL, CreatedAt: time.Now()}
+	m.grants[g.ID] = g
+	return g, nil
+}
+
+func (m *memoryRepo) ListInstanceGrants(userID uuid.UUID) ([]InstanceGrant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []InstanceGrant{}
+	for _, g := range m.grants {
+		if g.UserID == userID {
+			out = append(out, *g)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryRepo) TouchInstanceGrant(userID uuid.UUID, instanceURL string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, g := range m.grants {
+		if g.UserID == userID && g.InstanceURL == instanceURL {
+			now := time.Now()
+			g.LastUsedAt = &now
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryRepo) DeleteInstanceGrant(userID, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if g, ok := m.grants[id]; !ok || g.UserID != userID {
+		return sql.ErrNoRows
+	}
+	delete(m.grants, id)
+	return nil
+}
+
+func (m *memoryRepo) GetTOTPSecret(userID uuid.UUID) (*TOTPSecret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.totp[userID]; ok {
+		stored := *t
+		return &stored, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRepo) SavePendingTOTPSecret(userID uuid.UUID, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.totp[userID]; ok && t.EnabledAt != nil {
+		return sql.ErrNoRows
+	}
+	m.totp[userID] = &TOTPSecret{UserID: userID, Secret: secret, CreatedAt: time.Now()}
+	return nil
+}
+
+func (m *memoryRepo) EnableTOTP(userID uuid.UUID, recoveryCodeHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totp[userID]
+	if !ok || t.EnabledAt != nil {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	t.EnabledAt = &now
+	m.setRecoveryCodes(userID, recoveryCodeHashes)
+	return nil
+}
+
+func (m *memoryRepo) UseTOTPStep(userID uuid.UUID, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totp[userID]
+	if !ok || t.LastStep >= step {
+		return false, nil
+	}
+	t.LastStep = step
+	return true, nil
+}
+
+func (m *memoryRepo) DisableTOTP(userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.totp, userID)
+	delete(m.recovery, userID)
+	return nil
+}
+
+func (m *memoryRepo) ReplaceRecoveryCodes(userID uuid.UUID, codeHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setRecoveryCodes(userID, codeHashes)
+	return nil
+}
+
+func (m *memoryRepo) setRecoveryCodes(userID uuid.UUID, codeHashes []string) {
+	m.recovery[userID] = map[string]bool{}
+	for _, h := range codeHashes {
+		m.recovery[userID][h] = true
+	}
+}
+
+func (m *memoryRepo) ConsumeRecoveryCode(userID uuid.UUID, codeHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.recovery[userID][codeHash] {
+		return false, nil
+	}
+	delete(m.recovery[userID], codeHash)
+	return true, nil
+}
+
+func (m *memoryRepo) CountRecoveryCodes(userID uuid.UUID) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.recovery[userID]), nil
+}
+
+func (m *memoryRepo) CreateMFATicket(userID uuid.UUID, tokenHash, deviceName string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tickets[tokenHash] = &MFATicket{ID: uuid.New(), UserID: userID, DeviceName: deviceName, ExpiresAt: expiresAt}
+	return nil
+}
+
+func (m *memoryRepo) GetMFATicket(tokenHash string) (*MFATicket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tickets[tokenHash]; ok && time.Now().Before(t.ExpiresAt) {
+		stored := *t
+		return &stored, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRepo) RecordMFATicketFailure(id uuid.UUID) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tickets {
+		if t.ID == id {
+			t.Attempts++
+			return t.Attempts, nil
+		}
+	}
+	return 0, sql.ErrNoRows
+}
+
+func (m *memoryRepo) DeleteMFATicket(id uuid.UUID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, t := range m.tickets {
+		if t.ID == id {
+			delete(m.tickets, hash)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryRepo) CreateWebAuthnChallenge(c *WebAuthnChallenge) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *c
+	m.ceremony[c.Challenge] = &stored
+	return nil
+}
+
+func (m *memoryRepo) ConsumeWebAuthnChallenge(challenge, ceremony string) (*WebAuthnChallenge, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.ceremony[challenge]
+	if !ok || c.Ceremony != ceremony {
+		return nil, sql.ErrNoRows
+	}
+	delete(m.ceremony, challenge)
+	if time.Now().After(c.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+func (m *memoryRepo) CreatePasskey(p *Passkey) (*Passkey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *p
+	stored.ID, stored.CreatedAt = uuid.New(), time.Now()
+	m.passkeys[stored.ID] = &stored
+	out := stored
+	return &out, nil
+}
+
+func (m *memoryRepo) ListPasskeys(userID uuid.UUID) ([]Passkey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []Passkey{}
+	for _, p := range m.passkeys {
+		if p.UserID == userID {
+			out = append(out, *p)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryRepo) GetPasskeyByCredentialID(credentialID []byte) (*Passkey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.passkeys {
+		if string(p.CredentialID) == string(credentialID) {
+			stored := *p
+			return &stored, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRepo) UpdatePasskeySignCount(id uuid.UUID, signCount uint32) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.passkeys[id]
+	if !ok || !(p.SignCount < signCount || (p.SignCount == 0 && signCount == 0)) {
+		return false, nil
+	}
+	now := time.Now()
+	p.SignCount, p.LastUsedAt = signCount, &now
+	return true, nil
+}
+
+func (m *memoryRepo) DeletePasskey(userID, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.passkeys[id]; !ok || p.UserID != userID {
+		return sql.ErrNoRows
+	}
+	delete(m.passkeys, id)
+	return nil
+}
+
+func (m *memoryRepo) CreateOAuthClient(c *OAuthClient) (*OAuthClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *c
+	stored.ID, stored.CreatedAt, stored.Public = uuid.New(), time.Now(), c.SecretHash == nil
+	m.clients[stored.ID] = &stored
+	out := stored
+	return &out, nil
+}
+
+func (m *memoryRepo) GetOAuthClient(id uuid.UUID) (*OAuthClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.clients[id]; ok {
+		stored := *c
+		return &stored, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRepo) ListOAuthClients(ownerID uuid.UUID) ([]OAuthClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []OAuthClient{}
+	for _, c := range m.clients {
+		if c.OwnerID == ownerID {
+			out = append(out, *c)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryRepo) DeleteOAuthClient(ownerID, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.clients[id]; !ok || c.OwnerID != ownerID {
+		return sql.ErrNoRows
+	}
+	delete(m.clients, id)
+	for key := range m.consents {
+		if key[1] == id {
+			delete(m.consents, key)
+		}
+	}
+	return nil
+}
+
+func (m *memoryRepo) GetOAuthConsent(userID, clientID uuid.UUID) (*OAuthConsent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.consents[[2]uuid.UUID{userID, clientID}]; ok {
+		stored := *c
+		return &stored, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRepo) SaveOAuthConsent(userID, clientID uuid.UUID, scopes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]uuid.UUID{userID, clientID}
+	now := time.Now()
+	c, ok := m.consents[key]
+	if !ok {
+		c = &OAuthConsent{UserID: userID, ClientID: clientID, ClientName: m.clients[clientID].Name, CreatedAt: now}
+		m.consents[key] = c
+	}
+	c.Scopes, c.UpdatedAt = scopes, now
+	return nil
+}
+
+func (m *memoryRepo) ListOAuthConsents(userID uuid.UUID) ([]OAuthConsent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []OAuthConsent{}
+	for _, c := range m.consents {
+		if c.UserID == userID {
+			out = append(out, *c)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryRepo) DeleteOAuthConsent(userID, clientID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]uuid.UUID{userID, clientID}
+	if _, ok := m.consents[key]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.consents, key)
+	for hash, c := range m.codes {
+		if c.UserID == userID && c.ClientID == clientID {
+			delete(m.codes, hash)
+		}
+	}
+	return nil
+}
+
+func (m *memoryRepo) CreateOAuthCode(c *OAuthCode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *c
+	m.codes[c.CodeHash] = &stored
+	return nil
+}
+
+func (m *memoryRepo) ConsumeOAuthCode(codeHash string) (*OAuthCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.codes[codeHash]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	delete(m.codes, codeHash)
+	if time.Now().After(c.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+func (m *memoryRepo) ScheduleAccountDeletion(userID uuid.UUID, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deletion[userID] = at
+	return nil
+}
+
+func (m *memoryRepo) CancelAccountDeletion(userID uuid.UUID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.deletion[userID]
+	delete(m.deletion, userID)
+	return ok, nil
+}
+
+// DeleteDueAccounts only removes what the tests look at after a deletion:
+// the user, their sessions and their grants.
+func (m *memoryRepo) DeleteDueAccounts(now time.Time) ([]uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []uuid.UUID
+	for userID, at := range m.deletion {
+		if at.After(now) {
+			continue
+		}
+		for id, g := range m.grants {
+			if g.UserID == userID {
+				n := &DeletionNotice{ID: uuid.New(), UserID: userID, InstanceURL: g.InstanceURL}
+				m.notices[n.ID] = n
+				delete(m.grants, id)
+			}
+		}
+		for id, s := range m.sessions {
+			if s.UserID == userID {
+				delete(m.sessions, id)
+			}
+		}
+		delete(m.users, userID)
+		delete(m.deletion, userID)
+		ids = append(ids, userID)
+	}
+	return ids, nil
+}
+
+// DueDeletionNotices ignores next attempt times: the tests deliver each
+// round by hand.
+func (m *memoryRepo) DueDeletionNotices(now time.Time, limit int) ([]DeletionNotice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []DeletionNotice
+	for _, n := range m.notices {
+		out = append(out, *n)
+	}
+	return out, nil
+}
+
+func (m *memoryRepo) DeleteDeletionNotice(id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.notices, id)
+	return nil
+}
+
+func (m *memoryRepo) RetryDeletionNotice(id uuid.UUID, next time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notices[id].Attempts++
+	return nil
+}
+
+// unlock ends every lockout, as if time had passed.
+// unlock moves the login throttle's clock past any lockout.
+func (m *memoryRepo) unlock() {
+	now := m.MemoryStore.Now
+	m.MemoryStore.Now = func() time.Time { return now().Add(loginthrottle.MaxLockout) }
+}
+
+// outbox records sent emails.
+type outbox struct {
+	mu   sync.Mutex
+	sent []mail.Message
+}
+
+func (o *outbox) Send(ctx context.Context, msg mail.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sent = append(o.sent, msg)
+	return nil
+}
+
+var linkToken = regexp.MustCompile(`https://app\.example\.com/([a-z-]+)\?token=([0-9a-f]+)`)
+
+// lastLink returns the page and token of the link in the last email.
+func (o *outbox) lastLink(t *testing.T) (page, token string) {
+	t.Helper()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.sent) == 0 {
+		t.Fatal("no email sent")
+	}
+	m := linkToken.FindStringSubmatch(o.sent[len(o.sent)-1].Body)
+	if m == nil {
+		t.Fatalf("no link in %q", o.sent[len(o.sent)-1].Body)
+	}
+	return m[1], m[2]
+}
+
+func newTestService(t *testing.T) (*Service, *memoryRepo) {
+	svc, repo, _ := newTestServiceWithMail(t)
+	return svc, repo
+}
+
+func newTestServiceWithMail(t *testing.T) (*Service, *memoryRepo, *outbox) {
+	t.Helper()
+	keys, err := LoadKeyRing(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, mails := newMemoryRepo(), &outbox{}
+	return NewService(repo, keys, mails, "https://auth.example.com", "https://app.example.com"), repo, mails
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	svc, _ := newTestService(t)
+	laptop := ClientInfo{DeviceName: "Laptop", IP: "203.0.113.1", UserAgent: "Firefox"}
+
+	first, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, _, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{DeviceName: "Phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := svc.ValidateAccessToken(first.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ := svc.ListSessions(claims.UserID, claims.SessionID)
+	if len(sessions) != 2 {
+		t.Fatalf("sessions = %+v", sessions)
+	}
+	for _, s := range sessions {
+		if s.Current != (s.DeviceName == "Laptop") {
+			t.Errorf("session %+v marked current = %v", s, s.Current)
+		}
+	}
+
+	rotated, err := svc.RefreshTokens(first.RefreshToken, laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.RefreshTokens(first.RefreshToken, ClientInfo{IP: "198.51.100.7"}); err != ErrInvalidToken {
+		t.Fatalf("replayed refresh token = %v", err)
+	}
+	if _, err := svc.RefreshTokens(rotated.RefreshToken, laptop); err != ErrInvalidToken {
+		t.Errorf("session survived refresh token reuse: %v", err)
+	}
+	if _, err := svc.RefreshTokens(phone.RefreshToken, ClientInfo{}); err != nil {
+		t.Errorf("other session revoked: %v", err)
+	}
+}
+
+func TestInstanceTokens(t *testing.T) {
+	svc, _ := newTestService(t)
+	resp, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := resp.User.ID
+
+	if _, err := svc.IssueInstanceToken(userID, "https://chat.example.com"); err != ErrInstanceNotAllowed {
+		t.Fatalf("token for unauthorized instance: %v", err)
+	}
+	if _, err := svc.AuthorizeInstance(userID, "HTTPS://Chat.Example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := svc.IssueInstanceToken(userID, "https://chat.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Instance tokens aren't accepted by the auth server itself
+	if _, err := svc.ValidateAccessToken(token.AccessToken); err != ErrInvalidToken {
+		t.Errorf("instance token accepted centrally: %v", err)
+	}
+	if _, err := svc.IssueInstanceToken(userID, "javascript:alert(1)"); err != ErrInvalidInstanceURL {
+		t.Errorf("bad instance URL = %v", err)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	svc, _, mails := newTestServiceWithMail(t)
+	resp, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, _ := svc.ValidateAccessToken(resp.AccessToken); claims.EmailVerified {
+		t.Error("new account claims a verified email")
+	}
+
+	page, first := mails.lastLink(t)
+	if page != "verify-email" {
+		t.Fatalf("registration mailed a %s link", page)
+	}
+	if err := svc.ResendVerification(resp.User.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, second := mails.lastLink(t)
+	if err := svc.VerifyEmail(first); err != ErrInvalidToken {
+		t.Errorf("superseded link = %v", err)
+	}
+	if err := svc.VerifyEmail(second); err != nil {
+		t.Fatal(err)
+	}
+
+	login, _, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, _ := svc.ValidateAccessToken(login.AccessToken); !claims.EmailVerified {
+		t.Error("verified email not in claims")
+	}
+	if err := svc.ResendVerification(resp.User.ID); err != ErrAlreadyVerified {
+		t.Errorf("resend after verifying = %v", err)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	svc, _, mails := newTestServiceWithMail(t)
+	resp, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := len(mails.sent)
+	err = svc.ForgotPassword("nobody@example.com", ClientInfo{})
+	svc.background.Wait()
+	if err != nil || len(mails.sent) != sent {
+		t.Fatalf("unknown email = %v, %d emails", err, len(mails.sent)-sent)
+	}
+	if err := svc.ForgotPassword("a@example.com", ClientInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	svc.background.Wait()
+	page, token := mails.lastLink(t)
+	if page != "reset-password" {
+		t.Fatalf("mailed a %s link", page)
+	}
+
+	if err := svc.ResetPassword(token, "short"); err != validation.ErrWeakPassword {
+		t.Errorf("weak password = %v", err)
+	}
+	if err := svc.ResetPassword(token, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.ResetPassword(token, "another password"); err != ErrInvalidToken {
+		t.Errorf("reused reset token = %v", err)
+	}
+
+	if _, err := svc.RefreshTokens(resp.RefreshToken, ClientInfo{}); err != ErrInvalidToken {
+		t.Errorf("session survived password reset: %v", err)
+	}
+	if _, _, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{}); err != ErrInvalidCredentials {
+		t.Errorf("old password = %v", err)
+	}
+	if _, _, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "correct horse"}, ClientInfo{}); err != nil {
+		t.Errorf("new password = %v", err)
+	}
+}
+
+func TestPasswordResetThrottling(t *testing.T) {
+	svc, _, mails := newTestServiceWithMail(t)
+	if _, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, ClientInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	sent := len(mails.sent)
+
+	// Someone can't flood an inbox, with one IP address or many
+	var throttled *loginthrottle.ThrottledError
+	for i := 0; i <= loginthrottle.AccountFreeAttempts; i++ {
+		err := svc.ForgotPassword("a@example.com", ClientInfo{IP: fmt.Sprintf("198.51.100.%d", i)})
+		if i < loginthrottle.AccountFreeAttempts && err != nil {
+			t.Fatalf("request %d = %v", i+1, err)
+		}
+		if i == loginthrottle.AccountFreeAttempts && !errors.As(err, &throttled) {
+			t.Errorf("request %d = %v", i+1, err)
+		}
+	}
+	svc.background.Wait()
+	if n := len(mails.sent) - sent; n != loginthrottle.AccountFreeAttempts {
+		t.Errorf("%d reset emails sent", n)
+	}
+
+	// or everyone's from one address
+	for i := 0; i < loginthrottle.IPFreeAttempts; i++ {
+		_ = svc.ForgotPassword(fmt.Sprintf("user%d@example.com", i), ClientInfo{IP: "203.0.113.1"})
+	}
+	if err := svc.ForgotPassword("b@example.com", ClientInfo{IP: "203.0.113.1"}); !errors.As(err, &throttled) {
+		t.Errorf("request from a throttled IP = %v", err)
+	}
+
+	// Resets don't lock anyone out of logging in
+	if _, _, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{IP: "203.0.113.1"}); err != nil {
+		t.Errorf("login after reset requests = %v", err)
+	}
+	svc.background.Wait()
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	svc, repo := newTestService(t)
+	resp, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := resp.User.ID
+
+	if _, err := svc.BeginTOTPSetup(userID, ReauthRequest{Password: "wrong"}); err != ErrInvalidCredentials {
+		t.Fatalf("setup with wrong password = %v", err)
+	}
+	setup, err := svc.BeginTOTPSetup(userID, ReauthRequest{Password: "hunter22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not required until confirmed
+	if _, challenge, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{}); err != nil || challenge != nil {
+		t.Fatalf("login before confirming = %v, %+v", err, challenge)
+	}
+
+	step := totpStep(time.Now())
+	code := func(offset int64) string {
+		c, err := totpCode(setup.Secret, step+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	if _, err := svc.ConfirmTOTPSetup(userID, code(-5)); err != ErrInvalidMFACode {
+		t.Errorf("confirm with wrong code = %v", err)
+	}
+	codes, err := svc.ConfirmTOTPSetup(userID, code(-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("recovery codes = %v", codes.RecoveryCodes)
+	}
+
+	tokens, challenge, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22", DeviceName: "Laptop"}, ClientInfo{DeviceName: "Laptop"})
+	if err != nil || tokens != nil || challenge == nil || !challenge.MFARequired {
+		t.Fatalf("login with 2FA = %+v, %+v, %v", tokens, challenge, err)
+	}
+	if _, err := svc.CompleteMFALogin(MFALoginRequest{Ticket: challenge.Ticket, Code: code(-1)}, ClientInfo{}); err != ErrInvalidMFACode {
+		t.Errorf("replayed confirmation code = %v", err)
+	}
+	login, err := svc.CompleteMFALogin(MFALoginRequest{Ticket: challenge.Ticket, Code: code(0)}, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, _ := svc.ValidateAccessToken(login.AccessToken)
+	sessions, _ := svc.ListSessions(userID, claims.SessionID)
+	for _, s := range sessions {
+		if s.Current && s.DeviceName != "Laptop" {
+			t.Errorf("session device = %q", s.DeviceName)
+		}
+	}
+	if _, err := svc.CompleteMFALogin(MFALoginRequest{Ticket: challenge.Ticket, Code: code(1)}, ClientInfo{}); err != ErrInvalidToken {
+		t.Errorf("reused ticket = %v", err)
+	}
+
+	// Recovery codes work once, however they're typed
+	_, challenge, _ = svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{})
+	if _, err := svc.CompleteMFALogin(MFALoginRequest{Ticket: challenge.Ticket, Code: strings.ToUpper(codes.RecoveryCodes[0])}, ClientInfo{}); err != nil {
+		t.Fatalf("recovery code = %v", err)
+	}
+	_, challenge, _ = svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{})
+	if _, err := svc.CompleteMFALogin(MFALoginRequest{Ticket: challenge.Ticket, Code: codes.RecoveryCodes[0]}, ClientInfo{}); err != ErrInvalidMFACode {
+		t.Errorf("reused recovery code = %v", err)
+	}
+
+	// Wrong codes count against the account like wrong passwords, so
+	// signing in again for a new ticket doesn't allow more guesses. The
+	// password attempts count until the second factor is right too.
+	for i := 0; i < 2; i++ {
+		_, challenge, err = svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{})
+		if err != nil {
+			t.Fatalf("login %d = %v", i+1, err)
+		}
+		svc.CompleteMFALogin(MFALoginRequest{Ticket: challenge.Ticket, Code: "not-a-code"}, ClientInfo{})
+	}
+	var throttled *loginthrottle.ThrottledError
+	if _, err := svc.CompleteMFALogin(MFALoginRequest{Ticket: challenge.Ticket, Code: codes.RecoveryCodes[1]}, ClientInfo{}); !errors.As(err, &throttled) {
+		t.Fatalf("code after %d failures = %v", loginthrottle.AccountFreeAttempts, err)
+	}
+	repo.unlock()
+	if _, err := svc.CompleteMFALogin(MFALoginRequest{Ticket: challenge.Ticket, Code: codes.RecoveryCodes[1]}, ClientInfo{}); err != nil {
+		t.Fatalf("code once the lockout lifts = %v", err)
+	}
+
+	// Sensitive actions need the second factor too
+	change := ChangeEmailRequest{Email: "b@example.com", ReauthRequest: ReauthRequest{Password: "hunter22"}}
+	if _, err := svc.ChangeEmail(userID, change); err != ErrMFARequired {
+		t.Errorf("email change without code = %v", err)
+	}
+	change.Code = code(1)
+	user, err := svc.ChangeEmail(userID, change)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "b@example.com" || user.EmailVerified {
+		t.Errorf("changed user = %+v", user)
+	}
+
+	if err := svc.DisableTOTP(userID, ReauthRequest{Password: "hunter22", Code: codes.RecoveryCodes[2]}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := svc.MFAStatus(userID); status.TOTPEnabled || status.RecoveryCodesRemaining != 0 {
+		t.Errorf("status after disabling = %+v", status)
+	}
+	if _, challenge, err := svc.Login(LoginRequest{Email: "b@example.com", Password: "hunter22"}, ClientInfo{}); err != nil || challenge != nil {
+		t.Errorf("login after disabling = %v, %+v", err, challenge)
+	}
+}
+
+func TestPasskeys(t *testing.T) {
+	svc, _, mails := newTestServiceWithMail(t)
+	svc.WebAuthn = webauthn.NewRelyingParty("app.example.com", "OpenCord", []string{"https://app.example.com"})
+	authn := webauthntest.NewAuthenticator("https://app.example.com")
+
+	resp, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := resp.User.ID
+
+	if _, err := svc.BeginPasskeyRegistration(userID, ReauthRequest{Password: "wrong"}); err != ErrInvalidCredentials {
+		t.Fatalf("registration with wrong password = %v", err)
+	}
+	opts, err := svc.BeginPasskeyRegistration(userID, ReauthRequest{Password: "hunter22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := authn.Register(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passkey, err := svc.FinishPasskeyRegistration(userID, PasskeyRegistrationRequest{Name: "Laptop", Credential: *created})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.FinishPasskeyRegistration(userID, PasskeyRegistrationRequest{Credential: *created}); err != ErrInvalidPasskey {
+		t.Errorf("replayed registration = %v", err)
+	}
+
+	// Passwordless login
+	login, err := svc.BeginPasskeyLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, err := authn.Assert(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := svc.FinishPasskeyLogin(PasskeyLoginRequest{Credential: *assertion}, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.User.ID != userID {
+		t.Errorf("logged in as %s", tokens.User.ID)
+	}
+	if _, err := svc.FinishPasskeyLogin(PasskeyLoginRequest{Credential: *assertion}, ClientInfo{}); err != ErrInvalidPasskey {
+		t.Errorf("replayed assertion = %v", err)
+	}
+
+	// Primary login needs user verification
+	authn.UserVerified = false
+	login, _ = svc.BeginPasskeyLogin()
+	assertion, _ = authn.Assert(login)
+	if _, err := svc.FinishPasskeyLogin(PasskeyLoginRequest{Credential: *assertion}, ClientInfo{}); err != ErrInvalidPasskey {
+		t.Errorf("login without user verification = %v", err)
+	}
+
+	// ...but as a second factor, presence is enough
+	setup, _ := svc.BeginTOTPSetup(userID, ReauthRequest{Password: "hunter22"})
+	code, _ := totpCode(setup.Secret, totpStep(time.Now()))
+	codes, err := svc.ConfirmTOTPSetup(userID, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, challenge, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(challenge.Methods); n == 0 || challenge.Methods[n-1] != MFAMethodWebAuthn {
+		t.Fatalf("methods = %v", challenge.Methods)
+	}
+	mfa, err := svc.BeginMFAPasskey(challenge.Ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfa.AllowCredentials) != 1 {
+		t.Errorf("allowed credentials = %+v", mfa.AllowCredentials)
+	}
+	assertion, _ = authn.Assert(mfa)
+	if _, err := svc.CompleteMFALogin(MFALoginRequest{Ticket: challenge.Ticket, WebAuthn: assertion}, ClientInfo{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing a passkey needs the password and code like adding one
+	if err := svc.DeletePasskey(userID, passkey.ID, ReauthRequest{Password: "hunter22"}); err != ErrMFARequired {
+		t.Errorf("delete without code = %v", err)
+	}
+	if err := svc.DeletePasskey(userID, passkey.ID, ReauthRequest{Password: "hunter22", Code: codes.RecoveryCodes[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if last := mails.sent[len(mails.sent)-1]; last.Subject != "A passkey was removed from your account" || !strings.Contains(last.Body, `"Laptop"`) {
+		t.Errorf("last email = %q: %s", last.Subject, last.Body)
+	}
+	_, challenge, _ = svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{})
+	if _, err := svc.BeginMFAPasskey(challenge.Ticket); err != ErrInvalidPasskey {
+		t.Errorf("passkey challenge without passkeys = %v", err)
+	}
+}
+
+func TestOpenIDConnect(t *testing.T) {
+	svc, _ := newTestService(t)
+	resp, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := resp.User.ID
+
+	if _, err := svc.RegisterOAuthClient(userID, CreateOAuthClientRequest{Name: "App", RedirectURIs: []string{"http://evil.example.com/cb"}}); err != ErrInvalidRedirectURIs {
+		t.Errorf("plain http redirect URI = %v", err)
+	}
+	client, err := svc.RegisterOAuthClient(userID, CreateOAuthClientRequest{Name: "App", RedirectURIs: []string{"https://client.example.com/cb"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.ClientSecret == "" {
+		t.Fatal("confidential client has no secret")
+	}
+
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	req := AuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            client.ID.String(),
+		RedirectURI:         "https://client.example.com/cb",
+		Scope:               "openid profile",
+		State:               "xyz",
+		Nonce:               "n-0S6",
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(sum[:]),
+		CodeChallengeMethod: "S256",
+	}
+
+	// The authorization endpoint hands over to the consent page, unless
+	// the redirect URI isn't the client's
+	location, err := svc.StartAuthorization(req)
+	if err != nil || !strings.HasPrefix(location, "https://app.example.com/oauth/authorize?") {
+		t.Fatalf("StartAuthorization = %q, %v", location, err)
+	}
+	bad := req
+	bad.RedirectURI = "https://evil.example.com/cb"
+	if _, err := svc.StartAuthorization(bad); err != ErrInvalidRedirectURI {
+		t.Errorf("unregistered redirect URI = %v", err)
+	}
+	bad = req
+	bad.CodeChallenge = ""
+	if location, _ := svc.StartAuthorization(bad); !strings.Contains(location, "error=invalid_request") {
+		t.Errorf("request without PKCE redirected to %q", location)
+	}
+
+	prompt, err := svc.ConsentPrompt(userID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt.Consented || prompt.ClientName != "App" || len(prompt.Scopes) != 2 {
+		t.Errorf("prompt = %+v", prompt)
+	}
+	location, _ = svc.Authorize(userID, req, false)
+	if !strings.Contains(location, "error=access_denied") {
+		t.Errorf("denied consent redirected to %q", location)
+	}
+
+	authorize := func() string {
+		t.Helper()
+		location, err := svc.Authorize(userID, req, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(location)
+		if u.Query().Get("state") != "xyz" || u.Query().Get("iss") != "https://auth.example.com" {
+			t.Errorf("redirected to %q", location)
+		}
+		return u.Query().Get("code")
+	}
+	exchange := TokenRequest{
+		GrantType:    "authorization_code",
+		Code:         authorize(),
+		RedirectURI:  req.RedirectURI,
+		ClientID:     client.ID.String(),
+		ClientSecret: client.ClientSecret,
+		CodeVerifier: verifier,
+	}
+
+	wrongSecret := exchange
+	wrongSecret.ClientSecret = "nope"
+	if _, err := svc.ExchangeAuthorizationCode(wrongSecret); oauthCode(err) != "invalid_client" {
+		t.Errorf("wrong client secret = %v", err)
+	}
+	tokens, err := svc.ExchangeAuthorizationCode(exchange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.ExchangeAuthorizationCode(exchange); oauthCode(err) != "invalid_grant" {
+		t.Errorf("replayed code = %v", err)
+	}
+	exchange.Code, exchange.CodeVerifier = authorize(), strings.Repeat("w", 43)
+	if _, err := svc.ExchangeAuthorizationCode(exchange); oauthCode(err) != "invalid_grant" {
+		t.Errorf("wrong code verifier = %v", err)
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(tokens.IDToken, claims, svc.verificationKey, jwt.WithAudience(client.ID.String())); err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != userID.String() || claims["nonce"] != "n-0S6" || claims["preferred_username"] != "alice" {
+		t.Errorf("ID token claims = %v", claims)
+	}
+	if _, ok := claims["email"]; ok {
+		t.Error("ID token has email without the email scope")
+	}
+
+	// OAuth tokens only work at the userinfo endpoint, and ID tokens not
+	// even there
+	if _, err := svc.ValidateAccessToken(tokens.AccessToken); err != ErrInvalidToken {
+		t.Errorf("OAuth access token accepted by the API: %v", err)
+	}
+	if _, err := svc.UserInfo(tokens.IDToken); err != ErrInvalidToken {
+		t.Errorf("ID token accepted at userinfo: %v", err)
+	}
+	info, err := svc.UserInfo(tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["sub"] != userID.String() || info["name"] != "Alice" {
+		t.Errorf("userinfo = %v", info)
+	}
+
+	// Asking for more scopes asks for consent again
+	req.Scope = "openid email"
+	if prompt, _ := svc.ConsentPrompt(userID, req); prompt.Consented {
+		t.Error("consent covers a new scope")
+	}
+	req.Scope = "openid"
+	if prompt, _ := svc.ConsentPrompt(userID, req); !prompt.Consented {
+		t.Error("consent doesn't cover a granted scope")
+	}
+
+	if err := svc.RevokeOAuthConsent(userID, client.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.UserInfo(tokens.AccessToken); err != ErrInvalidToken {
+		t.Errorf("userinfo after revoking = %v", err)
+	}
+}
+
+func oauthCode(err error) string {
+	var oauthErr *OAuthError
+	if errors.As(err, &oauthErr) {
+		return oauthErr.Code
+	}
+	return ""
+}
+
+func TestLoginThrottling(t *testing.T) {
+	svc, repo, mails := newTestServiceWithMail(t)
+	if _, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, ClientInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	attacker := ClientInfo{IP: "198.51.100.7"}
+	login := func(email, password string, client ClientInfo) error {
+		_, _, err := svc.Login(LoginRequest{Email: email, Password: password}, client)
+		return err
+	}
+
+	// Real and unknown accounts are locked out after the same number of
+	// failures, with the same errors
+	for _, email := range []string{"a@example.com", "nobody@example.com"} {
+		for i := 0; i < loginthrottle.AccountFreeAttempts; i++ {
+			if err := login(email, "wrong", attacker); err != ErrInvalidCredentials {
+				t.Fatalf("failure %d for %s = %v", i+1, email, err)
+			}
+		}
+		var throttled *loginthrottle.ThrottledError
+		if err := login(email, "hunter22", ClientInfo{IP: "203.0.113.1"}); !errors.As(err, &throttled) || throttled.RetryAfter <= 0 {
+			t.Errorf("login to locked out %s = %v", email, err)
+		}
+	}
+	if len(mails.sent) != 2 || !strings.Contains(mails.sent[1].Body, "198.51.100.7") {
+		t.Fatalf("lockout notifications = %+v", mails.sent)
+	}
+
+	// Once it lifts, the owner hears about a login after the failures
+	repo.unlock()
+	if err := login("a@example.com", "hunter22", ClientInfo{IP: "203.0.113.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if last := mails.sent[len(mails.sent)-1]; last.Subject != "New sign-in to your account" {
+		t.Errorf("last email = %q", last.Subject)
+	}
+
+	// Guessing across many accounts locks out the IP address
+	for i := 0; i < loginthrottle.IPFreeAttempts; i++ {
+		_ = login(fmt.Sprintf("user%d@example.com", i), "wrong", attacker)
+	}
+	var throttled *loginthrottle.ThrottledError
+	if err := login("a@example.com", "hunter22", attacker); !errors.As(err, &throttled) {
+		t.Errorf("login from locked out IP = %v", err)
+	}
+	if err := login("a@example.com", "hunter22", ClientInfo{IP: "203.0.113.1"}); err != nil {
+		t.Errorf("login from another IP = %v", err)
+	}
+}
+
+func TestReauthThrottling(t *testing.T) {
+	svc, repo := newTestService(t)
+	resp, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := resp.User.ID
+
+	// Someone with a stolen access token gets as many guesses as at login
+	thief := ClientInfo{IP: "198.51.100.7"}
+	for i := 0; i < loginthrottle.AccountFreeAttempts; i++ {
+		if _, err := svc.DeleteAccount(userID, ReauthRequest{Password: "wrong", Client: thief}); err != ErrInvalidCredentials {
+			t.Fatalf("failure %d = %v", i+1, err)
+		}
+	}
+	var throttled *loginthrottle.ThrottledError
+	if _, err := svc.BeginTOTPSetup(userID, ReauthRequest{Password: "hunter22", Client: thief}); !errors.As(err, &throttled) {
+		t.Errorf("reauthentication after %d failures = %v", loginthrottle.AccountFreeAttempts, err)
+	}
+	if _, _, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{}); !errors.As(err, &throttled) {
+		t.Errorf("login after %d failed reauthentications = %v", loginthrottle.AccountFreeAttempts, err)
+	}
+
+	repo.unlock()
+	if _, err := svc.BeginTOTPSetup(userID, ReauthRequest{Password: "hunter22"}); err != nil {
+		t.Errorf("reauthentication once the lockout lifts = %v", err)
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	svc, _ := newTestService(t)
+	dir := t.TempDir()
+	// SHA-1("correct horse battery staple") = ABF7AAD6438836DBE526AA231ABDE2D0EEF74D42
+	if err := os.WriteFile(filepath.Join(dir, "ABF7A.txt"), []byte("AD6438836DBE526AA231ABDE2D0EEF74D42:3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if svc.BreachedPasswords, err = breach.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	register := func(email, username, password string) error {
+		_, err := svc.Register(RegisterRequest{Email: email, Username: username, DisplayName: "Alice", Password: password}, ClientInfo{})
+		return err
+	}
+	for _, tc := range []struct {
+		email, username, password string
+		want                      *validation.FieldError
+	}{
+		// The rules are tested in the validation package; these check each
+		// field, the identifiers and the breached list are passed along
+		{"not an email", "alice", "hunter22", validation.ErrInvalidEmail},
+		{"a@example.com", "Admin", "hunter22", validation.ErrReservedUsername},
+		{"a@example.com", "alice", "short", validation.ErrWeakPassword},
+		{"alice.smith@example.com", "alice", "ALICE.SMITH", validation.ErrGuessablePassword},
+		{"a@example.com", "alice", "correct horse battery staple", validation.ErrBreachedPassword},
+	} {
+		if err := register(tc.email, tc.username, tc.password); err != tc.want {
+			t.Errorf("Register(%q, %q, %q) = %v, want %v", tc.email, tc.username, tc.password, err, tc.want)
+		}
+	}
+
+	// Uniqueness ignores case, and so does logging in
+	if err := register(" a@example.com ", "alice", "hunter22"); err != nil {
+		t.Fatal(err)
+	}
+	if err := register("A@Example.com", "bob", "hunter22"); err != validation.ErrEmailTaken {
+		t.Errorf("duplicate email = %v", err)
+	}
+	if err := register("b@example.com", "ALICE", "hunter22"); err != validation.ErrUsernameTaken {
+		t.Errorf("duplicate username = %v", err)
+	}
+	if _, _, err := svc.Login(LoginRequest{Email: "A@EXAMPLE.COM", Password: "hunter22"}, ClientInfo{}); err != nil {
+		t.Errorf("login with differently cased email = %v", err)
+	}
+}
+
+func TestNoticeClientStaysOutside(t *testing.T) {
+	for address, public := range map[string]bool{
+		"93.184.216.34:443":        true,
+		"[2606:2800:220:1::1]:443": true,
+		"127.0.0.1:80":             false,
+		"10.1.2.3:80":              false,
+		"169.254.169.254:80":       false,
+		"100.100.100.200:80":       false,
+		"[::1]:80":                 false,
+		"[fd00:ec2::254]:80":       false,
+		"[fe80::1]:80":             false,
+		"[::ffff:192.168.1.1]:80":  false,
+		"[64:ff9b::10.0.0.1]:80":   false,
+		"0.0.0.0:80":               false,
+	} {
+		if err := dialPublicOnly("tcp", address, nil); (err == nil) != public {
+			t.Errorf("dial %s: %v", address, err)
+		}
+	}
+
+	var hits []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.Path)
+		http.Redirect(w, r, "/internal", http.StatusFound)
+	}))
+	defer server.Close()
+	if _, err := noticeClient.Post(server.URL+"/api/auth/events", "application/secevent+jwt", nil); err == nil || len(hits) != 0 {
+		t.Errorf("notice to loopback: %v, hits %v", err, hits)
+	}
+
+	// Redirects aren't followed either
+	client := *noticeClient
+	client.Transport = nil
+	resp, err := client.Post(server.URL+"/api/auth/events", "application/secevent+jwt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || len(hits) != 1 {
+		t.Errorf("redirect: %s, hits %v", resp.Status, hits)
+	}
+}
+
+func TestAccountDeletion(t *testing.T) {
+	svc, repo, mails := newTestServiceWithMail(t)
+	resp, err := svc.Register(RegisterRequest{Email: "a@example.com", Username: "alice", DisplayName: "Alice", Password: "hunter22"}, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := resp.User.ID
+
+	var events []*http.Request
+	var tokens []string
+	instance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		events, tokens = append(events, r), append(tokens, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer instance.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+	// The test instances listen on loopback, which noticeClient refuses
+	defer func(c *http.Client) { noticeClient = c }(noticeClient)
+	noticeClient = &http.Client{Timeout: time.Second}
+	for _, url := range []string{instance.URL, down.URL} {
+		if _, err := repo.CreateInstanceGrant(userID, url); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The export has the account's data but none of its secrets
+	archive, err := svc.ExportAccount(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	if !strings.Contains(files["profile.json"], `"email": "a@example.com"`) || !strings.Contains(files["instances.json"], instance.URL) {
+		t.Errorf("export = %v", files)
+	}
+	for name, data := range files {
+		if strings.Contains(data, "$2a$") || strings.Contains(data, resp.RefreshToken) {
+			t.Errorf("%s leaks a secret: %s", name, data)
+		}
+	}
+
+	// Deleting needs the password, and logs the user out
+	if _, err := svc.DeleteAccount(userID, ReauthRequest{Password: "wrong"}); err != ErrInvalidCredentials {
+		t.Fatalf("delete with wrong password = %v", err)
+	}
+	at, err := svc.DeleteAccount(userID, ReauthRequest{Password: "hunter22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(at); d < accountDeletionGrace-time.Minute || d > accountDeletionGrace {
+		t.Errorf("deletion scheduled in %v", d)
+	}
+	if _, err := svc.RefreshTokens(resp.RefreshToken, ClientInfo{}); err != ErrInvalidToken {
+		t.Errorf("session survived account deletion: %v", err)
+	}
+
+	// Signing in during the grace period keeps the account
+	if _, _, err := svc.Login(LoginRequest{Email: "a@example.com", Password: "hunter22"}, ClientInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if last := mails.sent[len(mails.sent)-1]; last.Subject != "Your OpenCord account won't be deleted" {
+		t.Errorf("last email = %q", last.Subject)
+	}
+	svc.deleteDueAccounts(at.Add(time.Second))
+	if _, err := repo.GetUserByID(userID); err != nil {
+		t.Fatalf("cancelled deletion went ahead: %v", err)
+	}
+
+	if at, err = svc.DeleteAccount(userID, ReauthRequest{Password: "hunter22"}); err != nil {
+		t.Fatal(err)
+	}
+	svc.deleteDueAccounts(at.Add(-time.Second))
+	if _, err := repo.GetUserByID(userID); err != nil {
+		t.Fatalf("deleted during the grace period: %v", err)
+	}
+	svc.deleteDueAccounts(at.Add(time.Second))
+	if _, err := repo.GetUserByID(userID); err == nil {
+		t.Fatal("account still exists after the grace period")
+	}
+
+	// Each authorized instance gets a signed account_deleted event; ones
+	// that don't accept it are retried
+	svc.deliverDeletionNotices(time.Now())
+	if len(events) != 1 || events[0].URL.Path != "/api/auth/events" || events[0].Header.Get("Content-Type") != "application/secevent+jwt" {
+		t.Fatalf("events = %+v", events)
+	}
+	token, err := jwt.Parse(tokens[0], svc.verificationKey, jwt.WithAudience(instance.URL), jwt.WithIssuer("https://auth.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if token.Header["typ"] != securityEventType || claims["sub"] != userID.String() {
+		t.Errorf("event header %v, claims %v", token.Header, claims)
+	}
+	if _, ok := claims["events"].(map[string]interface{})[EventAccountDeleted]; !ok {
+		t.Errorf("events claim = %v", claims["events"])
+	}
+	if len(repo.notices) != 1 {
+		t.Fatalf("%d notices left, want the failed one", len(repo.notices))
+	}
+	for _, n := range repo.notices {
+		if n.InstanceURL != down.URL || n.Attempts != 1 {
+			t.Errorf("left notice = %+v", n)
+		}
+	}
+	if d := noticeRetry(maxNoticeAttempts); d != maxNoticeRetry {
+		t.Errorf("last retry delay = %v", d)
+	}
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/opencord/shared/loginthrottle"
+)
+
+// Logins are throttled per account and IP address by loginthrottle. These
+// hooks let the account's owner know what happened.
+
+// beginLogin counts a login attempt before the password is checked. It
+// fails with a *loginthrottle.ThrottledError while the account or IP
+// address is locked out.
+func (s *Service) beginLogin(email string, client ClientInfo) (*loginthrottle.Attempt, error) {
+	return loginthrottle.Begin(s.repo, loginthrottle.NewKeys(email, client.IP))
+}
+
+// loginFailed tells the account's owner, if there is one, when it first
+// gets locked out.
+func (s *Service) loginFailed(attempt *loginthrottle.Attempt, user *User, client ClientInfo) {
+	if user != nil && attempt.LockedOut() {
+		log.Printf("locked out logins to user %s after %d failures (last from %s)", user.ID, attempt.Failures, client.IP)
+		s.notifySecurityChange(user.ID, "Failed sign-in attempts on your account",
+			fmt.Sprintf("There were %d failed attempts to sign in to your OpenCord account, the last one from %s. "+
+				"We've paused sign-ins to it for a while.", attempt.Failures, client.IP))
+	}
+}
+
+// loginSucceeded clears the attempt, letting the owner know if someone got
+// in after enough failures to be locked out.
+func (s *Service) loginSucceeded(attempt *loginthrottle.Attempt, user *User, client ClientInfo) {
+	if err := attempt.Succeeded(); err != nil {
+		log.Printf("failed to clear login failures for user %s: %v", user.ID, err)
+	}
+	if failures := attempt.EarlierFailures(); failures >= loginthrottle.AccountFreeAttempts {
+		s.notifySecurityChange(user.ID, "New sign-in to your account",
+			fmt.Sprintf("Someone signed in to your OpenCord account from %s (%s) after %d failed attempts.",
+				client.IP, client.UserAgent, failures))
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, truncated to 6 digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	step := totpStep(now)
+
+	for _, offset := range []int64{-1, 0, 1} {
+		code, _ := totpCode(secret, step+offset)
+		if got, ok := matchTOTP(secret, code[:3]+" "+code[3:], now); !ok || got != step+offset {
+			t.Errorf("code for step %+d: matched %v at %d", offset, ok, got)
+		}
+	}
+	code, _ := totpCode(secret, step-2)
+	if _, ok := matchTOTP(secret, code, now); ok {
+		t.Error("accepted a code from a minute ago")
+	}
+
+	uri := totpURI("OpenCord", "a@example.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/OpenCord:a@example.com?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("uri = %s", uri)
+	}
+}
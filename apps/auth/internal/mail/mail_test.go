@@ -0,0 +1,112 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// smtpSink accepts one message and hands back the envelope recipient and
+// the data.
+func smtpSink(t *testing.T) (host string, port int, got chan [2]string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got = make(chan [2]string, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		reply("220 sink ready")
+		var rcpt string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 sink")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				rcpt = strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>")
+				reply("250 ok")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				got <- [2]string{rcpt, data.String()}
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, got
+}
+
+func TestSMTPMailer(t *testing.T) {
+	host, port, got := smtpSink(t)
+	m := NewSMTPMailer(host, port, "", "", "OpenCord <no-reply@example.com>")
+
+	msg := Message{To: "alice@example.com", Subject: "Reset your password", Body: "Line one\nLine two"}
+	if err := m.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	sent := <-got
+	if sent[0] != "alice@example.com" {
+		t.Errorf("recipient = %q", sent[0])
+	}
+	for _, want := range []string{"Subject: Reset your password\r\n", "From: OpenCord <no-reply@example.com>\r\n", "Line one\r\nLine two"} {
+		if !strings.Contains(sent[1], want) {
+			t.Errorf("message missing %q:\n%s", want, sent[1])
+		}
+	}
+
+	bad := Message{To: "alice@example.com\r\nBcc: eve@example.com", Subject: "x"}
+	if err := m.Send(context.Background(), bad); err == nil {
+		t.Error("header injection accepted")
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewFileMailer(dir, "no-reply@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Send(context.Background(), Message{To: "bob@example.com", Subject: "Hi", Body: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), "-bob@example.com.eml") {
+		t.Fatalf("files = %v", entries)
+	}
+	data, _ := os.ReadFile(dir + "/" + entries[0].Name())
+	if !strings.Contains(string(data), "To: bob@example.com\r\n") {
+		t.Errorf("file = %q", data)
+	}
+}
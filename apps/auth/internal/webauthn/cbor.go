@@ -0,0 +1,133 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Just enough of CBOR (RFC 8949) to read attestation objects and COSE
+// keys. Integers decode to int64, byte strings to []byte, text to string,
+// arrays to []interface{} and maps to map[interface{}]interface{}. Floats
+// and indefinite lengths aren't used by authenticators and are rejected.
+
+var errCBOR = errors.New("malformed CBOR")
+
+const maxCBORDepth = 16
+
+// decodeCBOR decodes one item from the start of b, returning it and the
+// bytes that follow it.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeItem(b, 0)
+}
+
+func decodeItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deeply", errCBOR)
+	}
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22:
+			return nil, b, nil
+		}
+		return nil, nil, fmt.Errorf("%w: unsupported simple value %d", errCBOR, info)
+	}
+
+	arg, b, err := readArgument(info, b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return int64(arg), b, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if arg > uint64(len(b)) {
+			return nil, nil, fmt.Errorf("%w: string runs past end", errCBOR)
+		}
+		s, rest := b[:arg], b[arg:]
+		if major == 3 {
+			return string(s), rest, nil
+		}
+		return append([]byte(nil), s...), rest, nil
+	case 4:
+		// Each element takes at least a byte
+		if arg > uint64(len(b)) {
+			return nil, nil, fmt.Errorf("%w: array runs past end", errCBOR)
+		}
+		arr := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var v interface{}
+			if v, b, err = decodeItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, b, nil
+	case 5:
+		if arg > uint64(len(b))/2 {
+			return nil, nil, fmt.Errorf("%w: map runs past end", errCBOR)
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var k, v interface{}
+			if k, b, err = decodeItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key %T", errCBOR, k)
+			}
+			if v, b, err = decodeItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			if _, dup := m[k]; dup {
+				return nil, nil, fmt.Errorf("%w: duplicate map key %v", errCBOR, k)
+			}
+			m[k] = v
+		}
+		return m, b, nil
+	case 6:
+		// Tags carry no meaning we need; decode the tagged item
+		return decodeItem(b, depth+1)
+	}
+	return nil, nil, fmt.Errorf("%w: unsupported major type %d", errCBOR, major)
+}
+
+func readArgument(info byte, b []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24 && len(b) >= 1:
+		return uint64(b[0]), b[1:], nil
+	case info == 25 && len(b) >= 2:
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26 && len(b) >= 4:
+		return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27 && len(b) >= 8:
+		return binary.BigEndian.Uint64(b), b[8:], nil
+	case info >= 28:
+		return 0, nil, fmt.Errorf("%w: unsupported length encoding %d", errCBOR, info)
+	}
+	return 0, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+}
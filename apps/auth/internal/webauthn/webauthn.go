@@ -0,0 +1,397 @@
+// Package webauthn implements the relying party side of WebAuthn
+// (https://www.w3.org/TR/webauthn-2/) registration and authentication
+// ceremonies. Binary fields cross the wire base64url-encoded; clients
+// convert them to and from ArrayBuffers.
+//
+// Attestation statements aren't verified: we ask for "none" and only use
+// the credential public key, so a credential is trusted as much as the
+// account that registered it.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidResponse is wrapped by every verification failure.
+var ErrInvalidResponse = errors.New("invalid WebAuthn response")
+
+// ceremonyTimeout is the timeout suggested to the browser.
+const ceremonyTimeout = 5 * time.Minute
+
+// User verification requirements
+const (
+	VerificationRequired  = "required"
+	VerificationPreferred = "preferred"
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+var b64 = base64.RawURLEncoding
+
+// RelyingParty verifies ceremonies for one site. ID is the domain
+// credentials are scoped to; Origins lists the exact origins (scheme,
+// host, port) of the web apps allowed to use them.
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+func NewRelyingParty(id, name string, origins []string) *RelyingParty {
+	return &RelyingParty{ID: id, Name: name, Origins: origins}
+}
+
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// UserEntity identifies the account a credential is created for. ID is an
+// opaque handle, base64url-encoded, that authenticators hand back at login.
+type UserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are passed to navigator.credentials.create().
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are passed to navigator.credentials.get(). An empty
+// AllowCredentials lets the user pick any passkey they have for the site.
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// AttestationResponse is the PublicKeyCredential returned by
+// navigator.credentials.create().
+type AttestationResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports,omitempty"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the PublicKeyCredential returned by
+// navigator.credentials.get().
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// Credential is a newly registered credential to store for the user.
+type Credential struct {
+	ID         []byte
+	PublicKey  []byte // COSE_Key
+	SignCount  uint32
+	AAGUID     []byte
+	Transports []string
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// With the attested flag (registration only)
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+// NewChallenge returns a random challenge for a ceremony.
+func NewChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate challenge: %w", err)
+	}
+	return b64.EncodeToString(b), nil
+}
+
+// EncodeID and DecodeID convert credential IDs and user handles to and
+// from their wire encoding.
+func EncodeID(id []byte) string {
+	return b64.EncodeToString(id)
+}
+
+func DecodeID(s string) ([]byte, error) {
+	return b64.DecodeString(s)
+}
+
+// Challenge returns the challenge a response answers, so the caller can
+// look up the ceremony before verifying it.
+func Challenge(clientDataJSON string) (string, error) {
+	cd, err := parseClientData(clientDataJSON)
+	if err != nil {
+		return "", err
+	}
+	return cd.Challenge, nil
+}
+
+// CreationOptions builds the options for registering a credential.
+// exclude lists the user's existing credentials so the same authenticator
+// isn't registered twice.
+func (rp *RelyingParty) CreationOptions(challenge string, user UserEntity, exclude []CredentialDescriptor) *CreationOptions {
+	if exclude == nil {
+		exclude = []CredentialDescriptor{}
+	}
+	return &CreationOptions{
+		Challenge: challenge,
+		RP:        RelyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User:      user,
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: AlgES256},
+			{Type: "public-key", Alg: AlgEdDSA},
+			{Type: "public-key", Alg: AlgRS256},
+		},
+		Timeout:            ceremonyTimeout.Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: VerificationPreferred,
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions builds the options for authenticating with one of allow,
+// or with any discoverable credential if allow is empty.
+func (rp *RelyingParty) RequestOptions(challenge string, allow []CredentialDescriptor, userVerification string) *RequestOptions {
+	if allow == nil {
+		allow = []CredentialDescriptor{}
+	}
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          ceremonyTimeout.Milliseconds(),
+		RPID:             rp.ID,
+		AllowCredentials: allow,
+		UserVerification: userVerification,
+	}
+}
+
+// VerifyRegistration checks a response to CreationOptions built with
+// challenge and returns the credential it created.
+func (rp *RelyingParty) VerifyRegistration(resp *AttestationResponse, challenge string) (*Credential, error) {
+	if err := rp.checkClientData(resp.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	raw, err := b64.DecodeString(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object is not base64url", ErrInvalidResponse)
+	}
+	v, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	obj, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: attestation object is not a map", ErrInvalidResponse)
+	}
+	rawAuthData, ok := obj["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing authenticator data", ErrInvalidResponse)
+	}
+
+	ad, err := rp.checkAuthenticatorData(rawAuthData, false)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, fmt.Errorf("%w: no attested credential", ErrInvalidResponse)
+	}
+	if rawID, err := b64.DecodeString(resp.RawID); err != nil || !bytes.Equal(rawID, ad.credentialID) {
+		return nil, fmt.Errorf("%w: credential ID mismatch", ErrInvalidResponse)
+	}
+	if _, err := parsePublicKey(ad.publicKey); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+
+	return &Credential{
+		ID:         ad.credentialID,
+		PublicKey:  ad.publicKey,
+		SignCount:  ad.signCount,
+		AAGUID:     ad.aaguid,
+		Transports: resp.Response.Transports,
+	}, nil
+}
+
+// VerifyAssertion checks a response to RequestOptions built with
+// challenge, signed by the stored credential publicKey with signature
+// counter storedCount. userHandle is the account the credential belongs
+// to. It returns the new counter value to store.
+//
+// Counters that don't increase suggest the credential was cloned and are
+// rejected, except for authenticators that always report zero.
+func (rp *RelyingParty) VerifyAssertion(resp *AssertionResponse, challenge string, publicKey, userHandle []byte, storedCount uint32, requireUV bool) (uint32, error) {
+	if err := rp.checkClientData(resp.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+	if resp.Response.UserHandle != "" {
+		handle, err := b64.DecodeString(resp.Response.UserHandle)
+		if err != nil || !bytes.Equal(handle, userHandle) {
+			return 0, fmt.Errorf("%w: user handle mismatch", ErrInvalidResponse)
+		}
+	}
+
+	rawAuthData, err := b64.DecodeString(resp.Response.AuthenticatorData)
+	if err != nil {
+		return 0, fmt.Errorf("%w: authenticator data is not base64url", ErrInvalidResponse)
+	}
+	ad, err := rp.checkAuthenticatorData(rawAuthData, requireUV)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return 0, fmt.Errorf("%w: stored key: %v", ErrInvalidResponse, err)
+	}
+	sig, err := b64.DecodeString(resp.Response.Signature)
+	if err != nil {
+		return 0, fmt.Errorf("%w: signature is not base64url", ErrInvalidResponse)
+	}
+	clientDataJSON, _ := b64.DecodeString(resp.Response.ClientDataJSON)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if !key.verify(append(rawAuthData, clientDataHash[:]...), sig) {
+		return 0, fmt.Errorf("%w: bad signature", ErrInvalidResponse)
+	}
+
+	if (ad.signCount != 0 || storedCount != 0) && ad.signCount <= storedCount {
+		return 0, fmt.Errorf("%w: signature counter went from %d to %d", ErrInvalidResponse, storedCount, ad.signCount)
+	}
+	return ad.signCount, nil
+}
+
+func parseClientData(clientDataJSON string) (*clientData, error) {
+	raw, err := b64.DecodeString(clientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data is not base64url", ErrInvalidResponse)
+	}
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, fmt.Errorf("%w: client data is not JSON", ErrInvalidResponse)
+	}
+	return &cd, nil
+}
+
+func (rp *RelyingParty) checkClientData(clientDataJSON, ceremony, challenge string) error {
+	cd, err := parseClientData(clientDataJSON)
+	if err != nil {
+		return err
+	}
+	if cd.Type != ceremony {
+		return fmt.Errorf("%w: client data type %q", ErrInvalidResponse, cd.Type)
+	}
+	if cd.Challenge != challenge {
+		return fmt.Errorf("%w: challenge mismatch", ErrInvalidResponse)
+	}
+	for _, origin := range rp.Origins {
+		if cd.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: origin %q not allowed", ErrInvalidResponse, cd.Origin)
+}
+
+func (rp *RelyingParty) checkAuthenticatorData(raw []byte, requireUV bool) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalidResponse)
+	}
+	ad := &authenticatorData{
+		rpIDHash:  raw[:32],
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return nil, fmt.Errorf("%w: credential is for another site", ErrInvalidResponse)
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, fmt.Errorf("%w: user not present", ErrInvalidResponse)
+	}
+	if requireUV && ad.flags&flagUserVerified == 0 {
+		return nil, fmt.Errorf("%w: user not verified", ErrInvalidResponse)
+	}
+
+	if ad.flags&flagAttested != 0 {
+		rest := raw[37:]
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidResponse)
+		}
+		ad.aaguid = rest[:16]
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+			return nil, fmt.Errorf("%w: bad credential ID", ErrInvalidResponse)
+		}
+		ad.credentialID, rest = rest[:idLen], rest[idLen:]
+
+		// The key is followed by extensions, if any
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: credential public key: %v", ErrInvalidResponse, err)
+		}
+		ad.publicKey = rest[:len(rest)-len(after)]
+	}
+	return ad, nil
+}
@@ -0,0 +1,85 @@
+package webauthn_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/opencord/auth/internal/webauthn"
+	"github.com/opencord/auth/internal/webauthn/webauthntest"
+)
+
+func TestCeremonies(t *testing.T) {
+	rp := webauthn.NewRelyingParty("example.com", "OpenCord", []string{"https://app.example.com"})
+	authn := webauthntest.NewAuthenticator("https://app.example.com")
+	userHandle := []byte("user-1")
+
+	challenge, _ := webauthn.NewChallenge()
+	created, err := authn.Register(rp.CreationOptions(challenge, webauthn.UserEntity{
+		ID: webauthn.EncodeID(userHandle), Name: "alice", DisplayName: "Alice",
+	}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := webauthn.Challenge(created.Response.ClientDataJSON); got != challenge {
+		t.Errorf("Challenge() = %q, want %q", got, challenge)
+	}
+	if _, err := rp.VerifyRegistration(created, "another challenge"); !errors.Is(err, webauthn.ErrInvalidResponse) {
+		t.Errorf("registration for another challenge = %v", err)
+	}
+	cred, err := rp.VerifyRegistration(created, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert := func(allow []webauthn.CredentialDescriptor) (*webauthn.AssertionResponse, string) {
+		t.Helper()
+		challenge, _ := webauthn.NewChallenge()
+		resp, err := authn.Assert(rp.RequestOptions(challenge, allow, webauthn.VerificationRequired))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, challenge
+	}
+
+	// Discoverable login
+	resp, challenge := assert(nil)
+	count, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, userHandle, cred.SignCount, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, []byte("user-2"), cred.SignCount, true); err == nil {
+		t.Error("accepted another user's handle")
+	}
+	if _, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, userHandle, count, true); err == nil {
+		t.Error("accepted a counter that didn't increase")
+	}
+
+	// Tampered signature
+	resp, challenge = assert([]webauthn.CredentialDescriptor{{Type: "public-key", ID: webauthn.EncodeID(cred.ID)}})
+	good := resp.Response.Signature
+	resp.Response.Signature = good[:len(good)-2] + "AA"
+	if _, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, userHandle, count, true); err == nil {
+		t.Error("accepted a bad signature")
+	}
+	resp.Response.Signature = good
+	if count, err = rp.VerifyAssertion(resp, challenge, cred.PublicKey, userHandle, count, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without user verification it only works as a second factor
+	authn.UserVerified = false
+	resp, challenge = assert(nil)
+	if _, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, userHandle, count, true); err == nil {
+		t.Error("accepted an unverified user")
+	}
+	if _, err := rp.VerifyAssertion(resp, challenge, cred.PublicKey, userHandle, count, false); err != nil {
+		t.Errorf("second factor without UV = %v", err)
+	}
+
+	// Other sites' pages can't use the credential
+	phishing := webauthn.NewRelyingParty("example.com", "OpenCord", []string{"https://app.example.net"})
+	resp, challenge = assert(nil)
+	if _, err := phishing.VerifyAssertion(resp, challenge, cred.PublicKey, userHandle, 0, false); err == nil {
+		t.Error("accepted an assertion from another origin")
+	}
+}
@@ -0,0 +1,223 @@
+// Package webauthntest provides a software authenticator for testing
+// WebAuthn relying parties without a browser or security key.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/opencord/auth/internal/webauthn"
+)
+
+// Authenticator holds ES256 credentials in memory and answers ceremonies
+// the way a browser plus platform authenticator would.
+type Authenticator struct {
+	// Origin is reported in client data, as a browser would for the page
+	// running the ceremony.
+	Origin string
+
+	// UserVerified sets the UV flag, as if the user entered a PIN or used
+	// biometrics. Defaults to true.
+	UserVerified bool
+
+	credentials []*credential
+}
+
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+func NewAuthenticator(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, UserVerified: true}
+}
+
+// Register creates a credential for opts.
+func (a *Authenticator) Register(opts *webauthn.CreationOptions) (*webauthn.AttestationResponse, error) {
+	for _, ex := range opts.ExcludeCredentials {
+		for _, c := range a.credentials {
+			if webauthn.EncodeID(c.id) == ex.ID {
+				return nil, errors.New("authenticator already registered")
+			}
+		}
+	}
+	userHandle, err := webauthn.DecodeID(opts.User.ID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	c := &credential{id: id, rpID: opts.RP.ID, userHandle: userHandle, key: key}
+	a.credentials = append(a.credentials, c)
+
+	// Attested credential data: AAGUID (zero), ID length, ID, COSE key
+	attested := make([]byte, 16, 18+len(id))
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(id)))
+	attested = append(attested, id...)
+	attested = append(attested, coseKey(&key.PublicKey)...)
+
+	authData := a.authenticatorData(c, 0x40, attested)
+	attestationObject := encodeMap([]entry{
+		{"fmt", "none"},
+		{"attStmt", []entry{}},
+		{"authData", authData},
+	})
+
+	resp := &webauthn.AttestationResponse{ID: webauthn.EncodeID(id), RawID: webauthn.EncodeID(id), Type: "public-key"}
+	resp.Response.ClientDataJSON = a.clientData("webauthn.create", opts.Challenge)
+	resp.Response.AttestationObject = webauthn.EncodeID(attestationObject)
+	resp.Response.Transports = []string{"internal"}
+	return resp, nil
+}
+
+// Assert signs in with a credential allowed by opts; any credential for the
+// site if opts allows all.
+func (a *Authenticator) Assert(opts *webauthn.RequestOptions) (*webauthn.AssertionResponse, error) {
+	c := a.find(opts)
+	if c == nil {
+		return nil, errors.New("no matching credential")
+	}
+	c.signCount++
+
+	authData := a.authenticatorData(c, 0, nil)
+	clientDataJSON := a.clientData("webauthn.get", opts.Challenge)
+	raw, _ := webauthn.DecodeID(clientDataJSON)
+	clientDataHash := sha256.Sum256(raw)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &webauthn.AssertionResponse{ID: webauthn.EncodeID(c.id), RawID: webauthn.EncodeID(c.id), Type: "public-key"}
+	resp.Response.ClientDataJSON = clientDataJSON
+	resp.Response.AuthenticatorData = webauthn.EncodeID(authData)
+	resp.Response.Signature = webauthn.EncodeID(sig)
+	resp.Response.UserHandle = webauthn.EncodeID(c.userHandle)
+	return resp, nil
+}
+
+func (a *Authenticator) find(opts *webauthn.RequestOptions) *credential {
+	for _, c := range a.credentials {
+		if c.rpID != opts.RPID {
+			continue
+		}
+		if len(opts.AllowCredentials) == 0 {
+			return c
+		}
+		for _, allowed := range opts.AllowCredentials {
+			if webauthn.EncodeID(c.id) == allowed.ID {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Authenticator) authenticatorData(c *credential, flags byte, attested []byte) []byte {
+	flags |= 0x01 // user present
+	if a.UserVerified {
+		flags |= 0x04
+	}
+	rpIDHash := sha256.Sum256([]byte(c.rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, c.signCount)
+	return append(data, attested...)
+}
+
+func (a *Authenticator) clientData(typ, challenge string) string {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":        typ,
+		"challenge":   challenge,
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	return webauthn.EncodeID(b)
+}
+
+func coseKey(pub *ecdsa.PublicKey) []byte {
+	x, y := make([]byte, 32), make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	return encodeMap([]entry{
+		{int64(1), int64(2)},                 // kty: EC2
+		{int64(3), int64(webauthn.AlgES256)}, // alg
+		{int64(-1), int64(1)},                // crv: P-256
+		{int64(-2), x},
+		{int64(-3), y},
+	})
+}
+
+// entry is a CBOR map entry. Keys are int64 or string; values are those,
+// []byte, or nested []entry maps.
+type entry struct {
+	key   interface{}
+	value interface{}
+}
+
+// encodeMap encodes a CBOR map in canonical key order.
+func encodeMap(entries []entry) []byte {
+	encoded := make([][2][]byte, len(entries))
+	for i, e := range entries {
+		encoded[i] = [2][]byte{encodeItem(e.key), encodeItem(e.value)}
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		a, b := encoded[i][0], encoded[j][0]
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return string(a) < string(b)
+	})
+	out := head(5, uint64(len(entries)))
+	for _, kv := range encoded {
+		out = append(out, kv[0]...)
+		out = append(out, kv[1]...)
+	}
+	return out
+}
+
+func encodeItem(v interface{}) []byte {
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []entry:
+		return encodeMap(v)
+	}
+	panic("webauthntest: can't encode value")
+}
+
+func head(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+}
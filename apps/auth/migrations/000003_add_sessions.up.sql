@@ -0,0 +1,24 @@
+-- A session is a family of refresh tokens descended from one login
+CREATE TABLE IF NOT EXISTS sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_name TEXT NOT NULL DEFAULT '',
+    ip_address TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+
+-- Rotated tokens are kept, marked used, so replaying one can be detected
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS session_id UUID REFERENCES sessions(id) ON DELETE CASCADE;
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS used_at TIMESTAMPTZ;
+
+-- Each existing token becomes its own session
+INSERT INTO sessions (id, user_id, created_at, last_used_at)
+SELECT id, user_id, created_at, created_at FROM refresh_tokens WHERE session_id IS NULL;
+UPDATE refresh_tokens SET session_id = id WHERE session_id IS NULL;
+
+ALTER TABLE refresh_tokens ALTER COLUMN session_id SET NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session ON refresh_tokens(session_id);
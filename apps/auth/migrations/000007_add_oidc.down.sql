@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS oauth_codes;
+DROP TABLE IF EXISTS oauth_consents;
+DROP TABLE IF EXISTS oauth_clients;
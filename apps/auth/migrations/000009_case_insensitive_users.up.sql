@@ -0,0 +1,30 @@
+-- Existing accounts may differ only in case. Emails can't be changed for
+-- their owners, so stop and say which ones need sorting out by hand.
+DO $$
+DECLARE
+    dupes TEXT;
+BEGIN
+    SELECT string_agg(email, ', ') INTO dupes FROM (
+        SELECT LOWER(email) AS email FROM users
+        WHERE email IS NOT NULL
+        GROUP BY LOWER(email) HAVING COUNT(*) > 1
+    ) d;
+    IF dupes IS NOT NULL THEN
+        RAISE EXCEPTION 'accounts share email addresses that differ only in case: %. Change or remove all but one account for each, then run the migrations again', dupes;
+    END IF;
+END $$;
+
+-- A username that clashes with an older account's gets the start of the
+-- user's ID appended, e.g. Bob -> Bob-1f0c9a2e
+UPDATE users u
+SET username = LEFT(u.username, 23) || '-' || LEFT(REPLACE(u.id::text, '-', ''), 8)
+WHERE EXISTS (
+    SELECT 1 FROM users o
+    WHERE LOWER(o.username) = LOWER(u.username)
+      AND (o.created_at, o.id) < (u.created_at, u.id)
+);
+
+-- Usernames and emails are unique regardless of case, and logins look
+-- emails up case-insensitively
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_key ON users (LOWER(email));
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_key ON users (LOWER(username));
@@ -0,0 +1,18 @@
+-- Accounts are deleted a grace period after the user asks; logging in
+-- before then cancels it
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled_at ON users(deletion_scheduled_at)
+    WHERE deletion_scheduled_at IS NOT NULL;
+
+-- account_deleted events still to be delivered to the instances a deleted
+-- user had authorized. The user row is gone by then, so no foreign key
+CREATE TABLE IF NOT EXISTS account_deletion_notices (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    instance_url TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_deletion_notices_next_attempt_at ON account_deletion_notices(next_attempt_at);
@@ -6,6 +6,9 @@ import { AuthPage } from './pages/auth';
 import { AddInstancePage } from './pages/add-instance';
 import { ChannelPage } from './pages/channel';
 import { WelcomePage } from './pages/welcome';
+import { ResetPasswordPage } from './pages/reset-password';
+import { VerifyEmailPage } from './pages/verify-email';
+import { OAuthAuthorizePage } from './pages/oauth-authorize';
 
 function RequireAuth({ children }: { children: React.ReactNode }) {
   const accessToken = useAuthStore((s) => s.accessToken);
@@ -35,6 +38,9 @@ export function App() {
     <Routes>
       <Route path="/auth" element={<AuthPage />} />
       <Route path="/add-instance" element={<AddInstancePage />} />
+      <Route path="/reset-password" element={<ResetPasswordPage />} />
+      <Route path="/verify-email" element={<VerifyEmailPage />} />
+      <Route path="/oauth/authorize" element={<OAuthAuthorizePage />} />
       <Route
         path="/"
         element={
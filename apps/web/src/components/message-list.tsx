@@ -1,5 +1,5 @@
 import { useRef, useEffect, useState } from 'react';
-import type { Message } from '@opencord/shared';
+import type { Attachment, Message } from '@opencord/shared';
 import { Avatar, AvatarImage, AvatarFallback } from '@/components/ui/avatar';
 import { ScrollArea } from '@/components/ui/scroll-area';
 import {
@@ -19,7 +19,7 @@ import {
   AlertDialogAction,
 } from '@/components/ui/alert-dialog';
 import { getInitials, hashColor } from '@/lib/utils';
-import { Pencil, Trash2, MoreHorizontal } from 'lucide-react';
+import { Pencil, Trash2, MoreHorizontal, FileDown } from 'lucide-react';
 
 interface MessageListProps {
   messages: Message[];
@@ -147,6 +147,9 @@ export function MessageList({
                     className="mt-2 max-w-md max-h-80 rounded-lg"
                   />
                 )}
+                {msg.attachments?.map((attachment) => (
+                  <AttachmentView key={attachment.id} attachment={attachment} />
+                ))}
               </div>
 
               {isOwn && !isEditing && (
@@ -206,3 +209,71 @@ export function MessageList({
     </ScrollArea>
   );
 }
+
+function formatDuration(ms: number): string {
+  const total = Math.round(ms / 1000);
+  const minutes = Math.floor(total / 60);
+  const seconds = total % 60;
+  return `${minutes}:${seconds.toString().padStart(2, '0')}`;
+}
+
+function formatSize(bytes: number): string {
+  if (bytes < 1024) return `${bytes} B`;
+  if (bytes < 1024 * 1024) return `${(bytes / 1024).toFixed(1)} KB`;
+  return `${(bytes / (1024 * 1024)).toFixed(1)} MB`;
+}
+
+/** Attachment URLs are usually signed, so the size joins their query string */
+function variantUrl(url: string, size: string) {
+  return `${url}${url.includes('?') ? '&' : '?'}size=${size}`;
+}
+
+function AttachmentView({ attachment }: { attachment: Attachment }) {
+  if (attachment.inline && attachment.category === 'image') {
+    return (
+      <img
+        src={
+          attachment.variants.includes('medium')
+            ? variantUrl(attachment.url, 'medium')
+            : attachment.url
+        }
+        alt={attachment.filename}
+        width={attachment.width ?? undefined}
+        height={attachment.height ?? undefined}
+        className="mt-2 max-w-md max-h-80 rounded-lg"
+      />
+    );
+  }
+  if (attachment.inline && attachment.category === 'video') {
+    return (
+      <video
+        src={attachment.url}
+        controls
+        preload="metadata"
+        className="mt-2 max-w-md max-h-80 rounded-lg"
+      />
+    );
+  }
+  if (attachment.inline && attachment.category === 'audio') {
+    return (
+      <div className="mt-2 max-w-md">
+        <p className="text-xs text-muted-foreground">
+          {attachment.filename}
+          {attachment.durationMs != null && ` · ${formatDuration(attachment.durationMs)}`}
+        </p>
+        <audio src={attachment.url} controls preload="metadata" className="w-full" />
+      </div>
+    );
+  }
+  return (
+    <a
+      href={attachment.url}
+      download={attachment.filename}
+      className="mt-2 flex max-w-md items-center gap-2 rounded-lg border px-3 py-2 text-primary hover:underline"
+    >
+      <FileDown className="size-4 shrink-0" />
+      <span className="truncate">{attachment.filename}</span>
+      <span className="ml-auto shrink-0 text-xs text-muted-foreground">{formatSize(attachment.size)}</span>
+    </a>
+  );
+}
@@ -1,7 +1,8 @@
 import { useMemo, useEffect } from 'react';
-import { InstanceConnection, AuthClient } from '@opencord/api-client';
+import { InstanceConnection } from '@opencord/api-client';
 import { useInstanceStore } from '@/stores/instance-store';
 import { useAuthStore } from '@/stores/auth-store';
+import { authorizeInstance, getInstanceToken } from '@/lib/instance-token';
 
 export function useActiveConnection(): InstanceConnection | null {
   const activeUrl = useInstanceStore((s) => s.activeInstanceUrl);
@@ -18,9 +19,6 @@ export function useInitConnections() {
   const setInstanceConnection = useInstanceStore((s) => s.setInstanceConnection);
   const setInstanceAuth = useInstanceStore((s) => s.setInstanceAuth);
   const centralAccessToken = useAuthStore((s) => s.accessToken);
-  const centralRefreshToken = useAuthStore((s) => s.refreshToken);
-  const authServerUrl = useAuthStore((s) => s.authServerUrl);
-  const setCentralTokens = useAuthStore((s) => s.setTokens);
 
   useEffect(() => {
     for (const [url, state] of instances) {
@@ -42,31 +40,24 @@ export function useInitConnections() {
         conn.connectWS();
         setInstanceConnection(url, conn);
       } else {
-        // Central auth: use global auth store tokens
+        // Central auth: exchange the central session for instance-scoped tokens
         if (!centralAccessToken) continue;
 
-        const conn = new InstanceConnection(url, {
-          accessToken: centralAccessToken,
-          onAuthFailure: async () => {
-            if (!authServerUrl || !centralRefreshToken) return null;
-            try {
-              const authClient = new AuthClient(authServerUrl, {
-                accessToken: centralAccessToken,
-                refreshToken: centralRefreshToken,
-                onTokenRefreshed: (newAccess, newRefresh) => {
-                  setCentralTokens(newAccess, newRefresh);
-                },
-              });
-              const resp = await authClient.refresh();
-              return resp.accessToken;
-            } catch {
-              return null;
-            }
-          },
-        });
-        conn.connectWS();
+        const getToken = () => getInstanceToken(url);
+        const conn = new InstanceConnection(url, { onAuthFailure: getToken });
         setInstanceConnection(url, conn);
+        // Every instance in the list was joined by the user, so make sure
+        // it's authorized (instances joined before authorization existed
+        // aren't yet)
+        authorizeInstance(url)
+          .catch(() => {})
+          .then(getToken)
+          .then((token) => {
+            if (!token) return;
+            conn.setAccessToken(token);
+            conn.connectWS();
+          });
       }
     }
-  }, [instances, setInstanceConnection, setInstanceAuth, centralAccessToken, centralRefreshToken, authServerUrl, setCentralTokens]);
+  }, [instances, setInstanceConnection, setInstanceAuth, centralAccessToken]);
 }
@@ -119,10 +119,22 @@ export function useTypingIndicator(channelId: string | undefined, currentUserId?
               n.delete(data.userId);
               return n;
             });
-          }, 5000);
+          }, 12000);
           next.set(data.userId, { name: data.username, timeout });
           return next;
         });
+      } else if (event.event === 'typing_stop') {
+        const data = event.data as { userId: string; channelId: string };
+        if (data.channelId !== channelId) return;
+
+        setTypers((prev) => {
+          const existing = prev.get(data.userId);
+          if (!existing) return prev;
+          clearTimeout(existing.timeout);
+          const next = new Map(prev);
+          next.delete(data.userId);
+          return next;
+        });
       }
     });
 
@@ -0,0 +1,39 @@
+import { AuthClient } from '@opencord/api-client';
+import { useAuthStore } from '@/stores/auth-store';
+
+let client: AuthClient | null = null;
+let clientUrl: string | null = null;
+
+// One client is shared by every instance (and other users of the central
+// session) so that their refreshes of it are deduplicated.
+export function centralClient(): AuthClient | null {
+  const { authServerUrl, accessToken, refreshToken, setTokens } = useAuthStore.getState();
+  if (!authServerUrl || !accessToken) return null;
+  if (!client || clientUrl !== authServerUrl) {
+    client = new AuthClient(authServerUrl, { onTokenRefreshed: setTokens });
+    clientUrl = authServerUrl;
+  }
+  client.setTokens(accessToken, refreshToken);
+  return client;
+}
+
+// Lets an instance receive tokens for the signed-in user. Called when the
+// user joins it, never on the instance's say-so.
+export async function authorizeInstance(instanceUrl: string): Promise<void> {
+  const client = centralClient();
+  if (!client) throw new Error('Not signed in');
+  await client.authorizeInstance(instanceUrl);
+}
+
+// Exchanges the central session for a short-lived token scoped to one
+// instance, refreshing the session first if needed.
+export async function getInstanceToken(instanceUrl: string): Promise<string | null> {
+  const client = centralClient();
+  if (!client) return null;
+  try {
+    const res = await client.getInstanceToken(instanceUrl);
+    return res.accessToken;
+  } catch {
+    return null;
+  }
+}
@@ -0,0 +1,89 @@
+import type {
+  PasskeyAssertion,
+  PasskeyAttestation,
+  PasskeyCreationOptions,
+  PasskeyRequestOptions,
+} from '@opencord/shared';
+
+// The auth server speaks WebAuthn JSON with base64url-encoded buffers;
+// the browser API wants ArrayBuffers.
+
+function fromBase64url(s: string): ArrayBuffer {
+  const b64 = s.replace(/-/g, '+').replace(/_/g, '/').padEnd(Math.ceil(s.length / 4) * 4, '=');
+  const bin = atob(b64);
+  const bytes = new Uint8Array(bin.length);
+  for (let i = 0; i < bin.length; i++) bytes[i] = bin.charCodeAt(i);
+  return bytes.buffer;
+}
+
+function toBase64url(buf: ArrayBuffer): string {
+  let bin = '';
+  new Uint8Array(buf).forEach((b) => (bin += String.fromCharCode(b)));
+  return btoa(bin).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+export function passkeysSupported(): boolean {
+  return typeof window !== 'undefined' && !!window.PublicKeyCredential;
+}
+
+/** Runs the browser's passkey creation prompt. */
+export async function createPasskey(options: PasskeyCreationOptions): Promise<PasskeyAttestation> {
+  const cred = (await navigator.credentials.create({
+    publicKey: {
+      ...options,
+      challenge: fromBase64url(options.challenge),
+      user: { ...options.user, id: fromBase64url(options.user.id) },
+      excludeCredentials: options.excludeCredentials.map((c) => ({
+        ...c,
+        id: fromBase64url(c.id),
+        transports: c.transports as AuthenticatorTransport[] | undefined,
+      })),
+      authenticatorSelection: options.authenticatorSelection as AuthenticatorSelectionCriteria,
+      attestation: options.attestation as AttestationConveyancePreference,
+    },
+  })) as PublicKeyCredential | null;
+  if (!cred) throw new Error('Passkey creation was cancelled');
+
+  const response = cred.response as AuthenticatorAttestationResponse;
+  return {
+    id: cred.id,
+    rawId: toBase64url(cred.rawId),
+    type: cred.type,
+    response: {
+      clientDataJSON: toBase64url(response.clientDataJSON),
+      attestationObject: toBase64url(response.attestationObject),
+      transports: response.getTransports?.(),
+    },
+  };
+}
+
+/** Runs the browser's passkey sign-in prompt. */
+export async function getPasskey(options: PasskeyRequestOptions): Promise<PasskeyAssertion> {
+  const cred = (await navigator.credentials.get({
+    publicKey: {
+      challenge: fromBase64url(options.challenge),
+      timeout: options.timeout,
+      rpId: options.rpId,
+      allowCredentials: options.allowCredentials.map((c) => ({
+        ...c,
+        id: fromBase64url(c.id),
+        transports: c.transports as AuthenticatorTransport[] | undefined,
+      })),
+      userVerification: options.userVerification as UserVerificationRequirement,
+    },
+  })) as PublicKeyCredential | null;
+  if (!cred) throw new Error('Passkey sign-in was cancelled');
+
+  const response = cred.response as AuthenticatorAssertionResponse;
+  return {
+    id: cred.id,
+    rawId: toBase64url(cred.rawId),
+    type: cred.type,
+    response: {
+      clientDataJSON: toBase64url(response.clientDataJSON),
+      authenticatorData: toBase64url(response.authenticatorData),
+      signature: toBase64url(response.signature),
+      userHandle: response.userHandle ? toBase64url(response.userHandle) : undefined,
+    },
+  };
+}
@@ -3,6 +3,7 @@ import { useNavigate } from 'react-router-dom';
 import { InstanceConnection } from '@opencord/api-client';
 import { useInstanceStore } from '@/stores/instance-store';
 import { useAuthStore } from '@/stores/auth-store';
+import { authorizeInstance, getInstanceToken } from '@/lib/instance-token';
 import { validateInstanceUrl } from '@opencord/shared';
 import type { InstanceInfo } from '@opencord/shared';
 import { Button } from '@/components/ui/button';
@@ -29,7 +30,6 @@ export function AddInstancePage() {
   const addInstance = useInstanceStore((s) => s.addInstance);
   const setInstanceConnection = useInstanceStore((s) => s.setInstanceConnection);
   const setInstanceAuth = useInstanceStore((s) => s.setInstanceAuth);
-  const accessToken = useAuthStore((s) => s.accessToken);
   const authServerUrl = useAuthStore((s) => s.authServerUrl);
   const navigate = useNavigate();
 
@@ -79,8 +79,13 @@ export function AddInstancePage() {
     setLoading(true);
     setError(null);
     try {
+      await authorizeInstance(instanceUrl);
+      const getToken = () => getInstanceToken(instanceUrl);
+      const token = await getToken();
+      if (!token) throw new Error('Could not sign in to this instance');
       const conn = new InstanceConnection(instanceUrl, {
-        accessToken: accessToken ?? undefined,
+        accessToken: token,
+        onAuthFailure: getToken,
       });
 
       await conn.joinWithInvite(inviteCode.trim());
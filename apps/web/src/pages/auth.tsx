@@ -1,6 +1,7 @@
 import { useState } from 'react';
-import { useNavigate } from 'react-router-dom';
-import { AuthClient } from '@opencord/api-client';
+import { useNavigate, useSearchParams } from 'react-router-dom';
+import { AuthClient, isMFAChallenge } from '@opencord/api-client';
+import type { MFAChallenge } from '@opencord/shared';
 import { useAuthStore } from '@/stores/auth-store';
 import { validateEmail, validatePassword, validateUsername, validateDisplayName } from '@opencord/shared';
 import { Button } from '@/components/ui/button';
@@ -9,8 +10,9 @@ import { Label } from '@/components/ui/label';
 import { Card, CardContent, CardHeader, CardTitle, CardDescription } from '@/components/ui/card';
 import { Spinner } from '@/components/ui/spinner';
 import { toast } from 'sonner';
+import { getPasskey, passkeysSupported } from '@/lib/passkey';
 
-const DEFAULT_AUTH_URL = import.meta.env.VITE_AUTH_SERVER_URL || 'http://localhost:9090';
+export const DEFAULT_AUTH_URL = import.meta.env.VITE_AUTH_SERVER_URL || 'http://localhost:9090';
 
 export function AuthPage() {
   const [isLogin, setIsLogin] = useState(true);
@@ -21,9 +23,26 @@ export function AuthPage() {
   const [username, setUsername] = useState('');
   const [displayName, setDisplayName] = useState('');
   const [password, setPassword] = useState('');
+  const [challenge, setChallenge] = useState<MFAChallenge | null>(null);
+  const [code, setCode] = useState('');
 
   const setAuth = useAuthStore((s) => s.setAuth);
   const navigate = useNavigate();
+  const [params] = useSearchParams();
+  // Only follow links within the app, e.g. back to an OAuth consent page
+  const next = params.get('next');
+  const destination = next && next.startsWith('/') && !next.startsWith('//') ? next : '/';
+
+  const handleForgotPassword = async () => {
+    const emailErr = validateEmail(email);
+    if (emailErr) { setError('Enter your email to reset your password'); return; }
+    try {
+      await new AuthClient(DEFAULT_AUTH_URL).forgotPassword(email);
+      toast.success('If that email has an account, a reset link is on its way.');
+    } catch (e: any) {
+      toast.error(e.message ?? 'Failed to send reset email');
+    }
+  };
 
   const handleSubmit = async () => {
     setError(null);
@@ -46,13 +65,18 @@ export function AuthPage() {
       let authResp;
 
       if (isLogin) {
-        authResp = await client.login({ email, password });
+        const resp = await client.login({ email, password });
+        if (isMFAChallenge(resp)) {
+          setChallenge(resp);
+          return;
+        }
+        authResp = resp;
       } else {
         authResp = await client.register({ email, username, displayName, password });
       }
 
       setAuth(DEFAULT_AUTH_URL, authResp.user, authResp.accessToken, authResp.refreshToken);
-      navigate('/');
+      navigate(destination);
     } catch (e: any) {
       const msg = e.message ?? 'Authentication failed';
       setError(msg);
@@ -62,6 +86,98 @@ export function AuthPage() {
     }
   };
 
+  const handlePasskey = async () => {
+    setLoading(true);
+    setError(null);
+    try {
+      const client = new AuthClient(DEFAULT_AUTH_URL);
+      const authResp = challenge
+        ? await client.completeMfaLoginWithPasskey(challenge.ticket, await getPasskey(await client.beginMfaPasskey(challenge.ticket)))
+        : await client.finishPasskeyLogin(await getPasskey(await client.beginPasskeyLogin()));
+      setAuth(DEFAULT_AUTH_URL, authResp.user, authResp.accessToken, authResp.refreshToken);
+      navigate(destination);
+    } catch (e: any) {
+      // Dismissing the browser prompt isn't an error worth showing
+      if (e.name !== 'NotAllowedError') {
+        setError(e.message ?? 'Passkey sign-in failed');
+      }
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const handleCode = async () => {
+    if (!challenge) return;
+    setLoading(true);
+    setError(null);
+    try {
+      const client = new AuthClient(DEFAULT_AUTH_URL);
+      const authResp = await client.completeMfaLogin(challenge.ticket, code.trim());
+      setAuth(DEFAULT_AUTH_URL, authResp.user, authResp.accessToken, authResp.refreshToken);
+      navigate(destination);
+    } catch (e: any) {
+      const msg = e.message ?? 'Authentication failed';
+      setError(msg);
+      // The ticket is gone once it expires or too many codes were wrong
+      if (msg.includes('sign in again')) {
+        setChallenge(null);
+        setCode('');
+      }
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  if (challenge) {
+    return (
+      <div className="min-h-screen bg-background flex items-center justify-center">
+        <Card className="w-full max-w-md">
+          <CardHeader>
+            <CardTitle className="text-2xl">Two-Factor Authentication</CardTitle>
+            <CardDescription>Enter the code from your authenticator app, or one of your recovery codes.</CardDescription>
+          </CardHeader>
+          <CardContent>
+            <div className="space-y-2">
+              <Label htmlFor="code">Code</Label>
+              <Input
+                id="code"
+                autoComplete="one-time-code"
+                autoFocus
+                value={code}
+                onChange={(e) => setCode(e.target.value)}
+                onKeyDown={(e) => e.key === 'Enter' && handleCode()}
+              />
+              {error && <p className="text-sm text-destructive">{error}</p>}
+            </div>
+
+            <Button onClick={handleCode} disabled={loading || !code.trim()} className="w-full mt-6">
+              {loading && <Spinner size="sm" className="text-primary-foreground" />}
+              Verify
+            </Button>
+            {challenge.methods.includes('webauthn') && passkeysSupported() && (
+              <Button variant="outline" onClick={handlePasskey} disabled={loading} className="w-full mt-2">
+                Use a passkey
+              </Button>
+            )}
+
+            <p className="text-center mt-4 text-sm text-muted-foreground">
+              <button
+                onClick={() => {
+                  setChallenge(null);
+                  setCode('');
+                  setError(null);
+                }}
+                className="text-primary hover:text-primary/80"
+              >
+                Back to sign in
+              </button>
+            </p>
+          </CardContent>
+        </Card>
+      </div>
+    );
+  }
+
   return (
     <div className="min-h-screen bg-background flex items-center justify-center">
       <Card className="w-full max-w-md">
@@ -114,6 +230,14 @@ export function AuthPage() {
                 onKeyDown={(e) => e.key === 'Enter' && handleSubmit()}
               />
               {error && <p className="text-sm text-destructive">{error}</p>}
+              {isLogin && (
+                <button
+                  onClick={handleForgotPassword}
+                  className="text-sm text-primary hover:text-primary/80"
+                >
+                  Forgot password?
+                </button>
+              )}
             </div>
           </div>
 
@@ -121,6 +245,11 @@ export function AuthPage() {
             {loading && <Spinner size="sm" className="text-primary-foreground" />}
             {isLogin ? 'Sign In' : 'Create Account'}
           </Button>
+          {isLogin && passkeysSupported() && (
+            <Button variant="outline" onClick={handlePasskey} disabled={loading} className="w-full mt-2">
+              Sign in with a passkey
+            </Button>
+          )}
 
           <p className="text-center mt-4 text-sm text-muted-foreground">
             {isLogin ? "Don't have an account? " : 'Already have an account? '}
@@ -0,0 +1,95 @@
+import { useEffect, useState } from 'react';
+import { Navigate, useLocation } from 'react-router-dom';
+import type { ConsentPrompt } from '@opencord/shared';
+import { useAuthStore } from '@/stores/auth-store';
+import { centralClient } from '@/lib/instance-token';
+import { Button } from '@/components/ui/button';
+import { Card, CardContent, CardHeader, CardTitle, CardDescription } from '@/components/ui/card';
+import { Spinner } from '@/components/ui/spinner';
+
+const SCOPE_DESCRIPTIONS: Record<string, string> = {
+  openid: 'Know who you are on OpenCord',
+  profile: 'See your username, display name and avatar',
+  email: 'See your email address',
+};
+
+// Consent page for apps logging in with OpenCord. The auth server's
+// authorization endpoint sends the browser here with the app's request.
+export function OAuthAuthorizePage() {
+  const location = useLocation();
+  const accessToken = useAuthStore((s) => s.accessToken);
+  const [prompt, setPrompt] = useState<ConsentPrompt | null>(null);
+  const [loading, setLoading] = useState(false);
+  const [error, setError] = useState<string | null>(null);
+
+  const answer = async (approve: boolean) => {
+    const client = centralClient();
+    if (!client) return;
+    setLoading(true);
+    try {
+      window.location.assign(await client.answerConsent(location.search, approve));
+    } catch (e: any) {
+      setError(e.message ?? 'Authorization failed');
+      setLoading(false);
+    }
+  };
+
+  useEffect(() => {
+    const client = centralClient();
+    if (!client) return;
+    client
+      .getConsentPrompt(location.search)
+      .then((p) => {
+        // Nothing new to agree to: go straight back to the app
+        if (p.consented) {
+          answer(true);
+        } else {
+          setPrompt(p);
+        }
+      })
+      .catch((e: any) => setError(e.message ?? 'Invalid authorization request'));
+  }, [location.search, accessToken]);
+
+  if (!accessToken) {
+    return <Navigate to={`/auth?next=${encodeURIComponent(location.pathname + location.search)}`} replace />;
+  }
+
+  return (
+    <div className="min-h-screen bg-background flex items-center justify-center">
+      <Card className="w-full max-w-md">
+        <CardHeader>
+          <CardTitle className="text-2xl">
+            {error ? 'Authorization Failed' : prompt ? `Sign in to ${prompt.clientName}` : 'Loading…'}
+          </CardTitle>
+          <CardDescription>
+            {error ?? (prompt && `${prompt.clientName} wants to use your OpenCord account. It will be able to:`)}
+          </CardDescription>
+        </CardHeader>
+        <CardContent>
+          {!prompt && !error && <Spinner />}
+          {prompt && !error && (
+            <>
+              <ul className="list-disc pl-5 space-y-1 text-sm">
+                {prompt.scopes.map((scope) => (
+                  <li key={scope}>{SCOPE_DESCRIPTIONS[scope] ?? scope}</li>
+                ))}
+              </ul>
+              <p className="text-xs text-muted-foreground mt-4">
+                You'll be sent to {new URL(prompt.redirectUri).host || prompt.redirectUri}. You can revoke access at any time.
+              </p>
+              <div className="flex gap-2 mt-6">
+                <Button variant="outline" onClick={() => answer(false)} disabled={loading} className="flex-1">
+                  Cancel
+                </Button>
+                <Button onClick={() => answer(true)} disabled={loading} className="flex-1">
+                  {loading && <Spinner size="sm" className="text-primary-foreground" />}
+                  Allow
+                </Button>
+              </div>
+            </>
+          )}
+        </CardContent>
+      </Card>
+    </div>
+  );
+}
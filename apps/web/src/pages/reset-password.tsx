@@ -0,0 +1,66 @@
+import { useState } from 'react';
+import { useNavigate, useSearchParams } from 'react-router-dom';
+import { AuthClient } from '@opencord/api-client';
+import { validatePassword } from '@opencord/shared';
+import { Button } from '@/components/ui/button';
+import { Input } from '@/components/ui/input';
+import { Label } from '@/components/ui/label';
+import { Card, CardContent, CardHeader, CardTitle, CardDescription } from '@/components/ui/card';
+import { Spinner } from '@/components/ui/spinner';
+import { toast } from 'sonner';
+import { DEFAULT_AUTH_URL } from './auth';
+
+export function ResetPasswordPage() {
+  const [params] = useSearchParams();
+  const token = params.get('token') ?? '';
+  const [password, setPassword] = useState('');
+  const [loading, setLoading] = useState(false);
+  const [error, setError] = useState<string | null>(null);
+  const navigate = useNavigate();
+
+  const handleSubmit = async () => {
+    const passErr = validatePassword(password);
+    if (passErr) { setError(passErr); return; }
+
+    setLoading(true);
+    setError(null);
+    try {
+      await new AuthClient(DEFAULT_AUTH_URL).resetPassword(token, password);
+      toast.success('Password changed. Sign in with your new password.');
+      navigate('/auth');
+    } catch (e: any) {
+      setError(e.message ?? 'Failed to reset password');
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  return (
+    <div className="min-h-screen bg-background flex items-center justify-center">
+      <Card className="w-full max-w-md">
+        <CardHeader>
+          <CardTitle className="text-2xl">Choose a New Password</CardTitle>
+          <CardDescription>You'll be signed out on all your devices.</CardDescription>
+        </CardHeader>
+        <CardContent>
+          <div className="space-y-2">
+            <Label htmlFor="password">New Password</Label>
+            <Input
+              id="password"
+              type="password"
+              value={password}
+              onChange={(e) => setPassword(e.target.value)}
+              onKeyDown={(e) => e.key === 'Enter' && handleSubmit()}
+            />
+            {error && <p className="text-sm text-destructive">{error}</p>}
+          </div>
+
+          <Button onClick={handleSubmit} disabled={loading || !token} className="w-full mt-6">
+            {loading && <Spinner size="sm" className="text-primary-foreground" />}
+            Reset Password
+          </Button>
+        </CardContent>
+      </Card>
+    </div>
+  );
+}
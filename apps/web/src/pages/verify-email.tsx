@@ -0,0 +1,48 @@
+import { useEffect, useState } from 'react';
+import { Link, useSearchParams } from 'react-router-dom';
+import { AuthClient } from '@opencord/api-client';
+import { Card, CardContent, CardHeader, CardTitle, CardDescription } from '@/components/ui/card';
+import { Spinner } from '@/components/ui/spinner';
+import { DEFAULT_AUTH_URL } from './auth';
+
+export function VerifyEmailPage() {
+  const [params] = useSearchParams();
+  const token = params.get('token') ?? '';
+  const [status, setStatus] = useState<'verifying' | 'verified' | 'failed'>('verifying');
+  const [error, setError] = useState<string | null>(null);
+
+  useEffect(() => {
+    new AuthClient(DEFAULT_AUTH_URL)
+      .verifyEmail(token)
+      .then(() => setStatus('verified'))
+      .catch((e: any) => {
+        setError(e.message ?? 'Verification failed');
+        setStatus('failed');
+      });
+  }, [token]);
+
+  return (
+    <div className="min-h-screen bg-background flex items-center justify-center">
+      <Card className="w-full max-w-md">
+        <CardHeader>
+          <CardTitle className="text-2xl">
+            {status === 'verified' ? 'Email Verified' : status === 'failed' ? 'Verification Failed' : 'Verifying…'}
+          </CardTitle>
+          <CardDescription>
+            {status === 'verified' && 'Thanks for confirming your email address.'}
+            {status === 'failed' && error}
+          </CardDescription>
+        </CardHeader>
+        <CardContent>
+          {status === 'verifying' ? (
+            <Spinner />
+          ) : (
+            <Link to="/" className="text-sm text-primary hover:text-primary/80">
+              Continue to OpenCord
+            </Link>
+          )}
+        </CardContent>
+      </Card>
+    </div>
+  );
+}
@@ -2,16 +2,39 @@ import type {
   AuthResponse,
   RegisterRequest,
   LoginRequest,
+  MFAChallenge,
+  MFAStatus,
+  TOTPSetup,
+  ReauthRequest,
+  AccountDeletion,
+  Passkey,
+  PasskeyCreationOptions,
+  PasskeyRequestOptions,
+  PasskeyAttestation,
+  PasskeyAssertion,
   User,
+  Session,
+  InstanceGrant,
+  InstanceTokenResponse,
+  OAuthClient,
+  NewOAuthClient,
+  CreateOAuthClientRequest,
+  OAuthConsent,
+  ConsentPrompt,
   ApiResponse,
   ApiError,
 } from '@opencord/shared';
 
+export function isMFAChallenge(resp: AuthResponse | MFAChallenge): resp is MFAChallenge {
+  return 'mfaRequired' in resp && resp.mfaRequired;
+}
+
 export class AuthClient {
   private baseUrl: string;
   private accessToken: string | null = null;
   private refreshToken: string | null = null;
   private onTokenRefreshed?: (accessToken: string, refreshToken: string) => void;
+  private refreshing: Promise<AuthResponse> | null = null;
 
   constructor(
     url: string,
@@ -42,14 +65,96 @@ export class AuthClient {
     return res.data;
   }
 
-  async login(req: LoginRequest): Promise<AuthResponse> {
-    const res = await this.request<ApiResponse<AuthResponse>>('POST', '/api/auth/login', req);
+  /** Logs in, or returns a challenge if the account needs a second factor. */
+  async login(req: LoginRequest): Promise<AuthResponse | MFAChallenge> {
+    const res = await this.request<ApiResponse<AuthResponse | MFAChallenge>>('POST', '/api/auth/login', req);
+    if (isMFAChallenge(res.data)) return res.data;
+    this.accessToken = res.data.accessToken;
+    this.refreshToken = res.data.refreshToken;
+    return res.data;
+  }
+
+  /** Answers a login challenge with a TOTP or recovery code. */
+  async completeMfaLogin(ticket: string, code: string): Promise<AuthResponse> {
+    const res = await this.request<ApiResponse<AuthResponse>>('POST', '/api/auth/login/mfa', { ticket, code });
+    this.accessToken = res.data.accessToken;
+    this.refreshToken = res.data.refreshToken;
+    return res.data;
+  }
+
+  /** Answers a login challenge with a passkey, using options from beginMfaPasskey. */
+  async completeMfaLoginWithPasskey(ticket: string, credential: PasskeyAssertion): Promise<AuthResponse> {
+    const res = await this.request<ApiResponse<AuthResponse>>('POST', '/api/auth/login/mfa', {
+      ticket,
+      webauthn: credential,
+    });
+    this.accessToken = res.data.accessToken;
+    this.refreshToken = res.data.refreshToken;
+    return res.data;
+  }
+
+  async beginMfaPasskey(ticket: string): Promise<PasskeyRequestOptions> {
+    const res = await this.request<ApiResponse<PasskeyRequestOptions>>('POST', '/api/auth/login/mfa/passkey', { ticket });
+    return res.data;
+  }
+
+  // === Passkeys ===
+
+  async beginPasskeyLogin(): Promise<PasskeyRequestOptions> {
+    const res = await this.request<ApiResponse<PasskeyRequestOptions>>('POST', '/api/auth/passkey/begin');
+    return res.data;
+  }
+
+  async finishPasskeyLogin(credential: PasskeyAssertion, deviceName?: string): Promise<AuthResponse> {
+    const res = await this.request<ApiResponse<AuthResponse>>('POST', '/api/auth/passkey/finish', {
+      credential,
+      deviceName,
+    });
     this.accessToken = res.data.accessToken;
     this.refreshToken = res.data.refreshToken;
     return res.data;
   }
 
-  async refresh(): Promise<AuthResponse> {
+  async listPasskeys(): Promise<Passkey[]> {
+    const res = await this.authedRequest<ApiResponse<Passkey[]>>('GET', '/api/users/me/passkeys');
+    return res.data;
+  }
+
+  async beginPasskeyRegistration(reauth: ReauthRequest): Promise<PasskeyCreationOptions> {
+    const res = await this.authedRequest<ApiResponse<PasskeyCreationOptions>>(
+      'POST',
+      '/api/users/me/passkeys/begin',
+      reauth
+    );
+    return res.data;
+  }
+
+  async finishPasskeyRegistration(name: string, credential: PasskeyAttestation): Promise<Passkey> {
+    const res = await this.authedRequest<ApiResponse<Passkey>>('POST', '/api/users/me/passkeys', { name, credential });
+    return res.data;
+  }
+
+  async deletePasskey(id: string, reauth: ReauthRequest): Promise<void> {
+    await this.authedRequest('DELETE', `/api/users/me/passkeys/${id}`, reauth);
+  }
+
+  setTokens(accessToken: string, refreshToken: string | null) {
+    this.accessToken = accessToken;
+    this.refreshToken = refreshToken;
+  }
+
+  // Concurrent callers share one refresh: presenting the same refresh
+  // token twice looks like token theft and ends the session.
+  refresh(): Promise<AuthResponse> {
+    if (!this.refreshing) {
+      this.refreshing = this.doRefresh().finally(() => {
+        this.refreshing = null;
+      });
+    }
+    return this.refreshing;
+  }
+
+  private async doRefresh(): Promise<AuthResponse> {
     if (!this.refreshToken) throw new Error('No refresh token');
     const res = await this.request<ApiResponse<AuthResponse>>('POST', '/api/auth/refresh', {
       refreshToken: this.refreshToken,
@@ -77,6 +182,152 @@ export class AuthClient {
     return res.data;
   }
 
+  async changeEmail(email: string, reauth: ReauthRequest): Promise<User> {
+    const res = await this.authedRequest<ApiResponse<User>>('POST', '/api/users/me/email', { email, ...reauth });
+    return res.data;
+  }
+
+  /** Signs out everywhere; signing in again before the returned date keeps the account. */
+  async deleteAccount(reauth: ReauthRequest): Promise<AccountDeletion> {
+    const res = await this.authedRequest<ApiResponse<AccountDeletion>>('DELETE', '/api/users/me', reauth);
+    return res.data;
+  }
+
+  /** ZIP of the account; each instance exports its own messages and uploads. */
+  async exportAccount(): Promise<Blob> {
+    return this.authedRequest<Blob>('GET', '/api/users/me/export', undefined, 'blob');
+  }
+
+  // === Two-factor authentication ===
+
+  async getMfaStatus(): Promise<MFAStatus> {
+    const res = await this.authedRequest<ApiResponse<MFAStatus>>('GET', '/api/users/me/mfa');
+    return res.data;
+  }
+
+  async beginTotpSetup(reauth: ReauthRequest): Promise<TOTPSetup> {
+    const res = await this.authedRequest<ApiResponse<TOTPSetup>>('POST', '/api/users/me/mfa/totp', reauth);
+    return res.data;
+  }
+
+  /** Turns TOTP on; the recovery codes returned are never shown again. */
+  async confirmTotpSetup(code: string): Promise<string[]> {
+    const res = await this.authedRequest<ApiResponse<{ recoveryCodes: string[] }>>(
+      'POST',
+      '/api/users/me/mfa/totp/confirm',
+      { code }
+    );
+    return res.data.recoveryCodes;
+  }
+
+  async disableTotp(reauth: ReauthRequest): Promise<void> {
+    await this.authedRequest('DELETE', '/api/users/me/mfa/totp', reauth);
+  }
+
+  async regenerateRecoveryCodes(reauth: ReauthRequest): Promise<string[]> {
+    const res = await this.authedRequest<ApiResponse<{ recoveryCodes: string[] }>>(
+      'POST',
+      '/api/users/me/mfa/recovery-codes',
+      reauth
+    );
+    return res.data.recoveryCodes;
+  }
+
+  // === Password reset & email verification ===
+
+  /** Emails a reset link if the address has an account; resolves either way. */
+  async forgotPassword(email: string): Promise<void> {
+    await this.request('POST', '/api/auth/forgot-password', { email });
+  }
+
+  async resetPassword(token: string, password: string): Promise<void> {
+    await this.request('POST', '/api/auth/reset-password', { token, password });
+  }
+
+  async verifyEmail(token: string): Promise<void> {
+    await this.request('POST', '/api/auth/verify-email', { token });
+  }
+
+  async resendVerification(): Promise<void> {
+    await this.authedRequest('POST', '/api/auth/resend-verification');
+  }
+
+  // === Sessions ===
+
+  async listSessions(): Promise<Session[]> {
+    const res = await this.authedRequest<ApiResponse<Session[]>>('GET', '/api/sessions');
+    return res.data;
+  }
+
+  async revokeSession(id: string): Promise<void> {
+    await this.authedRequest('DELETE', `/api/sessions/${id}`);
+  }
+
+  // === Instances ===
+
+  async listInstances(): Promise<InstanceGrant[]> {
+    const res = await this.authedRequest<ApiResponse<InstanceGrant[]>>('GET', '/api/users/me/instances');
+    return res.data;
+  }
+
+  async authorizeInstance(instanceUrl: string): Promise<InstanceGrant> {
+    const res = await this.authedRequest<ApiResponse<InstanceGrant>>('POST', '/api/users/me/instances', {
+      instanceUrl,
+    });
+    return res.data;
+  }
+
+  async revokeInstance(id: string): Promise<void> {
+    await this.authedRequest('DELETE', `/api/users/me/instances/${id}`);
+  }
+
+  /** Exchanges the session for a token only the given (authorized) instance accepts. */
+  async getInstanceToken(instanceUrl: string): Promise<InstanceTokenResponse> {
+    const res = await this.authedRequest<ApiResponse<InstanceTokenResponse>>('POST', '/api/auth/instance-token', {
+      instanceUrl,
+    });
+    return res.data;
+  }
+
+  // === OpenID Connect ===
+
+  /** Describes the authorization request in `query` (the consent page's search string). */
+  async getConsentPrompt(query: string): Promise<ConsentPrompt> {
+    const res = await this.authedRequest<ApiResponse<ConsentPrompt>>('GET', `/api/oauth/authorize${query}`);
+    return res.data;
+  }
+
+  /** Answers an authorization request; returns where to send the browser. */
+  async answerConsent(query: string, approve: boolean): Promise<string> {
+    const res = await this.authedRequest<ApiResponse<{ redirectUri: string }>>('POST', `/api/oauth/authorize${query}`, {
+      approve,
+    });
+    return res.data.redirectUri;
+  }
+
+  async listOAuthClients(): Promise<OAuthClient[]> {
+    const res = await this.authedRequest<ApiResponse<OAuthClient[]>>('GET', '/api/oauth/clients');
+    return res.data;
+  }
+
+  async createOAuthClient(req: CreateOAuthClientRequest): Promise<NewOAuthClient> {
+    const res = await this.authedRequest<ApiResponse<NewOAuthClient>>('POST', '/api/oauth/clients', req);
+    return res.data;
+  }
+
+  async deleteOAuthClient(clientId: string): Promise<void> {
+    await this.authedRequest('DELETE', `/api/oauth/clients/${clientId}`);
+  }
+
+  async listAuthorizedApps(): Promise<OAuthConsent[]> {
+    const res = await this.authedRequest<ApiResponse<OAuthConsent[]>>('GET', '/api/oauth/consents');
+    return res.data;
+  }
+
+  async revokeAuthorizedApp(clientId: string): Promise<void> {
+    await this.authedRequest('DELETE', `/api/oauth/consents/${clientId}`);
+  }
+
   private async request<T>(method: string, path: string, body?: unknown): Promise<T> {
     const response = await fetch(`${this.baseUrl}${path}`, {
       method,
@@ -93,7 +344,7 @@ export class AuthClient {
     return response.json();
   }
 
-  private async authedRequest<T>(method: string, path: string, body?: unknown): Promise<T> {
+  private async authedRequest<T>(method: string, path: string, body?: unknown, as: 'json' | 'blob' = 'json'): Promise<T> {
     const headers: Record<string, string> = { 'Content-Type': 'application/json' };
     if (this.accessToken) {
       headers['Authorization'] = `Bearer ${this.accessToken}`;
@@ -126,6 +377,7 @@ export class AuthClient {
     }
 
     if (response.status === 204) return undefined as T;
+    if (as === 'blob') return (await response.blob()) as T;
     return response.json();
   }
 }
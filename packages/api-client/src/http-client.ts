@@ -6,6 +6,7 @@ export class HttpClient {
   private refreshToken: string | null = null;
   private onAuthFailure?: () => Promise<string | null>;
   private onTokenRefreshed?: (accessToken: string, refreshToken: string) => void;
+  private refreshing: Promise<string | null> | null = null;
 
   constructor(
     baseUrl: string,
@@ -52,7 +53,7 @@ export class HttpClient {
   async request<T>(
     method: string,
     path: string,
-    options?: { body?: unknown; params?: Record<string, string>; auth?: boolean }
+    options?: { body?: unknown; params?: Record<string, string>; auth?: boolean; blob?: boolean }
   ): Promise<T> {
     const url = new URL(`${this.baseUrl}${path}`);
     if (options?.params) {
@@ -94,10 +95,25 @@ export class HttpClient {
       return undefined as T;
     }
 
+    if (options?.blob) {
+      return (await response.blob()) as T;
+    }
+
     return response.json();
   }
 
-  private async tryRefresh(): Promise<string | null> {
+  // Concurrent 401s share one refresh: presenting the same refresh token
+  // twice looks like token theft and ends the session.
+  private tryRefresh(): Promise<string | null> {
+    if (!this.refreshing) {
+      this.refreshing = this.doRefresh().finally(() => {
+        this.refreshing = null;
+      });
+    }
+    return this.refreshing;
+  }
+
+  private async doRefresh(): Promise<string | null> {
     // Try local refresh first (if we have a refresh token)
     if (this.refreshToken) {
       try {
@@ -1,5 +1,5 @@
 export { HttpClient } from './http-client';
-export { AuthClient } from './auth-client';
+export { AuthClient, isMFAChallenge } from './auth-client';
 export { InstanceConnection } from './instance-connection';
 export type { WSEventHandler } from './instance-connection';
 export { ConnectionManager } from './connection-manager';
@@ -1,9 +1,13 @@
 import type {
   InstanceInfo,
+  UpdateInstanceRequest,
+  StorageUsage,
+  QuarantinedAttachment,
   Channel,
   CreateChannelRequest,
   UpdateChannelRequest,
   Message,
+  Attachment,
   CreateMessageRequest,
   UpdateMessageRequest,
   MessageListResponse,
@@ -12,6 +16,7 @@ import type {
   Invite,
   CreateInviteRequest,
   User,
+  Session,
   WSEvent,
   ApiResponse,
   AuthResponse,
@@ -30,6 +35,7 @@ export class InstanceConnection {
   private wsReconnectAttempts = 0;
   private wsReconnectTimer: ReturnType<typeof setTimeout> | null = null;
   private _connected = false;
+  private renewToken?: () => Promise<string | null>;
 
   readonly url: string;
 
@@ -44,6 +50,7 @@ export class InstanceConnection {
   ) {
     this.url = url.replace(/\/$/, '');
     this.http = new HttpClient(this.url, options);
+    this.renewToken = options?.onAuthFailure;
   }
 
   get connected(): boolean {
@@ -98,6 +105,15 @@ export class InstanceConnection {
     this.http.clearTokens();
   }
 
+  async listSessions(): Promise<Session[]> {
+    const res = await this.http.request<ApiResponse<Session[]>>('GET', '/api/sessions');
+    return res.data;
+  }
+
+  async revokeSession(id: string): Promise<void> {
+    await this.http.request('DELETE', `/api/sessions/${id}`);
+  }
+
   // === Instance ===
 
   async getInstanceInfo(): Promise<InstanceInfo> {
@@ -105,6 +121,16 @@ export class InstanceConnection {
     return res.data;
   }
 
+  async updateInstance(req: UpdateInstanceRequest): Promise<InstanceInfo> {
+    const res = await this.http.request<ApiResponse<InstanceInfo>>('PATCH', '/api/instance', { body: req });
+    return res.data;
+  }
+
+  async getStorageUsage(): Promise<StorageUsage> {
+    const res = await this.http.request<ApiResponse<StorageUsage>>('GET', '/api/instance/storage');
+    return res.data;
+  }
+
   // === User ===
 
   async getMe(): Promise<User> {
@@ -112,6 +138,11 @@ export class InstanceConnection {
     return res.data;
   }
 
+  /** ZIP of the user's profile, messages and uploads on this instance. */
+  async exportData(): Promise<Blob> {
+    return this.http.request<Blob>('GET', '/api/users/me/export', { blob: true });
+  }
+
   // === Channels ===
 
   async createChannel(req: CreateChannelRequest): Promise<Channel> {
@@ -197,12 +228,18 @@ export class InstanceConnection {
 
   // === Upload ===
 
+  /** Uploads an image with a permanent public URL, for avatars and the instance icon. */
   async uploadImage(file: File): Promise<string> {
+    const attachment = await this.waitForAttachment(await this.uploadAttachment(file, true));
+    return attachment.url;
+  }
+
+  async uploadAttachment(file: File, isPublic = false): Promise<Attachment> {
     const formData = new FormData();
     formData.append('file', file);
 
     const token = this.http.getAccessToken();
-    const response = await fetch(`${this.url}/api/upload`, {
+    const response = await fetch(`${this.url}/api/upload${isPublic ? '/public' : ''}`, {
       method: 'POST',
       headers: token ? { Authorization: `Bearer ${token}` } : {},
       body: formData,
@@ -210,7 +247,46 @@ export class InstanceConnection {
 
     if (!response.ok) throw new Error('Upload failed');
     const data = await response.json();
-    return data.data.url;
+    return data.data;
+  }
+
+  /**
+   * Resolves once a processing upload has been scanned and is ready, via the
+   * attachment_update WebSocket event. Rejects if it was quarantined or
+   * couldn't be scanned.
+   */
+  waitForAttachment(attachment: Attachment): Promise<Attachment> {
+    return new Promise((resolve, reject) => {
+      const settle = (a: Attachment) => {
+        if (a.status === 'ready') resolve(a);
+        else reject(new Error(a.status === 'quarantined' ? 'File was flagged as unsafe' : 'File could not be scanned'));
+      };
+      if (attachment.status !== 'processing') {
+        settle(attachment);
+        return;
+      }
+      const unsubscribe = this.onWSEvent((event) => {
+        const updated = event.data as Attachment;
+        if (event.event === 'attachment_update' && updated.id === attachment.id) {
+          unsubscribe();
+          settle(updated);
+        }
+      });
+    });
+  }
+
+  async getQuarantine(): Promise<QuarantinedAttachment[]> {
+    const res = await this.http.request<ApiResponse<QuarantinedAttachment[]>>('GET', '/api/upload/quarantine');
+    return res.data;
+  }
+
+  async releaseQuarantined(id: string): Promise<Attachment> {
+    const res = await this.http.request<ApiResponse<Attachment>>('POST', `/api/upload/quarantine/${id}/release`);
+    return res.data;
+  }
+
+  async deleteQuarantined(id: string): Promise<void> {
+    await this.http.request('DELETE', `/api/upload/quarantine/${id}`);
   }
 
   // === WebSocket ===
@@ -286,8 +362,14 @@ export class InstanceConnection {
   private attemptReconnect() {
     if (this.wsReconnectAttempts >= WS_MAX_RECONNECT_ATTEMPTS) return;
 
-    this.wsReconnectTimer = setTimeout(() => {
+    this.wsReconnectTimer = setTimeout(async () => {
       this.wsReconnectAttempts++;
+      // Instance tokens are short-lived, so the one the socket was opened
+      // with has likely expired
+      if (this.renewToken) {
+        const token = await this.renewToken();
+        if (token) this.http.setAccessToken(token);
+      }
       this.connectWS();
     }, WS_RECONNECT_INTERVAL);
   }
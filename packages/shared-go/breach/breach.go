@@ -0,0 +1,129 @@
+// Package breach checks passwords against lists of known-compromised ones.
+//
+// Big lists are kept on disk in the k-anonymity range format served by Have
+// I Been Pwned: the SHA-1 hashes of the passwords, split into one file per
+// 5-character hash prefix (00000.txt … FFFFF.txt) whose lines are the
+// remaining 35 characters and a count, e.g.
+// "0018A45C4D1DEF81644B54AB7F969B88D65:10". Checking a password only reads
+// the one file for its prefix, and the list never holds a password in the
+// clear. The official downloader produces exactly this layout.
+package breach
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const prefixLength = 5
+
+// List is a range-file directory of breached password hashes.
+type List struct {
+	dir string
+}
+
+// Open returns the list in dir, which must exist.
+func Open(dir string) (*List, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &List{dir: dir}, nil
+}
+
+// Contains reports whether the password is on the list. A missing range
+// file means none of the list's passwords share the prefix.
+func (l *List) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:prefixLength], hash[prefixLength:]
+
+	f, err := os.Open(filepath.Join(l.dir, prefix+".txt"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// Common reports whether the password is one of the handful that top every
+// breach, so they're refused even without a list on disk.
+func Common(password string) bool {
+	_, ok := commonPasswords[strings.ToLower(password)]
+	return ok
+}
+
+// commonPasswords are the most used passwords long enough to pass a length
+// check.
+var commonPasswords = map[string]struct{}{
+	"12345678":      {},
+	"123456789":     {},
+	"1234567890":    {},
+	"12345678910":   {},
+	"123123123":     {},
+	"11111111":      {},
+	"00000000":      {},
+	"87654321":      {},
+	"11223344":      {},
+	"password":      {},
+	"password1":     {},
+	"password12":    {},
+	"password123":   {},
+	"passw0rd":      {},
+	"p@ssw0rd":      {},
+	"qwertyuiop":    {},
+	"qwerty123":     {},
+	"qwerty12":      {},
+	"1q2w3e4r":      {},
+	"1q2w3e4r5t":    {},
+	"1qaz2wsx":      {},
+	"zaq12wsx":      {},
+	"asdfghjkl":     {},
+	"asdf1234":      {},
+	"abcd1234":      {},
+	"abc12345":      {},
+	"aa123456":      {},
+	"iloveyou":      {},
+	"iloveyou1":     {},
+	"sunshine":      {},
+	"princess":      {},
+	"football":      {},
+	"baseball":      {},
+	"superman":      {},
+	"starwars":      {},
+	"whatever":      {},
+	"trustno1":      {},
+	"letmein1":      {},
+	"welcome1":      {},
+	"welcome123":    {},
+	"michelle":      {},
+	"jennifer":      {},
+	"computer":      {},
+	"internet":      {},
+	"changeme":      {},
+	"qazwsxedc":     {},
+	"opencord":      {},
+	"opencord1":     {},
+	"opencord123":   {},
+	"admin123":      {},
+	"administrator": {},
+}
@@ -0,0 +1,45 @@
+package breach
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	// SHA-1("correct horse battery staple") = ABF7AAD6438836DBE526AA231ABDE2D0EEF74D42
+	lines := "0018A45C4D1DEF81644B54AB7F969B88D65:10\r\nad6438836dbe526aa231abde2d0eef74d42:3\r\n"
+	if err := os.WriteFile(filepath.Join(dir, "ABF7A.txt"), []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	list, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := list.Contains("correct horse battery staple"); err != nil || !ok {
+		t.Fatalf("Contains(listed) = %v, %v; want true", ok, err)
+	}
+	// Hashes are of the exact password
+	if ok, err := list.Contains("Correct horse battery staple"); err != nil || ok {
+		t.Fatalf("Contains(unlisted) = %v, %v; want false", ok, err)
+	}
+	// No range file for the prefix
+	if ok, err := list.Contains("something else entirely"); err != nil || ok {
+		t.Fatalf("Contains(no range) = %v, %v; want false", ok, err)
+	}
+
+	if _, err := Open(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("Open(missing dir) succeeded")
+	}
+}
+
+func TestCommon(t *testing.T) {
+	if !Common("Password123") {
+		t.Error("Common(Password123) = false")
+	}
+	if Common("correct horse battery staple") {
+		t.Error("Common(passphrase) = true")
+	}
+}
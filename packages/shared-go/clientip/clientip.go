@@ -0,0 +1,111 @@
+// Package clientip finds the address of the client behind a request.
+//
+// X-Forwarded-For and X-Real-IP are only believed when the connection comes
+// from a trusted proxy; anyone else could put any address in them, and
+// per-IP limits would then be useless.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// privateRanges are the loopback and private networks that reverse proxies
+// usually reach the server from.
+var privateRanges = []string{
+	"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+	"::1/128", "fc00::/7",
+}
+
+// Proxies is the set of addresses whose forwarding headers are trusted.
+type Proxies struct {
+	trusted []netip.Prefix
+}
+
+// ParseProxies parses a comma-separated list of addresses and CIDR ranges.
+// "private" stands for the loopback and private networks. An empty list
+// trusts no one.
+func ParseProxies(list string) (*Proxies, error) {
+	p := &Proxies{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case entry == "private":
+			for _, r := range privateRanges {
+				p.trusted = append(p.trusted, netip.MustParsePrefix(r))
+			}
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy range %q: %w", entry, err)
+			}
+			p.trusted = append(p.trusted, prefix.Masked())
+		default:
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy address %q: %w", entry, err)
+			}
+			p.trusted = append(p.trusted, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		}
+	}
+	return p, nil
+}
+
+func (p *Proxies) trusts(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that made r. Behind trusted
+// proxies that's the last address in X-Forwarded-For that isn't one of
+// them, since each proxy appends the address it was connected from and
+// only the ones it added can be believed. X-Real-IP is used when there is
+// no X-Forwarded-For.
+func (p *Proxies) ClientIP(r *http.Request) string {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !p.trusts(peer) {
+		return host
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				// Whoever added this can't be told apart from the client
+				break
+			}
+			if !p.trusts(addr) {
+				return addr.Unmap().String()
+			}
+			peer = addr
+		}
+		return peer.Unmap().String()
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
+}
+
+// Middleware sets r.RemoteAddr to the client's address, in place of
+// chi's RealIP, which trusts the headers from anyone.
+func (p *Proxies) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = p.ClientIP(r)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,48 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseProxies("private, 203.0.113.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, peer, forwardedFor, realIP, want string
+	}{
+		{"direct", "198.51.100.1:5000", "", "", "198.51.100.1"},
+		{"spoofed header from a client", "198.51.100.1:5000", "192.0.2.9", "192.0.2.9", "198.51.100.1"},
+		{"behind a proxy", "10.0.0.2:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"spoofed header through a proxy", "10.0.0.2:5000", "192.0.2.9, 198.51.100.1", "", "198.51.100.1"},
+		{"through two proxies", "10.0.0.2:5000", "198.51.100.1, 203.0.113.7", "", "198.51.100.1"},
+		{"X-Real-IP from a proxy", "[::1]:5000", "", "198.51.100.1", "198.51.100.1"},
+		{"proxy without headers", "10.0.0.2:5000", "", "", "10.0.0.2"},
+		{"garbage before a proxy", "10.0.0.2:5000", "nonsense, 10.0.0.3", "", "10.0.0.3"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.peer
+		if tc.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if got := proxies.ClientIP(r); got != tc.want {
+			t.Errorf("%s: ClientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := ParseProxies("10.0.0.0/33"); err == nil {
+		t.Error("invalid range accepted")
+	}
+	none, _ := ParseProxies("")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := none.ClientIP(r); got != "127.0.0.1" {
+		t.Errorf("with no trusted proxies ClientIP = %q", got)
+	}
+}
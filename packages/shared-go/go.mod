@@ -0,0 +1,8 @@
+module github.com/opencord/shared
+
+go 1.21
+
+require (
+	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.24.0
+)
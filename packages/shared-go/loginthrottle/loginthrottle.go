@@ -0,0 +1,157 @@
+// Package loginthrottle limits password guessing.
+//
+// Logins are counted per account, keyed by the email tried so that unknown
+// addresses behave exactly like real ones, and per IP address. Past a few
+// free attempts every one locks the key out for twice as long as the one
+// before, up to MaxLockout. Counts reset after FailureWindow without
+// attempts.
+//
+// An attempt is counted before the password is checked and taken back if
+// it turns out to be right. Checking first and counting after the
+// comparison would let a burst of parallel guesses all pass the check.
+package loginthrottle
+
+import (
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AccountFreeAttempts = 5
+	IPFreeAttempts      = 20
+	LockoutBase         = 30 * time.Second
+	MaxLockout          = 15 * time.Minute
+	FailureWindow       = time.Hour
+)
+
+// ThrottledError is returned for a login attempted while the account or IP
+// address is locked out.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return "too many failed login attempts"
+}
+
+// DummyPasswordHash is compared against when no account has the email, so
+// that a login takes as long whether or not the account exists.
+var DummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// Keys are the throttle keys a login is counted against.
+type Keys struct {
+	Account string
+	IP      string // empty if the client's address is unknown
+}
+
+// NewKeys keys an IPv6 client by its /64: a single host usually has the
+// whole network and could otherwise try from a new address every time.
+func NewKeys(email, ip string) Keys {
+	keys := Keys{Account: "account:" + strings.ToLower(strings.TrimSpace(email))}
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		addr = addr.Unmap()
+		if addr.Is6() {
+			prefix, _ := addr.WithZone("").Prefix(64)
+			keys.IP = "ip:" + prefix.String()
+		} else {
+			keys.IP = "ip:" + addr.String()
+		}
+	} else if ip != "" {
+		keys.IP = "ip:" + ip
+	}
+	return keys
+}
+
+// Scoped returns the keys in their own namespace, for throttling something
+// other than logins by the same account and address.
+func (k Keys) Scoped(scope string) Keys {
+	scoped := Keys{Account: scope + ":" + k.Account}
+	if k.IP != "" {
+		scoped.IP = scope + ":" + k.IP
+	}
+	return scoped
+}
+
+// Lockout is how long a key is locked out after its nth attempt.
+func Lockout(attempts, free int) time.Duration {
+	if attempts < free {
+		return 0
+	}
+	return min(LockoutBase<<min(attempts-free, 10), MaxLockout)
+}
+
+// Store keeps the attempt counts; PostgresStore is the real one.
+type Store interface {
+	// RecordLoginAttempt counts an attempt against key, forgetting earlier
+	// ones older than FailureWindow, and locks the key for
+	// Lockout(attempts, free). It returns the count and the lockout it set.
+	// While the key is locked out it counts nothing and fails with a
+	// *ThrottledError.
+	RecordLoginAttempt(key string, free int) (attempts int, lockedUntil time.Time, err error)
+	// RefundLoginAttempt takes back an attempt, lifting the lockout it set
+	// unless a later attempt has replaced it.
+	RefundLoginAttempt(key string, lockedUntil time.Time) error
+	// ClearLoginAttempts forgets all of key's attempts.
+	ClearLoginAttempts(key string) error
+}
+
+// Attempt is a login counted against its keys.
+type Attempt struct {
+	store         Store
+	keys          Keys
+	accountLocked time.Time
+	ipLocked      time.Time
+
+	// Failures is how many times the account was tried in the window,
+	// this attempt included.
+	Failures int
+}
+
+// Begin counts a login against keys before the password is checked. It
+// fails with a *ThrottledError while either key is locked out. Nothing
+// more needs doing if the password is wrong.
+func Begin(store Store, keys Keys) (*Attempt, error) {
+	a := &Attempt{store: store, keys: keys}
+	var err error
+	if a.Failures, a.accountLocked, err = store.RecordLoginAttempt(keys.Account, AccountFreeAttempts); err != nil {
+		return nil, err
+	}
+	if keys.IP != "" {
+		if _, a.ipLocked, err = store.RecordLoginAttempt(keys.IP, IPFreeAttempts); err != nil {
+			// The account wasn't really tried
+			if rerr := store.RefundLoginAttempt(keys.Account, a.accountLocked); rerr != nil {
+				return nil, rerr
+			}
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// LockedOut reports whether this attempt is the failure that first locked
+// the account out.
+func (a *Attempt) LockedOut() bool {
+	return a.Failures == AccountFreeAttempts
+}
+
+// EarlierFailures is how many times the account was tried before this
+// attempt.
+func (a *Attempt) EarlierFailures() int {
+	return a.Failures - 1
+}
+
+// Succeeded clears the account's attempts and takes back this one from the
+// IP address. The IP's earlier failures are left to expire: an attacker
+// could otherwise reset them by logging in to an account of their own.
+func (a *Attempt) Succeeded() error {
+	if err := a.store.ClearLoginAttempts(a.keys.Account); err != nil {
+		return err
+	}
+	if a.keys.IP != "" {
+		return a.store.RefundLoginAttempt(a.keys.IP, a.ipLocked)
+	}
+	return nil
+}
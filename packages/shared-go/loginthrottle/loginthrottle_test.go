@@ -0,0 +1,161 @@
+package loginthrottle
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	for _, tc := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{AccountFreeAttempts - 1, 0},
+		{AccountFreeAttempts, LockoutBase},
+		{AccountFreeAttempts + 2, 4 * LockoutBase},
+		{100, MaxLockout},
+	} {
+		if got := Lockout(tc.attempts, AccountFreeAttempts); got != tc.want {
+			t.Errorf("Lockout(%d) = %v, want %v", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+func TestNewKeys(t *testing.T) {
+	for _, tc := range []struct{ ip, want string }{
+		{"198.51.100.7", "ip:198.51.100.7"},
+		{"::ffff:198.51.100.7", "ip:198.51.100.7"},
+		{"2001:db8:1:2:aaaa::1", "ip:2001:db8:1:2::/64"},
+		{"2001:db8:1:2:bbbb::9", "ip:2001:db8:1:2::/64"},
+		{"fe80::1%eth0", "ip:fe80::/64"},
+		{"", ""},
+	} {
+		if got := NewKeys("A@Example.com ", tc.ip); got.IP != tc.want || got.Account != "account:a@example.com" {
+			t.Errorf("NewKeys(%q) = %+v, want IP %q", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestScoped(t *testing.T) {
+	keys := NewKeys("a@example.com", "198.51.100.7").Scoped("reset")
+	if keys.Account != "reset:account:a@example.com" || keys.IP != "reset:ip:198.51.100.7" {
+		t.Errorf("scoped keys = %+v", keys)
+	}
+	if keys := NewKeys("a@example.com", "").Scoped("reset"); keys.IP != "" {
+		t.Errorf("scoped keys without an IP = %+v", keys)
+	}
+}
+
+func TestBegin(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.Now = func() time.Time { return now }
+	keys := NewKeys(" A@Example.com", "198.51.100.7")
+
+	for i := 1; i <= AccountFreeAttempts; i++ {
+		a, err := Begin(store, keys)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+		if a.Failures != i || a.LockedOut() != (i == AccountFreeAttempts) {
+			t.Fatalf("attempt %d: failures %d, locked out %v", i, a.Failures, a.LockedOut())
+		}
+	}
+	var throttled *ThrottledError
+	if _, err := Begin(store, NewKeys("a@example.com", "203.0.113.1")); !errors.As(err, &throttled) || throttled.RetryAfter != LockoutBase {
+		t.Fatalf("locked out account = %v", err)
+	}
+
+	// A success after the lockout lifts clears the account
+	now = now.Add(LockoutBase)
+	a, err := Begin(store, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.EarlierFailures() != AccountFreeAttempts {
+		t.Errorf("earlier failures = %d", a.EarlierFailures())
+	}
+	if err := a.Succeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := Begin(store, keys); err != nil || a.Failures != 1 {
+		t.Errorf("after success: %+v, %v", a, err)
+	}
+}
+
+func TestBeginIPLockout(t *testing.T) {
+	store := NewMemoryStore()
+	for i := 0; i < IPFreeAttempts; i++ {
+		if _, err := Begin(store, NewKeys(fmt.Sprintf("user%d@example.com", i), "198.51.100.7")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A locked out IP address doesn't use up the account's attempts
+	var throttled *ThrottledError
+	for i := 0; i < AccountFreeAttempts; i++ {
+		if _, err := Begin(store, NewKeys("a@example.com", "198.51.100.7")); !errors.As(err, &throttled) {
+			t.Fatalf("login from locked out IP = %v", err)
+		}
+	}
+	a, err := Begin(store, NewKeys("a@example.com", "203.0.113.1"))
+	if err != nil || a.Failures != 1 {
+		t.Fatalf("login from another IP: %+v, %v", a, err)
+	}
+}
+
+func TestBeginParallel(t *testing.T) {
+	store := NewMemoryStore()
+	keys := NewKeys("a@example.com", "")
+
+	// However many guesses arrive at once, only the free ones get in before
+	// the lockout
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	admitted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := Begin(store, keys); err == nil {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if admitted != AccountFreeAttempts {
+		t.Errorf("%d parallel attempts admitted, want %d", admitted, AccountFreeAttempts)
+	}
+}
+
+func TestSucceededKeepsIPFailures(t *testing.T) {
+	store := NewMemoryStore()
+	for i := 0; i < IPFreeAttempts-1; i++ {
+		if _, err := Begin(store, NewKeys(fmt.Sprintf("user%d@example.com", i), "198.51.100.7")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Logging in to an account of one's own takes back only that attempt
+	for i := 0; i < 3; i++ {
+		a, err := Begin(store, NewKeys("mine@example.com", "198.51.100.7"))
+		if err != nil {
+			t.Fatalf("own login %d: %v", i, err)
+		}
+		if err := a.Succeeded(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Begin(store, NewKeys("victim@example.com", "198.51.100.7")); err != nil {
+		t.Fatal(err)
+	}
+	var throttled *ThrottledError
+	if _, err := Begin(store, NewKeys("victim@example.com", "198.51.100.7")); !errors.As(err, &throttled) {
+		t.Errorf("IP not locked out after %d failures: %v", IPFreeAttempts, err)
+	}
+}
@@ -0,0 +1,67 @@
+package loginthrottle
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps attempts in memory, for tests.
+type MemoryStore struct {
+	mu   sync.Mutex
+	keys map[string]*memoryKey
+
+	// Now is the store's clock. Tests move it forward to let lockouts
+	// lift.
+	Now func() time.Time
+}
+
+type memoryKey struct {
+	attempts    int
+	lockedUntil time.Time
+	lastAttempt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{keys: map[string]*memoryKey{}, Now: time.Now}
+}
+
+func (m *MemoryStore) RecordLoginAttempt(key string, free int) (int, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.Now()
+	k, ok := m.keys[key]
+	if !ok || k.lastAttempt.Before(now.Add(-FailureWindow)) {
+		k = &memoryKey{}
+		m.keys[key] = k
+	}
+	if k.lockedUntil.After(now) {
+		return 0, time.Time{}, &ThrottledError{RetryAfter: k.lockedUntil.Sub(now)}
+	}
+	k.attempts++
+	k.lastAttempt = now
+	var until time.Time
+	if lockout := Lockout(k.attempts, free); lockout > 0 {
+		until = now.Add(lockout)
+		k.lockedUntil = until
+	}
+	return k.attempts, until, nil
+}
+
+func (m *MemoryStore) RefundLoginAttempt(key string, lockedUntil time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if k, ok := m.keys[key]; ok {
+		k.attempts = max(k.attempts-1, 0)
+		if !lockedUntil.IsZero() && k.lockedUntil.Equal(lockedUntil) {
+			k.lockedUntil = time.Time{}
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) ClearLoginAttempts(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, key)
+	return nil
+}
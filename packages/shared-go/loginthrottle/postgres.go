@@ -0,0 +1,86 @@
+package loginthrottle
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PostgresStore keeps attempts in the login_throttles table:
+//
+//	CREATE TABLE login_throttles (
+//	    key TEXT PRIMARY KEY,
+//	    failures INT NOT NULL DEFAULT 0,
+//	    locked_until TIMESTAMPTZ,
+//	    last_failure_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+//	);
+//
+// failures and last_failure_at count every attempt; successful ones are
+// taken back or cleared.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) RecordLoginAttempt(key string, free int) (int, time.Time, error) {
+	now := time.Now()
+	if _, err := s.db.Exec(`DELETE FROM login_throttles WHERE last_failure_at < $1`, now.Add(-FailureWindow)); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	// The upsert holds the row lock until commit, so a parallel attempt
+	// waits for it and then sees the lockout set below
+	var attempts int
+	err = tx.QueryRow(
+		`INSERT INTO login_throttles (key, failures, last_failure_at) VALUES ($1, 1, $2)
+		 ON CONFLICT (key) DO UPDATE SET failures = login_throttles.failures + 1, last_failure_at = $2
+		 WHERE login_throttles.locked_until IS NULL OR login_throttles.locked_until <= $2
+		 RETURNING failures`,
+		key, now,
+	).Scan(&attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		var until time.Time
+		if err := tx.QueryRow(`SELECT locked_until FROM login_throttles WHERE key = $1`, key).Scan(&until); err != nil {
+			return 0, time.Time{}, err
+		}
+		return 0, time.Time{}, &ThrottledError{RetryAfter: until.Sub(now)}
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var until time.Time
+	if lockout := Lockout(attempts, free); lockout > 0 {
+		// Postgres keeps microseconds; RefundLoginAttempt compares with this
+		until = now.Add(lockout).Truncate(time.Microsecond)
+		if _, err := tx.Exec(`UPDATE login_throttles SET locked_until = $2 WHERE key = $1`, key, until); err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+	return attempts, until, tx.Commit()
+}
+
+func (s *PostgresStore) RefundLoginAttempt(key string, lockedUntil time.Time) error {
+	_, err := s.db.Exec(
+		`UPDATE login_throttles SET
+			failures = GREATEST(failures - 1, 0),
+			locked_until = CASE WHEN locked_until = $2 THEN NULL ELSE locked_until END
+		 WHERE key = $1`,
+		key, sql.NullTime{Time: lockedUntil, Valid: !lockedUntil.IsZero()},
+	)
+	return err
+}
+
+func (s *PostgresStore) ClearLoginAttempts(key string) error {
+	_, err := s.db.Exec(`DELETE FROM login_throttles WHERE key = $1`, key)
+	return err
+}
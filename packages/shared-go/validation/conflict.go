@@ -0,0 +1,23 @@
+package validation
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// UserConflict turns a unique violation on the users table into the error
+// for the field that clashed, and returns any other error unchanged.
+func UserConflict(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return err
+	}
+	switch pqErr.Constraint {
+	case "users_email_key", "users_email_lower_key":
+		return ErrEmailTaken
+	case "users_username_key", "users_username_lower_key":
+		return ErrUsernameTaken
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+// Package validation holds the rules for account fields that central auth
+// and local auth instances both enforce, so the two can't drift apart.
+package validation
+
+import (
+	"log"
+	netmail "net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/opencord/shared/breach"
+)
+
+// FieldError is a problem with one field of a request. Clients get the
+// field and a machine-readable code alongside the message.
+type FieldError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Message
+}
+
+var (
+	ErrInvalidEmail       = &FieldError{"email", "invalid_email", "invalid email address"}
+	ErrEmailTaken         = &FieldError{"email", "email_taken", "email already taken"}
+	ErrInvalidUsername    = &FieldError{"username", "invalid_username", "username must be 2-32 letters, numbers, underscores or hyphens"}
+	ErrReservedUsername   = &FieldError{"username", "username_reserved", "username is reserved"}
+	ErrUsernameTaken      = &FieldError{"username", "username_taken", "username already taken"}
+	ErrInvalidDisplayName = &FieldError{"displayName", "invalid_display_name", "display name must be 1-64 characters"}
+	ErrWeakPassword       = &FieldError{"password", "weak_password", "password must be at least 8 characters"}
+	ErrPasswordTooLong    = &FieldError{"password", "password_too_long", "password must be at most 72 bytes"}
+	ErrGuessablePassword  = &FieldError{"password", "guessable_password", "password is too easy to guess"}
+	ErrBreachedPassword   = &FieldError{"password", "breached_password", "password has appeared in a data breach; choose another"}
+)
+
+const (
+	minUsernameLength    = 2
+	maxUsernameLength    = 32
+	maxDisplayNameLength = 64
+	maxEmailLength       = 255
+	minPasswordLength    = 8
+	// bcrypt ignores everything past 72 bytes
+	maxPasswordLength = 72
+	// minPasswordRunes rejects passwords like "aaaaaaaa" and "abababab"
+	minPasswordRunes = 4
+)
+
+// reservedUsernames could be mistaken for the service or its staff.
+// Matching is case-insensitive.
+var reservedUsernames = map[string]struct{}{
+	"admin": {}, "administrator": {}, "root": {}, "system": {}, "opencord": {},
+	"support": {}, "help": {}, "security": {}, "staff": {}, "official": {},
+	"moderator": {}, "mod": {}, "owner": {}, "everyone": {}, "here": {},
+	"api": {}, "auth": {}, "oauth": {}, "null": {}, "undefined": {},
+}
+
+// Email accepts a bare address ("a@example.com", no display name) whose
+// domain has at least one dot.
+func Email(email string) error {
+	if len(email) > maxEmailLength {
+		return ErrInvalidEmail
+	}
+	addr, err := netmail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return ErrInvalidEmail
+	}
+	domain := email[strings.LastIndex(email, "@")+1:]
+	if !strings.Contains(strings.Trim(domain, "."), ".") {
+		return ErrInvalidEmail
+	}
+	return nil
+}
+
+// Username allows the characters that are safe in mentions and URLs.
+// Uniqueness, which ignores case, is enforced by the database.
+func Username(username string) error {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return ErrInvalidUsername
+	}
+	for _, r := range username {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return ErrInvalidUsername
+		}
+	}
+	if _, ok := reservedUsernames[strings.ToLower(username)]; ok {
+		return ErrReservedUsername
+	}
+	return nil
+}
+
+func DisplayName(name string) error {
+	if name == "" || utf8.RuneCountInString(name) > maxDisplayNameLength {
+		return ErrInvalidDisplayName
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return ErrInvalidDisplayName
+		}
+	}
+	return nil
+}
+
+// Password checks a new password's length, refuses ones that are easy to
+// guess (including the account's own username or email), then looks it up
+// in breached if that isn't nil. The list failing to answer doesn't block
+// the user.
+func Password(password string, breached *breach.List, identifiers ...string) error {
+	if len(password) < minPasswordLength {
+		return ErrWeakPassword
+	}
+	if len(password) > maxPasswordLength {
+		return ErrPasswordTooLong
+	}
+
+	runes := make(map[rune]struct{})
+	for _, r := range password {
+		runes[r] = struct{}{}
+	}
+	if len(runes) < minPasswordRunes || breach.Common(password) {
+		return ErrGuessablePassword
+	}
+	for _, id := range identifiers {
+		if id != "" && (strings.EqualFold(password, id) || strings.EqualFold(password, localPart(id))) {
+			return ErrGuessablePassword
+		}
+	}
+
+	if breached != nil {
+		found, err := breached.Contains(password)
+		if err != nil {
+			log.Printf("failed to check breached passwords: %v", err)
+		} else if found {
+			return ErrBreachedPassword
+		}
+	}
+	return nil
+}
+
+// localPart is the part of an email address before the @.
+func localPart(email string) string {
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return email[:i]
+	}
+	return email
+}
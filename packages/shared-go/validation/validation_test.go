@@ -0,0 +1,89 @@
+package validation
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+
+	"github.com/opencord/shared/breach"
+)
+
+func TestFields(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err, want error
+	}{
+		{"email", Email("a@example.com"), nil},
+		{"not an email", Email("not an email"), ErrInvalidEmail},
+		{"display name in email", Email("Alice <a@example.com>"), ErrInvalidEmail},
+		{"dotless domain", Email("a@localhost"), ErrInvalidEmail},
+		{"username", Username("alice_smith-2"), nil},
+		{"short username", Username("a"), ErrInvalidUsername},
+		{"username with space", Username("alice smith"), ErrInvalidUsername},
+		{"long username", Username(strings.Repeat("a", 33)), ErrInvalidUsername},
+		{"reserved username", Username("Admin"), ErrReservedUsername},
+		{"display name", DisplayName("Alice Smith 🎉"), nil},
+		{"empty display name", DisplayName(""), ErrInvalidDisplayName},
+		{"display name with newline", DisplayName("Alice\nSmith"), ErrInvalidDisplayName},
+	} {
+		if tc.err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, tc.err, tc.want)
+		}
+	}
+}
+
+func TestPassword(t *testing.T) {
+	dir := t.TempDir()
+	// SHA-1("correct horse battery staple") = ABF7AAD6438836DBE526AA231ABDE2D0EEF74D42
+	if err := os.WriteFile(filepath.Join(dir, "ABF7A.txt"), []byte("AD6438836DBE526AA231ABDE2D0EEF74D42:3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	list, err := breach.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		password string
+		want     error
+	}{
+		{"hunter22", nil},
+		{"short", ErrWeakPassword},
+		{strings.Repeat("ab1!", 19), ErrPasswordTooLong},
+		{"abababab", ErrGuessablePassword},
+		{"Password123", ErrGuessablePassword},
+		{"ALICE.SMITH", ErrGuessablePassword},
+		{"alice12345", ErrGuessablePassword},
+		{"correct horse battery staple", ErrBreachedPassword},
+	} {
+		err := Password(tc.password, list, "alice12345", "alice.smith@example.com")
+		if err != tc.want {
+			t.Errorf("Password(%q) = %v, want %v", tc.password, err, tc.want)
+		}
+	}
+
+	// Without a list only the built-in checks apply
+	if err := Password("correct horse battery staple", nil); err != nil {
+		t.Errorf("Password without a list = %v", err)
+	}
+}
+
+func TestUserConflict(t *testing.T) {
+	for _, tc := range []struct {
+		err, want error
+	}{
+		{&pq.Error{Code: "23505", Constraint: "users_email_key"}, ErrEmailTaken},
+		{&pq.Error{Code: "23505", Constraint: "users_username_lower_key"}, ErrUsernameTaken},
+	} {
+		if got := UserConflict(tc.err); got != tc.want {
+			t.Errorf("UserConflict(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+	other := &pq.Error{Code: "23503", Constraint: "users_email_key"}
+	if err := UserConflict(other); err != other {
+		t.Errorf("UserConflict(foreign key) = %v", err)
+	}
+}
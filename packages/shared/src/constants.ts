@@ -5,6 +5,12 @@ export const MESSAGE_PAGE_SIZE = 50;
 export const MAX_MESSAGE_LENGTH = 4000;
 export const MAX_USERNAME_LENGTH = 32;
 export const MAX_DISPLAY_NAME_LENGTH = 64;
+export const MIN_PASSWORD_LENGTH = 8;
+export const MAX_PASSWORD_LENGTH = 72; // bytes; bcrypt ignores the rest
+export const RESERVED_USERNAMES = [
+  'admin', 'administrator', 'root', 'system', 'opencord', 'support', 'help', 'security', 'staff', 'official',
+  'moderator', 'mod', 'owner', 'everyone', 'here', 'api', 'auth', 'oauth', 'null', 'undefined',
+];
 export const MAX_CHANNEL_NAME_LENGTH = 100;
 export const ALLOWED_IMAGE_TYPES = ['image/jpeg', 'image/png', 'image/gif', 'image/webp'];
 export const MAX_IMAGE_SIZE = 10 * 1024 * 1024; // 10MB
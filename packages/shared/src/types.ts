@@ -2,6 +2,7 @@
 export interface User {
   id: string;
   email: string;
+  emailVerified?: boolean; // central auth only
   username: string;
   displayName: string;
   avatarUrl: string | null;
@@ -21,17 +22,160 @@ export interface RegisterRequest {
   username: string;
   displayName: string;
   password: string;
+  deviceName?: string;
 }
 
 export interface LoginRequest {
   email: string;
   password: string;
+  deviceName?: string;
+}
+
+// Returned by a central login when the account has two-factor authentication;
+// answer it with AuthClient.completeMfaLogin
+export interface MFAChallenge {
+  mfaRequired: true;
+  ticket: string;
+  methods: string[];
+  expiresAt: string;
+}
+
+export interface MFAStatus {
+  totpEnabled: boolean;
+  recoveryCodesRemaining: number;
+}
+
+export interface TOTPSetup {
+  secret: string;
+  otpauthUri: string;
+}
+
+export interface Passkey {
+  id: string;
+  name: string;
+  createdAt: string;
+  lastUsedAt: string | null;
+}
+
+// WebAuthn options and credentials as JSON: binary fields are base64url strings
+export interface CredentialDescriptorJSON {
+  type: 'public-key';
+  id: string;
+  transports?: string[];
+}
+
+export interface PasskeyCreationOptions {
+  challenge: string;
+  rp: { id: string; name: string };
+  user: { id: string; name: string; displayName: string };
+  pubKeyCredParams: { type: 'public-key'; alg: number }[];
+  timeout: number;
+  excludeCredentials: CredentialDescriptorJSON[];
+  authenticatorSelection: { residentKey: string; userVerification: string };
+  attestation: string;
+}
+
+export interface PasskeyRequestOptions {
+  challenge: string;
+  timeout: number;
+  rpId: string;
+  allowCredentials: CredentialDescriptorJSON[];
+  userVerification: string;
+}
+
+export interface PasskeyAttestation {
+  id: string;
+  rawId: string;
+  type: string;
+  response: { clientDataJSON: string; attestationObject: string; transports?: string[] };
+}
+
+export interface PasskeyAssertion {
+  id: string;
+  rawId: string;
+  type: string;
+  response: { clientDataJSON: string; authenticatorData: string; signature: string; userHandle?: string };
+}
+
+// Re-confirms the user before a sensitive action; code is required with 2FA on
+export interface ReauthRequest {
+  password: string;
+  code?: string;
+}
+
+// Returned by DELETE /api/users/me; signing in before then cancels it
+export interface AccountDeletion {
+  deletionScheduledAt: string;
 }
 
 export interface RefreshRequest {
   refreshToken: string;
 }
 
+// A login on one device; refreshing keeps it alive
+export interface Session {
+  id: string;
+  deviceName: string;
+  ipAddress: string;
+  userAgent: string;
+  createdAt: string;
+  lastUsedAt: string;
+  current: boolean;
+}
+
+// An instance the user allowed to receive tokens from the central auth server
+export interface InstanceGrant {
+  id: string;
+  instanceUrl: string;
+  createdAt: string;
+  lastUsedAt: string | null;
+}
+
+// A short-lived token only the named instance accepts
+export interface InstanceTokenResponse {
+  accessToken: string;
+  expiresAt: string;
+}
+
+// A third-party app that logs users in through the auth server's OpenID
+// Connect provider
+export interface OAuthClient {
+  clientId: string;
+  name: string;
+  redirectUris: string[];
+  public: boolean;
+  createdAt: string;
+}
+
+// Returned once on registration; confidential clients get a secret
+export interface NewOAuthClient extends OAuthClient {
+  clientSecret?: string;
+}
+
+export interface CreateOAuthClientRequest {
+  name: string;
+  redirectUris: string[];
+  public?: boolean;
+}
+
+// An app the user has let log them in
+export interface OAuthConsent {
+  clientId: string;
+  clientName: string;
+  scopes: string[];
+  createdAt: string;
+  updatedAt: string;
+}
+
+// An authorization request as shown on the consent page
+export interface ConsentPrompt {
+  clientId: string;
+  clientName: string;
+  redirectUri: string;
+  scopes: string[];
+  consented: boolean;
+}
+
 // Channel
 export interface Channel {
   id: string;
@@ -61,6 +205,41 @@ export interface Message {
   createdAt: string;
   updatedAt: string | null;
   author?: MessageAuthor;
+  attachments: Attachment[];
+}
+
+export type AttachmentCategory = 'image' | 'video' | 'audio' | 'document' | 'archive';
+
+/**
+ * Uploads are `processing` while the instance scans them for malware; only
+ * `ready` attachments have a URL and can be sent.
+ */
+export type AttachmentStatus = 'processing' | 'ready' | 'quarantined' | 'failed';
+
+export interface Attachment {
+  id: string;
+  uploaderId: string;
+  messageId: string | null;
+  filename: string;
+  contentType: string;
+  size: number;
+  width: number | null;
+  height: number | null;
+  sha256: string;
+  blurhash: string | null;
+  /** Resized sizes available by adding `size=<name>` to the URL's query */
+  variants: ('small' | 'medium' | 'large')[];
+  /** Playback length, audio and video only */
+  durationMs: number | null;
+  status: AttachmentStatus;
+  /** Public uploads (avatars, instance icon) have a permanent URL; others are signed and expire */
+  public: boolean;
+  category: AttachmentCategory;
+  /** Whether the browser can show or play it in place; otherwise offer a download */
+  inline: boolean;
+  /** Signed URLs expire; refetch the message for a fresh one */
+  url: string;
+  createdAt: string;
 }
 
 export interface MessageAuthor {
@@ -72,7 +251,7 @@ export interface MessageAuthor {
 
 export interface CreateMessageRequest {
   content: string;
-  imageUrl?: string;
+  attachmentIds?: string[];
 }
 
 export interface UpdateMessageRequest {
@@ -122,6 +301,36 @@ export interface InstanceInfo {
   version: string;
   registrationOpen: boolean;
   authServerUrl: string | null;
+  /** Largest upload accepted, in bytes */
+  maxUploadSize: number;
+  /** Storage quotas in bytes; null is unlimited */
+  storageQuota: number | null;
+  userStorageQuota: number | null;
+}
+
+export interface UpdateInstanceRequest {
+  name?: string;
+  iconUrl?: string;
+  description?: string;
+  registrationOpen?: boolean;
+  maxUploadSize?: number;
+  /** 0 removes the quota */
+  storageQuota?: number;
+  userStorageQuota?: number;
+}
+
+export interface StorageUsage {
+  usedBytes: number;
+  storageQuota: number | null;
+  userStorageQuota: number | null;
+  users: { userId: string; username: string; files: number; bytes: number }[];
+}
+
+/** An upload the malware scanner flagged, awaiting admin review */
+export interface QuarantinedAttachment extends Attachment {
+  username: string;
+  signature: string;
+  scannedAt: string;
 }
 
 // WebSocket Events
@@ -133,6 +342,7 @@ export type WSEventType =
   | 'presence_update'
   | 'member_join' | 'member_leave'
   | 'channel_create' | 'channel_update' | 'channel_delete'
+  | 'attachment_update'
   | 'rtc:join' | 'rtc:offer' | 'rtc:answer' | 'rtc:ice_candidate' | 'rtc:peer_joined' | 'rtc:peer_left' | 'rtc:leave';
 
 export interface WSEvent<T = unknown> {
@@ -152,6 +362,10 @@ export interface ApiResponse<T> {
 
 export interface ApiError {
   error: string;
+  // Set when one field of the request was rejected, e.g. field "username"
+  // with code "username_taken"
+  field?: string;
+  code?: string;
 }
 
 // Instance Connection (client-side)
@@ -1,4 +1,12 @@
-import { MAX_USERNAME_LENGTH, MAX_DISPLAY_NAME_LENGTH, MAX_CHANNEL_NAME_LENGTH, MAX_MESSAGE_LENGTH } from './constants';
+import {
+  MAX_USERNAME_LENGTH,
+  MAX_DISPLAY_NAME_LENGTH,
+  MAX_CHANNEL_NAME_LENGTH,
+  MAX_MESSAGE_LENGTH,
+  MIN_PASSWORD_LENGTH,
+  MAX_PASSWORD_LENGTH,
+  RESERVED_USERNAMES,
+} from './constants';
 
 export function validateEmail(email: string): string | null {
   const emailRegex = /^[^\s@]+@[^\s@]+\.[^\s@]+$/;
@@ -12,6 +20,7 @@ export function validateUsername(username: string): string | null {
   if (username.length < 2) return 'Username must be at least 2 characters';
   if (username.length > MAX_USERNAME_LENGTH) return `Username must be at most ${MAX_USERNAME_LENGTH} characters`;
   if (!/^[a-zA-Z0-9_-]+$/.test(username)) return 'Username can only contain letters, numbers, hyphens, and underscores';
+  if (RESERVED_USERNAMES.includes(username.toLowerCase())) return 'That username is reserved';
   return null;
 }
 
@@ -23,7 +32,8 @@ export function validateDisplayName(name: string): string | null {
 
 export function validatePassword(password: string): string | null {
   if (!password) return 'Password is required';
-  if (password.length < 8) return 'Password must be at least 8 characters';
+  if (password.length < MIN_PASSWORD_LENGTH) return `Password must be at least ${MIN_PASSWORD_LENGTH} characters`;
+  if (new TextEncoder().encode(password).length > MAX_PASSWORD_LENGTH) return 'Password is too long';
   return null;
 }
 